@@ -4,7 +4,12 @@ go 1.12
 
 require (
 	github.com/kfilimon/go-zendesk v0.2.0
-	github.com/mattermost/mattermost-server/v5 v5.18.0
+	github.com/mattermost/go-i18n v1.11.0
+	github.com/mattermost/ldap v3.0.4+incompatible // indirect
+	github.com/mattermost/mattermost-server/v5 v5.24.0
 	github.com/mholt/archiver/v3 v3.3.0
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
+	github.com/stretchr/testify v1.5.1
+	golang.org/x/net v0.0.0-20200501053045-e0ff5e5a1de5
+	gopkg.in/asn1-ber.v1 v1.0.0-20181015200546-f715ec2f112d // indirect
 )
@@ -0,0 +1,766 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/pkg/errors"
+)
+
+// Client wraps the go-zendesk client and adds the Zendesk API endpoints the library doesn't
+// cover. Those requests are authenticated the same way as the wrapped client.
+type Client struct {
+	zendesk.Client
+
+	baseURL     string
+	authorize   func(r *http.Request)
+	requestFunc zendesk.RequestFunction
+	maxRetries  int
+
+	// requestID is sent in the requestIDHeader of every request, see withRequestID.
+	requestID string
+	// organizationCache caches the names resolved by organizationNames for the command the client
+	// was made for by withRequestID. Clients shared by several commands don't cache them.
+	organizationCache map[int64]string
+}
+
+// requestIDHeader carries the correlation ID of the command making a Zendesk API request, so the
+// command can be matched with the Zendesk API access logs.
+const requestIDHeader = "X-Request-Id"
+
+// withRequestID returns a copy of the client sending requestID along with its requests. The
+// client it is made from is left unchanged, it may be shared by several commands.
+func (c *Client) withRequestID(requestID string) *Client {
+	traced := *c
+	traced.Client = c.Client.WithHeader(requestIDHeader, requestID)
+	traced.requestID = requestID
+	traced.organizationCache = map[int64]string{}
+	return &traced
+}
+
+// TicketForm represents a Zendesk ticket form.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/rest_api/docs/support/ticket_forms
+type TicketForm struct {
+	ID          *int64  `json:"id,omitempty"`
+	Name        *string `json:"name,omitempty"`
+	DisplayName *string `json:"display_name,omitempty"`
+	Active      *bool   `json:"active,omitempty"`
+	Default     *bool   `json:"default,omitempty"`
+}
+
+// newOAuthClient creates a client for the Zendesk instance at zendeskURL authenticated with an OAuth
+// access token. Requests rate limited by Zendesk are retried up to maxRetries times, see retryRateLimited.
+func newOAuthClient(zendeskURL, token string, maxRetries int) (*Client, error) {
+	zendeskURL = strings.TrimRight(zendeskURL, "/")
+	retry := retryRateLimited(maxRetries)
+	client, err := zendesk.NewURLClientWithOAuthToken(zendeskURL, token, retry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		Client:  client,
+		baseURL: zendeskURL,
+		authorize: func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+token)
+		},
+		requestFunc: retry(http.DefaultClient.Do),
+		maxRetries:  maxRetries,
+	}, nil
+}
+
+// apiTokenCredentialPrefix marks the stored credentials of users connected with an API token
+// instead of OAuth, see apiTokenCredential.
+const apiTokenCredentialPrefix = "apitoken:"
+
+// apiTokenCredential encodes the email and API token of a user, so they are stored with setToken
+// like an OAuth access token.
+func apiTokenCredential(email, apiToken string) string {
+	return apiTokenCredentialPrefix + email + " " + apiToken
+}
+
+// newUserClient creates a client authenticated with a credential stored by setToken, either an
+// OAuth access token or an API token.
+func newUserClient(zendeskURL, credential string, maxRetries int) (*Client, error) {
+	if strings.HasPrefix(credential, apiTokenCredentialPrefix) {
+		if fields := strings.Fields(strings.TrimPrefix(credential, apiTokenCredentialPrefix)); len(fields) == 2 {
+			return newAPITokenClient(zendeskURL, fields[0], fields[1], maxRetries)
+		}
+	}
+	return newOAuthClient(zendeskURL, credential, maxRetries)
+}
+
+// newAPITokenClient creates a client for the Zendesk instance at zendeskURL authenticated with the
+// API token of an agent, using basic auth as `<email>/token:<api-token>`.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/rest_api/docs/support/introduction#api-token
+func newAPITokenClient(zendeskURL, email, apiToken string, maxRetries int) (*Client, error) {
+	return newBasicAuthClient(zendeskURL, email+"/token", apiToken, maxRetries)
+}
+
+// newBasicAuthClient creates a client for the Zendesk instance at zendeskURL authenticated with
+// basic auth, either with the password of an agent or, with a username ending in /token, an API
+// token.
+func newBasicAuthClient(zendeskURL, username, password string, maxRetries int) (*Client, error) {
+	zendeskURL = strings.TrimRight(zendeskURL, "/")
+	retry := retryRateLimited(maxRetries)
+	client, err := zendesk.NewURLClient(zendeskURL, username, password, retry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		Client:  client,
+		baseURL: zendeskURL,
+		authorize: func(r *http.Request) {
+			r.SetBasicAuth(username, password)
+		},
+		requestFunc: retry(http.DefaultClient.Do),
+		maxRetries:  maxRetries,
+	}, nil
+}
+
+// retryBaseDelay is the wait before the first retry of a rate limited request, it doubles with
+// every further retry.
+var retryBaseDelay = time.Second
+
+// maxRetryDelay is the longest the plugin waits before retrying a rate limited request. Zendesk
+// asking to wait longer is reported to the user right away, who is waiting for the command.
+const maxRetryDelay = 30 * time.Second
+
+// retryRateLimited retries requests Zendesk answered with 429 Too Many Requests up to maxRetries
+// times, with an exponential backoff that honors the Retry-After header. It wraps both the
+// go-zendesk client and the requests sent by Client, so every API call is covered.
+func retryRateLimited(maxRetries int) zendesk.MiddlewareFunction {
+	return func(next zendesk.RequestFunction) zendesk.RequestFunction {
+		return func(req *http.Request) (*http.Response, error) {
+			delay := retryBaseDelay
+			for attempt := 0; ; attempt++ {
+				res, err := next(req)
+				if err != nil || res.StatusCode != http.StatusTooManyRequests {
+					return res, err
+				}
+
+				if after, parseErr := strconv.Atoi(res.Header.Get("Retry-After")); parseErr == nil && time.Duration(after)*time.Second > delay {
+					delay = time.Duration(after) * time.Second
+				}
+				if attempt >= maxRetries || delay > maxRetryDelay || (req.Body != nil && req.GetBody == nil) {
+					// go-zendesk sleeps and retries on its own when Retry-After is set, the
+					// plugin has already waited long enough.
+					res.Header.Del("Retry-After")
+					return res, nil
+				}
+
+				_, _ = io.Copy(ioutil.Discard, res.Body)
+				res.Body.Close()
+				if req.GetBody != nil {
+					if req.Body, err = req.GetBody(); err != nil {
+						return nil, err
+					}
+				}
+				time.Sleep(delay)
+				delay *= 2
+			}
+		}
+	}
+}
+
+// ticketNotFoundError is returned by the ticket requests of Client when Zendesk answers
+// 404 Not Found, so that respondError can name the missing ticket.
+type ticketNotFoundError struct {
+	ticketID int64
+	err      error
+}
+
+func (e *ticketNotFoundError) Error() string {
+	return "ticket #" + formatID(e.ticketID) + " was not found"
+}
+
+// Cause returns the error response of Zendesk, see errors.Cause.
+func (e *ticketNotFoundError) Cause() error {
+	return e.err
+}
+
+// ticketError reports err as a ticketNotFoundError if Zendesk couldn't find the ticket.
+func ticketError(ticketID int64, err error) error {
+	if isAPIError(err, http.StatusNotFound) {
+		return &ticketNotFoundError{ticketID: ticketID, err: err}
+	}
+	return err
+}
+
+// ShowTicket loads a ticket, see ticketNotFoundError.
+func (c *Client) ShowTicket(id int64) (*zendesk.Ticket, error) {
+	ticket, err := c.Client.ShowTicket(id)
+	return ticket, ticketError(id, err)
+}
+
+// UpdateTicket updates a ticket, see ticketNotFoundError.
+func (c *Client) UpdateTicket(id int64, ticket *zendesk.Ticket) (*zendesk.Ticket, error) {
+	updated, err := c.Client.UpdateTicket(id, ticket)
+	return updated, ticketError(id, err)
+}
+
+// UpdateTicketSafely updates a ticket using safe_update: Zendesk rejects the update with
+// 409 Conflict when the ticket was updated after updatedStamp. Without a stamp this is a
+// regular update.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/rest_api/docs/support/tickets#protecting-against-ticket-update-collisions
+func (c *Client) UpdateTicketSafely(id int64, ticket *zendesk.Ticket, updatedStamp *time.Time) (*zendesk.Ticket, error) {
+	if updatedStamp == nil {
+		return c.UpdateTicket(id, ticket)
+	}
+
+	in := struct {
+		Ticket safeTicketUpdate `json:"ticket"`
+	}{
+		Ticket: safeTicketUpdate{
+			Ticket:       ticket,
+			SafeUpdate:   true,
+			UpdatedStamp: *updatedStamp,
+		},
+	}
+	out := new(zendesk.APIPayload)
+	err := c.do(http.MethodPut, "/api/v2/tickets/"+formatID(id)+".json", in, out)
+	return out.Ticket, ticketError(id, err)
+}
+
+type safeTicketUpdate struct {
+	*zendesk.Ticket
+	SafeUpdate   bool      `json:"safe_update"`
+	UpdatedStamp time.Time `json:"updated_stamp"`
+}
+
+// MergeTickets merges the source ticket into the target ticket: the comments of the source are
+// copied to the target and the source is closed. comment is added to both tickets as a private
+// note. Zendesk merges the tickets in the background, the returned job tracks the merge.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/api-reference/ticketing/tickets/tickets/#merge-tickets-into-target-ticket
+func (c *Client) MergeTickets(source, target int64, comment string) (*zendesk.JobStatus, error) {
+	in := struct {
+		IDs                   []int64 `json:"ids"`
+		SourceComment         string  `json:"source_comment"`
+		SourceCommentIsPublic bool    `json:"source_comment_is_public"`
+		TargetComment         string  `json:"target_comment"`
+		TargetCommentIsPublic bool    `json:"target_comment_is_public"`
+	}{
+		IDs:           []int64{source},
+		SourceComment: comment,
+		TargetComment: comment,
+	}
+	out := struct {
+		JobStatus *zendesk.JobStatus `json:"job_status"`
+	}{}
+	err := c.do(http.MethodPost, "/api/v2/tickets/"+formatID(target)+"/merge.json", in, &out)
+	return out.JobStatus, ticketError(target, err)
+}
+
+// ticketURL returns the agent URL of a ticket.
+func (c *Client) ticketURL(ticketID int64) string {
+	return c.baseURL + "/agent/tickets/" + formatID(ticketID)
+}
+
+// ticketLink returns a markdown link to a ticket labeled with its number and subject.
+func (c *Client) ticketLink(ticket *zendesk.Ticket) string {
+	label := formatID(*ticket.ID)
+	if ticket.Subject != nil {
+		label += ": " + *ticket.Subject
+	}
+	return "[" + label + "](" + c.ticketURL(*ticket.ID) + ")"
+}
+
+// ListTicketForms lists all ticket forms of the instance.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/rest_api/docs/support/ticket_forms#list-ticket-forms
+func (c *Client) ListTicketForms() ([]TicketForm, error) {
+	out := struct {
+		TicketForms []TicketForm `json:"ticket_forms"`
+	}{}
+	err := c.do(http.MethodGet, "/api/v2/ticket_forms.json", nil, &out)
+	return out.TicketForms, err
+}
+
+// ShowTicketForm fetches a ticket form by its ID.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/rest_api/docs/support/ticket_forms#show-ticket-form
+func (c *Client) ShowTicketForm(id int64) (*TicketForm, error) {
+	out := struct {
+		TicketForm *TicketForm `json:"ticket_form"`
+	}{}
+	err := c.do(http.MethodGet, "/api/v2/ticket_forms/"+formatID(id)+".json", nil, &out)
+	return out.TicketForm, err
+}
+
+// ShowTicketField fetches the definition of a ticket field by its ID.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/rest_api/docs/support/ticket_fields#show-ticket-field
+func (c *Client) ShowTicketField(id int64) (*zendesk.TicketField, error) {
+	out := new(zendesk.APIPayload)
+	err := c.do(http.MethodGet, "/api/v2/ticket_fields/"+formatID(id)+".json", nil, out)
+	return out.TicketField, err
+}
+
+// ShowCurrentUser fetches the Zendesk user the client is authenticated as.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/rest_api/docs/support/users#show-the-currently-authenticated-user
+func (c *Client) ShowCurrentUser() (*zendesk.User, error) {
+	out := new(zendesk.APIPayload)
+	err := c.do(http.MethodGet, "/api/v2/users/me.json", nil, out)
+	return out.User, err
+}
+
+// SearchUserByEmail returns the user with the given email, or nil if there is none. Unlike
+// SearchUsers of the go-zendesk client the email is escaped, so addresses like
+// jane+support@example.com are found.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/rest_api/docs/support/users#search-users
+func (c *Client) SearchUserByEmail(email string) (*zendesk.User, error) {
+	out := new(zendesk.APIPayload)
+	if err := c.do(http.MethodGet, "/api/v2/users/search.json?query="+url.QueryEscape("email:"+email), nil, out); err != nil {
+		return nil, err
+	}
+
+	for i := range out.Users {
+		if out.Users[i].Email != nil && strings.EqualFold(*out.Users[i].Email, email) {
+			return &out.Users[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// isAgent reports whether a user can work on tickets, i.e. is an agent or an admin.
+func isAgent(user *zendesk.User) bool {
+	return user.Role != nil && (*user.Role == "agent" || *user.Role == "admin")
+}
+
+// SearchTicketsByQuery returns a page of up to limit tickets matching a free text query, sorted
+// descending by sortBy, or best matches first without it, along with the total number of matching
+// tickets. Pages are numbered from 1. The query is passed to Zendesk as is, unlike SearchTickets
+// of the go-zendesk client which wraps the term in quotes and so only finds exact phrases.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/rest_api/docs/support/search
+func (c *Client) SearchTicketsByQuery(query string, page, limit int, sortBy string) ([]zendesk.Ticket, int, error) {
+	return c.searchTicketPage("type:ticket "+query, page, limit, sortBy)
+}
+
+// ListAssignedTickets returns a page of up to limit tickets with one of statuses assigned to the
+// agent the client is authenticated as, sorted descending by sortBy, e.g. most urgent first by
+// priority, along with the total number of such tickets. Zendesk sorts the results, so a single
+// page is fetched however many tickets are assigned. Pages are numbered from 1.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/rest_api/docs/support/search
+func (c *Client) ListAssignedTickets(statuses []string, page, limit int, sortBy string) ([]zendesk.Ticket, int, error) {
+	user, err := c.ShowCurrentUser()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := "type:ticket"
+	for _, status := range statuses {
+		query += " status:" + status
+	}
+	return c.searchTicketPage(query+" assignee:"+formatID(*user.ID), page, limit, sortBy)
+}
+
+// maxSearchResults is the number of results Zendesk returns at most for a search, over all pages.
+const maxSearchResults = 1000
+
+// searchTicketPage fetches a page of the tickets matching a search query, see SearchTicketsByQuery.
+func (c *Client) searchTicketPage(query string, page, limit int, sortBy string) ([]zendesk.Ticket, int, error) {
+	params := url.Values{}
+	params.Set("query", query)
+	if sortBy != "" {
+		params.Set("sort_by", sortBy)
+		params.Set("sort_order", "desc")
+	}
+	params.Set("page", strconv.Itoa(page))
+	params.Set("per_page", strconv.Itoa(limit))
+
+	out := new(zendesk.TicketSearchResults)
+	if err := c.do(http.MethodGet, "/api/v2/search.json?"+params.Encode(), nil, out); err != nil {
+		return nil, 0, err
+	}
+
+	tickets := out.Results
+	if len(tickets) > limit {
+		tickets = tickets[:limit]
+	}
+	total := (page-1)*limit + len(tickets)
+	if out.Count != nil && int(*out.Count) > total {
+		total = int(*out.Count)
+	}
+	return tickets, total, nil
+}
+
+// SLAPolicyMetric is a target of the SLA policy applied to a ticket, e.g. the first reply time.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/api-reference/ticketing/business-rules/sla_policies/
+type SLAPolicyMetric struct {
+	Metric *string `json:"metric,omitempty"`
+	// Stage is active while the target is running, paused or achieved.
+	Stage    *string    `json:"stage,omitempty"`
+	BreachAt *time.Time `json:"breach_at,omitempty"`
+}
+
+// ShowTicketMetrics returns a ticket along with the metrics of its SLA policy, none if no policy
+// applies to it.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/api-reference/ticketing/tickets/tickets/#sideloads
+func (c *Client) ShowTicketMetrics(ticketID int64) (*zendesk.Ticket, []SLAPolicyMetric, error) {
+	out := struct {
+		Ticket *struct {
+			zendesk.Ticket
+			SLAs *struct {
+				PolicyMetrics []SLAPolicyMetric `json:"policy_metrics"`
+			} `json:"slas"`
+		} `json:"ticket"`
+	}{}
+	err := c.do(http.MethodGet, "/api/v2/tickets/"+formatID(ticketID)+".json?include=slas", nil, &out)
+	if err != nil {
+		return nil, nil, ticketError(ticketID, err)
+	}
+	if out.Ticket == nil {
+		return nil, nil, errors.New("Zendesk didn't return the ticket")
+	}
+
+	var metrics []SLAPolicyMetric
+	if out.Ticket.SLAs != nil {
+		metrics = out.Ticket.SLAs.PolicyMetrics
+	}
+	return &out.Ticket.Ticket, metrics, nil
+}
+
+// Macro represents a Zendesk macro, a set of canned changes and comments applied to tickets.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/api-reference/ticketing/business-rules/macros/
+type Macro struct {
+	ID          *int64  `json:"id,omitempty"`
+	Title       *string `json:"title,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Active      *bool   `json:"active,omitempty"`
+}
+
+// maxShowMany is the most IDs Zendesk accepts in a single show_many request.
+const maxShowMany = 100
+
+// ShowManyOrganizations fetches organizations by their IDs, maxShowMany at a time. Unknown IDs are
+// left out of the results.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/api-reference/ticketing/organizations/organizations/#show-many-organizations
+func (c *Client) ShowManyOrganizations(ids []int64) ([]zendesk.Organization, error) {
+	var organizations []zendesk.Organization
+	for start := 0; start < len(ids); start += maxShowMany {
+		end := start + maxShowMany
+		if end > len(ids) {
+			end = len(ids)
+		}
+		sids := make([]string, 0, end-start)
+		for _, id := range ids[start:end] {
+			sids = append(sids, formatID(id))
+		}
+
+		out := new(zendesk.APIPayload)
+		if err := c.do(http.MethodGet, "/api/v2/organizations/show_many.json?ids="+strings.Join(sids, ","), nil, out); err != nil {
+			return nil, err
+		}
+		organizations = append(organizations, out.Organizations...)
+	}
+	return organizations, nil
+}
+
+// organizationNames returns the names of the organizations of tickets by ID. The names not cached
+// yet are resolved with a single ShowManyOrganizations call, rather than one call per ticket.
+func (c *Client) organizationNames(tickets []zendesk.Ticket) (map[int64]string, error) {
+	names := map[int64]string{}
+	var missing []int64
+	for _, ticket := range tickets {
+		if ticket.OrganizationID == nil {
+			continue
+		}
+		id := *ticket.OrganizationID
+		if name, ok := c.organizationCache[id]; ok {
+			names[id] = name
+			continue
+		}
+		if !containsID(missing, id) {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return names, nil
+	}
+
+	organizations, err := c.ShowManyOrganizations(missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, organization := range organizations {
+		if organization.ID == nil || organization.Name == nil {
+			continue
+		}
+		names[*organization.ID] = *organization.Name
+		if c.organizationCache != nil {
+			c.organizationCache[*organization.ID] = *organization.Name
+		}
+	}
+	return names, nil
+}
+
+// maxMacros is the most macros ListMacros returns, a single page of results.
+const maxMacros = 100
+
+// ListMacros returns the active macros available to the agent, ordered by title, and their total
+// number. At most maxMacros are returned.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/api-reference/ticketing/business-rules/macros/#list-active-macros
+func (c *Client) ListMacros() ([]Macro, int, error) {
+	out := struct {
+		Macros []Macro `json:"macros"`
+		Count  *int    `json:"count"`
+	}{}
+	err := c.do(http.MethodGet, "/api/v2/macros/active.json?sort_by=alphabetical&per_page="+strconv.Itoa(maxMacros), nil, &out)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := len(out.Macros)
+	if out.Count != nil && *out.Count > total {
+		total = *out.Count
+	}
+	return out.Macros, total, nil
+}
+
+// ApplyMacro returns the ticket as it would be after applying a macro, including the comment the
+// macro adds. Zendesk doesn't save the changes, the ticket has to be updated with the result.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/api-reference/ticketing/business-rules/macros/#show-ticket-after-changes
+func (c *Client) ApplyMacro(ticketID, macroID int64) (*zendesk.Ticket, error) {
+	out := struct {
+		Result struct {
+			Ticket  *zendesk.Ticket        `json:"ticket"`
+			Comment *zendesk.TicketComment `json:"comment"`
+		} `json:"result"`
+	}{}
+	err := c.do(http.MethodGet, "/api/v2/tickets/"+formatID(ticketID)+"/macros/"+formatID(macroID)+"/apply.json", nil, &out)
+	if err != nil {
+		return nil, err
+	}
+	if out.Result.Ticket == nil {
+		return nil, errors.New("Zendesk didn't return the result of the macro")
+	}
+
+	ticket := out.Result.Ticket
+	if out.Result.Comment != nil && (out.Result.Comment.Body != nil || out.Result.Comment.HTMLBody != nil) {
+		ticket.Comment = out.Result.Comment
+	}
+	return ticket, nil
+}
+
+// SideConversation represents a side conversation of a Zendesk ticket, a separate thread with
+// people outside of the ticket.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/api-reference/ticketing/side_conversation/side_conversation/
+type SideConversation struct {
+	ID        *string    `json:"id,omitempty"`
+	Subject   *string    `json:"subject,omitempty"`
+	State     *string    `json:"state,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// sideConversationMessage is a message posted to a side conversation. Only new side conversations
+// have recipients and a subject.
+type sideConversationMessage struct {
+	Subject string                      `json:"subject,omitempty"`
+	Body    string                      `json:"body"`
+	To      []sideConversationRecipient `json:"to,omitempty"`
+}
+
+type sideConversationRecipient struct {
+	Email string `json:"email"`
+}
+
+// ListSideConversations returns the side conversations of a ticket.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/api-reference/ticketing/side_conversation/side_conversation/#list-side-conversations
+func (c *Client) ListSideConversations(ticketID int64) ([]SideConversation, error) {
+	out := struct {
+		SideConversations []SideConversation `json:"side_conversations"`
+	}{}
+	err := c.do(http.MethodGet, "/api/v2/tickets/"+formatID(ticketID)+"/side_conversations", nil, &out)
+	return out.SideConversations, err
+}
+
+// CreateSideConversation starts a side conversation of a ticket with an email recipient.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/api-reference/ticketing/side_conversation/side_conversation/#create-side-conversation
+func (c *Client) CreateSideConversation(ticketID int64, to, subject, body string) (*SideConversation, error) {
+	in := struct {
+		Message sideConversationMessage `json:"message"`
+	}{
+		Message: sideConversationMessage{
+			Subject: subject,
+			Body:    body,
+			To:      []sideConversationRecipient{{Email: to}},
+		},
+	}
+	out := struct {
+		SideConversation *SideConversation `json:"side_conversation"`
+	}{}
+	err := c.do(http.MethodPost, "/api/v2/tickets/"+formatID(ticketID)+"/side_conversations", in, &out)
+	return out.SideConversation, err
+}
+
+// ReplyToSideConversation posts a message to a side conversation of a ticket.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/api-reference/ticketing/side_conversation/side_conversation/#reply-to-side-conversation
+func (c *Client) ReplyToSideConversation(ticketID int64, sideConversationID, body string) (*SideConversation, error) {
+	in := struct {
+		Message sideConversationMessage `json:"message"`
+	}{
+		Message: sideConversationMessage{Body: body},
+	}
+	out := struct {
+		SideConversation *SideConversation `json:"side_conversation"`
+	}{}
+	err := c.do(http.MethodPost, "/api/v2/tickets/"+formatID(ticketID)+"/side_conversations/"+url.PathEscape(sideConversationID)+"/reply", in, &out)
+	return out.SideConversation, err
+}
+
+// latestOpenSideConversation returns the most recently updated open side conversation, nil if
+// there is none.
+func latestOpenSideConversation(conversations []SideConversation) *SideConversation {
+	var latest *SideConversation
+	for i := range conversations {
+		conversation := &conversations[i]
+		if stringValue(conversation.State) != "open" || conversation.ID == nil {
+			continue
+		}
+		if latest == nil || (conversation.UpdatedAt != nil && (latest.UpdatedAt == nil || conversation.UpdatedAt.After(*latest.UpdatedAt))) {
+			latest = conversation
+		}
+	}
+	return latest
+}
+
+// commentsPerPage is the maximum page size of the Zendesk comments endpoint.
+const commentsPerPage = 100
+
+// FindLatestComment returns the most recent public or private comment of a ticket, or nil if
+// there is none. Comments are fetched newest first, page by page until a matching comment is
+// found, but no more than maxPages pages.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/rest_api/docs/support/ticket_comments#list-comments
+func (c *Client) FindLatestComment(ticketID int64, public bool, maxPages int) (*zendesk.TicketComment, error) {
+	for page := 1; page <= maxPages; page++ {
+		params := url.Values{}
+		params.Set("sort_order", "desc")
+		params.Set("per_page", strconv.Itoa(commentsPerPage))
+		params.Set("page", strconv.Itoa(page))
+
+		out := new(zendesk.APIPayload)
+		if err := c.do(http.MethodGet, "/api/v2/tickets/"+formatID(ticketID)+"/comments.json?"+params.Encode(), nil, out); err != nil {
+			return nil, err
+		}
+		for i := range out.Comments {
+			if out.Comments[i].Public != nil && *out.Comments[i].Public == public {
+				return &out.Comments[i], nil
+			}
+		}
+		if out.NextPage == nil {
+			break
+		}
+	}
+	return nil, nil
+}
+
+// ListUserGroups lists the groups a user is a member of.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/rest_api/docs/support/groups#list-groups
+func (c *Client) ListUserGroups(userID int64) ([]zendesk.Group, error) {
+	out := new(zendesk.APIPayload)
+	err := c.do(http.MethodGet, "/api/v2/users/"+formatID(userID)+"/groups.json", nil, out)
+	return out.Groups, err
+}
+
+// UploadAttachment uploads a file to Zendesk and returns the upload token, which attaches the
+// file to the ticket comment it is passed to.
+//
+// Zendesk Core API docs: https://developer.zendesk.com/rest_api/docs/support/attachments#upload-files
+func (c *Client) UploadAttachment(filename, contentType string, data []byte) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/api/v2/uploads.json?filename="+url.QueryEscape(filename), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	if contentType == "" {
+		contentType = "application/binary"
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	var out struct {
+		Upload struct {
+			Token string `json:"token"`
+		} `json:"upload"`
+	}
+	if err := c.send(req, &out); err != nil {
+		return "", err
+	}
+	return out.Upload.Token, nil
+}
+
+// do sends a request to the Zendesk API and decodes the JSON response into out. Failed requests
+// are reported as *zendesk.APIError, same as for the calls made by the go-zendesk client.
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, out)
+}
+
+// send authorizes and sends a request built by the caller, see do.
+func (c *Client) send(req *http.Request, out interface{}) error {
+	c.authorize(req)
+	if c.requestID != "" {
+		req.Header.Set(requestIDHeader, c.requestID)
+	}
+
+	res, err := c.requestFunc(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		apiErr := &zendesk.APIError{Response: res}
+		if err := json.NewDecoder(res.Body).Decode(apiErr); err != nil {
+			apiErr.Type = zendesk.String("Unknown")
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
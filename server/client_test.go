@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+)
+
+func TestUpdateTicketSafelyConflict(t *testing.T) {
+	lastUpdate := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Ticket struct {
+				Status       string    `json:"status"`
+				SafeUpdate   bool      `json:"safe_update"`
+				UpdatedStamp time.Time `json:"updated_stamp"`
+			} `json:"ticket"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			t.Fatal(err)
+		}
+		if !in.Ticket.SafeUpdate {
+			t.Error("expected safe_update to be set")
+		}
+		if in.Ticket.Status != "solved" {
+			t.Errorf("expected the ticket fields to be sent along, got status %q", in.Ticket.Status)
+		}
+
+		if in.Ticket.UpdatedStamp.Before(lastUpdate) {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"error":"UpdateConflict","description":"Safe Update prevented the update due to outdated ticket data."}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ticket":{"id":123,"status":"solved"}}`))
+	}))
+	defer server.Close()
+
+	client, err := newOAuthClient(server.URL, "token", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staleStamp := lastUpdate.Add(-time.Minute)
+	_, err = client.UpdateTicketSafely(123, &zendesk.Ticket{Status: zendesk.String("solved")}, &staleStamp)
+	if !isAPIError(err, http.StatusConflict) {
+		t.Fatalf("expected a conflict error, got %v", err)
+	}
+
+	ticket, err := client.UpdateTicketSafely(123, &zendesk.Ticket{Status: zendesk.String("solved")}, &lastUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *ticket.ID != 123 {
+		t.Errorf("expected ticket 123, got %d", *ticket.ID)
+	}
+}
+
+func TestSearchUserByEmail(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if query := r.URL.Query().Get("query"); query != "email:jane+support@example.com" {
+			t.Errorf("unexpected query %q", query)
+		}
+		_, _ = w.Write([]byte(`{"users":[
+			{"id":3,"email":"jane@example.com","role":"agent"},
+			{"id":1,"email":"Jane+Support@example.com","role":"agent","name":"Jane"}
+		]}`))
+	}))
+	defer server.Close()
+
+	client, err := newOAuthClient(server.URL, "token", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := client.SearchUserByEmail("jane+support@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user == nil || *user.ID != 1 {
+		t.Errorf("expected the first user with the email to be found, got %v", user)
+	}
+}
+
+func TestSearchTicketsByQuery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if query := r.URL.Query().Get("query"); query != "type:ticket login error" {
+			t.Errorf("unexpected query %q", query)
+		}
+		if perPage := r.URL.Query().Get("per_page"); perPage != "2" {
+			t.Errorf("expected 2 results per page, got %q", perPage)
+		}
+		_, _ = w.Write([]byte(`{"results":[{"id":1},{"id":2},{"id":3}],"count":3}`))
+	}))
+	defer server.Close()
+
+	client, err := newOAuthClient(server.URL, "token", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tickets, total, err := client.SearchTicketsByQuery("login error", 1, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tickets) != 2 || total != 3 {
+		t.Errorf("expected the results to be limited to 2 of 3, got %d of %d", len(tickets), total)
+	}
+}
+
+func TestListAssignedTicketsFetchesOnePage(t *testing.T) {
+	searches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/users/me.json" {
+			_, _ = w.Write([]byte(`{"user":{"id":5}}`))
+			return
+		}
+
+		searches++
+		query := r.URL.Query()
+		if q := query.Get("query"); q != "type:ticket status:open status:pending assignee:5" {
+			t.Errorf("unexpected query %q", q)
+		}
+		if query.Get("sort_by") != "priority" || query.Get("sort_order") != "desc" {
+			t.Errorf("expected the results to be sorted by priority, got %q", r.URL.RawQuery)
+		}
+		if perPage := query.Get("per_page"); perPage != "2" {
+			t.Errorf("expected 2 results per page, got %q", perPage)
+		}
+		_, _ = w.Write([]byte(`{"results":[{"id":1},{"id":2}],"count":30,"next_page":"` + r.URL.String() + `&page=2"}`))
+	}))
+	defer server.Close()
+
+	client, err := newOAuthClient(server.URL, "token", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tickets, total, err := client.ListAssignedTickets([]string{"open", "pending"}, 1, 2, "priority")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tickets) != 2 || total != 30 {
+		t.Errorf("expected 2 of 30 tickets, got %d of %d", len(tickets), total)
+	}
+	if searches != 1 {
+		t.Errorf("expected a single search request, got %d", searches)
+	}
+}
+
+func TestFindLatestComment(t *testing.T) {
+	var pages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if order := r.URL.Query().Get("sort_order"); order != "desc" {
+			t.Errorf("expected the newest comments first, got %q", order)
+		}
+		page := r.URL.Query().Get("page")
+		pages = append(pages, page)
+		switch page {
+		case "1":
+			_, _ = w.Write([]byte(`{"comments":[{"id":4,"public":true},{"id":3,"public":true}],"next_page":"2"}`))
+		case "2":
+			_, _ = w.Write([]byte(`{"comments":[{"id":2,"public":false},{"id":1,"public":false}],"next_page":"3"}`))
+		default:
+			_, _ = w.Write([]byte(`{"comments":[]}`))
+		}
+	}))
+	defer server.Close()
+
+	client, err := newOAuthClient(server.URL, "token", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comment, err := client.FindLatestComment(1, true, 5)
+	if err != nil || comment == nil || *comment.ID != 4 {
+		t.Errorf("expected the latest public comment, got %v, %v", comment, err)
+	}
+
+	pages = nil
+	comment, err = client.FindLatestComment(1, false, 5)
+	if err != nil || comment == nil || *comment.ID != 2 {
+		t.Errorf("expected the latest private comment from the second page, got %v, %v", comment, err)
+	}
+
+	pages = nil
+	comment, err = client.FindLatestComment(1, false, 1)
+	if err != nil || comment != nil {
+		t.Errorf("expected no comment within the page limit, got %v, %v", comment, err)
+	}
+	if len(pages) != 1 {
+		t.Errorf("expected a single page to be fetched, got %v", pages)
+	}
+}
+
+func TestRetryRateLimited(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	limited := 2
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if limited > 0 {
+			limited--
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"open"}}`))
+	}))
+	defer server.Close()
+
+	client, err := newOAuthClient(server.URL, "token", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = client.UpdateTicket(1, &zendesk.Ticket{Status: zendesk.String("open")}); err != nil {
+		t.Fatalf("expected the request to succeed after two retries, got %v", err)
+	}
+	if len(bodies) != 3 || bodies[2] != bodies[0] || bodies[0] == "" {
+		t.Errorf("expected the body to be sent again with every retry, got %q", bodies)
+	}
+
+	limited, bodies = 3, nil
+	_, err = client.UpdateTicketSafely(1, &zendesk.Ticket{Status: zendesk.String("open")}, &time.Time{})
+	if !isAPIError(err, http.StatusTooManyRequests) {
+		t.Fatalf("expected a rate limit error, got %v", err)
+	}
+	if len(bodies) != 3 {
+		t.Errorf("expected the request to be sent 3 times, got %d", len(bodies))
+	}
+}
@@ -2,27 +2,394 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
 	"regexp"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/mattermost/go-i18n/i18n/bundle"
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
 )
 
-const helpTextHeader = "###### Mattermost Zendesk Plugin - Slash Command Help\n"
+var errNotConnected = errors.New("not connected to Zendesk")
 
-const commonHelpText = "\n* `/zendesk status <case-number>` - Retrieve the current status of a case\n" +
-	"* `/zendesk details <case-number>` - Return details of the case\n" +
-	"* `/zendesk latest private <case-number>` - Retrieve the last internal comment posted to a case\n" +
-	"* `/zendesk latest public <case-number>` - Retrieve the last public comment posted to a case\n" +
-	"* `/zendesk update private <case-number>` - Post an internal comment to a case and notify agents\n" +
-	"* `/zendesk update public <case-number>` - Post a public comment to a case and notify agents\n" +
-	"* `/zendesk connect` - Connect to Zendesk\n" +
-	"* `/zendesk disconnect` - Disconnect from Zendesk\n" +
-	"* `/zendesk help` - Show Help\n"
+// commandInfo describes a subcommand for the help text and autocomplete.
+type commandInfo struct {
+	trigger     string
+	args        string
+	description string
+	examples    []string
+
+	// available reports whether the command is shown in the help, it is always shown when nil.
+	available func(state helpState) bool
+}
+
+// helpState is what the help text depends on besides the commands themselves.
+type helpState struct {
+	config    *configuration
+	connected bool
+	// T translates the help for the user asking for it.
+	T bundle.TranslateFunc
+}
+
+func (ci commandInfo) isAvailable(state helpState) bool {
+	return ci.available == nil || ci.available(state)
+}
+
+func whenConnected(state helpState) bool    { return state.connected }
+func whenDisconnected(state helpState) bool { return !state.connected }
+func whenWebhookEnabled(state helpState) bool {
+	return state.config.WebhookSecret != ""
+}
+
+func (ci commandInfo) usage() string {
+	if ci.args == "" {
+		return "/zendesk " + ci.trigger
+	}
+	return "/zendesk " + ci.trigger + " " + ci.args
+}
+
+// caseNumbers picks the case numbers out of the arguments of the command, by the positions of the
+// case number arguments in its usage, e.g. the second argument of macros apply. Flags don't take a
+// position, and a case number argument ending with "..." takes all the remaining arguments.
+func (ci commandInfo) caseNumbers(args []string) []string {
+	var usage []string
+	for _, word := range strings.Fields(ci.args) {
+		if !strings.HasPrefix(word, "[--") {
+			usage = append(usage, word)
+		}
+	}
+
+	var caseNumbers []string
+	position := 0
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") {
+			continue
+		}
+		if position >= len(usage) {
+			break
+		}
+		word := usage[position]
+		if _, err := strconv.ParseInt(arg, 10, 64); err == nil && strings.Contains(word, "case-number") {
+			caseNumbers = append(caseNumbers, arg)
+		}
+		if !strings.HasSuffix(word, "...>") {
+			position++
+		}
+	}
+	return caseNumbers
+}
+
+var zendeskCommands = []commandInfo{
+	{
+		trigger:     "status",
+		args:        "<case-number...>",
+		description: "Retrieve the current status of one or more cases",
+		examples:    []string{"/zendesk status 12345", "/zendesk status 12345 12346 12347"},
+	},
+	{
+		trigger:     "details",
+		args:        "<case-number> [--public]",
+		description: "Return details of the case, with --public they are posted to the channel for everyone",
+		examples:    []string{"/zendesk details 12345", "/zendesk details 12345 --public"},
+	},
+	{
+		trigger:     "link",
+		args:        "<case-number>",
+		description: "Post a link to a case with its subject and status to the channel",
+		examples:    []string{"/zendesk link 12345"},
+	},
+	{
+		trigger:     "requester",
+		args:        "<case-number>",
+		description: "Show the email, phone, organization and time zone of the requester of a case",
+		examples:    []string{"/zendesk requester 12345"},
+	},
+	{
+		trigger:     "sla",
+		args:        "<case-number>",
+		description: "Show the SLA targets of a case, when the next one is breached and which ones already are",
+		examples:    []string{"/zendesk sla 12345"},
+	},
+	{
+		trigger:     "latest private",
+		args:        "<case-number>",
+		description: "Retrieve the last internal comment posted to a case",
+		examples:    []string{"/zendesk latest private 12345"},
+	},
+	{
+		trigger:     "latest public",
+		args:        "<case-number>",
+		description: "Retrieve the last public comment posted to a case",
+		examples:    []string{"/zendesk latest public 12345"},
+	},
+	{
+		trigger:     "update",
+		args:        "[--preview] <case-number> [--status=<status>] [--priority=<priority>] [--file=<file-id>] <comment>",
+		description: "Post a comment to a case, private or public as set in the plugin settings",
+		examples:    []string{"/zendesk update 12345 Waiting for the logs from the customer."},
+	},
+	{
+		trigger:     "update private",
+		args:        "[--preview] <case-number> [--status=<status>] [--priority=<priority>] [--file=<file-id>] <comment>",
+		description: "Post an internal comment to a case and notify agents",
+		examples: []string{
+			"/zendesk update private 12345 Escalated to the backend team.",
+			"/zendesk update private 12345 Checked the logs:\nno errors on our side.",
+			"/zendesk update private 12345 --priority=high Customer is blocked in production.",
+		},
+	},
+	{
+		trigger:     "update public",
+		args:        "[--preview] <case-number> [--status=<status>] [--priority=<priority>] [--file=<file-id>] <comment>",
+		description: "Post a public comment to a case and notify agents",
+		examples: []string{
+			"/zendesk update public 12345 Thanks for reaching out, we are looking into it.",
+			"/zendesk update public 12345 --status=solved The fix has been deployed.",
+			"/zendesk update public 12345 --file=8xk3bm5qzbf3tkmtxydgzjoxdh Screenshot of the error attached.",
+			"/zendesk update public --preview 12345 Thanks for your patience, the fix is live.",
+		},
+	},
+	{
+		trigger:     "sidecomment",
+		args:        "<case-number> [--to=<email>] <text>",
+		description: "Post to the latest open side conversation of a case, or start one with --to",
+		examples: []string{
+			"/zendesk sidecomment 12345 The fix is ready for testing.",
+			"/zendesk sidecomment 12345 --to=vendor@example.com Could you check the attached logs?",
+		},
+	},
+	{
+		trigger:     "assign",
+		args:        "<case-number> <agent-email>",
+		description: "Assign a case to another agent",
+		examples:    []string{"/zendesk assign 12345 jane.doe@example.com"},
+	},
+	{
+		trigger:     "priority",
+		args:        "<case-number> <level>",
+		description: "Change the priority of a case to urgent, high, normal or low",
+		examples:    []string{"/zendesk priority 12345 high"},
+	},
+	{
+		trigger:     "solve",
+		args:        "<case-number> [comment]",
+		description: "Solve a case, optionally with a closing public comment",
+		examples:    []string{"/zendesk solve 12345", "/zendesk solve 12345 The fix has been deployed, thanks for your patience."},
+	},
+	{
+		trigger:     "reopen",
+		args:        "<case-number>",
+		description: "Reopen a solved case",
+		examples:    []string{"/zendesk reopen 12345"},
+	},
+	{
+		trigger:     "watch",
+		args:        "<case-number>",
+		description: "Post the updates of a case received by the webhook to this channel",
+		examples:    []string{"/zendesk watch 12345"},
+		available:   whenWebhookEnabled,
+	},
+	{
+		trigger:     "watch quiet",
+		args:        "<case-number> <quiet-hours> [--digest]",
+		description: "Hold back the updates of a watched case during quiet hours in your time zone, with --digest they are summed up at the end, off removes them",
+		examples:    []string{"/zendesk watch quiet 12345 22:00-07:00", "/zendesk watch quiet 12345 22:00-07:00 --digest", "/zendesk watch quiet 12345 off"},
+		available:   whenWebhookEnabled,
+	},
+	{
+		trigger:     "watch digest",
+		args:        "<case-number> <minutes>",
+		description: "Sum up the updates of a watched case in a single post every few minutes, off posts them right away again",
+		examples:    []string{"/zendesk watch digest 12345 30", "/zendesk watch digest 12345 off"},
+		available:   whenWebhookEnabled,
+	},
+	{
+		trigger:     "unwatch",
+		args:        "<case-number>",
+		description: "Stop posting the updates of a case to this channel",
+		examples:    []string{"/zendesk unwatch 12345"},
+		available:   whenWebhookEnabled,
+	},
+	{
+		trigger:     "tag add",
+		args:        "<case-number> <tag...>",
+		description: "Add tags to a case",
+		examples:    []string{"/zendesk tag add 12345 billing vip"},
+	},
+	{
+		trigger:     "tag remove",
+		args:        "<case-number> <tag...>",
+		description: "Remove tags from a case",
+		examples:    []string{"/zendesk tag remove 12345 vip"},
+	},
+	{
+		trigger:     "macros list",
+		description: "List the Zendesk macros available to you",
+		examples:    []string{"/zendesk macros list"},
+	},
+	{
+		trigger:     "macros apply",
+		args:        "<macro-id> <case-number>",
+		description: "Apply a Zendesk macro to a case, with the changes and the comment it makes",
+		examples:    []string{"/zendesk macros apply 360001 12345"},
+	},
+	{
+		trigger:     "create",
+		args:        "[--requester-email=<email>] [--requester-name=<name>] [--type=<question|incident|problem|task>] \"<subject>\" <description>",
+		description: "Open a new ticket, without arguments a dialog asks for the subject, description, priority and type",
+		examples: []string{
+			"/zendesk create",
+			"/zendesk create \"Cannot log in\" The customer gets an error after entering their password.",
+			"/zendesk create --requester-email=jane@example.com --requester-name=\"Jane Doe\" \"Cannot log in\" The password is rejected.",
+			"/zendesk create --type=incident \"Printer on fire\" The office printer caught fire.",
+		},
+	},
+	{
+		trigger:     "search",
+		args:        "[--sort=<priority|updated|created>] [--limit=<number>] <query>",
+		description: "Search tickets by free text, best matches first unless sorted",
+		examples:    []string{"/zendesk search login error", "/zendesk search status:open printer", "/zendesk search --sort=updated --limit=5 printer"},
+	},
+	{
+		trigger:     "list",
+		args:        "[--sort=<priority|updated|created>] [--limit=<number>]",
+		description: "List the open and pending tickets assigned to you, most urgent first unless sorted",
+		examples:    []string{"/zendesk list", "/zendesk list --sort=updated --limit=5"},
+	},
+	{
+		trigger:     "queue",
+		description: "Show your unsolved tickets in sections by status, with the number of tickets of each",
+		examples:    []string{"/zendesk queue"},
+	},
+	{
+		trigger:     "org",
+		args:        "<organization-name-or-id>",
+		description: "Summarize an organization: its domains, tier and open tickets",
+		examples:    []string{"/zendesk org Acme Inc", "/zendesk org 360001234567"},
+	},
+	{
+		trigger:     "org count",
+		args:        "<organization-name-or-id>",
+		description: "Show the number of open tickets of an organization",
+		examples:    []string{"/zendesk org count Acme Inc", "/zendesk org count 360001234567"},
+	},
+	{
+		trigger:     "problem",
+		args:        "<incident-case-number> <problem-case-number>",
+		description: "Link an incident to a problem ticket",
+		examples:    []string{"/zendesk problem 12346 12345"},
+	},
+	{
+		trigger:     "merge",
+		args:        "<source-case-number> <target-case-number> [comment]",
+		description: "Merge a duplicate ticket into another ticket and close it, after confirmation",
+		examples:    []string{"/zendesk merge 12346 12345", "/zendesk merge 12346 12345 Same outage as the original report"},
+	},
+	{
+		trigger:     "problem incidents",
+		args:        "<problem-case-number>",
+		description: "List the incidents linked to a problem ticket",
+		examples:    []string{"/zendesk problem incidents 12345"},
+	},
+	{
+		trigger:     "form",
+		args:        "<case-number> <form-name-or-id>",
+		description: "Switch a case to another ticket form",
+		examples:    []string{"/zendesk form 12345 Hardware request"},
+	},
+	{
+		trigger:     "my groups",
+		description: "List the Zendesk groups you are a member of",
+		examples:    []string{"/zendesk my groups"},
+	},
+	{
+		trigger:     "whoami",
+		description: "Show the Zendesk account you are connected as",
+		examples:    []string{"/zendesk whoami"},
+	},
+	{
+		trigger:     "connect",
+		description: "Connect to Zendesk",
+		examples:    []string{"/zendesk connect"},
+		available:   whenDisconnected,
+	},
+	{
+		trigger:     "connect dm",
+		description: "Receive the link to connect to Zendesk as a direct message",
+		examples:    []string{"/zendesk connect dm"},
+		available:   whenDisconnected,
+	},
+	{
+		trigger:     "connect token",
+		args:        "<email> <api-token>",
+		description: "Connect to Zendesk with an API token instead of OAuth",
+		examples:    []string{"/zendesk connect token jane@example.com 6wiIBWbGkBMo1mRDMuVwkw1EPsNkeUj95PIz2akv"},
+		available:   whenDisconnected,
+	},
+	{
+		trigger:     "disconnect",
+		description: "Disconnect from Zendesk",
+		examples:    []string{"/zendesk disconnect"},
+		available:   whenConnected,
+	},
+	{
+		trigger:     "help",
+		args:        "[examples]",
+		description: "Show Help, or copy-pasteable examples of every command",
+		examples:    []string{"/zendesk help", "/zendesk help examples"},
+	},
+}
+
+// localDescription returns the description of a command translated for the help, see helpState.
+// The descriptions are also used by the autocomplete, which isn't translated, so the English
+// description is kept with the command and used when there is no translation.
+func (ci commandInfo) localDescription(state helpState) string {
+	translationID := "zendesk.help.command." + strings.Replace(ci.trigger, " ", "_", -1)
+	if description := state.T(translationID); description != translationID {
+		return description
+	}
+	return ci.description
+}
+
+func commonHelpText(state helpState) string {
+	helpText := "\n"
+	if !state.connected {
+		helpText += state.T("zendesk.help.not_connected") + "\n\n"
+	}
+	for _, ci := range zendeskCommands {
+		if !ci.isAvailable(state) {
+			continue
+		}
+		description := ci.localDescription(state)
+		if ci.trigger == "update" {
+			description += state.T("zendesk.help.default_visibility", map[string]interface{}{"Visibility": state.config.getDefaultCommentVisibility()})
+		}
+		helpText += fmt.Sprintf("* `%s` - %s\n", ci.usage(), description)
+	}
+	return helpText
+}
+
+func examplesHelpText(state helpState) string {
+	helpText := ""
+	for _, ci := range zendeskCommands {
+		if !ci.isAvailable(state) {
+			continue
+		}
+		helpText += fmt.Sprintf("\n**%s**\n", ci.localDescription(state))
+		for _, example := range ci.examples {
+			helpText += "```\n" + example + "\n```\n"
+		}
+	}
+	return helpText + "\n" + state.T("zendesk.help.examples_footer") + "\n"
+}
 
 // CommandHandlerFunc -
 type CommandHandlerFunc func(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse
@@ -35,48 +402,230 @@ type CommandHandler struct {
 
 var zendeskCommandHandler = CommandHandler{
 	handlers: map[string]CommandHandlerFunc{
-		"connect":        executeConnect,
-		"disconnect":     executeDisconnect,
-		"status":         executeStatus,
-		"latest/private": executeLatestPrivate,
-		"latest/public":  executeLatestPublic,
-		"update/private": executeUpdatePrivate,
-		"update/public":  executeUpdatePublic,
-		"details":        executeDetails,
-		"help":           commandHelp,
+		"connect":           executeConnect,
+		"connect/token":     executeConnectToken,
+		"connect/dm":        executeConnectDM,
+		"disconnect":        executeDisconnect,
+		"status":            executeStatus,
+		"latest/private":    executeLatestPrivate,
+		"latest/public":     executeLatestPublic,
+		"update":            executeUpdate,
+		"update/private":    executeUpdatePrivate,
+		"update/public":     executeUpdatePublic,
+		"details":           executeDetails,
+		"link":              executeLink,
+		"requester":         executeRequester,
+		"sla":               executeSLA,
+		"sidecomment":       executeSideComment,
+		"org":               executeOrg,
+		"org/count":         executeOrgCount,
+		"problem":           executeProblem,
+		"problem/incidents": executeProblemIncidents,
+		"merge":             executeMerge,
+		"form":              executeForm,
+		"create":            executeCreate,
+		"assign":            executeAssign,
+		"priority":          executePriority,
+		"solve":             executeSolve,
+		"reopen":            executeReopen,
+		"watch":             executeWatch,
+		"watch/quiet":       executeWatchQuiet,
+		"watch/digest":      executeWatchDigest,
+		"unwatch":           executeUnwatch,
+		"tag/add":           executeTagAdd,
+		"tag/remove":        executeTagRemove,
+		"macros/list":       executeMacrosList,
+		"macros/apply":      executeMacrosApply,
+		"search":            executeSearch,
+		"list":              executeList,
+		"queue":             executeQueue,
+		"my/groups":         executeMyGroups,
+		"whoami":            executeWhoami,
+		"help":              commandHelp,
+		"help/examples":     commandHelpExamples,
 	},
 	defaultHandler: executeZendeskDefault,
 }
 
 func getCommand() *model.Command {
+	var triggers []string
+	for _, ci := range zendeskCommands {
+		triggers = append(triggers, ci.trigger)
+	}
+
 	return &model.Command{
 		Trigger:          "zendesk",
 		DisplayName:      "Zendesk",
 		Description:      "Integration with Zendesk.",
 		AutoComplete:     true,
-		AutoCompleteDesc: "Available commands: status, details, latest/private, latest/public, update/private, update/public, connect, disconnect, help",
+		AutoCompleteDesc: "Available commands: " + strings.Join(triggers, ", "),
 		AutoCompleteHint: "[command]",
+		AutocompleteData: getAutocompleteData(),
+	}
+}
+
+// getAutocompleteData builds the autocomplete tree from zendeskCommands, multi word triggers
+// like `latest private` become nested subcommands.
+func getAutocompleteData() *model.AutocompleteData {
+	root := model.NewAutocompleteData("zendesk", "[command]", "Available commands: status, details, latest, update, ...")
+	for _, ci := range zendeskCommands {
+		node := root
+		for _, trigger := range strings.Fields(ci.trigger) {
+			var sub *model.AutocompleteData
+			for _, existing := range node.SubCommands {
+				if existing.Trigger == trigger {
+					sub = existing
+				}
+			}
+			if sub == nil {
+				sub = model.NewAutocompleteData(trigger, "", "")
+				node.AddCommand(sub)
+			}
+			// A command can't have both arguments and subcommands, e.g. `problem` only keeps its hint.
+			node.Arguments = []*model.AutocompleteArg{}
+			node = sub
+		}
+		node.Hint = ci.args
+		node.HelpText = ci.description
+		if len(node.SubCommands) == 0 {
+			addAutocompleteArguments(node, ci.args)
+		}
+	}
+	return root
+}
+
+// addAutocompleteArguments declares the `<argument>` placeholders of a usage as text arguments.
+// Optional flags are skipped.
+func addAutocompleteArguments(node *model.AutocompleteData, args string) {
+	for _, arg := range strings.Fields(args) {
+		if !strings.HasPrefix(strings.Trim(arg, `"`), "<") {
+			continue
+		}
+		name := strings.Trim(arg, `"<>`)
+		pattern := ""
+		if strings.HasSuffix(name, "case-number") {
+			pattern = `^[0-9]+$`
+		}
+		node.AddTextArgument(strings.Replace(name, "-", " ", -1), name, pattern)
 	}
 }
 
 // ExecuteCommand -
 func (p *Plugin) ExecuteCommand(c *plugin.Context, commandArgs *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
-	args := strings.Fields(commandArgs.Command)
+	commandArgs.Command = normalizeCommand(commandArgs.Command)
+	// The instance flag is resolved from the command text by the handlers, see resolveInstance.
+	_, command := parseInstanceFlag(commandArgs.Command)
+	args := strings.Fields(command)
 	if len(args) == 0 || args[0] != "/zendesk" {
 		return p.help(commandArgs), nil
 	}
+	if !p.isCommandAllowed(commandArgs) {
+		return p.respondT(commandArgs, "zendesk.command.not_allowed"), nil
+	}
 	return zendeskCommandHandler.Handle(p, c, commandArgs, args[1:]...), nil
 }
 
+// isCommandAllowed reports whether commands may be run in the channel of a command, see
+// AllowedChannels and AllowedTeams. A channel is allowed when it is listed, or its team is.
+// Channels and teams are only loaded when their ID isn't listed, to match their name.
+func (p *Plugin) isCommandAllowed(commandArgs *model.CommandArgs) bool {
+	config := p.getConfiguration()
+	channels, teams := config.getAllowedChannels(), config.getAllowedTeams()
+	if len(channels) == 0 && len(teams) == 0 {
+		return true
+	}
+
+	if len(channels) > 0 {
+		if containsString(channels, commandArgs.ChannelId) {
+			return true
+		}
+		if channel, appErr := p.API.GetChannel(commandArgs.ChannelId); appErr == nil && containsFold(channels, channel.Name) {
+			return true
+		}
+	}
+
+	// Direct messages don't belong to a team, commands run there are checked against the team
+	// the user is currently viewing.
+	if len(teams) > 0 && commandArgs.TeamId != "" {
+		if containsString(teams, commandArgs.TeamId) {
+			return true
+		}
+		if team, appErr := p.API.GetTeam(commandArgs.TeamId); appErr == nil && containsFold(teams, team.Name) {
+			return true
+		}
+	}
+	return false
+}
+
 // Handle -
 func (ch CommandHandler) Handle(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
 	for n := len(args); n > 0; n-- {
-		h := ch.handlers[strings.Join(args[:n], "/")]
+		name := strings.Join(args[:n], "/")
+		h := ch.handlers[name]
 		if h != nil {
-			return h(p, c, header, args[n:]...)
+			p.auditCommand(header, name, args[n:])
+			return p.runHandler(name, h, c, header, args[n:]...)
+		}
+	}
+	return p.runHandler("default", ch.defaultHandler, c, header, args...)
+}
+
+// runHandler runs a command handler, turning a panic into a generic response so a bug in one
+// command doesn't take down the command processing.
+func (p *Plugin) runHandler(name string, h CommandHandlerFunc, c *plugin.Context, header *model.CommandArgs, args ...string) (response *model.CommandResponse) {
+	requestID := commandRequestID(c)
+	p.commandRequestIDs.Store(header, requestID)
+	defer p.commandRequestIDs.Delete(header)
+	p.API.LogDebug("running zendesk command", "command", strings.Replace(name, "/", " ", -1), "user_id", header.UserId, "request_id", requestID)
+
+	defer func() {
+		if r := recover(); r != nil {
+			p.API.LogError("recovered from a panic in a zendesk command",
+				"command", strings.Replace(name, "/", " ", -1),
+				"user_id", header.UserId,
+				"error", fmt.Sprint(r),
+				"stack", string(debug.Stack()),
+			)
+			response = p.respondT(header, "zendesk.command.panic")
+		}
+	}()
+	return h(p, c, header, args...)
+}
+
+// commandRequestID returns the correlation ID of a command, the ID of the Mattermost request
+// running it when there is one. It is sent to Zendesk with every request made for the command,
+// see requestIDHeader.
+func commandRequestID(c *plugin.Context) string {
+	if c != nil && c.RequestId != "" {
+		return c.RequestId
+	}
+	return model.NewId()
+}
+
+// auditCommand logs who ran which command against which cases. Only the case numbers of the
+// arguments are logged, never comments or other free text, see commandInfo.caseNumbers.
+func (p *Plugin) auditCommand(commandArgs *model.CommandArgs, name string, args []string) {
+	var caseNumbers []string
+	trigger := strings.Replace(name, "/", " ", -1)
+	for _, ci := range zendeskCommands {
+		if ci.trigger == trigger {
+			caseNumbers = ci.caseNumbers(args)
+			break
 		}
 	}
-	return ch.defaultHandler(p, c, header, args...)
+
+	// Unknown instances are logged as given, the command itself reports the error.
+	instance, _ := parseInstanceFlag(commandArgs.Command)
+	if resolved, err := p.resolveInstance(commandArgs); err == nil {
+		instance = resolved.Name
+	}
+	p.API.LogInfo("zendesk command",
+		"user_id", commandArgs.UserId,
+		"channel_id", commandArgs.ChannelId,
+		"command", strings.Replace(name, "/", " ", -1),
+		"instance", instance,
+		"case_numbers", strings.Join(caseNumbers, ","),
+	)
 }
 
 func commandHelp(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
@@ -84,360 +633,2740 @@ func commandHelp(p *Plugin, c *plugin.Context, header *model.CommandArgs, args .
 }
 
 func (p *Plugin) help(args *model.CommandArgs) *model.CommandResponse {
-	helpText := helpTextHeader
-	helpText += commonHelpText
+	state := p.getHelpState(args)
+	helpText := state.T("zendesk.help.title") + "\n"
+	helpText += commonHelpText(state)
 
 	p.postCommandResponse(args, helpText)
 	return &model.CommandResponse{}
 }
 
+func commandHelpExamples(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	state := p.getHelpState(header)
+	p.postCommandResponse(header, state.T("zendesk.help.examples_title")+"\n"+examplesHelpText(state))
+	return &model.CommandResponse{}
+}
+
+// getHelpState checks whether the user is connected to the Zendesk instance selected by the
+// command. The token is only read, so asking for help never counts against the rate limit.
+func (p *Plugin) getHelpState(args *model.CommandArgs) helpState {
+	state := helpState{config: p.getConfiguration(), T: p.T(args.UserId)}
+	if instance, err := p.resolveInstance(args); err == nil {
+		_, err = p.getToken(args.UserId, instance.Name)
+		state.connected = err == nil
+	}
+	return state
+}
+
 func executeConnect(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
 	if len(args) != 0 {
 		return p.help(commandArgs)
 	}
 
-	mmuser, err := p.API.GetUser(commandArgs.UserId)
+	instance, err := p.resolveInstance(commandArgs)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	mmuser, appErr := p.API.GetUser(commandArgs.UserId)
+	if appErr != nil {
+		return p.help(commandArgs)
+	}
+
+	// The link is posted in the channel when the direct message can't be sent.
+	if p.getConfiguration().ConnectLinkDM {
+		err = p.sendConnectLinkDM(mmuser, instance)
+		if err == nil {
+			return p.respondT(commandArgs, "zendesk.connect.link_sent")
+		}
+		p.API.LogWarn("failed to send the connect link as a direct message", "user_id", commandArgs.UserId, "error", err.Error())
+	}
+
+	return p.responsef(commandArgs, "%s", p.connectLinkText(mmuser, instance))
+}
+
+// executeConnectDM sends the connect link as a direct message from the bot so that it doesn't get lost.
+func executeConnectDM(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 0 {
+		return p.help(commandArgs)
+	}
+
+	instance, err := p.resolveInstance(commandArgs)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	mmuser, appErr := p.API.GetUser(commandArgs.UserId)
+	if appErr != nil {
+		return p.help(commandArgs)
+	}
+
+	if err := p.sendConnectLinkDM(mmuser, instance); err != nil {
+		return p.respondT(commandArgs, "zendesk.connect.dm_failed", map[string]interface{}{"Error": err.Error()})
+	}
+
+	return p.respondT(commandArgs, "zendesk.connect.link_sent")
+}
+
+// sendConnectLinkDM sends the link connecting a user to a Zendesk instance as a direct message from the bot.
+func (p *Plugin) sendConnectLinkDM(mmuser *model.User, instance *zendeskInstance) error {
+	channel, appErr := p.API.GetDirectChannel(mmuser.Id, p.botID)
+	if appErr != nil {
+		return appErr
+	}
+
+	_, appErr = p.API.CreatePost(&model.Post{
+		UserId:    p.botID,
+		ChannelId: channel.Id,
+		Message:   p.connectLinkText(mmuser, instance),
+	})
+	if appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// executeConnectToken connects the user with the API token of their Zendesk account, for
+// deployments without an OAuth client. The token is checked with Zendesk before it is stored.
+func executeConnectToken(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 2 || !strings.Contains(args[0], "@") {
+		return p.respondUsage(commandArgs, "connect token", "your email and an API token")
+	}
+	email, apiToken := args[0], args[1]
+
+	instance, err := p.resolveInstance(commandArgs)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	client, err := newAPITokenClient(instance.URL, email, apiToken, p.getConfiguration().getRateLimitRetries())
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	user, err := client.ShowCurrentUser()
+	if isAPIError(err, http.StatusUnauthorized) || (err == nil && (user == nil || user.ID == nil)) {
+		return p.respondT(commandArgs, "zendesk.connect.token_rejected")
+	}
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	if err := p.setToken(commandArgs.UserId, instance.Name, apiTokenCredential(email, apiToken)); err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	return p.respondT(commandArgs, "zendesk.connect.connected", map[string]interface{}{"URL": client.baseURL, "Name": stringValue(user.Name)})
+}
+
+// connectTokenMessageRegexp matches messages containing a `/zendesk connect token` command, e.g.
+// when it was sent with a leading space and was posted instead of run.
+var connectTokenMessageRegexp = regexp.MustCompile(`(?i)zendesk\s+(?:--instance=\S+\s+)?connect\s+token\s+\S+@\S+\s+\S+`)
+
+// MessageWillBePosted rejects messages containing a `/zendesk connect token` command, so API tokens
+// aren't posted to a channel. Commands themselves are never posted.
+func (p *Plugin) MessageWillBePosted(c *plugin.Context, post *model.Post) (*model.Post, string) {
+	if !connectTokenMessageRegexp.MatchString(post.Message) {
+		return nil, ""
+	}
+
+	p.API.SendEphemeralPost(post.UserId, &model.Post{
+		UserId:    p.botID,
+		ChannelId: post.ChannelId,
+		Message:   p.T(post.UserId)("zendesk.connect.token_in_message"),
+	})
+	return nil, "the message contains a Zendesk API token"
+}
+
+// connectLinkText returns the link connecting a user to a Zendesk instance, or how to connect with
+// an API token when no OAuth client is set up for it.
+func (p *Plugin) connectLinkText(mmuser *model.User, instance *zendeskInstance) string {
+	T := p.T(mmuser.Id)
+	if !instance.supportsOAuth() {
+		connect := "/zendesk connect token <email> <api-token>"
+		if !instance.isDefault() {
+			connect = "/zendesk --instance=" + instance.Name + " connect token <email> <api-token>"
+		}
+		return T("zendesk.connect.api_tokens", map[string]interface{}{"Command": connect})
+	}
+	if instance.isDefault() {
+		return T("zendesk.connect.link", map[string]interface{}{"Username": mmuser.Username, "URL": p.GetPluginURL() + routeUserConnect})
+	}
+	return T("zendesk.connect.link_instance", map[string]interface{}{
+		"Instance": instance.Name,
+		"Username": mmuser.Username,
+		"URL":      p.GetPluginURL() + routeUserConnect + "?instance=" + url.QueryEscape(instance.Name),
+	})
+}
+
+func executeDisconnect(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 0 {
+		return p.help(commandArgs)
+	}
+
+	instance, err := p.resolveInstance(commandArgs)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	// A token that can't be read, e.g. after the encryption key was rotated, is still removed.
+	if _, err = p.getToken(commandArgs.UserId, instance.Name); err == errNotConnected {
+		return p.respondT(commandArgs, "zendesk.disconnect.not_connected")
+	}
+
+	if err := p.deleteToken(commandArgs.UserId, instance.Name); err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	return p.respondT(commandArgs, "zendesk.disconnect.disconnected")
+}
+
+// executeStatus returns the current status of a case, I.e. Pending, Open, On-Hold, Solved Closed
+func executeStatus(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) == 0 {
+		return p.respondUsage(commandArgs, "status", "a case number")
+	}
+	if len(args) > 1 {
+		return p.respondStatuses(commandArgs, args)
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+
+	}
+
+	var ticket *zendesk.Ticket
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	progress := p.showProgress(commandArgs, "Fetching ticket #%d...", ticketNumber)
+	defer progress.close()
+
+	ticket, err = client.ShowTicket(ticketNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	// Partial API responses may come without a status.
+	if ticket == nil || ticket.Status == nil {
+		return p.respondT(commandArgs, "zendesk.status.unavailable", map[string]interface{}{"TicketID": ticketNumber})
+	}
+
+	p.markTicketSeen(commandArgs, ticket)
+	progress.finish(p.commandResponsePost(commandArgs, p.getConfiguration().formatStatus(*ticket.Status)))
+	return &model.CommandResponse{}
+}
+
+// maxStatusTickets is the most tickets a single `/zendesk status` can look up.
+const maxStatusTickets = 25
+
+// statusWorkers is how many tickets `/zendesk status` fetches from Zendesk at the same time.
+const statusWorkers = 5
+
+// ticketStatus is the outcome of looking up the status of one ticket of a batch.
+type ticketStatus struct {
+	arg    string
+	ticket *zendesk.Ticket
+	err    error
+}
+
+// respondStatuses lists the status of several tickets, one line per ticket. A ticket that can't be
+// found is reported on its line without failing the others.
+func (p *Plugin) respondStatuses(commandArgs *model.CommandArgs, args []string) *model.CommandResponse {
+	if len(args) > maxStatusTickets {
+		return p.respondT(commandArgs, "zendesk.status.too_many", map[string]interface{}{"Max": maxStatusTickets})
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	progress := p.showProgress(commandArgs, "Fetching %d tickets...", len(args))
+	defer progress.close()
+
+	results := make([]ticketStatus, len(args))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < statusWorkers && w < len(args); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = fetchTicketStatus(client, args[i])
+			}
+		}()
+	}
+	for i := range args {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	config := p.getConfiguration()
+	text := ""
+	for _, result := range results {
+		switch {
+		case isAPIError(result.err, http.StatusUnauthorized):
+			return p.respondError(commandArgs, result.err)
+		case result.err != nil:
+			text += fmt.Sprintf("* `%s`: %s\n", result.arg, result.err.Error())
+		default:
+			p.markTicketSeen(commandArgs, result.ticket)
+			text += fmt.Sprintf("* %s: **%s**\n", client.ticketLink(result.ticket), config.formatStatus(stringValue(result.ticket.Status)))
+		}
+	}
+	progress.finish(p.commandResponsePost(commandArgs, text))
+	return &model.CommandResponse{}
+}
+
+// fetchTicketStatus looks up the ticket of a case number argument for respondStatuses.
+func fetchTicketStatus(client *Client, arg string) ticketStatus {
+	ticketNumber, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return ticketStatus{arg: arg, err: errors.New("not a case number")}
+	}
+	ticket, err := client.ShowTicket(ticketNumber)
+	if err == nil && (ticket == nil || ticket.ID == nil || ticket.Status == nil) {
+		err = errors.New("status is unavailable")
+	}
+	return ticketStatus{arg: arg, ticket: ticket, err: err}
+}
+
+// executeDetails - Return details of the case, Assignee, Requester, Organization, Issue, Priority, Status etc.
+func executeDetails(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	public := false
+	var rest []string
+	for _, arg := range args {
+		switch {
+		case arg == "--public":
+			public = true
+		case strings.HasPrefix(arg, "--"):
+			return p.respondT(commandArgs, "zendesk.details.unknown_flag", map[string]interface{}{"Flag": arg})
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	if len(rest) != 1 {
+		return p.respondUsage(commandArgs, "details", "a case number")
+	}
+
+	ticketNumber, err := strconv.ParseInt(rest[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	// The ticket, its organization, form and custom fields are loaded one after another.
+	progress := p.showProgress(commandArgs, "Fetching ticket #%d...", ticketNumber)
+	defer progress.close()
+
+	ticket, err := client.ShowTicket(ticketNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	var organization *zendesk.Organization
+	if ticket.OrganizationID != nil {
+		organization, err = client.ShowOrganization(*ticket.OrganizationID)
+		if err != nil {
+			return p.respondError(commandArgs, err)
+		}
+	}
+
+	// The form is only informational, so don't fail the whole card if it can't be resolved.
+	var form *TicketForm
+	if ticket.TicketFormID != nil {
+		form, err = client.ShowTicketForm(*ticket.TicketFormID)
+		if err != nil {
+			p.API.LogWarn("failed to fetch ticket form", "ticket_form_id", *ticket.TicketFormID, "error", err.Error())
+		}
+	}
+
+	// Times of a card shared with the channel are shown in UTC, as its readers may be anywhere.
+	loc := time.UTC
+	if !public {
+		loc = p.userLocation(commandArgs.UserId)
+	}
+	// Internal notes aren't meant for the customers and other people of a channel, and only agents
+	// see them in Zendesk.
+	withInternalNote := !public && p.getConfiguration().ShowInternalNote && p.canSeeInternalNotes(client)
+	attachment, err := p.parseTicket(p.T(commandArgs.UserId), client, ticket, organization, form, loc, withInternalNote)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	p.markTicketSeen(commandArgs, ticket)
+
+	post := p.commandResponsePost(commandArgs, "")
+	post.AddProp("attachments", attachment)
+
+	if !public {
+		progress.finish(post)
+		return &model.CommandResponse{}
+	}
+	posted, appErr := p.createChannelPost(post)
+	if appErr != nil {
+		return p.respondT(commandArgs, "zendesk.details.post_failed", map[string]interface{}{"Error": appErr.Error()})
+	}
+	if !posted {
+		return p.respondT(commandArgs, "zendesk.channel_post.coalesced")
+	}
+
+	//TODO - remove - test only
+	//ticketStr, _ := json.Marshal(*ticket)
+	//p.postCommandResponse(commandArgs, "TEST ONLY - RAW OUTPUT: "+string(ticketStr))
+
+	return &model.CommandResponse{}
+}
+
+// executeUpdatePrivate - Post an Internal Comment to a case and notify agents
+func executeUpdatePrivate(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	return p.addTicketComment(commandArgs, "update private", false, args)
+}
+
+// executeUpdatePublic - Post a Public Comment to a case and update all associated customer contacts and agents
+func executeUpdatePublic(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	return p.addTicketComment(commandArgs, "update public", true, args)
+}
+
+// executeUpdate - Post a comment to a case with the default visibility set in the plugin settings
+func executeUpdate(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	return p.addTicketComment(commandArgs, "update", p.getConfiguration().getDefaultCommentVisibility() == commentVisibilityPublic, args)
+}
+
+// addTicketComment posts the comment of an update command to a case, along with the field changes
+// and files given as flags. trigger is the command the comment follows, e.g. `update private`.
+// With a leading --preview the comment is only shown to the user, and posted once they confirm it,
+// see sendCommentPreview.
+func (p *Plugin) addTicketComment(commandArgs *model.CommandArgs, trigger string, isPublic bool, args []string) *model.CommandResponse {
+	preview := len(args) > 0 && args[0] == previewFlag
+	if preview {
+		args = args[1:]
+	}
+	if len(args) < 1 {
+		return p.respondUsage(commandArgs, trigger, "a case number and a comment")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+
+	}
+
+	commentLine := parseCommentLine("(\\/zendesk\\s*"+strings.Join(strings.Fields(trigger), "\\s*")+"\\s*(?:"+previewFlag+"\\s*)?\\d*)(.*)", commandArgs.Command)
+
+	in := zendesk.Ticket{}
+	T := p.T(commandArgs.UserId)
+	commentLine, fileIDs, err := parseTicketUpdateFlags(T, commentLine, &in)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	if commentLine == "" {
+		return p.respondUsage(commandArgs, trigger, "a comment")
+	}
+	if err := checkCommentLength(commentLine); err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if isPublic && !p.canPostPublicComments(commandArgs.UserId) {
+		return p.respondT(commandArgs, "zendesk.comment.public_forbidden")
+	}
+
+	in.Comment = &zendesk.TicketComment{
+		Public: &isPublic,
+		Body:   &commentLine,
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	if preview {
+		return p.sendCommentPreview(commandArgs, trigger, isPublic, args, ticketNumber, commentLine, &in)
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	// Files that can't be attached are reported, but don't prevent the comment from being added.
+	var uploadFailures []string
+	in.Comment.Uploads, uploadFailures = p.uploadFiles(commandArgs.UserId, client, fileIDs)
+
+	// Agents mentioned in a private comment follow the ticket, so Zendesk notifies them. Mentions
+	// that can't be resolved are reported the same way as files.
+	var mentioned, mentionFailures []string
+	if !isPublic {
+		in.AdditionalCollaborators, mentioned, mentionFailures = resolveMentionedAgents(T, client, commentLine)
+	}
+
+	// Comments are appended, but field changes could overwrite a concurrent update.
+	var updatedTicket *zendesk.Ticket
+	if in.Status != nil || in.Priority != nil {
+		updatedTicket, err = p.updateTicketSafely(commandArgs, client, ticketNumber, &in)
+	} else {
+		updatedTicket, err = client.UpdateTicket(ticketNumber, &in)
+	}
+	if isAPIError(err, http.StatusConflict) {
+		return p.respondTicketConflict(commandArgs, client, ticketNumber)
+	}
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	translationID := "zendesk.comment.private_added"
+	if isPublic {
+		translationID = "zendesk.comment.public_added"
+	}
+	p.postCommandResponse(commandArgs, T(translationID, map[string]interface{}{"Comment": commentLine, "TicketID": *updatedTicket.ID})+
+		describeTicketUpdate(T, &in)+describeMentions(T, mentioned, mentionFailures)+describeUploadFailures(T, uploadFailures))
+
+	return &model.CommandResponse{}
+}
+
+// canPostPublicComments reports whether a user may post public comments, which Zendesk sends to
+// the customer, see PublicCommentUsers and PublicCommentRoles. The user is only loaded when their
+// ID isn't listed, to match their username and system roles.
+func (p *Plugin) canPostPublicComments(userID string) bool {
+	config := p.getConfiguration()
+	users, roles := config.getPublicCommentUsers(), config.getPublicCommentRoles()
+	if len(users) == 0 && len(roles) == 0 {
+		return true
+	}
+	if containsString(users, userID) {
+		return true
+	}
+
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		p.API.LogWarn("failed to load the user posting a public comment", "user_id", userID, "error", appErr.Error())
+		return false
+	}
+	if containsFold(users, user.Username) {
+		return true
+	}
+	for _, role := range user.GetRoles() {
+		if containsString(roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// executeLink - Post a minimal card linking to a case to the channel
+func executeLink(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 1 {
+		return p.respondUsage(commandArgs, "link", "a case number")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	ticket, err := client.ShowTicket(ticketNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	// Unlike the details card, only what is needed to recognize and open the ticket is shared.
+	title := "#" + formatID(ticketNumber)
+	if ticket.Subject != nil {
+		title += " " + *ticket.Subject
+	}
+	attachment := &model.SlackAttachment{
+		Color:     attachmentColor(ticket, p.getConfiguration().getTicketColors()),
+		Title:     title,
+		TitleLink: client.ticketURL(ticketNumber),
+	}
+	if ticket.Status != nil {
+		attachment.Fields = []*model.SlackAttachmentField{{Title: p.T(commandArgs.UserId)("zendesk.field.status"), Value: *ticket.Status, Short: true}}
+	}
+
+	post := p.commandResponsePost(commandArgs, "")
+	post.AddProp("attachments", []*model.SlackAttachment{attachment})
+	posted, appErr := p.createChannelPost(post)
+	if appErr != nil {
+		return p.respondT(commandArgs, "zendesk.link.post_failed", map[string]interface{}{"Error": appErr.Error()})
+	}
+	if !posted {
+		return p.respondT(commandArgs, "zendesk.channel_post.coalesced")
+	}
+	return &model.CommandResponse{}
+}
+
+// executeRequester - Show the contact details of the requester of a case
+func executeRequester(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 1 {
+		return p.respondUsage(commandArgs, "requester", "a case number")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	ticket, err := client.ShowTicket(ticketNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if ticket.RequesterID == nil {
+		return p.respondT(commandArgs, "zendesk.requester.none", map[string]interface{}{"Ticket": client.ticketLink(ticket)})
+	}
+
+	requester, err := client.ShowUser(*ticket.RequesterID)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	// The organization is only informational, so don't fail the whole card if it can't be resolved.
+	var organization *zendesk.Organization
+	if requester.OrganizationID != nil {
+		organization, err = client.ShowOrganization(*requester.OrganizationID)
+		if err != nil {
+			p.API.LogWarn("failed to fetch organization", "organization_id", *requester.OrganizationID, "error", err.Error())
+		}
+	}
+
+	T := p.T(commandArgs.UserId)
+	var fields []*model.SlackAttachmentField
+	for _, field := range []struct {
+		titleID string
+		value   *string
+	}{
+		{"zendesk.field.email", requester.Email},
+		{"zendesk.field.phone", requester.Phone},
+		{"zendesk.field.time_zone", requester.TimeZone},
+	} {
+		if stringValue(field.value) != "" {
+			fields = append(fields, &model.SlackAttachmentField{Title: T(field.titleID), Value: *field.value, Short: true})
+		}
+	}
+	if organization != nil && organization.Name != nil {
+		fields = append(fields, &model.SlackAttachmentField{Title: T("zendesk.field.organization"), Value: *organization.Name, Short: true})
+	}
+
+	post := p.commandResponsePost(commandArgs, "")
+	post.AddProp("attachments", []*model.SlackAttachment{{
+		Color:  defaultTicketColor,
+		Title:  stringValue(requester.Name),
+		Text:   T("zendesk.requester.title", map[string]interface{}{"Ticket": client.ticketLink(ticket)}),
+		Fields: fields,
+	}})
+	_ = p.API.SendEphemeralPost(commandArgs.UserId, post)
+	return &model.CommandResponse{}
+}
+
+// executeSLA - Show the SLA targets of a case and when they are breached
+func executeSLA(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 1 {
+		return p.respondUsage(commandArgs, "sla", "a case number")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	ticket, metrics, err := client.ShowTicketMetrics(ticketNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if len(metrics) == 0 {
+		return p.respondT(commandArgs, "zendesk.sla.none", map[string]interface{}{"Ticket": client.ticketLink(ticket)})
+	}
+
+	post := p.commandResponsePost(commandArgs, "")
+	post.AddProp("attachments", []*model.SlackAttachment{
+		slaAttachment(p.T(commandArgs.UserId), client, ticket, metrics, time.Now(), p.userLocation(commandArgs.UserId)),
+	})
+	_ = p.API.SendEphemeralPost(commandArgs.UserId, post)
+	return &model.CommandResponse{}
+}
+
+// Colors of the SLA card: red once a target is breached, orange when the next one is due within
+// slaWarningPeriod, green otherwise.
+const (
+	slaBreachedColor = "#d24b4e"
+	slaWarningColor  = "#f5a623"
+	slaOKColor       = "#3db887"
+)
+
+// slaWarningPeriod is how long before its breach an SLA target is shown as at risk.
+const slaWarningPeriod = time.Hour
+
+// slaAttachment renders the SLA targets of a ticket, one field per target, with the next breach
+// of the running targets in the text.
+func slaAttachment(T bundle.TranslateFunc, client *Client, ticket *zendesk.Ticket, metrics []SLAPolicyMetric, now time.Time, loc *time.Location) *model.SlackAttachment {
+	attachment := &model.SlackAttachment{
+		Color: slaOKColor,
+		Title: T("zendesk.field.sla"),
+		Text:  T("zendesk.sla.ticket", map[string]interface{}{"Ticket": client.ticketLink(ticket)}),
+	}
+
+	var breached []string
+	var nextBreach *time.Time
+	for _, metric := range metrics {
+		name := strings.Title(strings.Replace(stringValue(metric.Metric), "_", " ", -1))
+		stage := stringValue(metric.Stage)
+		value := stage
+		if stage == "active" && metric.BreachAt != nil {
+			if metric.BreachAt.After(now) {
+				value = T("zendesk.sla.due", map[string]interface{}{"Time": formatTimestamp(*metric.BreachAt, loc)})
+				if nextBreach == nil || metric.BreachAt.Before(*nextBreach) {
+					nextBreach = metric.BreachAt
+				}
+			} else {
+				value = T("zendesk.sla.breached_at", map[string]interface{}{"Time": formatTimestamp(*metric.BreachAt, loc)})
+				breached = append(breached, name)
+			}
+		}
+		attachment.Fields = append(attachment.Fields, &model.SlackAttachmentField{Title: name, Value: value, Short: true})
+	}
+
+	switch {
+	case len(breached) > 0:
+		attachment.Color = slaBreachedColor
+		attachment.Text += "\n" + T("zendesk.sla.breached", map[string]interface{}{"Targets": strings.Join(breached, ", ")})
+	case nextBreach != nil && nextBreach.Sub(now) <= slaWarningPeriod:
+		attachment.Color = slaWarningColor
+	}
+	if nextBreach != nil {
+		attachment.Text += "\n" + T("zendesk.sla.next_breach", map[string]interface{}{"Time": formatTimestamp(*nextBreach, loc)})
+	} else if len(breached) == 0 {
+		attachment.Text += "\n" + T("zendesk.sla.none_running")
+	}
+	return attachment
+}
+
+// sideCommentRecipientRegexp matches the --to flag of `/zendesk sidecomment` starting a new side
+// conversation.
+var sideCommentRecipientRegexp = regexp.MustCompile(`^--to=(\S+@\S+)\s*`)
+
+// executeSideComment - Post to a side conversation of a case rather than its comment thread
+func executeSideComment(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) < 2 {
+		return p.respondUsage(commandArgs, "sidecomment", "a case number and a text")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	text := parseCommentLine("(\\/zendesk\\s*sidecomment\\s*\\d*)(.*)", commandArgs.Command)
+	to := ""
+	if match := sideCommentRecipientRegexp.FindStringSubmatch(text); match != nil {
+		to, text = match[1], strings.TrimSpace(text[len(match[0]):])
+	}
+	if text == "" {
+		return p.respondUsage(commandArgs, "sidecomment", "a text")
+	}
+	if err := checkCommentLength(text); err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	ticket, err := client.ShowTicket(ticketNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	if to != "" {
+		if _, err = client.CreateSideConversation(ticketNumber, to, stringValue(ticket.Subject), text); err != nil {
+			return p.respondError(commandArgs, err)
+		}
+		return p.respondT(commandArgs, "zendesk.sidecomment.started", map[string]interface{}{"Ticket": client.ticketLink(ticket), "To": to})
+	}
+
+	conversations, err := client.ListSideConversations(ticketNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	conversation := latestOpenSideConversation(conversations)
+	if conversation == nil {
+		return p.respondT(commandArgs, "zendesk.sidecomment.none_open", map[string]interface{}{"Ticket": client.ticketLink(ticket), "TicketID": ticketNumber, "Text": text})
+	}
+
+	if _, err = client.ReplyToSideConversation(ticketNumber, *conversation.ID, text); err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	return p.respondT(commandArgs, "zendesk.sidecomment.posted", map[string]interface{}{"Subject": stringValue(conversation.Subject), "Ticket": client.ticketLink(ticket)})
+}
+
+// executeLatestPrivate - Return the last internal comment posted to a case
+func executeLatestPrivate(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 1 {
+		return p.respondUsage(commandArgs, "latest private", "a case number")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	lastPrivateComment, err := client.FindLatestComment(ticketNumber, false, p.getConfiguration().getCommentPagesLimit())
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if lastPrivateComment == nil || (lastPrivateComment.Body == nil && lastPrivateComment.HTMLBody == nil) {
+		return p.respondT(commandArgs, "zendesk.latest.no_private_comment", map[string]interface{}{"TicketID": ticketNumber})
+	}
+
+	p.postCommandResponse(commandArgs, commentText(lastPrivateComment))
+
+	return &model.CommandResponse{}
+}
+
+// executeLatestPublic -  Return the last Public Comment posted to a case
+func executeLatestPublic(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 1 {
+		return p.respondUsage(commandArgs, "latest public", "a case number")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	lastPublicComment, err := client.FindLatestComment(ticketNumber, true, p.getConfiguration().getCommentPagesLimit())
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if lastPublicComment == nil || (lastPublicComment.Body == nil && lastPublicComment.HTMLBody == nil) {
+		return p.respondT(commandArgs, "zendesk.latest.no_public_comment", map[string]interface{}{"TicketID": ticketNumber})
+	}
+
+	p.postCommandResponse(commandArgs, commentText(lastPublicComment))
+
+	return &model.CommandResponse{}
+}
+
+// executeCreate - Open a new ticket with a subject and a description
+func executeCreate(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) == 0 {
+		return p.openCreateDialog(commandArgs)
+	}
+
+	cmd, ok := parseCreateCommand(commandArgs.Command)
+	if !ok {
+		return p.help(commandArgs)
+	}
+	if cmd.requesterName != "" && cmd.requesterEmail == "" {
+		return p.respondT(commandArgs, "zendesk.create.requester_email_missing")
+	}
+	if cmd.ticketType != "" && !containsString(ticketTypes, cmd.ticketType) {
+		return p.respondT(commandArgs, "zendesk.create.unknown_type", map[string]interface{}{"Type": cmd.ticketType, "Types": strings.Join(ticketTypes, ", ")})
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	in := &zendesk.Ticket{
+		Subject: &cmd.subject,
+		Comment: &zendesk.TicketComment{
+			Body: &cmd.description,
+		},
+	}
+	if cmd.ticketType != "" {
+		in.Type = &cmd.ticketType
+	}
+
+	// Without a requester Zendesk makes the agent the requester of the ticket.
+	var requester *zendesk.User
+	if cmd.requesterEmail != "" {
+		requester, err = client.SearchUserByEmail(cmd.requesterEmail)
+		if err != nil {
+			return p.respondError(commandArgs, err)
+		}
+		if requester == nil {
+			if cmd.requesterName == "" {
+				return p.respondT(commandArgs, "zendesk.create.requester_unknown", map[string]interface{}{"Email": cmd.requesterEmail})
+			}
+			requester, err = client.CreateUser(&zendesk.User{Name: &cmd.requesterName, Email: &cmd.requesterEmail})
+			if err != nil {
+				return p.respondError(commandArgs, err)
+			}
+		}
+		in.RequesterID = requester.ID
+	}
+
+	ticket, err := client.CreateTicket(in)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	if requester == nil {
+		return p.respondT(commandArgs, "zendesk.create.created", map[string]interface{}{"Ticket": client.ticketLink(ticket)})
+	}
+	return p.respondT(commandArgs, "zendesk.create.created_for", map[string]interface{}{
+		"Ticket": client.ticketLink(ticket), "Name": stringValue(requester.Name), "Email": cmd.requesterEmail,
+	})
+}
+
+// openCreateDialog opens the dialog creating a ticket, for `/zendesk create` without arguments.
+// The connection is checked upfront, so users don't fill in a ticket they can't submit.
+func (p *Plugin) openCreateDialog(commandArgs *model.CommandArgs) *model.CommandResponse {
+	if _, ok := p.requireConnected(commandArgs); !ok {
+		return &model.CommandResponse{}
+	}
+	instance, err := p.resolveInstance(commandArgs)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	if err := p.openCreateTicketDialog(commandArgs.UserId, commandArgs.TriggerId, instance.Name, "", ""); err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	return &model.CommandResponse{}
+}
+
+// executeOrgCount - Return the number of open tickets of an organization
+func executeOrgCount(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) == 0 {
+		return p.respondUsage(commandArgs, "org count", "an organization")
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	organization, ok := p.resolveOrganization(commandArgs, client, strings.Join(args, " "))
+	if !ok {
+		return &model.CommandResponse{}
+	}
+
+	count, err := countOpenTickets(client, *organization.ID)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	return p.respondT(commandArgs, "zendesk.org.open_tickets", map[string]interface{}{
+		"Name": *organization.Name, "Open": count, "URL": openTicketsURL(client, *organization.ID),
+	})
+}
+
+// executeOrg - Summarize an organization: its domains, tier and open tickets
+func executeOrg(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) == 0 {
+		return p.respondUsage(commandArgs, "org", "an organization")
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	organization, ok := p.resolveOrganization(commandArgs, client, strings.Join(args, " "))
+	if !ok {
+		return &model.CommandResponse{}
+	}
+
+	count, err := countOpenTickets(client, *organization.ID)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	T := p.T(commandArgs.UserId)
+	fields := organizationFields(T, organization)
+	fields = append(fields, &model.SlackAttachmentField{
+		Title: T("zendesk.field.open_tickets"),
+		Value: fmt.Sprintf("[%d](%s)", count, openTicketsURL(client, *organization.ID)),
+		Short: true,
+	})
+
+	post := p.commandResponsePost(commandArgs, "")
+	post.AddProp("attachments", []*model.SlackAttachment{{
+		Color:     defaultTicketColor,
+		Title:     *organization.Name,
+		TitleLink: fmt.Sprintf("%s/agent/organizations/%d", client.baseURL, *organization.ID),
+		Fields:    fields,
+	}})
+	_ = p.API.SendEphemeralPost(commandArgs.UserId, post)
+	return &model.CommandResponse{}
+}
+
+// resolveOrganization finds the organization of a command by its ID or name. When none or several
+// organizations match, the user is told so, with the IDs of the candidates, and false is returned.
+func (p *Plugin) resolveOrganization(commandArgs *model.CommandArgs, client *Client, nameOrID string) (*zendesk.Organization, bool) {
+	organizations, err := findOrganizations(client, nameOrID)
+	if err != nil {
+		p.respondError(commandArgs, err)
+		return nil, false
+	}
+
+	if len(organizations) == 0 {
+		p.respondT(commandArgs, "zendesk.org.not_found", map[string]interface{}{"Query": nameOrID})
+		return nil, false
+	}
+	if len(organizations) > 1 {
+		text := p.T(commandArgs.UserId)("zendesk.org.ambiguous", map[string]interface{}{"Query": nameOrID}) + "\n"
+		for _, organization := range organizations {
+			text += fmt.Sprintf("* %d - %s\n", *organization.ID, *organization.Name)
+		}
+		p.postCommandResponse(commandArgs, text)
+		return nil, false
+	}
+	return &organizations[0], true
+}
+
+// countOpenTickets returns the number of unsolved tickets of an organization.
+func countOpenTickets(client *Client, organizationID int64) (int64, error) {
+	// Only the count is needed, so don't fetch more than a single ticket.
+	results, err := client.SearchTickets("", &zendesk.ListOptions{PerPage: 1},
+		zendesk.OrganizationFilter(int(organizationID)),
+		zendesk.StatusFilter(zendesk.StatusSolved, zendesk.LessThan))
+	if err != nil {
+		return 0, err
+	}
+
+	if results.Count == nil {
+		return 0, nil
+	}
+	return *results.Count, nil
+}
+
+// openTicketsURL returns the Zendesk search listing the unsolved tickets of an organization.
+func openTicketsURL(client *Client, organizationID int64) string {
+	query := fmt.Sprintf("type:ticket organization_id:%d status<solved", organizationID)
+	return client.baseURL + "/agent/search/1?q=" + url.QueryEscape(query)
+}
+
+func executeSearch(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	config := p.getConfiguration()
+	options, args, err := parseListFlags(p.T(commandArgs.UserId), args, config.getMaxListResults())
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if len(args) == 0 {
+		return p.respondUsage(commandArgs, "search", "what to search for")
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	limit := config.getSearchResultLimit()
+	if options.limit > 0 {
+		limit = options.limit
+	}
+	// Without a sort the best matches come first.
+	listing := newTicketListing(commandArgs, strings.Join(args, " "), options.sort, limit)
+	return p.showTicketPage(commandArgs, client, listing, "", 1, "")
+}
+
+func executeList(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	config := p.getConfiguration()
+	options, args, err := parseListFlags(p.T(commandArgs.UserId), args, config.getMaxListResults())
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if len(args) != 0 {
+		return p.respondUsage(commandArgs, "list", "only flags")
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	limit := config.getAssignedTicketsLimit()
+	if options.limit > 0 {
+		limit = options.limit
+	}
+	if options.sort == "" {
+		options.sort = "priority"
+	}
+	listing := newTicketListing(commandArgs, "", options.sort, limit)
+	return p.showTicketPage(commandArgs, client, listing, "", 1, "")
+}
+
+// executeQueue - Show the tickets assigned to the agent in sections by status
+func executeQueue(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 0 {
+		return p.respondUsage(commandArgs, "queue", "")
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	var statuses []string
+	for _, group := range queueGroups {
+		statuses = append(statuses, group.status)
+	}
+	config := p.getConfiguration()
+	tickets, total, err := client.ListAssignedTickets(statuses, 1, config.getMaxListResults(), "priority")
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if len(tickets) == 0 {
+		return p.respondT(commandArgs, "zendesk.queue.empty")
+	}
+
+	T := p.T(commandArgs.UserId)
+	message := T("zendesk.queue.title")
+	if total > len(tickets) {
+		message = T("zendesk.queue.most_urgent", map[string]interface{}{"Shown": len(tickets), "Total": total})
+	}
+
+	post := p.commandResponsePost(commandArgs, message)
+	post.AddProp("attachments", queueAttachments(T, client, sortTickets(tickets, "priority"), p.resolveOrganizationNames(client, tickets), config.getTicketColors()))
+	_ = p.API.SendEphemeralPost(commandArgs.UserId, post)
+	return &model.CommandResponse{}
+}
+
+// resolveOrganizationNames returns the names of the organizations of listed tickets by ID. The
+// organizations are only informational, so tickets are listed without them if they can't be
+// resolved.
+func (p *Plugin) resolveOrganizationNames(client *Client, tickets []zendesk.Ticket) map[int64]string {
+	names, err := client.organizationNames(tickets)
+	if err != nil {
+		p.API.LogWarn("failed to fetch the organizations of the listed tickets", "error", err.Error())
+	}
+	return names
+}
+
+func filterTicketsByStatus(tickets []zendesk.Ticket, statuses ...string) []zendesk.Ticket {
+	var filtered []zendesk.Ticket
+	for _, ticket := range tickets {
+		if ticket.Status != nil && containsString(statuses, *ticket.Status) {
+			filtered = append(filtered, ticket)
+		}
+	}
+	return filtered
+}
+
+// postTicketList sends an ephemeral post listing tickets with their status, priority and
+// organization.
+func (p *Plugin) postTicketList(commandArgs *model.CommandArgs, client *Client, message string, tickets []zendesk.Ticket) {
+	_ = p.API.SendEphemeralPost(commandArgs.UserId, p.ticketListPost(commandArgs, client, message, tickets))
+}
+
+// ticketListPost returns the post of postTicketList.
+func (p *Plugin) ticketListPost(commandArgs *model.CommandArgs, client *Client, message string, tickets []zendesk.Ticket) *model.Post {
+	organizationNames := p.resolveOrganizationNames(client, tickets)
+	colors := p.getConfiguration().getTicketColors()
+	T := p.T(commandArgs.UserId)
+
+	var attachments []*model.SlackAttachment
+	for i := range tickets {
+		attachment := &model.SlackAttachment{
+			Color: attachmentColor(&tickets[i], colors),
+			Text:  client.ticketLink(&tickets[i]),
+		}
+		if tickets[i].Status != nil {
+			attachment.Fields = append(attachment.Fields, &model.SlackAttachmentField{
+				Title: T("zendesk.field.status"),
+				Value: *tickets[i].Status,
+				Short: true,
+			})
+		}
+		if tickets[i].Priority != nil {
+			attachment.Fields = append(attachment.Fields, &model.SlackAttachmentField{
+				Title: T("zendesk.field.priority"),
+				Value: *tickets[i].Priority,
+				Short: true,
+			})
+		}
+		if tickets[i].OrganizationID != nil && organizationNames[*tickets[i].OrganizationID] != "" {
+			attachment.Fields = append(attachment.Fields, &model.SlackAttachmentField{
+				Title: T("zendesk.field.organization"),
+				Value: organizationNames[*tickets[i].OrganizationID],
+				Short: true,
+			})
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	post := p.commandResponsePost(commandArgs, message)
+	post.AddProp("attachments", attachments)
+	return post
+}
+
+// executeProblem - Link an incident to a problem ticket
+func executeProblem(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 2 {
+		return p.respondUsage(commandArgs, "problem", "the case numbers")
+	}
+
+	incidentNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	problemNumber, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if incidentNumber == problemNumber {
+		return p.respondT(commandArgs, "zendesk.problem.same_ticket")
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	problem, err := client.ShowTicket(problemNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if problem.Type == nil || *problem.Type != "problem" {
+		return p.respondT(commandArgs, "zendesk.problem.not_a_problem_link", map[string]interface{}{"TicketID": problemNumber})
+	}
+
+	incidentType := "incident"
+	incident, err := p.updateTicketSafely(commandArgs, client, incidentNumber, &zendesk.Ticket{
+		Type:      &incidentType,
+		ProblemID: &problemNumber,
+	})
+	if isAPIError(err, http.StatusConflict) {
+		return p.respondTicketConflict(commandArgs, client, incidentNumber)
+	}
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	return p.respondT(commandArgs, "zendesk.problem.linked", map[string]interface{}{"Incident": client.ticketLink(incident), "Problem": client.ticketLink(problem)})
+}
+
+// executeProblemIncidents - List the incidents linked to a problem ticket
+func executeProblemIncidents(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 1 {
+		return p.respondUsage(commandArgs, "problem incidents", "a case number")
+	}
+
+	problemNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	problem, err := client.ShowTicket(problemNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if problem.Type == nil || *problem.Type != "problem" {
+		return p.respondT(commandArgs, "zendesk.incidents.not_a_problem", map[string]interface{}{"TicketID": problemNumber})
+	}
+
+	incidents, err := client.ListTicketIncidents(problemNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if len(incidents) == 0 {
+		return p.respondT(commandArgs, "zendesk.incidents.none", map[string]interface{}{"Problem": client.ticketLink(problem)})
+	}
+
+	text := p.T(commandArgs.UserId)("zendesk.incidents.list", map[string]interface{}{"Problem": client.ticketLink(problem)}) + "\n"
+	for i := range incidents {
+		text += "* " + client.ticketLink(&incidents[i])
+		if incidents[i].Status != nil {
+			text += " - " + *incidents[i].Status
+		}
+		text += "\n"
+	}
+	p.postCommandResponse(commandArgs, text)
+	return &model.CommandResponse{}
+}
+
+// executeForm - Switch a ticket to another ticket form
+func executeForm(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) < 2 {
+		return p.respondUsage(commandArgs, "form", "a case number and a form")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	forms, err := client.ListTicketForms()
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if len(forms) <= 1 {
+		return p.respondT(commandArgs, "zendesk.form.single")
+	}
+
+	nameOrID := strings.Join(args[1:], " ")
+	var form *TicketForm
+	var names []string
+	for i := range forms {
+		if forms[i].Active != nil && !*forms[i].Active {
+			continue
+		}
+		names = append(names, "`"+*forms[i].Name+"`")
+		if strings.EqualFold(*forms[i].Name, nameOrID) || formatID(*forms[i].ID) == nameOrID {
+			form = &forms[i]
+		}
+	}
+	if form == nil {
+		return p.respondT(commandArgs, "zendesk.form.not_found", map[string]interface{}{"Form": nameOrID, "Forms": strings.Join(names, ", ")})
+	}
+
+	ticket, err := p.updateTicketSafely(commandArgs, client, ticketNumber, &zendesk.Ticket{TicketFormID: form.ID})
+	if isAPIError(err, http.StatusConflict) {
+		return p.respondTicketConflict(commandArgs, client, ticketNumber)
+	}
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	return p.respondT(commandArgs, "zendesk.form.changed", map[string]interface{}{"Ticket": client.ticketLink(ticket), "Form": *form.Name})
+}
+
+func executeAssign(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 2 {
+		return p.respondUsage(commandArgs, "assign", "a case number and an agent")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	email := args[1]
+	agent, err := client.SearchUserByEmail(email)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if agent == nil {
+		return p.respondT(commandArgs, "zendesk.assign.unknown_user", map[string]interface{}{"Email": email})
+	}
+	// Zendesk rejects end-users as assignees with an opaque error, so check the role upfront.
+	if !isAgent(agent) {
+		return p.respondT(commandArgs, "zendesk.assign.not_an_agent", map[string]interface{}{"Email": email})
+	}
+
+	ticket, err := p.updateTicketSafely(commandArgs, client, ticketNumber, &zendesk.Ticket{AssigneeID: agent.ID})
+	if isAPIError(err, http.StatusConflict) {
+		return p.respondTicketConflict(commandArgs, client, ticketNumber)
+	}
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	return p.respondT(commandArgs, "zendesk.assign.assigned", map[string]interface{}{"Ticket": client.ticketLink(ticket), "Name": stringValue(agent.Name), "Email": email})
+}
+
+// executePriority - Change the priority of a case
+func executePriority(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 2 {
+		return p.respondUsage(commandArgs, "priority", "a case number and a priority")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	priority := strings.ToLower(args[1])
+	if !containsString(ticketPriorities, priority) {
+		return p.respondT(commandArgs, "zendesk.priority.invalid", map[string]interface{}{"Priority": args[1], "Priorities": strings.Join(ticketPriorities, ", ")})
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	ticket, err := p.updateTicketSafely(commandArgs, client, ticketNumber, &zendesk.Ticket{Priority: &priority})
+	if isAPIError(err, http.StatusConflict) {
+		return p.respondTicketConflict(commandArgs, client, ticketNumber)
+	}
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	message := p.T(commandArgs.UserId)("zendesk.priority.changed", map[string]interface{}{"TicketID": ticketNumber})
+	p.postTicketList(commandArgs, client, message, []zendesk.Ticket{*ticket})
+	return &model.CommandResponse{}
+}
+
+// executeSolve - Solve a case, optionally posting a closing public comment in the same update
+func executeSolve(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) < 1 {
+		return p.respondUsage(commandArgs, "solve", "a case number")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	in := &zendesk.Ticket{Status: zendesk.String("solved")}
+	if comment := parseCommentLine("(\\/zendesk\\s*solve\\s*\\d*)(.*)", commandArgs.Command); comment != "" {
+		if err := checkCommentLength(comment); err != nil {
+			return p.respondError(commandArgs, err)
+		}
+		if !p.canPostPublicComments(commandArgs.UserId) {
+			return p.respondT(commandArgs, "zendesk.comment.public_forbidden")
+		}
+		in.Comment = &zendesk.TicketComment{
+			Public: zendesk.Bool(true),
+			Body:   &comment,
+		}
+	}
+
+	return p.changeTicketStatus(commandArgs, ticketNumber, in)
+}
+
+// executeReopen - Reopen a solved case
+func executeReopen(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 1 {
+		return p.respondUsage(commandArgs, "reopen", "a case number")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	return p.changeTicketStatus(commandArgs, ticketNumber, &zendesk.Ticket{Status: zendesk.String("open")})
+}
+
+// changeTicketStatus updates the status of a ticket for solve and reopen. Closed tickets can't
+// be updated at all in Zendesk, so they are refused upfront with an explanation.
+func (p *Plugin) changeTicketStatus(commandArgs *model.CommandArgs, ticketNumber int64, in *zendesk.Ticket) *model.CommandResponse {
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	ticket, err := client.ShowTicket(ticketNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	current := stringValue(ticket.Status)
+	if current == "closed" {
+		return p.respondT(commandArgs, "zendesk.status.closed", map[string]interface{}{"Ticket": client.ticketLink(ticket)})
+	}
+	if current == *in.Status && in.Comment == nil {
+		return p.respondT(commandArgs, "zendesk.status.unchanged", map[string]interface{}{"Ticket": client.ticketLink(ticket), "Status": current})
+	}
+
+	updated, err := p.updateTicketSafely(commandArgs, client, ticketNumber, in)
+	if isAPIError(err, http.StatusConflict) {
+		return p.respondTicketConflict(commandArgs, client, ticketNumber)
+	}
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	translationID := "zendesk.status.changed"
+	if in.Comment != nil {
+		translationID = "zendesk.status.changed_with_comment"
+	}
+	return p.respondT(commandArgs, translationID, map[string]interface{}{
+		"Ticket": client.ticketLink(updated), "From": current, "To": stringValue(updated.Status),
+	})
+}
+
+// executeWatch - Subscribe the channel to the updates of a case
+func executeWatch(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 1 {
+		return p.respondUsage(commandArgs, "watch", "a case number")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	instance, err := p.resolveInstance(commandArgs)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	client, err := p.getTokenClient(commandArgs.UserId, instance, token, p.requestIDOf(commandArgs))
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	// Only tickets the agent can see may be watched, the updates are posted for everyone in the channel.
+	ticket, err := client.ShowTicket(ticketNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	added, err := p.setTicketWatcher(instance.Name, ticketNumber, commandArgs.ChannelId, true)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if !added {
+		return p.respondT(commandArgs, "zendesk.watch.already", map[string]interface{}{"Ticket": client.ticketLink(ticket)})
+	}
+	return p.respondT(commandArgs, "zendesk.watch.started", map[string]interface{}{"Ticket": client.ticketLink(ticket)})
+}
+
+// executeUnwatch - Unsubscribe the channel from the updates of a case
+func executeUnwatch(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 1 {
+		return p.respondUsage(commandArgs, "unwatch", "a case number")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	instance, err := p.resolveInstance(commandArgs)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	removed, err := p.setTicketWatcher(instance.Name, ticketNumber, commandArgs.ChannelId, false)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if !removed {
+		return p.respondT(commandArgs, "zendesk.unwatch.not_watching", map[string]interface{}{"TicketID": ticketNumber})
+	}
+	// Updates already held back are dropped when they are flushed, see flushWatchDigest.
+	sub := watchSubscription{Instance: instance.Name, TicketID: ticketNumber, ChannelID: commandArgs.ChannelId}
+	if err := p.setWatchSettings(sub, &watchSettings{}); err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	return p.respondT(commandArgs, "zendesk.unwatch.stopped", map[string]interface{}{"TicketID": ticketNumber})
+}
+
+// executeWatchQuiet - Set or remove the quiet hours of the channel watching a case
+func executeWatchQuiet(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	digest := false
+	var values []string
+	for _, arg := range args {
+		if arg == "--digest" {
+			digest = true
+		} else {
+			values = append(values, arg)
+		}
+	}
+	if len(values) != 2 {
+		return p.respondUsage(commandArgs, "watch quiet", "a case number and the quiet hours")
+	}
+
+	ticketNumber, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	sub, settings, ok := p.loadWatchedSubscription(commandArgs, ticketNumber)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+
+	data := map[string]interface{}{"TicketID": ticketNumber}
+	translationID := "zendesk.watch.quiet_removed"
+	if strings.EqualFold(values[1], "off") {
+		settings.QuietHours = nil
+	} else {
+		quiet, valid := parseQuietHours(values[1], p.userLocation(commandArgs.UserId).String(), digest)
+		if !valid {
+			return p.respondT(commandArgs, "zendesk.watch.quiet_invalid", map[string]interface{}{"Value": values[1]})
+		}
+		settings.QuietHours = quiet
+		data["Hours"], data["TimeZone"] = quiet.String(), quiet.TimeZone
+		translationID = "zendesk.watch.quiet_dropped"
+		if digest {
+			translationID = "zendesk.watch.quiet_digested"
+		}
+	}
+
+	if err := p.setWatchSettings(sub, settings); err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	return p.respondT(commandArgs, translationID, data)
+}
+
+// executeWatchDigest - Set or remove the digest interval of the channel watching a case
+func executeWatchDigest(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 2 {
+		return p.respondUsage(commandArgs, "watch digest", "a case number and the interval")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	sub, settings, ok := p.loadWatchedSubscription(commandArgs, ticketNumber)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+
+	data := map[string]interface{}{"TicketID": ticketNumber}
+	translationID := "zendesk.watch.digest_removed"
+	if strings.EqualFold(args[1], "off") {
+		settings.DigestInterval = 0
+	} else {
+		minutes, err := strconv.Atoi(args[1])
+		if err != nil || minutes <= 0 || minutes > maxWatchDigestInterval {
+			return p.respondT(commandArgs, "zendesk.watch.digest_invalid", map[string]interface{}{"Value": args[1], "Max": maxWatchDigestInterval})
+		}
+		settings.DigestInterval = minutes
+		data["Minutes"] = minutes
+		translationID = "zendesk.watch.digest_set"
+	}
+
+	// Updates already held back are still posted when their digest is due.
+	if err := p.setWatchSettings(sub, settings); err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	return p.respondT(commandArgs, translationID, data)
+}
+
+// loadWatchedSubscription returns the settings of the channel of a command watching a ticket. It
+// responds to the user and returns false if the channel isn't watching the ticket.
+func (p *Plugin) loadWatchedSubscription(commandArgs *model.CommandArgs, ticketNumber int64) (watchSubscription, *watchSettings, bool) {
+	instance, err := p.resolveInstance(commandArgs)
+	if err != nil {
+		p.respondError(commandArgs, err)
+		return watchSubscription{}, nil, false
+	}
+	sub := watchSubscription{Instance: instance.Name, TicketID: ticketNumber, ChannelID: commandArgs.ChannelId}
+
+	watchers, err := p.getTicketWatchers(sub.Instance, sub.TicketID)
+	if err != nil {
+		p.respondError(commandArgs, err)
+		return sub, nil, false
+	}
+	if !containsString(watchers, sub.ChannelID) {
+		p.respondT(commandArgs, "zendesk.unwatch.not_watching", map[string]interface{}{"TicketID": ticketNumber})
+		return sub, nil, false
+	}
+
+	settings, err := p.getWatchSettings(sub)
+	if err != nil {
+		p.respondError(commandArgs, err)
+		return sub, nil, false
+	}
+	return sub, settings, true
+}
+
+// executeTagAdd - Add tags to a case
+func executeTagAdd(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	return p.updateTicketTags(commandArgs, "add", args, func(tags []string, tag string) []string {
+		if containsString(tags, tag) {
+			return tags
+		}
+		return append(tags, tag)
+	})
+}
+
+// executeTagRemove - Remove tags from a case
+func executeTagRemove(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	return p.updateTicketTags(commandArgs, "remove", args, func(tags []string, tag string) []string {
+		var kept []string
+		for _, t := range tags {
+			if t != tag {
+				kept = append(kept, t)
+			}
+		}
+		return kept
+	})
+}
+
+// updateTicketTags applies apply for each tag given to the tag command to the current tags of
+// the ticket and writes the resulting set back.
+func (p *Plugin) updateTicketTags(commandArgs *model.CommandArgs, action string, args []string, apply func(tags []string, tag string) []string) *model.CommandResponse {
+	if len(args) < 2 {
+		return p.respondUsage(commandArgs, "tag "+action, "a case number and tags")
+	}
+
+	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	ticket, err := client.ShowTicket(ticketNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	// Zendesk stores tags in lower case.
+	tags := ticket.Tags
+	for _, tag := range args[1:] {
+		tags = apply(tags, strings.ToLower(tag))
+	}
+
+	if strings.Join(tags, " ") == strings.Join(ticket.Tags, " ") {
+		return p.respondTicketTags(commandArgs, client, ticket)
+	}
+
+	// The tags are sent with omitempty, so removing the last tags has to be explicit.
+	in := &zendesk.Ticket{Tags: tags}
+	if len(tags) == 0 {
+		in = &zendesk.Ticket{RemoveTags: ticket.Tags}
+	}
+
+	// The new tags are based on the ticket as just read, so reject the update if it changed since.
+	updated, err := client.UpdateTicketSafely(ticketNumber, in, ticket.UpdatedAt)
+	if isAPIError(err, http.StatusConflict) {
+		return p.respondTicketConflict(commandArgs, client, ticketNumber)
+	}
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	return p.respondTicketTags(commandArgs, client, updated)
+}
+
+func (p *Plugin) respondTicketTags(commandArgs *model.CommandArgs, client *Client, ticket *zendesk.Ticket) *model.CommandResponse {
+	if len(ticket.Tags) == 0 {
+		return p.respondT(commandArgs, "zendesk.tags.none", map[string]interface{}{"Ticket": client.ticketLink(ticket)})
+	}
+	return p.respondT(commandArgs, "zendesk.tags.list", map[string]interface{}{"Ticket": client.ticketLink(ticket), "Tags": strings.Join(ticket.Tags, "`, `")})
+}
+
+// cachedClient is a Zendesk client along with the token it authenticates with.
+type cachedClient struct {
+	token  string
+	client *Client
+}
+
+// userGroupsCacheTTL is how long group memberships are cached, they rarely change.
+const userGroupsCacheTTL = 5 * time.Minute
+
+type cachedGroups struct {
+	groups    []zendesk.Group
+	expiresAt time.Time
+}
+
+// executeMyGroups - List the Zendesk groups the connected agent belongs to
+func executeMyGroups(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 0 {
+		return p.respondUsage(commandArgs, "my groups", "")
+	}
+
+	if _, ok := p.requireConnected(commandArgs); !ok {
+		return &model.CommandResponse{}
+	}
+	groups, err := p.getUserGroups(commandArgs)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	if len(groups) == 0 {
+		return p.respondT(commandArgs, "zendesk.groups.none")
+	}
+
+	text := p.T(commandArgs.UserId)("zendesk.groups.list") + "\n"
+	for _, group := range groups {
+		if group.Deleted != nil && *group.Deleted {
+			continue
+		}
+		text += fmt.Sprintf("* %s (ID %d)\n", *group.Name, *group.ID)
+	}
+	p.postCommandResponse(commandArgs, text)
+	return &model.CommandResponse{}
+}
+
+// executeMacrosList - List the active macros available to the agent
+func executeMacrosList(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 0 {
+		return p.respondUsage(commandArgs, "macros list", "")
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	macros, total, err := client.ListMacros()
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if len(macros) == 0 {
+		return p.respondT(commandArgs, "zendesk.macros.none")
+	}
+
+	T := p.T(commandArgs.UserId)
+	text := T("zendesk.macros.list") + "\n"
+	if total > len(macros) {
+		text = T("zendesk.macros.list_first", map[string]interface{}{"Shown": len(macros), "Total": total}) + "\n"
+	}
+	for _, macro := range macros {
+		text += fmt.Sprintf("* `%d` %s\n", *macro.ID, stringValue(macro.Title))
+	}
+	p.postCommandResponse(commandArgs, text)
+	return &model.CommandResponse{}
+}
+
+// executeMacrosApply - Apply a macro to a case. Zendesk only computes the changes of the macro,
+// they are saved with a safe update so changes made meanwhile by others aren't overwritten.
+func executeMacrosApply(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 2 {
+		return p.respondUsage(commandArgs, "macros apply", "a macro ID and a case number")
+	}
+
+	macroID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	ticketNumber, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	// The ticket is loaded first, so a 404 of the macro can only mean the macro doesn't exist.
+	ticket, err := client.ShowTicket(ticketNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if stringValue(ticket.Status) == "closed" {
+		return p.respondT(commandArgs, "zendesk.macros.ticket_closed", map[string]interface{}{"Ticket": client.ticketLink(ticket)})
+	}
+
+	in, err := client.ApplyMacro(ticketNumber, macroID)
+	if isAPIError(err, http.StatusNotFound) {
+		return p.respondT(commandArgs, "zendesk.macros.not_found", map[string]interface{}{"MacroID": macroID})
+	}
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	updated, err := client.UpdateTicketSafely(ticketNumber, in, ticket.UpdatedAt)
+	if isAPIError(err, http.StatusConflict) {
+		return p.respondTicketConflict(commandArgs, client, ticketNumber)
+	}
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	p.markTicketSeen(commandArgs, updated)
+
+	message := p.T(commandArgs.UserId)("zendesk.macros.applied", map[string]interface{}{"MacroID": macroID, "TicketID": ticketNumber})
+	p.postTicketList(commandArgs, client, message, []zendesk.Ticket{*updated})
+	return &model.CommandResponse{}
+}
+
+// executeWhoami - Show the Zendesk account the user is connected as
+func executeWhoami(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 0 {
+		return p.respondUsage(commandArgs, "whoami", "")
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	user, err := client.ShowCurrentUser()
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if user == nil {
+		return p.respondT(commandArgs, "zendesk.whoami.no_user")
+	}
+
+	return p.respondT(commandArgs, "zendesk.whoami.connected", map[string]interface{}{
+		"URL": client.baseURL, "Name": stringValue(user.Name), "Email": stringValue(user.Email), "Role": stringValue(user.Role),
+	})
+}
+
+// getUserGroups returns the Zendesk groups of the connected agent, using the cached memberships
+// when fresh. The cache is cleared by deleteToken.
+func (p *Plugin) getUserGroups(commandArgs *model.CommandArgs) ([]zendesk.Group, error) {
+	instance, err := p.resolveInstance(commandArgs)
+	if err != nil {
+		return nil, err
+	}
+	key := tokenKey(commandArgs.UserId, instance.Name)
+
+	// Resolve the client first, so users who disconnected aren't served cached groups.
+	client, err := p.getInstanceClient(commandArgs.UserId, instance, p.requestIDOf(commandArgs))
+	if err != nil {
+		return nil, err
+	}
+
+	p.userGroupsLock.Lock()
+	cached, ok := p.userGroupsCache[key]
+	p.userGroupsLock.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.groups, nil
+	}
+
+	me, err := client.ShowCurrentUser()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := client.ListUserGroups(*me.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	p.userGroupsLock.Lock()
+	p.userGroupsCache[key] = cachedGroups{
+		groups:    groups,
+		expiresAt: time.Now().Add(userGroupsCacheTTL),
+	}
+	p.userGroupsLock.Unlock()
+
+	return groups, nil
+}
+
+// executeZendeskDefault is the default command if no other command fits. It defaults to help.
+func executeZendeskDefault(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	return p.help(header)
+}
+
+func (p *Plugin) postCommandResponse(args *model.CommandArgs, text string) {
+	_ = p.API.SendEphemeralPost(args.UserId, p.commandResponsePost(args, text))
+}
+
+// commandResponsePost returns a response of the bot to a command, sent as an ephemeral post or
+// posted to the channel. Commands run in a thread are answered in that thread.
+func (p *Plugin) commandResponsePost(args *model.CommandArgs, text string) *model.Post {
+	return &model.Post{
+		UserId:    p.botID,
+		ChannelId: args.ChannelId,
+		RootId:    args.RootId,
+		Message:   text,
+	}
+}
+
+// progressPost is an ephemeral message telling the user a slow command is waiting for Zendesk, e.g.
+// "Fetching ticket #1...". The command replaces it with its response using finish. Handlers defer
+// close, which deletes the message when they respond otherwise, e.g. with an error.
+type progressPost struct {
+	p      *Plugin
+	userID string
+	postID string
+}
+
+// showProgress posts a progress message for a command.
+func (p *Plugin) showProgress(commandArgs *model.CommandArgs, format string, args ...interface{}) *progressPost {
+	// The ID is assigned here rather than by the server, so the message can be updated later.
+	post := p.commandResponsePost(commandArgs, fmt.Sprintf(format, args...))
+	post.Id = model.NewId()
+	_ = p.API.SendEphemeralPost(commandArgs.UserId, post)
+	return &progressPost{p: p, userID: commandArgs.UserId, postID: post.Id}
+}
+
+// finish replaces the progress message with the response of the command.
+func (pp *progressPost) finish(post *model.Post) {
+	post.Id = pp.postID
+	_ = pp.p.API.UpdateEphemeralPost(pp.userID, post)
+	pp.postID = ""
+}
+
+// close deletes the progress message unless it was replaced by finish.
+func (pp *progressPost) close() {
+	if pp.postID != "" {
+		pp.p.API.DeleteEphemeralPost(pp.userID, pp.postID)
+		pp.postID = ""
+	}
+}
+
+func (p *Plugin) responsef(commandArgs *model.CommandArgs, format string, args ...interface{}) *model.CommandResponse {
+	p.postCommandResponse(commandArgs, fmt.Sprintf(format, args...))
+	return &model.CommandResponse{}
+}
+
+// commandUsages maps the triggers of zendeskCommands to their usage. The hints of the handlers
+// are looked up here, so they can't drift from the help.
+var commandUsages = func() map[string]string {
+	usages := make(map[string]string, len(zendeskCommands))
+	for _, ci := range zendeskCommands {
+		usages[ci.trigger] = ci.usage()
+	}
+	return usages
+}()
+
+// respondUsage tells the user how to run a command, e.g. "Please specify a case number in the form
+// `/zendesk status <case-number...>`." when what is "a case number". Without what the user is
+// only shown the form.
+func (p *Plugin) respondUsage(commandArgs *model.CommandArgs, trigger, what string) *model.CommandResponse {
+	if what == "" {
+		return p.respondT(commandArgs, "zendesk.command.usage", map[string]interface{}{"Usage": commandUsages[trigger]})
+	}
+	return p.respondT(commandArgs, "zendesk.command.usage_missing", map[string]interface{}{"What": what, "Usage": commandUsages[trigger]})
+}
+
+var instanceFlagRegexp = regexp.MustCompile(`^(/zendesk)\s+--instance=(\S*)`)
+
+// parseInstanceFlag returns the instance selected with `/zendesk --instance=<name> ...` and the
+// command without the flag.
+func parseInstanceFlag(command string) (instance, rest string) {
+	matches := instanceFlagRegexp.FindStringSubmatch(command)
+	if matches == nil {
+		return "", command
+	}
+	return strings.ToLower(matches[2]), matches[1] + command[len(matches[0]):]
+}
+
+var createCommandRegexp = regexp.MustCompile(`(?s)^/zendesk\s+create\s+((?:--(?:requester-email|requester-name|type)=(?:"[^"]*"|\S+)\s+)*)"([^"]*)"(.*)$`)
+
+var createFlagRegexp = regexp.MustCompile(`--(requester-email|requester-name|type)=(?:"([^"]*)"|(\S+))`)
+
+// createCommand is a parsed `/zendesk create` command.
+type createCommand struct {
+	subject        string
+	description    string
+	requesterEmail string
+	requesterName  string
+	// ticketType is one of ticketTypes when the command is valid, "" leaves the type unset.
+	ticketType string
+}
+
+// parseCreateCommand extracts the double quoted subject and the description following it from
+// a create command, along with the optional requester and type flags in front of the subject. The subject
+// doubles as the description when none is given, as Zendesk requires one.
+func parseCreateCommand(command string) (*createCommand, bool) {
+	_, command = parseInstanceFlag(command)
+
+	// Mobile keyboards tend to replace straight quotes with typographic ones.
+	command = strings.NewReplacer("\u201c", "\"", "\u201d", "\"").Replace(command)
+
+	matches := createCommandRegexp.FindStringSubmatch(command)
+	if matches == nil {
+		return nil, false
+	}
+
+	cmd := &createCommand{
+		subject:     strings.TrimSpace(matches[2]),
+		description: strings.TrimSpace(matches[3]),
+	}
+	if cmd.subject == "" {
+		return nil, false
+	}
+	if cmd.description == "" {
+		cmd.description = cmd.subject
+	}
+
+	for _, flag := range createFlagRegexp.FindAllStringSubmatch(matches[1], -1) {
+		value := strings.TrimSpace(flag[2] + flag[3])
+		switch flag[1] {
+		case "requester-email":
+			cmd.requesterEmail = value
+		case "requester-name":
+			cmd.requesterName = value
+		default:
+			cmd.ticketType = strings.ToLower(value)
+		}
+	}
+	return cmd, true
+}
+
+// normalizeCommand trims trailing whitespace from every line and collapses the runs of spaces and
+// tabs of the command prefix, up to and including the case number, into a single space. Mobile
+// clients inject stray whitespace there. The text after the case number is a comment body and
+// only loses its trailing whitespace, so indented code, aligned text and nested lists survive;
+// so do the newlines of the command. Commands without a case number are collapsed on their
+// whole first line.
+func normalizeCommand(command string) string {
+	lines := strings.Split(strings.TrimSpace(command), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	lines[0] = normalizeCommandPrefix(lines[0])
+	return strings.Join(lines, "\n")
+}
+
+// normalizeCommandPrefix collapses the whitespace of a command line up to its first number, see
+// normalizeCommand.
+func normalizeCommandPrefix(line string) string {
+	var words []string
+	rest := line
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			break
+		}
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		word := rest[:end]
+		words = append(words, word)
+		rest = rest[end:]
+		if _, err := strconv.ParseInt(word, 10, 64); err == nil {
+			break
+		}
+	}
+
+	prefix := strings.Join(words, " ")
+	if body := strings.TrimLeft(rest, " \t"); body != "" {
+		return prefix + " " + body
+	}
+	return prefix
+}
+
+// updateTicketSafely updates a ticket with safe_update set to the updated_at the user last saw in
+// the status or details of the ticket, so changes made by others since then are not overwritten.
+// Without a recent stamp this is a regular update.
+func (p *Plugin) updateTicketSafely(commandArgs *model.CommandArgs, client *Client, ticketNumber int64, in *zendesk.Ticket) (*zendesk.Ticket, error) {
+	instance, err := p.resolveInstance(commandArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	stamp, err := p.getSeenTicketStamp(commandArgs.UserId, instance.Name, ticketNumber)
+	if err != nil {
+		p.API.LogWarn("failed to load ticket stamp", "ticket_id", ticketNumber, "error", err.Error())
+	}
+
+	ticket, err := client.UpdateTicketSafely(ticketNumber, in, stamp)
+	if err != nil {
+		return nil, err
+	}
+	// The user knows about their own update, further updates shouldn't conflict with it.
+	p.markTicketSeen(commandArgs, ticket)
+	return ticket, nil
+}
+
+// markTicketSeen records the ticket as shown to the user, see updateTicketSafely.
+func (p *Plugin) markTicketSeen(commandArgs *model.CommandArgs, ticket *zendesk.Ticket) {
+	instance, err := p.resolveInstance(commandArgs)
+	if err == nil {
+		err = p.setSeenTicketStamp(commandArgs.UserId, instance.Name, ticket)
+	}
+	if err != nil {
+		p.API.LogWarn("failed to store ticket stamp", "error", err.Error())
+	}
+}
+
+// respondTicketConflict tells the user the ticket changed while they were updating it and shows its latest state.
+func (p *Plugin) respondTicketConflict(commandArgs *model.CommandArgs, client *Client, ticketNumber int64) *model.CommandResponse {
+	T := p.T(commandArgs.UserId)
+	text := T("zendesk.error.conflict", map[string]interface{}{"TicketID": ticketNumber})
+
+	ticket, err := client.ShowTicket(ticketNumber)
+	if err == nil {
+		p.markTicketSeen(commandArgs, ticket)
+		details := ""
+		if ticket.Status != nil {
+			details += T("zendesk.error.conflict_status", map[string]interface{}{"Status": *ticket.Status})
+		}
+		if ticket.Priority != nil {
+			details += T("zendesk.error.conflict_priority", map[string]interface{}{"Priority": *ticket.Priority})
+		}
+		if ticket.UpdatedAt != nil {
+			details += T("zendesk.error.conflict_updated", map[string]interface{}{"Updated": ticket.UpdatedAt.UTC().Format(time.RFC1123)})
+		}
+		text += "\n" + T("zendesk.error.conflict_state", map[string]interface{}{"Ticket": client.ticketLink(ticket), "Details": details})
+	}
+
+	p.postCommandResponse(commandArgs, text+"\n"+T("zendesk.error.conflict_retry"))
+	return &model.CommandResponse{}
+}
+
+// isAPIError reports whether err is an error response from the Zendesk API with the given status code.
+func isAPIError(err error, statusCode int) bool {
+	apiErr, ok := err.(*zendesk.APIError)
+	return ok && apiErr.Response != nil && apiErr.Response.StatusCode == statusCode
+}
+
+// respondError reports a failed command to the user. Zendesk answers 401 when the stored token
+// was revoked or has expired, so the token is refreshed, or dropped and the user is asked to
+// connect again when it can't be.
+// 403 is not handled here, Zendesk also uses it for tickets the agent isn't allowed to see.
+// Requests still rate limited after the retries of retryRateLimited are reported as such, and
+// tickets Zendesk couldn't find by their number.
+func (p *Plugin) respondError(commandArgs *model.CommandArgs, err error) *model.CommandResponse {
+	if notFound, ok := err.(*ticketNotFoundError); ok {
+		return p.respondT(commandArgs, "zendesk.error.ticket_not_found", map[string]interface{}{"TicketID": notFound.ticketID})
+	}
+	if isAPIError(err, http.StatusTooManyRequests) {
+		return p.respondT(commandArgs, "zendesk.error.rate_limited")
+	}
+	if !isAPIError(err, http.StatusUnauthorized) {
+		return p.responsef(commandArgs, "%s", err.Error())
+	}
+
+	connect := "/zendesk connect"
+	if instance, instanceErr := p.resolveInstance(commandArgs); instanceErr == nil {
+		// Tokens revoked before they were due to expire are refreshed as well, users only have to
+		// connect again when that fails.
+		if token, tokenErr := p.getToken(commandArgs.UserId, instance.Name); tokenErr == nil {
+			if _, renewErr := p.renewOAuthToken(commandArgs.UserId, instance, token); renewErr == nil {
+				return p.respondT(commandArgs, "zendesk.error.session_renewed")
+			}
+		}
+		if deleteErr := p.deleteToken(commandArgs.UserId, instance.Name); deleteErr != nil {
+			p.API.LogWarn("failed to delete expired Zendesk token", "user_id", commandArgs.UserId, "error", deleteErr.Error())
+		}
+		if !instance.isDefault() {
+			connect = "/zendesk --instance=" + instance.Name + " connect"
+		}
+	}
+	return p.respondT(commandArgs, "zendesk.error.session_expired", map[string]interface{}{"Command": connect})
+}
+
+// requireConnected returns the Zendesk token of the user running the command for the instance
+// selected by it. Users who aren't connected are prompted to connect, with a link to do so, and
+// false is returned; so are other errors. Handlers return right away then.
+func (p *Plugin) requireConnected(commandArgs *model.CommandArgs) (string, bool) {
+	instance, err := p.resolveInstance(commandArgs)
 	if err != nil {
-		return p.help(commandArgs)
+		p.respondError(commandArgs, err)
+		return "", false
 	}
 
-	return p.responsef(commandArgs, "[Click here to link your Zendesk account - /%s/](%s%s)",
-		mmuser.Username, p.GetPluginURL(), routeUserConnect)
+	token, err := p.getFreshToken(commandArgs.UserId, instance)
+	if err == errNotConnected {
+		p.postCommandResponse(commandArgs, p.connectPrompt(commandArgs.UserId, instance))
+		return "", false
+	}
+	if err != nil {
+		p.respondError(commandArgs, err)
+		return "", false
+	}
+	return token, true
 }
 
-func executeDisconnect(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
-	if len(args) != 0 {
-		return p.help(commandArgs)
+// connectPrompt asks a user who isn't connected to a Zendesk instance to connect.
+func (p *Plugin) connectPrompt(userID string, instance *zendeskInstance) string {
+	mmuser, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		connect := "/zendesk connect"
+		if !instance.isDefault() {
+			connect = "/zendesk --instance=" + instance.Name + " connect"
+		}
+		return p.T(userID)("zendesk.connect.prompt", map[string]interface{}{"Command": connect})
 	}
+	return p.T(userID)("zendesk.connect.prompt_link") + " " + p.connectLinkText(mmuser, instance)
+}
 
-	if _, ok := p.oauthAccessTokenMap[commandArgs.UserId]; ok {
-		delete(p.oauthAccessTokenMap, commandArgs.UserId)
-		p.postCommandResponse(commandArgs, "Disconnected")
-		return &model.CommandResponse{}
+// getUserClient returns a client for the Zendesk instance selected by the command, authenticated
+// with the token of the Mattermost user running it, see requireConnected.
+func (p *Plugin) getUserClient(commandArgs *model.CommandArgs, token string) (*Client, error) {
+	instance, err := p.resolveInstance(commandArgs)
+	if err != nil {
+		return nil, err
 	}
 
-	return p.responsef(commandArgs, "You are not connected. To connect run `/zendesk connect`.")
+	return p.getTokenClient(commandArgs.UserId, instance, token, p.requestIDOf(commandArgs))
 }
 
-// executeStatus returns the current status of a case, I.e. Pending, Open, On-Hold, Solved Closed
-func executeStatus(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
-	if len(args) != 1 {
-		return p.responsef(commandArgs, "Please specify a case number in the form `/zendesk status <case-number>`.")
+// requestIDOf returns the correlation ID of the command run with commandArgs, see runHandler. Code
+// running outside of a command handler gets a new one.
+func (p *Plugin) requestIDOf(commandArgs *model.CommandArgs) string {
+	if requestID, ok := p.commandRequestIDs.Load(commandArgs); ok {
+		return requestID.(string)
 	}
+	return model.NewId()
+}
 
-	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+// getInstanceClient returns a client for a Zendesk instance authenticated as the given Mattermost
+// user, or errNotConnected if the user isn't connected to it. The client sends requestID along with
+// its requests, see getTokenClient.
+func (p *Plugin) getInstanceClient(userID string, instance *zendeskInstance, requestID string) (*Client, error) {
+	token, err := p.getFreshToken(userID, instance)
 	if err != nil {
-		return p.responsef(commandArgs, err.Error())
-
+		return nil, err
 	}
+	return p.getTokenClient(userID, instance, token, requestID)
+}
 
-	var ticket *zendesk.Ticket
+// getTokenClient returns a client for a Zendesk instance authenticated with the token of the given
+// Mattermost user. Every command calling Zendesk gets its client here, so this is where users are
+// rate limited, and where the correlation ID of the command or HTTP request is attached to the
+// client, see requestIDHeader.
+func (p *Plugin) getTokenClient(userID string, instance *zendeskInstance, token, requestID string) (*Client, error) {
+	if !p.allowCommand(userID, time.Now()) {
+		return nil, errRateLimited
+	}
 
-	if token, ok := p.oauthAccessTokenMap[commandArgs.UserId]; ok {
-		var client zendesk.Client
-		u, _ := url.Parse(p.getConfiguration().ZendeskURL)
-		clientHost := strings.Split(u.Host, ".")[0]
-		client, err = zendesk.NewClientWithOAuthToken(clientHost, token)
-		if err != nil {
-			return p.responsef(commandArgs, err.Error())
-		}
-		ticket, err = client.ShowTicket(ticketNumber)
-		if err != nil {
-			return p.responsef(commandArgs, err.Error())
-		}
-	} else {
-		p.postCommandResponse(commandArgs, "Please connect to Zendesk")
-		return &model.CommandResponse{}
+	// The token is always read from the KV store, so a client is only reused while the token it
+	// was built with is still current, also when it changed on another node of a cluster.
+	key := tokenKey(userID, instance.Name)
+	p.clientCacheLock.Lock()
+	defer p.clientCacheLock.Unlock()
+	maxRetries := p.getConfiguration().getRateLimitRetries()
+	if cached, ok := p.clientCache[key]; ok && cached.token == token && cached.client.baseURL == strings.TrimRight(instance.URL, "/") &&
+		cached.client.maxRetries == maxRetries {
+		return cached.client.withRequestID(requestID), nil
 	}
 
-	status := *ticket.Status
-	p.postCommandResponse(commandArgs, status)
-	return &model.CommandResponse{}
+	client, err := newUserClient(instance.URL, token, maxRetries)
+	if err != nil {
+		return nil, err
+	}
+	p.clientCache[key] = cachedClient{token: token, client: client}
+	return client.withRequestID(requestID), nil
 }
 
-// executeDetails - Return details of the case, Assignee, Requester, Organization, Issue, Priority, Status etc.
-func executeDetails(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
-	if len(args) != 1 {
-		return p.responsef(commandArgs, "Please specify a case number in the form `/zendesk status <case-number>`.")
+// getSharedClient returns a client for the default Zendesk instance authenticated with the Zendesk
+// account of the plugin, see sharedCredentials, or errNoSharedCredentials. The client is shared by
+// all its callers and rebuilt when the settings change.
+func (p *Plugin) getSharedClient(requestID string) (*Client, error) {
+	user, password, err := p.sharedCredentials()
+	if err != nil {
+		return nil, err
 	}
-
-	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
+	config := p.getConfiguration()
+	instance, err := config.getInstance(defaultInstanceName)
 	if err != nil {
-		return p.responsef(commandArgs, err.Error())
+		return nil, err
+	}
 
+	p.clientCacheLock.Lock()
+	defer p.clientCacheLock.Unlock()
+	maxRetries := config.getRateLimitRetries()
+	credential := user + " " + password
+	if cached := p.sharedClient; cached.client != nil && cached.token == credential && cached.client.baseURL == strings.TrimRight(instance.URL, "/") &&
+		cached.client.maxRetries == maxRetries {
+		return cached.client.withRequestID(requestID), nil
 	}
 
-	var ticket *zendesk.Ticket
+	client, err := newBasicAuthClient(instance.URL, user, password, maxRetries)
+	if err != nil {
+		return nil, err
+	}
+	p.sharedClient = cachedClient{token: credential, client: client}
+	return client.withRequestID(requestID), nil
+}
 
-	if token, ok := p.oauthAccessTokenMap[commandArgs.UserId]; ok {
-		var client zendesk.Client
-		u, _ := url.Parse(p.getConfiguration().ZendeskURL)
-		clientHost := strings.Split(u.Host, ".")[0]
-		client, err = zendesk.NewClientWithOAuthToken(clientHost, token)
-		if err != nil {
-			return p.responsef(commandArgs, err.Error())
-		}
-		ticket, err = client.ShowTicket(ticketNumber)
-		if err != nil {
-			return p.responsef(commandArgs, err.Error())
+// resolveInstance returns the Zendesk instance selected with the --instance flag of the command.
+// Without the flag the instance the team is routed to is used, or the default instance.
+func (p *Plugin) resolveInstance(commandArgs *model.CommandArgs) (*zendeskInstance, error) {
+	config := p.getConfiguration()
+	name, _ := parseInstanceFlag(commandArgs.Command)
+	if name == "" && commandArgs.TeamId != "" && config.TeamInstances != "" {
+		teamName := ""
+		if team, appErr := p.API.GetTeam(commandArgs.TeamId); appErr == nil {
+			teamName = team.Name
 		}
-	} else {
-		p.postCommandResponse(commandArgs, "Please connect to Zendesk")
-		return &model.CommandResponse{}
+		name = config.getTeamInstanceName(commandArgs.TeamId, teamName)
 	}
+	return config.getInstance(name)
+}
 
-	var organization *zendesk.Organization
-	if ticket.OrganizationID != nil {
-		organization, err = p.zendeskClient.ShowOrganization(*ticket.OrganizationID)
+// findOrganizations resolves an organization by its ID or name. More than one organization is
+// returned when the name is ambiguous, none when nothing matches.
+func findOrganizations(client zendesk.Client, nameOrID string) ([]zendesk.Organization, error) {
+	if id, err := strconv.ParseInt(nameOrID, 10, 64); err == nil {
+		organization, err := client.ShowOrganization(id)
 		if err != nil {
-			return p.responsef(commandArgs, err.Error())
+			return nil, err
 		}
+		return []zendesk.Organization{*organization}, nil
 	}
 
-	attachment, err := p.parseTicket(ticket, organization)
+	organizations, err := client.AutocompleteOrganizations(nameOrID)
 	if err != nil {
-		return p.responsef(commandArgs, err.Error())
+		return nil, err
 	}
-
-	post := &model.Post{
-		UserId:    p.botID,
-		ChannelId: commandArgs.ChannelId,
+	for _, organization := range organizations {
+		if organization.Name != nil && strings.EqualFold(*organization.Name, nameOrID) {
+			return []zendesk.Organization{organization}, nil
+		}
 	}
-	post.AddProp("attachments", attachment)
-
-	_ = p.API.SendEphemeralPost(commandArgs.UserId, post)
-
-	//TODO - remove - test only
-	//ticketStr, _ := json.Marshal(*ticket)
-	//p.postCommandResponse(commandArgs, "TEST ONLY - RAW OUTPUT: "+string(ticketStr))
-
-	return &model.CommandResponse{}
+	return organizations, nil
 }
 
-// executeUpdatePrivate - Post an Internal Comment to a case and notify agents
-func executeUpdatePrivate(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
-
-	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
-	if err != nil {
-		return p.responsef(commandArgs, err.Error())
-
-	}
-
-	commentLine := parseCommentLine("(\\/zendesk\\s*update\\s*private\\s*\\d*)(.*)", commandArgs.Command)
+var ticketStatuses = []string{"open", "pending", "hold", "solved"}
 
-	isPublic := false
-	in := zendesk.Ticket{
-		Comment: &zendesk.TicketComment{
-			Public: &isPublic,
-			Body:   &commentLine,
-		},
-	}
+var ticketPriorities = []string{"urgent", "high", "normal", "low"}
 
-	var updatedTicket *zendesk.Ticket
+// parseTicketUpdateFlags consumes the `--name=value` flags at the start of a comment and applies
+// them to the ticket, so a comment and field changes are submitted in a single update. The
+// remaining comment text is returned along with the Mattermost file IDs given with `--file`.
+func parseTicketUpdateFlags(T bundle.TranslateFunc, text string, ticket *zendesk.Ticket) (string, []string, error) {
+	var fileIDs []string
+	for strings.HasPrefix(text, "--") {
+		end := strings.IndexAny(text, " \t\n")
+		if end < 0 {
+			end = len(text)
+		}
+		flag := text[2:end]
+		text = strings.TrimSpace(text[end:])
 
-	if token, ok := p.oauthAccessTokenMap[commandArgs.UserId]; ok {
-		var client zendesk.Client
-		u, _ := url.Parse(p.getConfiguration().ZendeskURL)
-		clientHost := strings.Split(u.Host, ".")[0]
-		client, err = zendesk.NewClientWithOAuthToken(clientHost, token)
-		if err != nil {
-			return p.responsef(commandArgs, err.Error())
+		parts := strings.SplitN(flag, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return "", nil, errors.New(T("zendesk.update.flag_value_missing", map[string]interface{}{"Flag": parts[0]}))
 		}
-		updatedTicket, err = client.UpdateTicket(ticketNumber, &in)
-		if err != nil {
-			return p.responsef(commandArgs, err.Error())
+		name, value := parts[0], strings.ToLower(parts[1])
+
+		switch name {
+		case "status":
+			if !containsString(ticketStatuses, value) {
+				return "", nil, errors.New(T("zendesk.update.invalid_status", map[string]interface{}{"Status": value, "Statuses": strings.Join(ticketStatuses, ", ")}))
+			}
+			ticket.Status = &value
+		case "priority":
+			if !containsString(ticketPriorities, value) {
+				return "", nil, errors.New(T("zendesk.priority.invalid", map[string]interface{}{"Priority": value, "Priorities": strings.Join(ticketPriorities, ", ")}))
+			}
+			ticket.Priority = &value
+		case "file":
+			fileIDs = append(fileIDs, value)
+		default:
+			return "", nil, errors.New(T("zendesk.update.unknown_flag", map[string]interface{}{"Flag": name}))
 		}
-	} else {
-		p.postCommandResponse(commandArgs, "Please connect to Zendesk")
-		return &model.CommandResponse{}
 	}
 
-	p.postCommandResponse(commandArgs, "Private comment ["+commentLine+"] was added to ticket #"+strconv.FormatInt(*updatedTicket.ID, 10))
-
-	return &model.CommandResponse{}
+	return text, fileIDs, nil
 }
 
-// executeUpdatePublic - Post a Public Comment to a case and update all associated customer contacts and agents
-func executeUpdatePublic(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
-	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
-	if err != nil {
-		return p.responsef(commandArgs, err.Error())
-
+// describeTicketUpdate lists the ticket fields set by parseTicketUpdateFlags for the confirmation message.
+func describeTicketUpdate(T bundle.TranslateFunc, ticket *zendesk.Ticket) string {
+	var changes []string
+	if ticket.Status != nil {
+		changes = append(changes, T("zendesk.comment.status_set", map[string]interface{}{"Status": *ticket.Status}))
 	}
-
-	commentLine := parseCommentLine("(\\/zendesk\\s*update\\s*public\\s*\\d*)(.*)", commandArgs.Command)
-
-	isPublic := true
-	in := zendesk.Ticket{
-		Comment: &zendesk.TicketComment{
-			Public: &isPublic,
-			Body:   &commentLine,
-		},
+	if ticket.Priority != nil {
+		changes = append(changes, T("zendesk.comment.priority_set", map[string]interface{}{"Priority": *ticket.Priority}))
+	}
+	if len(changes) == 0 {
+		return ""
 	}
+	return " (" + strings.Join(changes, ", ") + ")"
+}
 
-	var updatedTicket *zendesk.Ticket
+// maxAttachmentSize is the largest file Zendesk accepts as an attachment, bigger files are
+// rejected before they are downloaded from Mattermost.
+const maxAttachmentSize = 50 * 1024 * 1024
+
+// uploadFiles uploads Mattermost files to Zendesk and returns their upload tokens, along with a
+// description of every file that couldn't be uploaded. Users can only attach files they uploaded
+// themselves or that were posted to a channel they can read.
+func (p *Plugin) uploadFiles(userID string, client *Client, fileIDs []string) ([]string, []string) {
+	T := p.T(userID)
+	var tokens, failures []string
+	for _, fileID := range fileIDs {
+		info, appErr := p.API.GetFileInfo(fileID)
+		if appErr != nil || !p.canReadFile(userID, info) {
+			failures = append(failures, T("zendesk.comment.file_not_found", map[string]interface{}{"File": fileID}))
+			continue
+		}
+		if info.Size > maxAttachmentSize {
+			failures = append(failures, T("zendesk.comment.file_too_large", map[string]interface{}{"File": info.Name, "Size": maxAttachmentSize / 1024 / 1024}))
+			continue
+		}
 
-	if token, ok := p.oauthAccessTokenMap[commandArgs.UserId]; ok {
-		var client zendesk.Client
-		u, _ := url.Parse(p.getConfiguration().ZendeskURL)
-		clientHost := strings.Split(u.Host, ".")[0]
-		client, err = zendesk.NewClientWithOAuthToken(clientHost, token)
-		if err != nil {
-			return p.responsef(commandArgs, err.Error())
+		data, appErr := p.API.GetFile(fileID)
+		if appErr != nil {
+			failures = append(failures, fmt.Sprintf("`%s` (%s)", info.Name, appErr.Error()))
+			continue
 		}
-		updatedTicket, err = client.UpdateTicket(ticketNumber, &in)
+		token, err := client.UploadAttachment(info.Name, info.MimeType, data)
 		if err != nil {
-			return p.responsef(commandArgs, err.Error())
+			failures = append(failures, fmt.Sprintf("`%s` (%s)", info.Name, err.Error()))
+			continue
 		}
-	} else {
-		p.postCommandResponse(commandArgs, "Please connect to Zendesk")
-		return &model.CommandResponse{}
+		tokens = append(tokens, token)
 	}
-
-	p.postCommandResponse(commandArgs, "Public comment ["+commentLine+"] was added to ticket #"+strconv.FormatInt(*updatedTicket.ID, 10))
-
-	return &model.CommandResponse{}
+	return tokens, failures
 }
 
-// executeLatestPrivate - Return the last internal comment posted to a case
-func executeLatestPrivate(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
-	if len(args) != 1 {
-		return p.responsef(commandArgs, "Please specify a case number in the form `/zendesk latest private <case-number>`.")
+func (p *Plugin) canReadFile(userID string, info *model.FileInfo) bool {
+	if info.CreatorId == userID {
+		return true
 	}
-
-	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
-	if err != nil {
-		return p.responsef(commandArgs, err.Error())
-
+	if info.PostId == "" {
+		return false
 	}
-
-	var ticketComments []zendesk.TicketComment
-
-	if token, ok := p.oauthAccessTokenMap[commandArgs.UserId]; ok {
-		var client zendesk.Client
-		u, _ := url.Parse(p.getConfiguration().ZendeskURL)
-		clientHost := strings.Split(u.Host, ".")[0]
-		client, err = zendesk.NewClientWithOAuthToken(clientHost, token)
-		if err != nil {
-			return p.responsef(commandArgs, err.Error())
-		}
-		ticketComments, err = client.ListTicketComments(ticketNumber)
-		if err != nil {
-			return p.responsef(commandArgs, err.Error())
-		}
-	} else {
-		p.postCommandResponse(commandArgs, "Please connect to Zendesk")
-		return &model.CommandResponse{}
+	post, appErr := p.API.GetPost(info.PostId)
+	if appErr != nil {
+		return false
 	}
+	return p.API.HasPermissionToChannel(userID, post.ChannelId, model.PERMISSION_READ_CHANNEL)
+}
 
-	var lastPrivateComment zendesk.TicketComment
-	for i := len(ticketComments) - 1; i >= 0; i-- {
-		currentComment := ticketComments[i]
-		if !*currentComment.Public {
-			lastPrivateComment = currentComment
-			break
+// agentMentionRegexp matches the @<email> mentions of Zendesk agents in a comment.
+var agentMentionRegexp = regexp.MustCompile(`(?:^|\s)@([^\s@]+@[^\s@]+\.[A-Za-z]{2,})`)
+
+// resolveMentionedAgents looks up the agents mentioned as @<email> in a comment and returns their
+// IDs as additional collaborators, i.e. followers, of the ticket along with their emails. Mentions
+// of unknown users or end users are described in failures, they don't prevent the comment from
+// being added. The mentions are left in the comment.
+func resolveMentionedAgents(T bundle.TranslateFunc, client *Client, comment string) (collaborators []interface{}, emails, failures []string) {
+	seen := map[string]bool{}
+	for _, match := range agentMentionRegexp.FindAllStringSubmatch(comment, -1) {
+		email := strings.ToLower(match[1])
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+
+		user, err := client.SearchUserByEmail(email)
+		switch {
+		case err != nil:
+			failures = append(failures, fmt.Sprintf("`%s` (%s)", email, err.Error()))
+		case user == nil || user.ID == nil:
+			failures = append(failures, T("zendesk.comment.mention_unknown", map[string]interface{}{"Email": email}))
+		case !isAgent(user):
+			failures = append(failures, T("zendesk.comment.mention_not_agent", map[string]interface{}{"Email": email}))
+		default:
+			collaborators = append(collaborators, *user.ID)
+			emails = append(emails, email)
 		}
 	}
-
-	p.postCommandResponse(commandArgs, *lastPrivateComment.Body)
-
-	return &model.CommandResponse{}
+	return collaborators, emails, failures
 }
 
-// executeLatestPublic -  Return the last Public Comment posted to a case
-func executeLatestPublic(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
-	if len(args) != 1 {
-		return p.responsef(commandArgs, "Please specify a case number in the form `/zendesk latest public <case-number>`.")
+// describeMentions lists the agents notified of a comment and the mentions that were skipped for
+// the confirmation message.
+func describeMentions(T bundle.TranslateFunc, emails, failures []string) string {
+	text := ""
+	if len(emails) > 0 {
+		text += "\n" + T("zendesk.comment.notified_agents", map[string]interface{}{"Agents": strings.Join(emails, ", ")})
 	}
-
-	ticketNumber, err := strconv.ParseInt(args[0], 10, 64)
-	if err != nil {
-		return p.responsef(commandArgs, err.Error())
-
+	if len(failures) > 0 {
+		text += "\n" + T("zendesk.comment.mentions_skipped", map[string]interface{}{"Mentions": strings.Join(failures, ", ")})
 	}
+	return text
+}
 
-	var ticketComments []zendesk.TicketComment
+// describeUploadFailures lists the files that couldn't be attached for the confirmation message.
+func describeUploadFailures(T bundle.TranslateFunc, failures []string) string {
+	if len(failures) == 0 {
+		return ""
+	}
+	return "\n" + T("zendesk.comment.upload_failures", map[string]interface{}{"Files": strings.Join(failures, ", ")})
+}
 
-	if token, ok := p.oauthAccessTokenMap[commandArgs.UserId]; ok {
-		var client zendesk.Client
-		u, _ := url.Parse(p.getConfiguration().ZendeskURL)
-		clientHost := strings.Split(u.Host, ".")[0]
-		client, err = zendesk.NewClientWithOAuthToken(clientHost, token)
-		if err != nil {
-			return p.responsef(commandArgs, err.Error())
-		}
-		ticketComments, err = client.ListTicketComments(ticketNumber)
-		if err != nil {
-			return p.responsef(commandArgs, err.Error())
+// containsFold is containsString ignoring case.
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
 		}
-	} else {
-		p.postCommandResponse(commandArgs, "Please connect to Zendesk")
-		return &model.CommandResponse{}
 	}
+	return false
+}
 
-	var lastPublicComment zendesk.TicketComment
-	for i := len(ticketComments) - 1; i >= 0; i-- {
-		currentComment := ticketComments[i]
-		if *currentComment.Public {
-			lastPublicComment = currentComment
-			break
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
 		}
 	}
-
-	p.postCommandResponse(commandArgs, *lastPublicComment.Body)
-
-	return &model.CommandResponse{}
+	return false
 }
 
-// executeZendeskDefault is the default command if no other command fits. It defaults to help.
-func executeZendeskDefault(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
-	return p.help(header)
+func containsID(values []int64, value int64) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
-func (p *Plugin) postCommandResponse(args *model.CommandArgs, text string) {
-	post := &model.Post{
-		UserId:    p.botID,
-		ChannelId: args.ChannelId,
-		Message:   text,
+// parseCommentLine returns the comment of a command, the second group of regexString matched from
+// the start of the command, without surrounding whitespace. Leading whitespace is skipped, as
+// commands don't always go through normalizeCommand. Only the command prefix is stripped, the
+// same text further in the comment is kept. Commands not matching have no comment, callers
+// reject empty comments with a usage hint.
+func parseCommentLine(regexString string, command string) string {
+	_, command = parseInstanceFlag(strings.TrimLeft(command, " \t"))
+	re := regexp.MustCompile("(?s)^" + regexString)
+	matches := re.FindStringSubmatch(command)
+	if matches == nil {
+		return ""
 	}
-	_ = p.API.SendEphemeralPost(args.UserId, post)
+	return strings.TrimSpace(matches[2])
 }
 
-func (p *Plugin) responsef(commandArgs *model.CommandArgs, format string, args ...interface{}) *model.CommandResponse {
-	p.postCommandResponse(commandArgs, fmt.Sprintf(format, args...))
-	return &model.CommandResponse{}
-}
+// maxCommentBytes is the largest comment body Zendesk accepts.
+const maxCommentBytes = 64 * 1024
 
-func parseCommentLine(regexString string, command string) string {
-	re := regexp.MustCompile(regexString)
-	commentLine := re.ReplaceAllString(command, "$2")
+var errCommentTooLong = errors.Errorf("the comment is too long, Zendesk accepts up to %d KB", maxCommentBytes/1024)
 
-	return commentLine
+// checkCommentLength rejects comment bodies Zendesk would refuse, before any request is made.
+func checkCommentLength(comment string) error {
+	if len(comment) > maxCommentBytes {
+		return errCommentTooLong
+	}
+	return nil
 }
 
-func (p *Plugin) parseTicket(ticket *zendesk.Ticket, organization *zendesk.Organization) ([]*model.SlackAttachment, error) {
-	ticketID := strconv.FormatInt(*ticket.ID, 10)
-
-	zendeskURL := p.getConfiguration().ZendeskURL
-	text := fmt.Sprintf("[%s](%s%s)", ticketID+": "+*ticket.Subject, zendeskURL, "/agent/tickets/"+ticketID)
-	desc := truncate(*ticket.Description, 3000)
-	if desc != "" {
-		text += "\n\n" + desc + "\n"
+// parseTicket builds the details card of a ticket. With withInternalNote the latest internal note of
+// the ticket is shown as well, see canSeeInternalNotes.
+func (p *Plugin) parseTicket(T bundle.TranslateFunc, client *Client, ticket *zendesk.Ticket, organization *zendesk.Organization, form *TicketForm, loc *time.Location, withInternalNote bool) ([]*model.SlackAttachment, error) {
+	text := client.ticketLink(ticket)
+	// Tickets created through some channels have no description.
+	if ticket.Description != nil {
+		if desc := truncate(*ticket.Description, p.getConfiguration().getDescriptionLimit()); desc != "" {
+			text += "\n\n" + desc + "\n"
+		}
 	}
 
 	var fields []*model.SlackAttachmentField
 
 	if ticket.Status != nil {
 		fields = append(fields, &model.SlackAttachmentField{
-			Title: "Status",
-			Value: *ticket.Status,
+			Title: T("zendesk.field.status"),
+			Value: p.getConfiguration().formatStatus(*ticket.Status),
 			Short: true,
 		})
 	}
 
 	if ticket.AssigneeEmail != nil {
 		fields = append(fields, &model.SlackAttachmentField{
-			Title: "Assignee",
+			Title: T("zendesk.field.assignee"),
 			Value: *ticket.AssigneeEmail,
 			Short: true,
 		})
@@ -445,7 +3374,7 @@ func (p *Plugin) parseTicket(ticket *zendesk.Ticket, organization *zendesk.Organ
 
 	if ticket.Requester != nil && ticket.Requester.Name != nil {
 		fields = append(fields, &model.SlackAttachmentField{
-			Title: "Requester",
+			Title: T("zendesk.field.requester"),
 			Value: *ticket.Requester.Name,
 			Short: true,
 		})
@@ -453,35 +3382,291 @@ func (p *Plugin) parseTicket(ticket *zendesk.Ticket, organization *zendesk.Organ
 
 	if organization != nil && organization.Name != nil {
 		fields = append(fields, &model.SlackAttachmentField{
-			Title: "Organization",
+			Title: T("zendesk.field.organization"),
 			Value: *organization.Name,
 			Short: true,
 		})
 	}
 
+	fields = append(fields, organizationFields(T, organization)...)
+
 	if ticket.Priority != nil {
 		fields = append(fields, &model.SlackAttachmentField{
-			Title: "Priority",
+			Title: T("zendesk.field.priority"),
 			Value: *ticket.Priority,
 			Short: true,
 		})
 	}
 
+	if ticket.Type != nil && *ticket.Type != "" {
+		fields = append(fields, &model.SlackAttachmentField{
+			Title: T("zendesk.field.type"),
+			Value: *ticket.Type,
+			Short: true,
+		})
+	}
+
+	// Incidents link to the problem they were reported for.
+	if ticket.ProblemID != nil && stringValue(ticket.Type) == "incident" {
+		fields = append(fields, &model.SlackAttachmentField{
+			Title: T("zendesk.field.problem"),
+			Value: "[" + formatID(*ticket.ProblemID) + "](" + client.ticketURL(*ticket.ProblemID) + ")",
+			Short: true,
+		})
+	}
+
+	if form != nil && form.Name != nil {
+		fields = append(fields, &model.SlackAttachmentField{
+			Title: T("zendesk.field.form"),
+			Value: *form.Name,
+			Short: true,
+		})
+	}
+
+	fields = append(fields, p.customTicketFields(client, ticket)...)
+
+	if ticket.CreatedAt != nil {
+		fields = append(fields, &model.SlackAttachmentField{
+			Title: T("zendesk.field.created"),
+			Value: formatTimestamp(*ticket.CreatedAt, loc),
+			Short: true,
+		})
+	}
+
+	if ticket.UpdatedAt != nil {
+		fields = append(fields, &model.SlackAttachmentField{
+			Title: T("zendesk.field.updated"),
+			Value: formatTimestamp(*ticket.UpdatedAt, loc),
+			Short: true,
+		})
+	}
+
+	if withInternalNote {
+		fields = append(fields, p.internalNoteField(T, client, ticket)...)
+	}
+
 	return []*model.SlackAttachment{
 		{
-			Color:  "#95b7d0",
+			Color:  attachmentColor(ticket, p.getConfiguration().getTicketColors()),
 			Text:   text,
 			Fields: fields,
 		},
 	}, nil
 }
 
+// internalNoteField returns the field of the details card showing the latest internal note of a
+// ticket, none if it has no internal note. The note is only informational, so it is left out when
+// it can't be loaded.
+func (p *Plugin) internalNoteField(T bundle.TranslateFunc, client *Client, ticket *zendesk.Ticket) []*model.SlackAttachmentField {
+	config := p.getConfiguration()
+	note, err := client.FindLatestComment(*ticket.ID, false, config.getCommentPagesLimit())
+	if err != nil {
+		p.API.LogWarn("failed to fetch the latest internal note", "ticket_id", *ticket.ID, "error", err.Error())
+		return nil
+	}
+	if note == nil {
+		return nil
+	}
+	text := truncate(commentText(note), config.getDescriptionLimit())
+	if text == "" {
+		return nil
+	}
+	return []*model.SlackAttachmentField{{
+		Title: T("zendesk.field.internal_note"),
+		Value: text,
+	}}
+}
+
+// canSeeInternalNotes reports whether the agent connected to the client can see the internal notes
+// of tickets. End users only see the public comments of their own tickets.
+func (p *Plugin) canSeeInternalNotes(client *Client) bool {
+	user, err := client.ShowCurrentUser()
+	if err != nil {
+		p.API.LogWarn("failed to fetch the current Zendesk user", "error", err.Error())
+		return false
+	}
+	return isAgent(user)
+}
+
+// attachmentColor picks the color of a ticket's details card from its status, or else its priority.
+func attachmentColor(ticket *zendesk.Ticket, colors map[string]string) string {
+	for _, value := range []*string{ticket.Status, ticket.Priority} {
+		if value == nil {
+			continue
+		}
+		if color, ok := colors[strings.ToLower(*value)]; ok {
+			return color
+		}
+	}
+	return defaultTicketColor
+}
+
+// ticketFieldsCacheTTL is how long the titles of custom ticket fields are cached, they rarely change.
+const ticketFieldsCacheTTL = time.Hour
+
+type cachedTicketField struct {
+	title     string
+	expiresAt time.Time
+}
+
+// customTicketFields returns the custom fields configured in TicketCustomFields for the details
+// card, in the configured order. Fields without a value are left out.
+func (p *Plugin) customTicketFields(client *Client, ticket *zendesk.Ticket) []*model.SlackAttachmentField {
+	var fields []*model.SlackAttachmentField
+	for _, id := range p.getConfiguration().getTicketCustomFieldIDs() {
+		for _, custom := range ticket.CustomFields {
+			if custom.ID == nil || *custom.ID != id {
+				continue
+			}
+			value := formatCustomFieldValue(custom.Value)
+			if value == "" {
+				break
+			}
+			fields = append(fields, &model.SlackAttachmentField{
+				Title: p.getTicketFieldTitle(client, id),
+				Value: value,
+				Short: true,
+			})
+			break
+		}
+	}
+	return fields
+}
+
+// getTicketFieldTitle returns the title of a custom ticket field, using the cached definition
+// when fresh. The field ID is shown instead if the definition can't be fetched.
+func (p *Plugin) getTicketFieldTitle(client *Client, id int64) string {
+	key := client.baseURL + "/" + formatID(id)
+	p.ticketFieldsLock.Lock()
+	cached, ok := p.ticketFieldsCache[key]
+	p.ticketFieldsLock.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.title
+	}
+
+	field, err := client.ShowTicketField(id)
+	if err != nil || field == nil || field.Title == nil {
+		if err != nil {
+			p.API.LogWarn("failed to fetch ticket field", "ticket_field_id", id, "error", err.Error())
+		}
+		return "Field " + formatID(id)
+	}
+
+	p.ticketFieldsLock.Lock()
+	defer p.ticketFieldsLock.Unlock()
+	p.ticketFieldsCache[key] = cachedTicketField{title: *field.Title, expiresAt: time.Now().Add(ticketFieldsCacheTTL)}
+	return *field.Title
+}
+
+// formatCustomFieldValue renders the value of a custom field, which Zendesk sends as a string,
+// a number, a boolean or a list of options depending on the field type.
+func formatCustomFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		if v {
+			return "Yes"
+		}
+		return "No"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s := formatCustomFieldValue(item); s != "" {
+				values = append(values, s)
+			}
+		}
+		return strings.Join(values, ", ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// organizationCustomFields are the custom organization fields shown in the details card, by key.
+var organizationCustomFields = []struct {
+	key     string
+	titleID string
+}{
+	{key: "tier", titleID: "zendesk.field.tier"},
+	{key: "plan", titleID: "zendesk.field.plan"},
+}
+
+// organizationFields returns the domains and the tier or plan of an organization for the details
+// card and the organization summary, leaving out whatever isn't set.
+func organizationFields(T bundle.TranslateFunc, organization *zendesk.Organization) []*model.SlackAttachmentField {
+	if organization == nil {
+		return nil
+	}
+
+	var fields []*model.SlackAttachmentField
+	if organization.DomainNames != nil && len(*organization.DomainNames) > 0 {
+		fields = append(fields, &model.SlackAttachmentField{
+			Title: T("zendesk.field.domains"),
+			Value: strings.Join(*organization.DomainNames, ", "),
+			Short: true,
+		})
+	}
+
+	for _, custom := range organizationCustomFields {
+		for key, value := range organization.OrganizationFields {
+			if !strings.EqualFold(key, custom.key) || value == nil || fmt.Sprint(value) == "" {
+				continue
+			}
+			fields = append(fields, &model.SlackAttachmentField{
+				Title: T(custom.titleID),
+				Value: fmt.Sprint(value),
+				Short: true,
+			})
+		}
+	}
+	return fields
+}
+
+// userLocation returns the timezone set in the profile of a Mattermost user, or UTC if it can't
+// be determined.
+func (p *Plugin) userLocation(userID string) *time.Location {
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(user.GetPreferredTimezone())
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// formatTimestamp formats a time in the given location, the zone is always shown so UTC times
+// aren't mistaken for local ones.
+func formatTimestamp(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format("2006-01-02 15:04 MST")
+}
+
+// stringValue returns the value of an optional Zendesk field, or "" if it isn't set.
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func formatID(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// truncate shortens s to at most max characters, ending it with "..." if it was cut. It counts
+// runes rather than bytes, so multibyte characters are never split.
 func truncate(s string, max int) string {
-	if len(s) <= max || max < 0 {
+	runes := []rune(s)
+	if len(runes) <= max || max < 0 {
 		return s
 	}
 	if max > 3 {
-		return s[:max-3] + "..."
+		return string(runes[:max-3]) + "..."
 	}
-	return s[:max]
+	return string(runes[:max])
 }
@@ -0,0 +1,1985 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNormalizeCommand(t *testing.T) {
+	for name, tc := range map[string]struct {
+		command  string
+		expected string
+	}{
+		"trailing newline": {
+			command:  "/zendesk status 123\n",
+			expected: "/zendesk status 123",
+		},
+		"double spaces": {
+			command:  "/zendesk  update  private 123  hello  world",
+			expected: "/zendesk update private 123 hello  world",
+		},
+		"tabs and trailing spaces per line": {
+			command:  "/zendesk update public 123\tfirst line  \nsecond\t line\n\n",
+			expected: "/zendesk update public 123 first line\nsecond\t line",
+		},
+		"indented body lines": {
+			command:  "/zendesk update public 123 Steps:\n    go test ./...\n  - nested  item \n",
+			expected: "/zendesk update public 123 Steps:\n    go test ./...\n  - nested  item",
+		},
+		"no case number": {
+			command:  "/zendesk  my \t groups ",
+			expected: "/zendesk my groups",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if actual := normalizeCommand(tc.command); actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseCommentLineAfterNormalize(t *testing.T) {
+	for name, tc := range map[string]struct {
+		command  string
+		expected string
+	}{
+		"trailing newline": {
+			command:  "/zendesk update private 123 hello world\n",
+			expected: "hello world",
+		},
+		"double spaces": {
+			command:  "/zendesk  update  private  123  hello  world",
+			expected: "hello  world",
+		},
+		"indented line in the body": {
+			command:  "/zendesk update private 123 Run:\n\tmake test\n    make dist",
+			expected: "Run:\n\tmake test\n    make dist",
+		},
+		"multiline body": {
+			command:  "/zendesk update private 123 first line\nsecond line\n",
+			expected: "first line\nsecond line",
+		},
+		"spaces and tabs between update and private": {
+			command:  "/zendesk update   \t  private 123 hello",
+			expected: "hello",
+		},
+		"blank body": {
+			command:  "/zendesk update private 123   \n\t ",
+			expected: "",
+		},
+		"command repeated in the body": {
+			command:  "/zendesk update private 123 run /zendesk update private 5 again",
+			expected: "run /zendesk update private 5 again",
+		},
+		"other command": {
+			command:  "/zendesk update public 123 hello",
+			expected: "",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			actual := parseCommentLine("(\\/zendesk\\s*update\\s*private\\s*\\d*)(.*)", normalizeCommand(tc.command))
+			if actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseCommentLineWithoutNormalize(t *testing.T) {
+	for command, expected := range map[string]string{
+		"/zendesk  update   private   123   hello world":      "hello world",
+		"/zendesk  update \t  private\t123   hello  world \n": "hello  world",
+		" \t/zendesk update private 123 hello":                "hello",
+		" /zendesk --instance=eu update private 123 hello":    "hello",
+		"/zendesk  update   private   123   ":                 "",
+	} {
+		if actual := parseCommentLine("(\\/zendesk\\s*update\\s*private\\s*\\d*)(.*)", command); actual != expected {
+			t.Errorf("expected %q for %q, got %q", expected, command, actual)
+		}
+	}
+}
+
+func TestCommentLengthIsChecked(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("expected no request, got %s %s", r.Method, r.URL.Path)
+	})
+	defer ct.close()
+
+	long := strings.Repeat("a", maxCommentBytes+1)
+	for _, command := range []string{"/zendesk update private 1 " + long, "/zendesk solve 1 " + long, "/zendesk sidecomment 1 " + long} {
+		if message := ct.execute(t, command); message != "the comment is too long, Zendesk accepts up to 64 KB" {
+			t.Errorf("unexpected response %q", message)
+		}
+	}
+	if message := ct.execute(t, "/zendesk update private 1 \n \n"); !strings.HasPrefix(message, "Please specify a comment") {
+		t.Errorf("unexpected response %q", message)
+	}
+}
+
+func TestParseTicketUpdateFlags(t *testing.T) {
+	T := newTestPlugin(&plugintest.API{}).T("user")
+	for name, tc := range map[string]struct {
+		text             string
+		expectedText     string
+		expectedStatus   string
+		expectedPriority string
+		expectedFiles    string
+		expectError      bool
+	}{
+		"no flags": {
+			text:         "just a comment",
+			expectedText: "just a comment",
+		},
+		"status and priority": {
+			text:             "--status=solved --priority=HIGH solving with note",
+			expectedText:     "solving with note",
+			expectedStatus:   "solved",
+			expectedPriority: "high",
+		},
+		"flag only": {
+			text:           "--status=pending",
+			expectedText:   "",
+			expectedStatus: "pending",
+		},
+		"files": {
+			text:           "--file=abc --status=open --file=def see attached",
+			expectedText:   "see attached",
+			expectedFiles:  "[abc def]",
+			expectedStatus: "open",
+		},
+		"flags in the middle are part of the comment": {
+			text:         "see --status=solved",
+			expectedText: "see --status=solved",
+		},
+		"invalid status": {
+			text:        "--status=done comment",
+			expectError: true,
+		},
+		"missing value": {
+			text:        "--priority comment",
+			expectError: true,
+		},
+		"unknown flag": {
+			text:        "--assignee=bob comment",
+			expectError: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ticket := zendesk.Ticket{}
+			text, fileIDs, err := parseTicketUpdateFlags(T, tc.text, &ticket)
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != tc.expectedText {
+				t.Errorf("expected text %q, got %q", tc.expectedText, text)
+			}
+			if status := stringValue(ticket.Status); status != tc.expectedStatus {
+				t.Errorf("expected status %q, got %q", tc.expectedStatus, status)
+			}
+			if priority := stringValue(ticket.Priority); priority != tc.expectedPriority {
+				t.Errorf("expected priority %q, got %q", tc.expectedPriority, priority)
+			}
+			if len(fileIDs) > 0 || tc.expectedFiles != "" {
+				if files := fmt.Sprint(fileIDs); files != tc.expectedFiles {
+					t.Errorf("expected files %s, got %s", tc.expectedFiles, files)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCreateCommand(t *testing.T) {
+	for name, tc := range map[string]struct {
+		command  string
+		expected *createCommand
+	}{
+		"subject and description": {
+			command:  `/zendesk create "Cannot log in" The password is rejected.`,
+			expected: &createCommand{subject: "Cannot log in", description: "The password is rejected."},
+		},
+		"multiline description": {
+			command:  "/zendesk create \"Outage\" first line\nsecond line",
+			expected: &createCommand{subject: "Outage", description: "first line\nsecond line"},
+		},
+		"typographic quotes": {
+			command:  "/zendesk create “Cannot log in” details",
+			expected: &createCommand{subject: "Cannot log in", description: "details"},
+		},
+		"subject only": {
+			command:  `/zendesk create "Cannot log in"`,
+			expected: &createCommand{subject: "Cannot log in", description: "Cannot log in"},
+		},
+		"requester": {
+			command: `/zendesk create --requester-email=jane@example.com --requester-name="Jane Doe" "Cannot log in" details`,
+			expected: &createCommand{subject: "Cannot log in", description: "details",
+				requesterEmail: "jane@example.com", requesterName: "Jane Doe"},
+		},
+		"requester email only": {
+			command:  `/zendesk create --requester-email=jane@example.com "Cannot log in"`,
+			expected: &createCommand{subject: "Cannot log in", description: "Cannot log in", requesterEmail: "jane@example.com"},
+		},
+		"type": {
+			command:  `/zendesk create --type=Incident --requester-email=jane@example.com "Printer on fire" details`,
+			expected: &createCommand{subject: "Printer on fire", description: "details", requesterEmail: "jane@example.com", ticketType: "incident"},
+		},
+		"missing subject": {
+			command: "/zendesk create",
+		},
+		"unquoted subject": {
+			command: "/zendesk create Cannot log in",
+		},
+		"empty subject": {
+			command: `/zendesk create "" description`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cmd, ok := parseCreateCommand(tc.command)
+			if ok != (tc.expected != nil) {
+				t.Fatalf("expected ok to be %v", tc.expected != nil)
+			}
+			if ok && *cmd != *tc.expected {
+				t.Errorf("expected %+v, got %+v", *tc.expected, *cmd)
+			}
+		})
+	}
+}
+
+func TestParseInstanceFlag(t *testing.T) {
+	for name, tc := range map[string]struct {
+		command  string
+		instance string
+		rest     string
+	}{
+		"no flag": {
+			command: "/zendesk status 123",
+			rest:    "/zendesk status 123",
+		},
+		"flag": {
+			command:  "/zendesk --instance=eu status 123",
+			instance: "eu",
+			rest:     "/zendesk status 123",
+		},
+		"flag after subcommand is not an instance": {
+			command: "/zendesk status --instance=eu 123",
+			rest:    "/zendesk status --instance=eu 123",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			instance, rest := parseInstanceFlag(tc.command)
+			if instance != tc.instance || rest != tc.rest {
+				t.Errorf("expected (%q, %q), got (%q, %q)", tc.instance, tc.rest, instance, rest)
+			}
+		})
+	}
+}
+
+func TestGetAutocompleteData(t *testing.T) {
+	data := getAutocompleteData()
+	if err := data.IsValid(); err != nil {
+		t.Fatal(err)
+	}
+
+	find := func(node *model.AutocompleteData, trigger string) *model.AutocompleteData {
+		for _, sub := range node.SubCommands {
+			if sub.Trigger == trigger {
+				return sub
+			}
+		}
+		t.Fatalf("%s has no subcommand %s", node.Trigger, trigger)
+		return nil
+	}
+
+	latest := find(data, "latest")
+	find(latest, "public")
+	private := find(latest, "private")
+	if len(private.Arguments) != 1 || private.Arguments[0].Data.(*model.AutocompleteTextArg).Hint != "case-number" {
+		t.Errorf("expected a case-number argument, got %v", private.Arguments)
+	}
+
+	if problem := find(data, "problem"); len(problem.Arguments) != 0 {
+		t.Errorf("commands with subcommands must not have arguments, got %v", problem.Arguments)
+	}
+}
+
+func TestSortTicketsByPriority(t *testing.T) {
+	tickets := []zendesk.Ticket{
+		{ID: zendesk.Int(1), Status: zendesk.String("open")},
+		{ID: zendesk.Int(2), Status: zendesk.String("pending"), Priority: zendesk.String("low")},
+		{ID: zendesk.Int(3), Status: zendesk.String("hold"), Priority: zendesk.String("urgent")},
+		{ID: zendesk.Int(4), Status: zendesk.String("open"), Priority: zendesk.String("high")},
+	}
+
+	var ids []int64
+	for _, ticket := range sortTickets(filterTicketsByStatus(tickets, "open", "pending"), "priority") {
+		ids = append(ids, *ticket.ID)
+	}
+	if fmt.Sprint(ids) != "[4 2 1]" {
+		t.Errorf("expected tickets [4 2 1], got %v", ids)
+	}
+}
+
+func TestRespondErrorDropsExpiredToken(t *testing.T) {
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	p := newTestPlugin(api)
+
+	encrypted, encryptErr := p.encryptToken("token")
+	if encryptErr != nil {
+		t.Fatal(encryptErr)
+	}
+	// The token has no refresh token, so it can't be renewed.
+	api.On("KVGet", "user"+tokenKeySuffix).Return([]byte(encrypted), nil)
+	api.On("KVGet", "user"+refreshTokenKeySuffix).Return(nil, nil)
+	api.On("KVDelete", "user"+tokenKeySuffix).Return(nil)
+	api.On("KVDelete", "user"+refreshTokenKeySuffix).Return(nil)
+	api.On("SendEphemeralPost", "user", mock.MatchedBy(func(post *model.Post) bool {
+		return post.Message == "Your Zendesk session expired, please run `/zendesk connect` again."
+	})).Return(nil)
+
+	err := &zendesk.APIError{Response: &http.Response{StatusCode: http.StatusUnauthorized}}
+	p.respondError(&model.CommandArgs{UserId: "user", Command: "/zendesk status 123"}, err)
+}
+
+// commandTest runs commands as "user", connected to a fake Zendesk instance, and collects the
+// ephemeral responses. The KV store is kept in memory.
+type commandTest struct {
+	p         *Plugin
+	api       *plugintest.API
+	server    *httptest.Server
+	kv        map[string][]byte
+	responses []*model.Post
+	audit     []string
+}
+
+func newCommandTest(t *testing.T, zendeskHandler http.HandlerFunc) *commandTest {
+	ct := &commandTest{
+		api:    &plugintest.API{},
+		server: httptest.NewServer(zendeskHandler),
+		kv:     map[string][]byte{},
+	}
+	ct.p = newTestPlugin(ct.api)
+	ct.p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: ct.server.URL, ZendeskClientID: "id", ZendeskClientSecrete: "secret"})
+
+	ct.api.On("KVGet", mock.AnythingOfType("string")).Return(func(key string) []byte {
+		return ct.kv[key]
+	}, nil).Maybe()
+	ct.api.On("KVSet", mock.AnythingOfType("string"), mock.AnythingOfType("[]uint8")).Run(func(args mock.Arguments) {
+		ct.kv[args.String(0)] = args.Get(1).([]byte)
+	}).Return(nil).Maybe()
+	ct.api.On("KVSetWithExpiry", mock.AnythingOfType("string"), mock.AnythingOfType("[]uint8"), mock.AnythingOfType("int64")).Run(func(args mock.Arguments) {
+		ct.kv[args.String(0)] = args.Get(1).([]byte)
+	}).Return(nil).Maybe()
+	ct.api.On("KVDelete", mock.AnythingOfType("string")).Run(func(args mock.Arguments) {
+		delete(ct.kv, args.String(0))
+	}).Return(nil).Maybe()
+	ct.api.On("KVCompareAndSet", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("[]uint8")).Return(func(key string, oldValue, newValue []byte) bool {
+		if current, ok := ct.kv[key]; ok != (oldValue != nil) || !bytes.Equal(current, oldValue) {
+			return false
+		}
+		ct.kv[key] = newValue
+		return true
+	}, nil).Maybe()
+	ct.api.On("KVCompareAndDelete", mock.AnythingOfType("string"), mock.Anything).Return(func(key string, oldValue []byte) bool {
+		if current, ok := ct.kv[key]; !ok || !bytes.Equal(current, oldValue) {
+			return false
+		}
+		delete(ct.kv, key)
+		return true
+	}, nil).Maybe()
+	ct.api.On("LogInfo", "zendesk command", "user_id", "user", "channel_id", "channel", "command", mock.Anything,
+		"instance", mock.Anything, "case_numbers", mock.Anything).Run(func(args mock.Arguments) {
+		ct.audit = append(ct.audit, fmt.Sprintf("%s %s %s", args.String(6), args.String(8), args.String(10)))
+	}).Return().Maybe()
+	ct.api.On("LogDebug", "running zendesk command", "command", mock.Anything, "user_id", "user", "request_id", mock.AnythingOfType("string")).Return().Maybe()
+	ct.api.On("SendEphemeralPost", "user", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		ct.responses = append(ct.responses, args.Get(1).(*model.Post))
+	}).Return(nil).Maybe()
+	// Progress messages are replaced by the response, or dropped when they are deleted.
+	ct.api.On("UpdateEphemeralPost", "user", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		post := args.Get(1).(*model.Post)
+		for i := range ct.responses {
+			if ct.responses[i].Id == post.Id {
+				ct.responses[i] = post
+			}
+		}
+	}).Return(nil).Maybe()
+	ct.api.On("DeleteEphemeralPost", "user", mock.AnythingOfType("string")).Run(func(args mock.Arguments) {
+		for i, post := range ct.responses {
+			if post.Id == args.String(1) {
+				ct.responses = append(ct.responses[:i], ct.responses[i+1:]...)
+				break
+			}
+		}
+	}).Return().Maybe()
+
+	if err := ct.p.setToken("user", defaultInstanceName, "token"); err != nil {
+		t.Fatal(err)
+	}
+	return ct
+}
+
+func (ct *commandTest) close() {
+	ct.server.Close()
+}
+
+// execute runs a command and returns the message of the last response.
+func (ct *commandTest) execute(t *testing.T, command string) string {
+	ct.responses = nil
+	if _, appErr := ct.p.ExecuteCommand(nil, &model.CommandArgs{UserId: "user", ChannelId: "channel", Command: command}); appErr != nil {
+		t.Fatal(appErr)
+	}
+	if len(ct.responses) == 0 {
+		t.Fatalf("%s didn't respond", command)
+	}
+	return ct.responses[len(ct.responses)-1].Message
+}
+
+func TestAssignRejectsEndUsers(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("expected no ticket update, got %s %s", r.Method, r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"users":[{"id":1,"email":"customer@example.com","role":"end-user"}]}`))
+	})
+	defer ct.close()
+
+	message := ct.execute(t, "/zendesk assign 123 customer@example.com")
+	if message != "`customer@example.com` isn't an agent, tickets can only be assigned to agents and admins." {
+		t.Errorf("unexpected response %q", message)
+	}
+}
+
+func TestAssignConflict(t *testing.T) {
+	var safeUpdates int
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v2/users/search.json":
+			_, _ = w.Write([]byte(`{"users":[{"id":9,"email":"agent@example.com","role":"agent"}]}`))
+		case r.Method == http.MethodPut:
+			var in struct {
+				Ticket map[string]interface{} `json:"ticket"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			if in.Ticket["safe_update"] == true {
+				safeUpdates++
+			}
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"error":"UpdateConflict"}`))
+		default:
+			_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"open","updated_at":"2020-05-01T10:00:00Z"}}`))
+		}
+	})
+	defer ct.close()
+
+	ct.execute(t, "/zendesk status 1")
+	message := ct.execute(t, "/zendesk assign 1 agent@example.com")
+	if safeUpdates != 1 || !strings.HasPrefix(message, "Ticket #1 was changed by someone else") {
+		t.Errorf("expected the conflicting safe update to be reported, got %d safe updates and %q", safeUpdates, message)
+	}
+}
+
+func TestCreateWithNewRequester(t *testing.T) {
+	var requesterID int64
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/users/search.json":
+			_, _ = w.Write([]byte(`{"users":[]}`))
+		case "/api/v2/users.json":
+			_, _ = w.Write([]byte(`{"user":{"id":42,"name":"Jane Doe","email":"jane@example.com"}}`))
+		case "/api/v2/tickets.json":
+			var in struct {
+				Ticket zendesk.Ticket `json:"ticket"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			if in.Ticket.RequesterID != nil {
+				requesterID = *in.Ticket.RequesterID
+			}
+			_, _ = w.Write([]byte(`{"ticket":{"id":7,"subject":"Cannot log in"}}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+	defer ct.close()
+
+	message := ct.execute(t, `/zendesk create --requester-email=jane@example.com --requester-name="Jane Doe" "Cannot log in" details`)
+	if requesterID != 42 {
+		t.Errorf("expected the new user to be the requester, got %d", requesterID)
+	}
+	if !strings.Contains(message, "created for **Jane Doe** (jane@example.com)") {
+		t.Errorf("unexpected response %q", message)
+	}
+}
+
+func TestTicketType(t *testing.T) {
+	var createdType string
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/tickets.json":
+			var in struct {
+				Ticket zendesk.Ticket `json:"ticket"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			createdType = stringValue(in.Ticket.Type)
+			_, _ = w.Write([]byte(`{"ticket":{"id":7,"subject":"Printer on fire"}}`))
+		default:
+			_, _ = w.Write([]byte(`{"ticket":{"id":7,"status":"open","type":"incident","problem_id":5}}`))
+		}
+	})
+	defer ct.close()
+	ct.api.On("GetUser", "user").Return(&model.User{}, nil)
+
+	message := ct.execute(t, `/zendesk create --type=bug "Printer on fire" details`)
+	if message != "Unknown ticket type `bug`, please use one of: question, incident, problem, task." {
+		t.Errorf("unexpected response %q", message)
+	}
+	if createdType != "" {
+		t.Errorf("expected no ticket to be created, got type %q", createdType)
+	}
+
+	ct.execute(t, `/zendesk create --type=incident "Printer on fire" details`)
+	if createdType != "incident" {
+		t.Errorf("expected an incident to be created, got %q", createdType)
+	}
+
+	ct.execute(t, "/zendesk details 7")
+	var fields []string
+	for _, field := range ct.responses[len(ct.responses)-1].Attachments()[0].Fields {
+		fields = append(fields, fmt.Sprintf("%s=%v", field.Title, field.Value))
+	}
+	expected := "Status=open; Type=incident; Problem=[5](" + ct.server.URL + "/agent/tickets/5)"
+	if strings.Join(fields, "; ") != expected {
+		t.Errorf("expected fields %q, got %q", expected, strings.Join(fields, "; "))
+	}
+}
+
+func TestUpdateUsesStampSeenByUser(t *testing.T) {
+	const seen = "2020-05-01T10:00:00Z"
+	var updates []map[string]interface{}
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"open","updated_at":"` + seen + `"}}`))
+		case http.MethodPut:
+			var in struct {
+				Ticket map[string]interface{} `json:"ticket"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			updates = append(updates, in.Ticket)
+			_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"solved","updated_at":"2020-05-01T11:00:00Z"}}`))
+		}
+	})
+	defer ct.close()
+
+	ct.execute(t, "/zendesk update private 1 --status=pending unseen")
+	if len(updates) != 1 || updates[0]["safe_update"] != nil {
+		t.Fatalf("expected a plain update without a seen stamp, got %v", updates)
+	}
+
+	ct.execute(t, "/zendesk status 1")
+	updates = nil
+	ct.server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("expected no request but the update, got %s %s", r.Method, r.URL.Path)
+			return
+		}
+		var in struct {
+			Ticket map[string]interface{} `json:"ticket"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		updates = append(updates, in.Ticket)
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"solved","updated_at":"2020-05-01T11:00:00Z"}}`))
+	})
+
+	ct.execute(t, "/zendesk update private 1 --status=solved done")
+	if len(updates) != 1 || updates[0]["safe_update"] != true || updates[0]["updated_stamp"] != seen {
+		t.Errorf("expected a safe update with the seen stamp, got %v", updates)
+	}
+}
+
+func TestDisconnectDeletesUnreadableToken(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	})
+	defer ct.close()
+	ct.api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	ct.kv["user"+tokenKeySuffix] = []byte("encrypted with a rotated key")
+
+	if message := ct.execute(t, "/zendesk disconnect"); message != "Disconnected" {
+		t.Errorf("unexpected response %q", message)
+	}
+	if _, ok := ct.kv["user"+tokenKeySuffix]; ok {
+		t.Error("expected the unreadable token to be deleted")
+	}
+}
+
+func TestOrgCountListsAmbiguousOrganizations(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/organizations/autocomplete.json" {
+			t.Errorf("expected no ticket search, got %s %s", r.Method, r.URL.Path)
+			return
+		}
+		_, _ = w.Write([]byte(`{"organizations":[{"id":1,"name":"Acme Inc"},{"id":2,"name":"Acme Ltd"}]}`))
+	})
+	defer ct.close()
+
+	message := ct.execute(t, "/zendesk org count acme")
+	if !strings.HasPrefix(message, "Several organizations match `acme`") ||
+		!strings.Contains(message, "* 1 - Acme Inc\n") || !strings.Contains(message, "* 2 - Acme Ltd\n") {
+		t.Errorf("unexpected response %q", message)
+	}
+}
+
+func TestOrgSummary(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/organizations/9.json":
+			_, _ = w.Write([]byte(`{"organization":{"id":9,"name":"Acme","domain_names":["acme.com"],"organization_fields":{"tier":"gold"}}}`))
+		case "/api/v2/search.json":
+			if query := r.URL.Query().Get("query"); !strings.Contains(query, "organization_id:9") {
+				t.Errorf("unexpected search %q", query)
+			}
+			_, _ = w.Write([]byte(`{"results":[],"count":4}`))
+		case "/api/v2/organizations/autocomplete.json":
+			_, _ = w.Write([]byte(`{"organizations":[{"id":1,"name":"Acme Inc"},{"id":2,"name":"Acme Ltd"}]}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	})
+	defer ct.close()
+
+	ct.execute(t, "/zendesk org 9")
+	attachment := ct.responses[len(ct.responses)-1].Attachments()[0]
+	var fields []string
+	for _, field := range attachment.Fields {
+		fields = append(fields, field.Title+": "+fmt.Sprint(field.Value))
+	}
+	if attachment.Title != "Acme" || attachment.TitleLink != ct.server.URL+"/agent/organizations/9" {
+		t.Errorf("unexpected card %+v", attachment)
+	}
+	if len(fields) != 3 || fields[0] != "Domains: acme.com" || fields[1] != "Tier: gold" || !strings.HasPrefix(fields[2], "Open Tickets: [4](") {
+		t.Errorf("unexpected fields %v", fields)
+	}
+
+	// Ambiguous names list the candidates instead of guessing.
+	if message := ct.execute(t, "/zendesk org acme"); !strings.Contains(message, "* 1 - Acme Inc\n") || !strings.Contains(message, "* 2 - Acme Ltd\n") {
+		t.Errorf("unexpected response %q", message)
+	}
+}
+
+func TestProblemRejectsNonProblemTickets(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("expected no ticket update, got %s %s", r.Method, r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"ticket":{"id":2,"type":"question"}}`))
+	})
+	defer ct.close()
+
+	message := ct.execute(t, "/zendesk problem 1 2")
+	if message != "Ticket #2 is not a problem ticket, only problems can have incidents linked to them." {
+		t.Errorf("unexpected response %q", message)
+	}
+}
+
+func TestFormWithSingleTicketForm(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("expected no ticket update, got %s %s", r.Method, r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"ticket_forms":[{"id":1,"name":"Default","active":true}]}`))
+	})
+	defer ct.close()
+
+	message := ct.execute(t, "/zendesk form 1 Default")
+	if message != "Your Zendesk only has a single ticket form, there is nothing to change." {
+		t.Errorf("unexpected response %q", message)
+	}
+}
+
+func TestMyGroupsAreCached(t *testing.T) {
+	requests := 0
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/api/v2/users/me.json":
+			_, _ = w.Write([]byte(`{"user":{"id":5}}`))
+		case "/api/v2/users/5/groups.json":
+			_, _ = w.Write([]byte(`{"groups":[{"id":7,"name":"Support"}]}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+	defer ct.close()
+
+	for i := 0; i < 2; i++ {
+		if message := ct.execute(t, "/zendesk my groups"); !strings.Contains(message, "* Support (ID 7)") {
+			t.Errorf("unexpected response %q", message)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("expected the groups to be fetched once, got %d requests", requests)
+	}
+}
+
+func TestConnectDMSendsLinkFromBot(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	})
+	defer ct.close()
+	ct.p.botID = "bot"
+
+	var dm *model.Post
+	ct.api.On("GetUser", "user").Return(&model.User{Id: "user", Username: "jane"}, nil)
+	ct.api.On("GetConfig").Return(&model.Config{})
+	ct.api.On("GetDirectChannel", "user", "bot").Return(&model.Channel{Id: "dm"}, nil)
+	ct.api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		dm = args.Get(0).(*model.Post)
+	}).Return(&model.Post{}, nil)
+
+	message := ct.execute(t, "/zendesk connect dm")
+	if message != "The link to connect your Zendesk account was sent to you in a direct message." {
+		t.Errorf("unexpected response %q", message)
+	}
+	if dm == nil || dm.UserId != "bot" || dm.ChannelId != "dm" || !strings.Contains(dm.Message, routeUserConnect) {
+		t.Errorf("expected the connect link in a direct message from the bot, got %+v", dm)
+	}
+}
+
+func TestConnectSendsLinkAsDMWhenConfigured(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	})
+	defer ct.close()
+	ct.p.botID = "bot"
+	ct.p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: ct.server.URL, ZendeskClientID: "id", ZendeskClientSecrete: "secret", ConnectLinkDM: true})
+	ct.api.On("GetUser", "user").Return(&model.User{Id: "user", Username: "jane"}, nil)
+	ct.api.On("GetConfig").Return(&model.Config{})
+	ct.api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+
+	var dms int
+	ct.api.On("GetDirectChannel", "user", "bot").Return(&model.Channel{Id: "dm"}, nil).Once()
+	ct.api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) { dms++ }).Return(&model.Post{}, nil).Once()
+	if message := ct.execute(t, "/zendesk connect"); message != "The link to connect your Zendesk account was sent to you in a direct message." || dms != 1 {
+		t.Errorf("expected the link in a direct message, got %q", message)
+	}
+
+	// The link is posted in the channel when the direct message can't be sent.
+	ct.api.On("GetDirectChannel", "user", "bot").Return(nil, model.NewAppError("GetDirectChannel", "failed", nil, "", http.StatusInternalServerError))
+	if message := ct.execute(t, "/zendesk connect"); !strings.Contains(message, routeUserConnect) {
+		t.Errorf("expected the link in the channel, got %q", message)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	var priority string
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Ticket zendesk.Ticket `json:"ticket"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		priority = stringValue(in.Ticket.Priority)
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"open","priority":"high"}}`))
+	})
+	defer ct.close()
+
+	if message := ct.execute(t, "/zendesk priority 1 critical"); message != "Invalid priority `critical`, allowed values are: urgent, high, normal, low." {
+		t.Errorf("unexpected response %q", message)
+	}
+	if priority != "" {
+		t.Fatalf("expected no update for an invalid priority, got %q", priority)
+	}
+
+	ct.execute(t, "/zendesk priority 1 HIGH")
+	if priority != "high" {
+		t.Errorf("expected the priority to be updated to high, got %q", priority)
+	}
+	attachments := ct.responses[0].Attachments()
+	if len(attachments) != 1 || len(attachments[0].Fields) != 2 || attachments[0].Fields[1].Value != "high" {
+		t.Errorf("expected the new priority in the response, got %+v", attachments)
+	}
+}
+
+func TestPriorityConflict(t *testing.T) {
+	var safeUpdates int
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var in struct {
+				Ticket map[string]interface{} `json:"ticket"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			if in.Ticket["safe_update"] == true {
+				safeUpdates++
+			}
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"error":"UpdateConflict"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"open","priority":"low","updated_at":"2020-05-01T10:00:00Z"}}`))
+	})
+	defer ct.close()
+
+	ct.execute(t, "/zendesk status 1")
+	message := ct.execute(t, "/zendesk priority 1 high")
+	if safeUpdates != 1 || !strings.HasPrefix(message, "Ticket #1 was changed by someone else") {
+		t.Errorf("expected the conflicting safe update to be reported, got %d safe updates and %q", safeUpdates, message)
+	}
+}
+
+func TestTagAddAndRemove(t *testing.T) {
+	tags := []string{"billing"}
+	var updates []zendesk.Ticket
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var in struct {
+				Ticket zendesk.Ticket `json:"ticket"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			updates = append(updates, in.Ticket)
+			tags = in.Ticket.Tags
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"ticket": zendesk.Ticket{ID: zendesk.Int(1), Tags: tags}})
+	})
+	defer ct.close()
+
+	message := ct.execute(t, "/zendesk tag add 1 VIP billing vip")
+	if fmt.Sprint(tags) != "[billing vip]" {
+		t.Errorf("expected the tags to be deduplicated, got %v", tags)
+	}
+	if !strings.HasSuffix(message, "is tagged `billing`, `vip`.") {
+		t.Errorf("unexpected response %q", message)
+	}
+
+	ct.execute(t, "/zendesk tag remove 1 billing vip")
+	if last := updates[len(updates)-1]; fmt.Sprint(last.RemoveTags) != "[billing vip]" {
+		t.Errorf("expected the last tags to be removed explicitly, got %+v", last)
+	}
+
+	ct.execute(t, "/zendesk tag remove 1 missing")
+	if len(updates) != 2 {
+		t.Errorf("expected no update when the tags don't change, got %d updates", len(updates))
+	}
+}
+
+func TestUserLocation(t *testing.T) {
+	api := &plugintest.API{}
+	p := newTestPlugin(api)
+	api.On("GetUser", "berlin").Return(&model.User{Timezone: model.StringMap{"useAutomaticTimezone": "false", "manualTimezone": "Europe/Berlin"}}, nil)
+	api.On("GetUser", "unset").Return(&model.User{}, nil)
+	api.On("GetUser", "unknown").Return(nil, model.NewAppError("GetUser", "not_found", nil, "", http.StatusNotFound))
+
+	created := time.Date(2020, 1, 2, 15, 4, 0, 0, time.UTC)
+	for userID, expected := range map[string]string{
+		"berlin":  "2020-01-02 16:04 CET",
+		"unset":   "2020-01-02 15:04 UTC",
+		"unknown": "2020-01-02 15:04 UTC",
+	} {
+		if actual := formatTimestamp(created, p.userLocation(userID)); actual != expected {
+			t.Errorf("%s: expected %q, got %q", userID, expected, actual)
+		}
+	}
+}
+
+func TestInstanceClientIsCached(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer ct.close()
+	instance, err := ct.p.getConfiguration().getInstance(defaultInstanceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every caller gets its own copy of the cached client, sending its own request ID.
+	cached := func(requestID string) *Client {
+		client, err := ct.p.getInstanceClient("user", instance, requestID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.requestID != requestID {
+			t.Errorf("expected the client to send %q, got %q", requestID, client.requestID)
+		}
+		return ct.p.clientCache[tokenKey("user", defaultInstanceName)].client
+	}
+
+	first := cached("request-1")
+	if second := cached("request-2"); first != second {
+		t.Error("expected the client to be reused")
+	}
+
+	if err = ct.p.setToken("user", defaultInstanceName, "new token"); err != nil {
+		t.Fatal(err)
+	}
+	if third := cached("request-3"); third == first {
+		t.Error("expected a new client for a new token")
+	}
+}
+
+func TestDetailsPublic(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"description":"Printer on fire","status":"open"}}`))
+	})
+	defer ct.close()
+
+	var posted *model.Post
+	ct.api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		posted = args.Get(0).(*model.Post)
+	}).Return(&model.Post{}, nil)
+
+	if message := ct.execute(t, "/zendesk details --public"); !strings.HasPrefix(message, "Please specify a case number") {
+		t.Errorf("unexpected response %q", message)
+	}
+	if message := ct.execute(t, "/zendesk details 1 --pubic"); message != "Unknown flag `--pubic`, only `--public` is supported." {
+		t.Errorf("unexpected response %q", message)
+	}
+
+	if _, appErr := ct.p.ExecuteCommand(nil, &model.CommandArgs{UserId: "user", ChannelId: "channel", Command: "/zendesk details 1 --public"}); appErr != nil {
+		t.Fatal(appErr)
+	}
+	if posted == nil || posted.ChannelId != "channel" || len(posted.Attachments()) != 1 {
+		t.Errorf("expected the details to be posted to the channel, got %+v", posted)
+	}
+}
+
+func TestDetailsReplacesProgress(t *testing.T) {
+	found := true
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"description":"Printer on fire","status":"open"}}`))
+	})
+	defer ct.close()
+	ct.api.On("GetUser", "user").Return(&model.User{}, nil)
+
+	ct.execute(t, "/zendesk details 1")
+	if len(ct.responses) != 1 || len(ct.responses[0].Attachments()) != 1 {
+		t.Errorf("expected the progress message to be replaced by the details, got %+v", ct.responses)
+	}
+
+	found = false
+	ct.execute(t, "/zendesk details 1")
+	if len(ct.responses) != 1 || ct.responses[0].Message != "Ticket #1 was not found." {
+		t.Errorf("expected the progress message to be deleted, got %+v", ct.responses)
+	}
+}
+
+func TestUpdateWithFiles(t *testing.T) {
+	var uploaded string
+	var comment zendesk.TicketComment
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/uploads.json":
+			uploaded = r.URL.Query().Get("filename") + " " + r.Header.Get("Content-Type")
+			_, _ = w.Write([]byte(`{"upload":{"token":"upload-token"}}`))
+		default:
+			var in struct {
+				Ticket zendesk.Ticket `json:"ticket"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			comment = *in.Ticket.Comment
+			_, _ = w.Write([]byte(`{"ticket":{"id":1}}`))
+		}
+	})
+	defer ct.close()
+
+	ct.api.On("GetFileInfo", "own").Return(&model.FileInfo{Name: "log.txt", MimeType: "text/plain", CreatorId: "user", Size: 3}, nil)
+	ct.api.On("GetFile", "own").Return([]byte("log"), nil)
+	ct.api.On("GetFileInfo", "huge").Return(&model.FileInfo{Name: "dump.bin", CreatorId: "user", Size: maxAttachmentSize + 1}, nil)
+	ct.api.On("GetFileInfo", "private").Return(&model.FileInfo{Name: "secret.pdf", CreatorId: "other", PostId: "post"}, nil)
+	ct.api.On("GetPost", "post").Return(&model.Post{ChannelId: "secret"}, nil)
+	ct.api.On("HasPermissionToChannel", "user", "secret", model.PERMISSION_READ_CHANNEL).Return(false)
+
+	message := ct.execute(t, "/zendesk update public 1 --file=own --file=huge --file=private see attached")
+	if uploaded != "log.txt text/plain" {
+		t.Errorf("expected the own file to be uploaded, got %q", uploaded)
+	}
+	if stringValue(comment.Body) != "see attached" || fmt.Sprint(comment.Uploads) != "[upload-token]" {
+		t.Errorf("expected the comment with the upload, got %+v", comment)
+	}
+	if !strings.HasSuffix(message, "These files could not be attached: `dump.bin` (larger than 50 MB), `private` (file not found)") {
+		t.Errorf("unexpected response %q", message)
+	}
+}
+
+func TestOrganizationFields(t *testing.T) {
+	T := newTestPlugin(&plugintest.API{}).T("user")
+	if fields := organizationFields(T, nil); len(fields) != 0 {
+		t.Errorf("expected no fields without an organization, got %v", fields)
+	}
+	if fields := organizationFields(T, &zendesk.Organization{Name: zendesk.String("Acme")}); len(fields) != 0 {
+		t.Errorf("expected no fields without organization data, got %v", fields)
+	}
+
+	fields := organizationFields(T, &zendesk.Organization{
+		DomainNames:        &[]string{"acme.com", "acme.io"},
+		OrganizationFields: map[string]interface{}{"tier": "gold", "plan": nil, "region": "eu"},
+	})
+	var actual []string
+	for _, field := range fields {
+		actual = append(actual, field.Title+": "+fmt.Sprint(field.Value))
+	}
+	if fmt.Sprint(actual) != "[Domains: acme.com, acme.io Tier: gold]" {
+		t.Errorf("unexpected fields %v", actual)
+	}
+}
+
+func TestParseTicketWithoutDescription(t *testing.T) {
+	client, err := newOAuthClient("https://example.zendesk.com", "token", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(&plugintest.API{})
+	attachments, err := p.parseTicket(p.T("user"), client, &zendesk.Ticket{ID: zendesk.Int(1), Status: zendesk.String("open")}, nil, nil, time.UTC, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 1 || strings.Contains(attachments[0].Text, "\n") {
+		t.Errorf("expected a card without a description, got %+v", attachments)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		s        string
+		max      int
+		expected string
+	}{
+		"short":              {s: "hello", max: 5, expected: "hello"},
+		"ascii":              {s: "hello world", max: 8, expected: "hello..."},
+		"accents at the end": {s: "café crème", max: 10, expected: "café crème"},
+		"accents cut":        {s: "crème brûlée", max: 9, expected: "crème ..."},
+		"emoji at the cut":   {s: "ab😀😀😀😀", max: 5, expected: "ab..."},
+		"emoji kept":         {s: "😀😀😀😀😀", max: 4, expected: "😀..."},
+		"tiny max":           {s: "日本語テキスト", max: 2, expected: "日本"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			actual := truncate(tc.s, tc.max)
+			if actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+			if !utf8.ValidString(actual) {
+				t.Errorf("%q is not valid UTF-8", actual)
+			}
+		})
+	}
+}
+
+func TestSolveAndReopen(t *testing.T) {
+	status := "closed"
+	var update zendesk.Ticket
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var in struct {
+				Ticket zendesk.Ticket `json:"ticket"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			update = in.Ticket
+			status = *in.Ticket.Status
+		}
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"` + status + `"}}`))
+	})
+	defer ct.close()
+
+	if message := ct.execute(t, "/zendesk solve 1"); !strings.Contains(message, "is closed and can't be changed anymore") {
+		t.Errorf("unexpected response %q", message)
+	}
+	if update.Status != nil {
+		t.Fatalf("expected closed tickets not to be updated, got %+v", update)
+	}
+
+	status = "open"
+	message := ct.execute(t, "/zendesk solve 1 Fixed in\nthe latest release.")
+	if update.Comment == nil || !*update.Comment.Public || *update.Comment.Body != "Fixed in\nthe latest release." {
+		t.Errorf("expected a public closing comment, got %+v", update.Comment)
+	}
+	if !strings.Contains(message, "changed from open to **solved**") {
+		t.Errorf("unexpected response %q", message)
+	}
+
+	if message := ct.execute(t, "/zendesk reopen 1"); !strings.Contains(message, "changed from solved to **open**") {
+		t.Errorf("unexpected response %q", message)
+	}
+}
+
+func TestSolveConflict(t *testing.T) {
+	var safeUpdates int
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var in struct {
+				Ticket map[string]interface{} `json:"ticket"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			if in.Ticket["safe_update"] == true {
+				safeUpdates++
+			}
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"error":"UpdateConflict"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"open","updated_at":"2020-05-01T10:00:00Z"}}`))
+	})
+	defer ct.close()
+
+	ct.execute(t, "/zendesk status 1")
+	message := ct.execute(t, "/zendesk solve 1")
+	if safeUpdates != 1 || !strings.HasPrefix(message, "Ticket #1 was changed by someone else") {
+		t.Errorf("expected the conflicting safe update to be reported, got %d safe updates and %q", safeUpdates, message)
+	}
+}
+
+func TestWatchAndUnwatch(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ticket":{"id":1}}`))
+	})
+	defer ct.close()
+
+	if message := ct.execute(t, "/zendesk watch 1"); !strings.Contains(message, "is now watching ticket") {
+		t.Errorf("unexpected response %q", message)
+	}
+	if message := ct.execute(t, "/zendesk watch 1"); !strings.Contains(message, "is already watching ticket") {
+		t.Errorf("unexpected response %q", message)
+	}
+
+	ct.kv["watch_1"] = []byte(`["other","channel"]`)
+	if message := ct.execute(t, "/zendesk unwatch 1"); message != "This channel stopped watching ticket #1." {
+		t.Errorf("unexpected response %q", message)
+	}
+	if watchers := string(ct.kv["watch_1"]); watchers != `["other"]` {
+		t.Errorf("expected the other channel to keep watching, got %s", watchers)
+	}
+	if message := ct.execute(t, "/zendesk unwatch 1"); message != "This channel isn't watching ticket #1." {
+		t.Errorf("unexpected response %q", message)
+	}
+}
+
+func TestWatchRetriesConcurrentChanges(t *testing.T) {
+	ct := newCommandTest(t, nil)
+	defer ct.close()
+
+	// Another server adds a watcher between the first read and the write of the watchers.
+	reads := 0
+	ct.api.ExpectedCalls = append([]*mock.Call{ct.api.On("KVGet", "watch_1").Return(func(key string) []byte {
+		reads++
+		if reads == 1 {
+			data := ct.kv[key]
+			ct.kv[key] = []byte(`["other"]`)
+			return data
+		}
+		return ct.kv[key]
+	}, nil)}, ct.api.ExpectedCalls...)
+
+	updated, err := ct.p.setTicketWatcher(defaultInstanceName, 1, "channel", true)
+	if err != nil || !updated {
+		t.Fatalf("expected the watcher to be added, got %v, %v", updated, err)
+	}
+	if watchers := string(ct.kv["watch_1"]); watchers != `["other","channel"]` {
+		t.Errorf("expected the concurrently added watcher to be kept, got %s", watchers)
+	}
+	if reads != 2 {
+		t.Errorf("expected the watchers to be read again after the conflict, got %d reads", reads)
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/users/me.json" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"user":{"id":5,"name":"Jane Doe","email":"jane@example.com","role":"agent"}}`))
+	})
+	defer ct.close()
+
+	expected := "You are connected to " + ct.server.URL + " as **Jane Doe** (jane@example.com), role: agent."
+	if message := ct.execute(t, "/zendesk whoami"); message != expected {
+		t.Errorf("unexpected response %q", message)
+	}
+
+	delete(ct.kv, "user"+tokenKeySuffix)
+	ct.api.On("GetUser", "user").Return(nil, model.NewAppError("GetUser", "not_found", nil, "", http.StatusNotFound))
+	if message := ct.execute(t, "/zendesk whoami"); !strings.Contains(message, "/zendesk connect") {
+		t.Errorf("expected to be asked to connect, got %q", message)
+	}
+}
+
+func TestRequireConnectedPromptsWithLink(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s", r.URL.Path)
+	})
+	defer ct.close()
+	ct.api.On("GetUser", "user").Return(&model.User{Id: "user", Username: "jane"}, nil)
+	ct.api.On("GetConfig").Return(&model.Config{})
+	delete(ct.kv, "user"+tokenKeySuffix)
+
+	// Every handler prompts the same way.
+	for _, command := range []string{"/zendesk status 1", "/zendesk details 1", "/zendesk update 1 Hi", "/zendesk watch 1", "/zendesk my groups", "/zendesk create"} {
+		message := ct.execute(t, command)
+		if message != "Please connect to Zendesk first. [Click here to link your Zendesk account - /jane/]("+ct.p.GetPluginURL()+routeUserConnect+")" {
+			t.Errorf("%s: unexpected prompt %q", command, message)
+		}
+	}
+
+	// Without an OAuth client users are asked for an API token.
+	ct.p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: ct.server.URL})
+	if message := ct.execute(t, "/zendesk status 1"); !strings.Contains(message, "`/zendesk connect token <email> <api-token>`") {
+		t.Errorf("expected to be asked for an API token, got %q", message)
+	}
+}
+
+func TestDetailsCustomFields(t *testing.T) {
+	fieldRequests := 0
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/ticket_fields/11.json":
+			fieldRequests++
+			_, _ = w.Write([]byte(`{"ticket_field":{"id":11,"title":"Product Area"}}`))
+		case "/api/v2/ticket_fields/12.json":
+			fieldRequests++
+			_, _ = w.Write([]byte(`{"ticket_field":{"id":12,"title":"Severity"}}`))
+		default:
+			_, _ = w.Write([]byte(`{"ticket":{"id":1,"custom_fields":[
+				{"id":10,"value":"hidden"},{"id":12,"value":["sev_1","sev_2"]},{"id":11,"value":"billing"},{"id":13,"value":null}]}}`))
+		}
+	})
+	defer ct.close()
+	ct.p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: ct.server.URL, TicketCustomFields: "11, 12,13,nope"})
+	ct.api.On("GetUser", "user").Return(&model.User{}, nil)
+
+	for i := 0; i < 2; i++ {
+		ct.execute(t, "/zendesk details 1")
+		attachments := ct.responses[len(ct.responses)-1].Attachments()
+		var fields []string
+		for _, field := range attachments[0].Fields {
+			fields = append(fields, field.Title+"="+field.Value.(string))
+		}
+		if strings.Join(fields, "; ") != "Product Area=billing; Severity=sev_1, sev_2" {
+			t.Errorf("unexpected custom fields %v", fields)
+		}
+	}
+	if fieldRequests != 2 {
+		t.Errorf("expected the field definitions to be cached, got %d requests", fieldRequests)
+	}
+}
+
+func TestDetailsInternalNote(t *testing.T) {
+	role := "agent"
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/users/me.json":
+			_, _ = w.Write([]byte(`{"user":{"id":5,"role":"` + role + `"}}`))
+		case "/api/v2/tickets/1/comments.json":
+			_, _ = w.Write([]byte(`{"comments":[
+				{"id":3,"public":true,"body":"We are on it."},
+				{"id":2,"public":false,"body":"Customer is on the legacy plan."}]}`))
+		default:
+			_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"open"}}`))
+		}
+	})
+	defer ct.close()
+	ct.api.On("GetUser", "user").Return(&model.User{}, nil)
+	var posted *model.Post
+	ct.api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		posted = args.Get(0).(*model.Post)
+	}).Return(&model.Post{}, nil)
+	lastField := func(post *model.Post) string {
+		fields := post.Attachments()[0].Fields
+		field := fields[len(fields)-1]
+		return fmt.Sprintf("%s=%v", field.Title, field.Value)
+	}
+
+	ct.execute(t, "/zendesk details 1")
+	if field := lastField(ct.responses[0]); field != "Status=open" {
+		t.Errorf("expected no internal note until enabled, got %s", field)
+	}
+
+	ct.p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: ct.server.URL, ShowInternalNote: true})
+	ct.execute(t, "/zendesk details 1")
+	if field := lastField(ct.responses[0]); field != "Latest internal note=Customer is on the legacy plan." {
+		t.Errorf("expected the latest internal note, got %s", field)
+	}
+
+	if _, appErr := ct.p.ExecuteCommand(nil, &model.CommandArgs{UserId: "user", ChannelId: "channel", Command: "/zendesk details 1 --public"}); appErr != nil {
+		t.Fatal(appErr)
+	}
+	if posted == nil {
+		t.Fatal("expected the details to be posted to the channel")
+	}
+	if field := lastField(posted); field != "Status=open" {
+		t.Errorf("expected no internal note in a card shared with the channel, got %s", field)
+	}
+
+	role = "end-user"
+	ct.execute(t, "/zendesk details 1")
+	if field := lastField(ct.responses[0]); field != "Status=open" {
+		t.Errorf("expected no internal note for an end user, got %s", field)
+	}
+}
+
+func TestAttachmentColor(t *testing.T) {
+	colors := (&configuration{TicketColors: "pending #ABC\nhigh #123456\nnormal blue\n\n"}).getTicketColors()
+
+	for _, tc := range []struct {
+		status, priority *string
+		expected         string
+	}{
+		{zendesk.String("open"), zendesk.String("urgent"), "#d24b4e"},
+		{zendesk.String("solved"), zendesk.String("urgent"), "#3db887"},
+		{zendesk.String("Pending"), nil, "#ABC"},
+		{zendesk.String("open"), zendesk.String("high"), "#123456"},
+		{zendesk.String("open"), zendesk.String("normal"), defaultTicketColor},
+		{nil, nil, defaultTicketColor},
+	} {
+		if color := attachmentColor(&zendesk.Ticket{Status: tc.status, Priority: tc.priority}, colors); color != tc.expected {
+			t.Errorf("expected %s for %s/%s, got %s", tc.expected, stringValue(tc.status), stringValue(tc.priority), color)
+		}
+	}
+}
+
+func TestStatusOfSeveralTickets(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/tickets/101.json":
+			_, _ = w.Write([]byte(`{"ticket":{"id":101,"status":"open"}}`))
+		case "/api/v2/tickets/102.json":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"RecordNotFound","description":"Not found"}`))
+		default:
+			_, _ = w.Write([]byte(`{"ticket":{"id":103,"status":"solved"}}`))
+		}
+	})
+	defer ct.close()
+
+	message := ct.execute(t, "/zendesk status 101 102 abc 103")
+	lines := strings.Split(strings.TrimSpace(message), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected one line per ticket, got %q", message)
+	}
+	if !strings.HasPrefix(lines[0], "* [101](") || !strings.HasSuffix(lines[0], ": **open**") {
+		t.Errorf("unexpected line %q", lines[0])
+	}
+	if lines[1] != "* `102`: ticket #102 was not found" {
+		t.Errorf("expected the missing ticket to be reported on its line, got %q", lines[1])
+	}
+	if lines[2] != "* `abc`: not a case number" {
+		t.Errorf("unexpected line %q", lines[2])
+	}
+	if !strings.HasSuffix(lines[3], ": **solved**") {
+		t.Errorf("unexpected line %q", lines[3])
+	}
+}
+
+func TestRespondErrorRateLimited(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	defer ct.close()
+
+	if message := ct.execute(t, "/zendesk status 1"); message != "Zendesk is rate limiting us, try again shortly." {
+		t.Errorf("unexpected response %q", message)
+	}
+}
+
+func TestRespondErrorTicketNotFound(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":"RecordNotFound","description":"Not found"}`))
+	})
+	defer ct.close()
+
+	for _, command := range []string{
+		"/zendesk status 99999999",
+		"/zendesk details 99999999",
+		"/zendesk solve 99999999",
+		"/zendesk priority 99999999 high",
+	} {
+		if message := ct.execute(t, command); message != "Ticket #99999999 was not found." {
+			t.Errorf("unexpected response to %q: %q", command, message)
+		}
+	}
+}
+
+func TestUpdateWithDefaultVisibility(t *testing.T) {
+	var comment *zendesk.TicketComment
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Ticket zendesk.Ticket `json:"ticket"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		comment = in.Ticket.Comment
+		_, _ = w.Write([]byte(`{"ticket":{"id":1}}`))
+	})
+	defer ct.close()
+
+	if message := ct.execute(t, "/zendesk update 1 Waiting for the logs."); message != "Private comment [Waiting for the logs.] was added to ticket #1" {
+		t.Errorf("unexpected response %q", message)
+	}
+	if comment == nil || *comment.Public || *comment.Body != "Waiting for the logs." {
+		t.Errorf("expected a private comment by default, got %+v", comment)
+	}
+	if message := ct.execute(t, "/zendesk help"); !strings.Contains(message, "as set in the plugin settings, currently **private**") {
+		t.Errorf("expected the help to show the default visibility, got %q", message)
+	}
+
+	ct.p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: ct.server.URL, DefaultCommentVisibility: "public"})
+	if message := ct.execute(t, "/zendesk update 1 Fixed."); message != "Public comment [Fixed.] was added to ticket #1" {
+		t.Errorf("unexpected response %q", message)
+	}
+	if message := ct.execute(t, "/zendesk update private 1 Internal."); message != "Private comment [Internal.] was added to ticket #1" {
+		t.Errorf("unexpected response %q", message)
+	}
+	if *comment.Public || *comment.Body != "Internal." {
+		t.Errorf("expected the explicit visibility to win, got %+v", comment)
+	}
+}
+
+func TestHelpReflectsState(t *testing.T) {
+	ct := newCommandTest(t, nil)
+	defer ct.close()
+
+	message := ct.execute(t, "/zendesk help")
+	if strings.Contains(message, "not connected") || strings.Contains(message, "`/zendesk connect`") || !strings.Contains(message, "`/zendesk disconnect`") {
+		t.Errorf("expected the help of a connected user, got %q", message)
+	}
+	if strings.Contains(message, "/zendesk watch") {
+		t.Errorf("expected watch to be hidden while the webhook is disabled, got %q", message)
+	}
+
+	delete(ct.kv, "user"+tokenKeySuffix)
+	ct.p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: ct.server.URL, WebhookSecret: "s3cret"})
+	message = ct.execute(t, "/zendesk help")
+	if !strings.HasPrefix(message, "###### Mattermost Zendesk Plugin - Slash Command Help\n\n**You are not connected to Zendesk yet") || strings.Contains(message, "`/zendesk disconnect`") {
+		t.Errorf("expected the help to ask to connect first, got %q", message)
+	}
+	if !strings.Contains(message, "`/zendesk watch <case-number>`") {
+		t.Errorf("expected watch to be shown once the webhook is enabled, got %q", message)
+	}
+	if examples := ct.execute(t, "/zendesk help examples"); strings.Contains(examples, "/zendesk disconnect") {
+		t.Errorf("expected the examples to leave out disconnect, got %q", examples)
+	}
+}
+
+func TestCommandsAreAudited(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"open"}}`))
+	})
+	defer ct.close()
+	ct.api.On("GetConfig").Return(&model.Config{})
+
+	ct.execute(t, "/zendesk --instance=EU help")
+	ct.execute(t, "/zendesk status 1 2")
+	ct.execute(t, "/zendesk update private 1 The customer 42 is angry")
+	ct.execute(t, "/zendesk update public 3 --status=solved Fixed in 42")
+	ct.execute(t, "/zendesk macros apply 360001 4")
+	ct.execute(t, "/zendesk merge 5 6 Same as 7")
+
+	expected := []string{"help eu ", "status default 1,2", "update private default 1", "update public default 3",
+		"macros apply default 4", "merge default 5,6"}
+	if strings.Join(ct.audit, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected %q to be audited, got %q", expected, ct.audit)
+	}
+}
+
+func TestHandlerPanicIsRecovered(t *testing.T) {
+	ct := newCommandTest(t, nil)
+	defer ct.close()
+	ct.api.On("LogError", "recovered from a panic in a zendesk command", "command", "boom", "user_id", "user",
+		"error", "runtime error: invalid memory address or nil pointer dereference", "stack", mock.Anything).Return().Once()
+
+	handler := CommandHandler{
+		handlers: map[string]CommandHandlerFunc{
+			"boom": func(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+				var ticket *zendesk.Ticket
+				return p.responsef(commandArgs, "%s", *ticket.Status)
+			},
+		},
+		defaultHandler: executeZendeskDefault,
+	}
+	handler.Handle(ct.p, nil, &model.CommandArgs{UserId: "user", ChannelId: "channel", Command: "/zendesk boom"}, "boom")
+
+	if len(ct.responses) != 1 || ct.responses[0].Message != "Something went wrong processing your command." {
+		t.Errorf("expected the recovery message, got %v", ct.responses)
+	}
+	ct.api.AssertExpectations(t)
+}
+
+func TestLink(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"subject":"Printer on fire","description":"It smells.","status":"solved"}}`))
+	})
+	defer ct.close()
+
+	var posted *model.Post
+	ct.api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		posted = args.Get(0).(*model.Post)
+	}).Return(&model.Post{}, nil)
+
+	if _, appErr := ct.p.ExecuteCommand(nil, &model.CommandArgs{UserId: "user", ChannelId: "channel", Command: "/zendesk link 1"}); appErr != nil {
+		t.Fatal(appErr)
+	}
+	if posted == nil || posted.ChannelId != "channel" || len(posted.Attachments()) != 1 {
+		t.Fatalf("expected the link to be posted to the channel, got %+v", posted)
+	}
+	attachment := posted.Attachments()[0]
+	if attachment.Title != "#1 Printer on fire" || attachment.TitleLink != ct.server.URL+"/agent/tickets/1" || attachment.Text != "" {
+		t.Errorf("unexpected card %+v", attachment)
+	}
+	if len(attachment.Fields) != 1 || attachment.Fields[0].Value != "solved" || attachment.Color != "#3db887" {
+		t.Errorf("expected only the status, got %+v", attachment.Fields)
+	}
+}
+
+func TestRequester(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/tickets/1.json":
+			_, _ = w.Write([]byte(`{"ticket":{"id":1,"requester_id":5}}`))
+		case "/api/v2/tickets/2.json":
+			_, _ = w.Write([]byte(`{"ticket":{"id":2,"requester_id":6}}`))
+		case "/api/v2/users/5.json":
+			_, _ = w.Write([]byte(`{"user":{"id":5,"name":"Jane Doe","email":"jane@example.com","phone":"+1 555 0100","time_zone":"Berlin","organization_id":9}}`))
+		case "/api/v2/users/6.json":
+			_, _ = w.Write([]byte(`{"user":{"id":6,"name":"Bob","email":"bob@example.com","time_zone":"UTC"}}`))
+		case "/api/v2/organizations/9.json":
+			_, _ = w.Write([]byte(`{"organization":{"id":9,"name":"Acme"}}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	})
+	defer ct.close()
+
+	fields := func(command string) string {
+		ct.execute(t, command)
+		attachments := ct.responses[len(ct.responses)-1].Attachments()
+		var values []string
+		for _, field := range attachments[0].Fields {
+			values = append(values, field.Title+"="+field.Value.(string))
+		}
+		return attachments[0].Title + ": " + strings.Join(values, ", ")
+	}
+
+	if card := fields("/zendesk requester 1"); card != "Jane Doe: Email=jane@example.com, Phone=+1 555 0100, Time Zone=Berlin, Organization=Acme" {
+		t.Errorf("unexpected card %q", card)
+	}
+	if card := fields("/zendesk requester 2"); card != "Bob: Email=bob@example.com, Time Zone=UTC" {
+		t.Errorf("expected the missing phone and organization to be left out, got %q", card)
+	}
+}
+
+func TestUsageHintsNameTheirCommand(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s", r.URL.Path)
+	})
+	defer ct.close()
+
+	for _, ci := range zendeskCommands {
+		// Commands without required arguments have no usage hint to show.
+		if !strings.HasPrefix(ci.args, "<") {
+			continue
+		}
+		// create opens a dialog when run without arguments.
+		if ci.trigger == "create" {
+			continue
+		}
+		command := "/zendesk " + ci.trigger
+		if message := ct.execute(t, command); !strings.Contains(message, "`"+ci.usage()+"`") {
+			t.Errorf("%s: expected the hint `%s`, got %q", command, ci.usage(), message)
+		}
+	}
+}
+
+func TestConnectToken(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/users/me.json" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		if username, password, _ := r.BasicAuth(); username != "jane@example.com/token" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"Couldn't authenticate you"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"user":{"id":5,"name":"Jane Doe","email":"jane@example.com","role":"agent"}}`))
+	})
+	defer ct.close()
+	delete(ct.kv, "user"+tokenKeySuffix)
+
+	if message := ct.execute(t, "/zendesk connect token jane@example.com wrong"); message != "Zendesk rejected the email or the API token." {
+		t.Errorf("unexpected response %q", message)
+	}
+	if _, ok := ct.kv["user"+tokenKeySuffix]; ok {
+		t.Error("a rejected API token must not be stored")
+	}
+
+	if message := ct.execute(t, "/zendesk connect token jane@example.com secret"); message != "Connected to "+ct.server.URL+" as **Jane Doe**." {
+		t.Errorf("unexpected response %q", message)
+	}
+
+	// Later commands authenticate with the stored API token.
+	expected := "You are connected to " + ct.server.URL + " as **Jane Doe** (jane@example.com), role: agent."
+	if message := ct.execute(t, "/zendesk whoami"); message != expected {
+		t.Errorf("unexpected response %q", message)
+	}
+}
+
+func TestSideComment(t *testing.T) {
+	conversations := `{"side_conversations":[]}`
+	var posted []string
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v2/tickets/1.json":
+			_, _ = w.Write([]byte(`{"ticket":{"id":1,"subject":"Outage"}}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v2/tickets/1/side_conversations":
+			_, _ = w.Write([]byte(conversations))
+		case r.Method == http.MethodPost:
+			body, _ := ioutil.ReadAll(r.Body)
+			posted = append(posted, r.URL.Path+" "+string(body))
+			_, _ = w.Write([]byte(`{"side_conversation":{"id":"abc"}}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+	defer ct.close()
+
+	if message := ct.execute(t, "/zendesk sidecomment 1 Any news?"); !strings.Contains(message, "has no open side conversation") ||
+		!strings.HasSuffix(message, "`/zendesk sidecomment 1 --to=<email> Any news?`.") {
+		t.Errorf("expected to be offered to start a side conversation, got %q", message)
+	}
+
+	ct.execute(t, "/zendesk sidecomment 1 --to=vendor@example.com Any news?")
+	expected := `/api/v2/tickets/1/side_conversations {"message":{"subject":"Outage","body":"Any news?","to":[{"email":"vendor@example.com"}]}}`
+	if len(posted) != 1 || posted[0] != expected {
+		t.Errorf("expected a new side conversation, got %v", posted)
+	}
+
+	// The most recently updated open side conversation gets the reply.
+	conversations = `{"side_conversations":[
+		{"id":"old","subject":"Old","state":"open","updated_at":"2020-01-01T00:00:00Z"},
+		{"id":"new","subject":"New","state":"open","updated_at":"2020-02-01T00:00:00Z"},
+		{"id":"closed","subject":"Closed","state":"closed","updated_at":"2020-03-01T00:00:00Z"}]}`
+	posted = nil
+	message := ct.execute(t, "/zendesk sidecomment 1 Any news?\nThanks")
+	expected = `/api/v2/tickets/1/side_conversations/new/reply {"message":{"body":"Any news?\nThanks"}}`
+	if len(posted) != 1 || posted[0] != expected || !strings.HasPrefix(message, "Posted to the side conversation **New**") {
+		t.Errorf("expected a reply to the newest open side conversation, got %v %q", posted, message)
+	}
+}
+
+func TestMacros(t *testing.T) {
+	var update struct {
+		Ticket struct {
+			Status       string                `json:"status"`
+			Comment      zendesk.TicketComment `json:"comment"`
+			SafeUpdate   bool                  `json:"safe_update"`
+			UpdatedStamp time.Time             `json:"updated_stamp"`
+		} `json:"ticket"`
+	}
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v2/macros/active.json":
+			_, _ = w.Write([]byte(`{"macros":[{"id":11,"title":"Close and redirect"},{"id":12,"title":"Downgrade"}],"count":2}`))
+		case r.URL.Path == "/api/v2/tickets/5/macros/11/apply.json":
+			_, _ = w.Write([]byte(`{"result":{"ticket":{"id":5,"status":"solved"},"comment":{"body":"Thanks for reaching out!","public":true}}}`))
+		case r.URL.Path == "/api/v2/tickets/5/macros/13/apply.json":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPut:
+			_ = json.NewDecoder(r.Body).Decode(&update)
+			_, _ = w.Write([]byte(`{"ticket":{"id":5,"status":"solved"}}`))
+		default:
+			_, _ = w.Write([]byte(`{"ticket":{"id":5,"status":"open","updated_at":"2020-01-02T10:00:00Z"}}`))
+		}
+	})
+	defer ct.close()
+
+	message := ct.execute(t, "/zendesk macros list")
+	if !strings.HasSuffix(message, ":\n* `11` Close and redirect\n* `12` Downgrade\n") {
+		t.Errorf("unexpected response %q", message)
+	}
+
+	if message := ct.execute(t, "/zendesk macros apply 13 5"); message != "Macro 13 was not found, see `/zendesk macros list`." {
+		t.Errorf("unexpected response %q", message)
+	}
+
+	ct.execute(t, "/zendesk macros apply 11 5")
+	if update.Ticket.Status != "solved" || stringValue(update.Ticket.Comment.Body) != "Thanks for reaching out!" {
+		t.Errorf("expected the changes of the macro to be saved, got %+v", update.Ticket)
+	}
+	if !update.Ticket.SafeUpdate || !update.Ticket.UpdatedStamp.Equal(time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected a safe update of the loaded ticket, got %+v", update.Ticket)
+	}
+}
+
+func TestCommandRequestIDIsSentToZendesk(t *testing.T) {
+	var requestIDs []string
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		requestIDs = append(requestIDs, r.Header.Get(requestIDHeader))
+		switch r.URL.Path {
+		case "/api/v2/users/me.json":
+			_, _ = w.Write([]byte(`{"user":{"id":5}}`))
+		case "/api/v2/search.json":
+			_, _ = w.Write([]byte(`{"results":[],"count":0}`))
+		default:
+			_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"open"}}`))
+		}
+	})
+	defer ct.close()
+
+	// The status is loaded by go-zendesk, the search is sent by Client itself.
+	for _, command := range []string{"/zendesk status 1", "/zendesk list", "/zendesk watch 1", "/zendesk my groups"} {
+		requestIDs = nil
+		if _, appErr := ct.p.ExecuteCommand(&plugin.Context{RequestId: "request-1"}, &model.CommandArgs{UserId: "user", ChannelId: "channel", Command: command}); appErr != nil {
+			t.Fatal(appErr)
+		}
+		if len(requestIDs) == 0 {
+			t.Errorf("expected %q to call Zendesk", command)
+		}
+		for _, requestID := range requestIDs {
+			if requestID != "request-1" {
+				t.Errorf("expected the request ID of %q to be sent, got %v", command, requestIDs)
+				break
+			}
+		}
+	}
+
+	requestIDs = nil
+	ct.execute(t, "/zendesk status 1")
+	if len(requestIDs) != 1 || len(requestIDs[0]) != 26 {
+		t.Errorf("expected a generated request ID without a request, got %v", requestIDs)
+	}
+
+	ct.p.commandRequestIDs.Range(func(key, value interface{}) bool {
+		t.Errorf("expected no request ID to be left behind, got %v", value)
+		return true
+	})
+}
+
+func TestPrivateCommentMentionsAgents(t *testing.T) {
+	var update struct {
+		Ticket struct {
+			Comment                 zendesk.TicketComment `json:"comment"`
+			AdditionalCollaborators []int64               `json:"additional_collaborators"`
+		} `json:"ticket"`
+	}
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/users/search.json":
+			switch r.URL.Query().Get("query") {
+			case "email:agent@example.com":
+				_, _ = w.Write([]byte(`{"users":[{"id":7,"email":"agent@example.com","role":"agent"}]}`))
+			case "email:customer@example.com":
+				_, _ = w.Write([]byte(`{"users":[{"id":8,"email":"customer@example.com","role":"end-user"}]}`))
+			default:
+				_, _ = w.Write([]byte(`{"users":[]}`))
+			}
+		default:
+			_ = json.NewDecoder(r.Body).Decode(&update)
+			_, _ = w.Write([]byte(`{"ticket":{"id":1}}`))
+		}
+	})
+	defer ct.close()
+
+	message := ct.execute(t, "/zendesk update private 1 @agent@example.com, @customer@example.com and @ghost@example.com please check, cc @Agent@example.com")
+	if body := stringValue(update.Ticket.Comment.Body); !strings.HasPrefix(body, "@agent@example.com, @customer@example.com") {
+		t.Errorf("expected the mentions to be left in the comment, got %q", body)
+	}
+	if len(update.Ticket.AdditionalCollaborators) != 1 || update.Ticket.AdditionalCollaborators[0] != 7 {
+		t.Errorf("expected the agent to follow the ticket, got %v", update.Ticket.AdditionalCollaborators)
+	}
+	if !strings.HasSuffix(message, "\nNotified agents: agent@example.com\nThese mentions were skipped: `customer@example.com` (not an agent), `ghost@example.com` (no Zendesk user)") {
+		t.Errorf("unexpected response %q", message)
+	}
+
+	update.Ticket.AdditionalCollaborators = nil
+	ct.execute(t, "/zendesk update public 1 thanks @agent@example.com")
+	if len(update.Ticket.AdditionalCollaborators) != 0 {
+		t.Errorf("expected public comments not to add followers, got %v", update.Ticket.AdditionalCollaborators)
+	}
+}
+
+func TestCommandsRestrictedToChannels(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"open"}}`))
+	})
+	defer ct.close()
+	ct.api.On("GetChannel", "channel").Return(&model.Channel{Id: "channel", Name: "town-square"}, nil)
+	ct.api.On("GetTeam", "team").Return(&model.Team{Id: "team", Name: "sales"}, nil)
+
+	run := func(config configuration) string {
+		config.EncryptionKey, config.ZendeskURL = testEncryptionKey, ct.server.URL
+		ct.p.setConfiguration(&config)
+		ct.responses = nil
+		if _, appErr := ct.p.ExecuteCommand(nil, &model.CommandArgs{UserId: "user", ChannelId: "channel", TeamId: "team", Command: "/zendesk status 1"}); appErr != nil {
+			t.Fatal(appErr)
+		}
+		return ct.responses[len(ct.responses)-1].Message
+	}
+
+	for name, tc := range map[string]struct {
+		config  configuration
+		allowed bool
+	}{
+		"everywhere":          {config: configuration{}, allowed: true},
+		"channel by ID":       {config: configuration{AllowedChannels: "other, channel"}, allowed: true},
+		"channel by name":     {config: configuration{AllowedChannels: "support\nTown-Square"}, allowed: true},
+		"other channels":      {config: configuration{AllowedChannels: "support"}},
+		"team by name":        {config: configuration{AllowedChannels: "support", AllowedTeams: "sales"}, allowed: true},
+		"other teams":         {config: configuration{AllowedTeams: "team2 support"}},
+		"channel of the team": {config: configuration{AllowedTeams: "team"}, allowed: true},
+	} {
+		message := run(tc.config)
+		if tc.allowed && message != "open" {
+			t.Errorf("%s: expected the command to run, got %q", name, message)
+		}
+		if !tc.allowed && message != "This command isn't enabled in this channel." {
+			t.Errorf("%s: expected the command to be refused, got %q", name, message)
+		}
+	}
+}
+
+func TestPublicCommentsRestrictedToUsersAndRoles(t *testing.T) {
+	updates := 0
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			updates++
+		}
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"open"}}`))
+	})
+	defer ct.close()
+	roles := "system_user"
+	ct.api.On("GetUser", "user").Return(func(string) *model.User {
+		return &model.User{Id: "user", Username: "jane", Roles: roles}
+	}, nil)
+
+	configure := func(users, roles string) {
+		ct.p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: ct.server.URL, PublicCommentUsers: users, PublicCommentRoles: roles})
+	}
+
+	configure("lead, senior", "system_admin")
+	for _, command := range []string{"/zendesk update public 1 hello", "/zendesk solve 1 fixed"} {
+		if message := ct.execute(t, command); message != "You don't have permission to post public comments." {
+			t.Errorf("unexpected response to %q: %q", command, message)
+		}
+	}
+	if message := ct.execute(t, "/zendesk update private 1 hello"); !strings.HasPrefix(message, "Private comment") {
+		t.Errorf("expected private comments to be allowed, got %q", message)
+	}
+	if updates != 1 {
+		t.Errorf("expected only the private comment to be posted, got %d updates", updates)
+	}
+
+	roles = "system_user system_admin"
+	ct.execute(t, "/zendesk update public 1 hello")
+	roles = "system_user"
+	configure("user", "")
+	ct.execute(t, "/zendesk update public 1 hello")
+	configure("Jane", "")
+	ct.execute(t, "/zendesk update public 1 hello")
+	configure("", "")
+	ct.execute(t, "/zendesk update public 1 hello")
+	if updates != 5 {
+		t.Errorf("expected the allowed public comments to be posted, got %d updates", updates)
+	}
+}
+
+func TestSLA(t *testing.T) {
+	slas := `{"policy_metrics":[]}`
+	var query string
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"open","slas":` + slas + `}}`))
+	})
+	defer ct.close()
+	ct.api.On("GetUser", "user").Return(&model.User{}, nil)
+
+	message := ct.execute(t, "/zendesk sla 1")
+	if query != "include=slas" {
+		t.Errorf("expected the SLAs to be sideloaded, got query %q", query)
+	}
+	if message != "No SLA policy applies to ticket [1]("+ct.server.URL+"/agent/tickets/1)." {
+		t.Errorf("unexpected message for a ticket without SLA policy: %q", message)
+	}
+
+	soon := time.Now().Add(30 * time.Minute).UTC().Format(time.RFC3339)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	slas = `{"policy_metrics":[
+		{"metric":"next_reply_time","stage":"active","breach_at":"` + soon + `"},
+		{"metric":"first_reply_time","stage":"achieved"}]}`
+	ct.execute(t, "/zendesk sla 1")
+	attachment := ct.responses[len(ct.responses)-1].Attachments()[0]
+	if attachment.Color != slaWarningColor || !strings.Contains(attachment.Text, "Next breach: ") {
+		t.Errorf("expected a target due within the hour to be at risk, got %+v", attachment)
+	}
+	if len(attachment.Fields) != 2 || attachment.Fields[0].Title != "Next Reply Time" || attachment.Fields[1].Value != "achieved" {
+		t.Errorf("unexpected fields %+v", attachment.Fields)
+	}
+
+	slas = `{"policy_metrics":[{"metric":"requester_wait_time","stage":"active","breach_at":"` + past + `"}]}`
+	ct.execute(t, "/zendesk sla 1")
+	attachment = ct.responses[len(ct.responses)-1].Attachments()[0]
+	if attachment.Color != slaBreachedColor || !strings.Contains(attachment.Text, "Breached: Requester Wait Time") {
+		t.Errorf("expected the breached target to be reported, got %+v", attachment)
+	}
+}
+
+func TestStatusEmoji(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"status":"solved"}}`))
+	})
+	defer ct.close()
+	ct.p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: ct.server.URL, StatusEmoji: "solved :white_check_mark:"})
+
+	if message := ct.execute(t, "/zendesk status 1"); message != ":white_check_mark: solved" {
+		t.Errorf("expected the status with its emoji, got %q", message)
+	}
+}
+
+func TestResponsesStayInThread(t *testing.T) {
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ticket":{"id":1,"description":"Printer on fire","status":"open"}}`))
+	})
+	defer ct.close()
+	ct.api.On("GetUser", "user").Return(&model.User{}, nil)
+	var posted *model.Post
+	ct.api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		posted = args.Get(0).(*model.Post)
+	}).Return(&model.Post{}, nil)
+
+	for _, command := range []string{"/zendesk details 1", "/zendesk status", "/zendesk details 1 --public"} {
+		ct.responses = nil
+		if _, appErr := ct.p.ExecuteCommand(nil, &model.CommandArgs{UserId: "user", ChannelId: "channel", RootId: "thread", Command: command}); appErr != nil {
+			t.Fatal(appErr)
+		}
+		if len(ct.responses) == 0 && posted == nil {
+			t.Errorf("%s didn't respond", command)
+		}
+		for _, post := range ct.responses {
+			if post.RootId != "thread" {
+				t.Errorf("%s: expected the response to be posted in the thread, got %+v", command, post)
+			}
+		}
+	}
+	if posted == nil || posted.RootId != "thread" || len(posted.Attachments()) != 1 {
+		t.Errorf("expected the public details to be posted in the thread, got %+v", posted)
+	}
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"net/url"
+	"os"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
+	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/pkg/errors"
 )
 
@@ -26,6 +34,515 @@ type configuration struct {
 
 	// ZendeskClientID -
 	ZendeskClientID string `json:"zendeskclientid"`
+
+	// EncryptionKey is the AES-256 key used to encrypt the Zendesk tokens in the KV store.
+	EncryptionKey string `json:"encryptionkey"`
+
+	// ZendeskUser and ZendeskPassword are the Zendesk account of the plugin itself, used where no
+	// Mattermost user's connection applies, e.g. by the health route. The password is encrypted with
+	// EncryptionKey once the plugin sees it, see encryptZendeskPassword.
+	ZendeskUser     string `json:"zendeskuser"`
+	ZendeskPassword string `json:"zendeskpassword"`
+
+	// ZendeskInstances lists additional Zendesk instances, one per line in the form
+	// `<name> <url> [<client-id> <client-secret>]`.
+	ZendeskInstances string `json:"zendeskinstances"`
+
+	// TeamInstances routes the commands of a Mattermost team to a Zendesk instance, one team per
+	// line in the form `<team-name-or-id> <instance-name>`.
+	TeamInstances string `json:"teaminstances"`
+
+	// AllowedChannels restricts the commands to channels, listed by ID or name and separated by
+	// commas or whitespace. Commands are allowed everywhere when neither AllowedChannels nor
+	// AllowedTeams is set.
+	AllowedChannels string `json:"allowedchannels"`
+
+	// AllowedTeams restricts the commands to the channels of teams, listed like AllowedChannels.
+	AllowedTeams string `json:"allowedteams"`
+
+	// DefaultCommentVisibility is the visibility of the comments posted with `/zendesk update`,
+	// either private or public.
+	DefaultCommentVisibility string `json:"defaultcommentvisibility"`
+
+	// PublicCommentUsers lists the users allowed to post public comments, which are sent to the
+	// customer, by ID or username and separated by commas or whitespace. Everyone is allowed when
+	// neither PublicCommentUsers nor PublicCommentRoles is set.
+	PublicCommentUsers string `json:"publiccommentusers"`
+
+	// PublicCommentRoles lists the Mattermost system roles allowed to post public comments, e.g.
+	// system_admin, listed like PublicCommentUsers.
+	PublicCommentRoles string `json:"publiccommentroles"`
+
+	// SearchResultLimit is the maximum number of tickets returned by `/zendesk search`.
+	SearchResultLimit string `json:"searchresultlimit"`
+
+	// AssignedTicketsLimit is the maximum number of tickets listed by `/zendesk list`.
+	AssignedTicketsLimit string `json:"assignedticketslimit"`
+
+	// MaxListResults caps the --limit flag of the commands listing tickets.
+	MaxListResults string `json:"maxlistresults"`
+
+	// OAuthTimeout is the timeout in seconds of the OAuth token exchange with Zendesk.
+	OAuthTimeout string `json:"oauthtimeout"`
+
+	// WebhookSecret has to be passed as the secret query parameter by the Zendesk triggers calling
+	// the webhook.
+	WebhookSecret string `json:"webhooksecret"`
+
+	// WebhookChannelID is the channel ticket events received by the webhook are posted to.
+	WebhookChannelID string `json:"webhookchannelid"`
+
+	// OrganizationChannels routes the ticket events of an organization received by the webhook to
+	// a channel, one organization per line in the form `<organization-name-or-id> <channel-id>`.
+	OrganizationChannels string `json:"organizationchannels"`
+
+	// ChannelPostWindow is the number of seconds during which the same bot post isn't posted to a
+	// channel again. Empty or 0 posts every time.
+	ChannelPostWindow string `json:"channelpostwindow"`
+
+	// DescriptionLimit is the maximum number of characters of the description in the details card.
+	DescriptionLimit string `json:"descriptionlimit"`
+
+	// TicketCustomFields lists the IDs of the custom ticket fields shown in the details card,
+	// separated by commas.
+	TicketCustomFields string `json:"ticketcustomfields"`
+
+	// TicketColors overrides the colors of the details card, one status or priority per line in
+	// the form `<status-or-priority> <#hex-color>`.
+	TicketColors string `json:"ticketcolors"`
+
+	// StatusEmoji maps ticket statuses to the emoji shown before them, one status per line in the
+	// form `<status> <:emoji:>`.
+	StatusEmoji string `json:"statusemoji"`
+
+	// ShowInternalNote adds the latest internal note of the ticket to the details card of agents.
+	ShowInternalNote bool `json:"showinternalnote"`
+
+	// CommentPagesLimit is the maximum number of comment pages fetched to find the latest comment.
+	CommentPagesLimit string `json:"commentpageslimit"`
+
+	// CommandRateBurst is how many commands calling Zendesk a user can run in a row.
+	CommandRateBurst string `json:"commandrateburst"`
+
+	// CommandRatePerMinute is how many commands calling Zendesk a user can run per minute.
+	CommandRatePerMinute string `json:"commandrateperminute"`
+
+	// RateLimitRetries is how many times a request rate limited by Zendesk is retried.
+	RateLimitRetries string `json:"ratelimitretries"`
+
+	// ConnectLinkDM makes `/zendesk connect` send the connect link as a direct message from the bot.
+	ConnectLinkDM bool `json:"connectlinkdm"`
+
+	// BotUsername is the username of the bot posting the responses and the webhook updates.
+	BotUsername string `json:"botusername"`
+
+	// BotDisplayName is the display name of the bot.
+	BotDisplayName string `json:"botdisplayname"`
+
+	// DeveloperMode sends the OAuth redirects to developerSiteURL instead of the Site URL.
+	DeveloperMode bool `json:"developermode"`
+}
+
+// Defaults used when the configured value isn't a positive number.
+const (
+	defaultSearchResultLimit    = 10
+	defaultAssignedTicketsLimit = 20
+	defaultMaxListResults       = 50
+	defaultOAuthTimeoutSeconds  = 15
+	defaultCommentPagesLimit    = 10
+	defaultCommandRateBurst     = 10
+	defaultCommandRatePerMinute = 30
+	defaultRateLimitRetries     = 3
+	defaultDescriptionLimit     = 3000
+)
+
+// Names of the bot when none are configured.
+const (
+	defaultBotUsername    = "zendesk"
+	defaultBotDisplayName = "Zendesk Bot"
+)
+
+// Comment visibilities of DefaultCommentVisibility.
+const (
+	commentVisibilityPrivate = "private"
+	commentVisibilityPublic  = "public"
+)
+
+// getDefaultCommentVisibility returns the visibility of the comments posted with `/zendesk update`.
+// Comments are private unless public is explicitly configured.
+func (c *configuration) getDefaultCommentVisibility() string {
+	if strings.EqualFold(strings.TrimSpace(c.DefaultCommentVisibility), commentVisibilityPublic) {
+		return commentVisibilityPublic
+	}
+	return commentVisibilityPrivate
+}
+
+// getBotUsername returns the configured username of the bot. Mattermost usernames are lower case.
+func (c *configuration) getBotUsername() string {
+	if username := strings.ToLower(strings.TrimSpace(c.BotUsername)); username != "" {
+		return username
+	}
+	return defaultBotUsername
+}
+
+// getBotDisplayName returns the configured display name of the bot.
+func (c *configuration) getBotDisplayName() string {
+	if displayName := strings.TrimSpace(c.BotDisplayName); displayName != "" {
+		return displayName
+	}
+	return defaultBotDisplayName
+}
+
+// getSearchResultLimit returns the maximum number of tickets to return from a search.
+func (c *configuration) getSearchResultLimit() int {
+	return parsePositiveInt(c.SearchResultLimit, defaultSearchResultLimit)
+}
+
+// getAssignedTicketsLimit returns the maximum number of tickets to list from an agent's queue.
+func (c *configuration) getAssignedTicketsLimit() int {
+	return parsePositiveInt(c.AssignedTicketsLimit, defaultAssignedTicketsLimit)
+}
+
+// maxSearchPageSize is the largest page the Zendesk search returns.
+const maxSearchPageSize = 100
+
+// getMaxListResults returns how many tickets the commands listing tickets list at most, whatever
+// their --limit flag asks for. Zendesk returns no more than a page of search results.
+func (c *configuration) getMaxListResults() int {
+	limit := parsePositiveInt(c.MaxListResults, defaultMaxListResults)
+	if limit > maxSearchPageSize {
+		return maxSearchPageSize
+	}
+	return limit
+}
+
+// getOAuthTimeout returns how long to wait for Zendesk to exchange an authorization code for a token.
+func (c *configuration) getOAuthTimeout() time.Duration {
+	return time.Duration(parsePositiveInt(c.OAuthTimeout, defaultOAuthTimeoutSeconds)) * time.Second
+}
+
+// getChannelPostWindow returns how long the same bot post isn't posted to a channel again, zero
+// if duplicate posts aren't dropped, see createChannelPost.
+func (c *configuration) getChannelPostWindow() time.Duration {
+	return time.Duration(parsePositiveInt(c.ChannelPostWindow, 0)) * time.Second
+}
+
+// getCommentPagesLimit returns how many pages of comments to fetch at most when looking for the
+// latest public or private comment.
+func (c *configuration) getCommentPagesLimit() int {
+	return parsePositiveInt(c.CommentPagesLimit, defaultCommentPagesLimit)
+}
+
+// getCommandRateBurst returns the size of the per user token bucket, see rateLimiter.
+func (c *configuration) getCommandRateBurst() int {
+	return parsePositiveInt(c.CommandRateBurst, defaultCommandRateBurst)
+}
+
+// getCommandRatePerMinute returns how many tokens are added to a user's bucket per minute.
+func (c *configuration) getCommandRatePerMinute() int {
+	return parsePositiveInt(c.CommandRatePerMinute, defaultCommandRatePerMinute)
+}
+
+// getDescriptionLimit returns how many characters of a ticket description the details card shows.
+// Values beyond what a post can hold fall back to the default.
+func (c *configuration) getDescriptionLimit() int {
+	limit := parsePositiveInt(c.DescriptionLimit, defaultDescriptionLimit)
+	if limit > model.POST_MESSAGE_MAX_RUNES_V2 {
+		return defaultDescriptionLimit
+	}
+	return limit
+}
+
+// getRateLimitRetries returns how many times a request rate limited by Zendesk is retried.
+func (c *configuration) getRateLimitRetries() int {
+	return parsePositiveInt(c.RateLimitRetries, defaultRateLimitRetries)
+}
+
+// getTicketCustomFieldIDs returns the IDs of the custom ticket fields to show in the details card,
+// ignoring anything that isn't an ID.
+func (c *configuration) getTicketCustomFieldIDs() []int64 {
+	var ids []int64
+	for _, value := range strings.Split(c.TicketCustomFields, ",") {
+		if id, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil && id > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// defaultTicketColors are the colors of the details card by ticket status and priority. Anything
+// else gets defaultTicketColor.
+var defaultTicketColors = map[string]string{
+	"urgent": "#d24b4e",
+	"high":   "#f5a623",
+	"solved": "#3db887",
+	"closed": "#8a8a8a",
+}
+
+// defaultTicketColor is the color of cards with no specific status or priority color.
+const defaultTicketColor = "#95b7d0"
+
+var hexColorPattern = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// getTicketColors returns the colors of the details card by lowercase status and priority, the
+// defaults overridden by TicketColors. Lines that aren't a value followed by a hex color are ignored.
+func (c *configuration) getTicketColors() map[string]string {
+	colors := make(map[string]string, len(defaultTicketColors))
+	for value, color := range defaultTicketColors {
+		colors[value] = color
+	}
+	for _, line := range strings.Split(c.TicketColors, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !hexColorPattern.MatchString(fields[1]) {
+			continue
+		}
+		colors[strings.ToLower(fields[0])] = fields[1]
+	}
+	return colors
+}
+
+var emojiPattern = regexp.MustCompile(`^:[a-z0-9_+-]+:$`)
+
+// getStatusEmoji returns the emoji of the ticket statuses by lowercase status, as configured with
+// StatusEmoji. Lines that aren't a status followed by an emoji like :white_check_mark: are ignored.
+func (c *configuration) getStatusEmoji() map[string]string {
+	emoji := map[string]string{}
+	for _, line := range strings.Split(c.StatusEmoji, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !emojiPattern.MatchString(fields[1]) {
+			continue
+		}
+		emoji[strings.ToLower(fields[0])] = fields[1]
+	}
+	return emoji
+}
+
+// formatStatus returns a ticket status prefixed with its emoji, the status alone if it has none.
+func (c *configuration) formatStatus(status string) string {
+	if emoji, ok := c.getStatusEmoji()[strings.ToLower(status)]; ok {
+		return emoji + " " + status
+	}
+	return status
+}
+
+// parsePositiveInt parses a numeric setting, falling back to defaultValue if it isn't a positive number.
+func parsePositiveInt(value string, defaultValue int) int {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n <= 0 {
+		return defaultValue
+	}
+	return n
+}
+
+// defaultInstanceName is the name of the instance configured with ZendeskURL, ZendeskClientID
+// and ZendeskClientSecrete. It is used when a command doesn't select an instance.
+const defaultInstanceName = "default"
+
+// zendeskInstance is a Zendesk instance the plugin can connect to.
+type zendeskInstance struct {
+	Name         string
+	URL          string
+	ClientID     string
+	ClientSecret string
+}
+
+// supportsOAuth reports whether an OAuth client is set up for the instance. Without one, users
+// connect with an API token, see executeConnectToken.
+func (i *zendeskInstance) supportsOAuth() bool {
+	return i.ClientID != "" && i.ClientSecret != ""
+}
+
+// isDefault reports whether this is the primary instance.
+func (i *zendeskInstance) isDefault() bool {
+	return i.Name == defaultInstanceName
+}
+
+// getInstances returns all configured Zendesk instances, starting with the default one.
+func (c *configuration) getInstances() ([]*zendeskInstance, error) {
+	instances := []*zendeskInstance{{
+		Name:         defaultInstanceName,
+		URL:          strings.TrimRight(c.ZendeskURL, "/"),
+		ClientID:     c.ZendeskClientID,
+		ClientSecret: c.ZendeskClientSecrete,
+	}}
+
+	for i, line := range strings.Split(c.ZendeskInstances, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 && len(fields) != 4 {
+			return nil, errors.Errorf("line %d of the Zendesk instances must be in the form `<name> <url> [<client-id> <client-secret>]`", i+1)
+		}
+		instance := &zendeskInstance{
+			Name: strings.ToLower(fields[0]),
+			URL:  strings.TrimRight(fields[1], "/"),
+		}
+		if len(fields) == 4 {
+			instance.ClientID, instance.ClientSecret = fields[2], fields[3]
+		}
+		instances = append(instances, instance)
+	}
+
+	return instances, nil
+}
+
+// getInstance returns the Zendesk instance with the given name, or the default instance if name is empty.
+func (c *configuration) getInstance(name string) (*zendeskInstance, error) {
+	if name == "" {
+		name = defaultInstanceName
+	}
+
+	instances, err := c.getInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, instance := range instances {
+		if strings.EqualFold(instance.Name, name) {
+			return instance, nil
+		}
+		names = append(names, "`"+instance.Name+"`")
+	}
+	return nil, errors.Errorf("Unknown Zendesk instance `%s`, the configured instances are: %s.", name, strings.Join(names, ", "))
+}
+
+// getTeamInstanceName returns the name of the instance a team is routed to, or "" if the team
+// isn't mapped.
+func (c *configuration) getTeamInstanceName(teamID, teamName string) string {
+	for _, line := range strings.Split(c.TeamInstances, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if fields[0] == teamID || strings.EqualFold(fields[0], teamName) {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// getAllowedChannels returns the IDs and names of the channels listed in AllowedChannels.
+func (c *configuration) getAllowedChannels() []string {
+	return splitList(c.AllowedChannels)
+}
+
+// getAllowedTeams returns the IDs and names of the teams listed in AllowedTeams.
+func (c *configuration) getAllowedTeams() []string {
+	return splitList(c.AllowedTeams)
+}
+
+// getPublicCommentUsers returns the IDs and usernames listed in PublicCommentUsers.
+func (c *configuration) getPublicCommentUsers() []string {
+	return splitList(c.PublicCommentUsers)
+}
+
+// getPublicCommentRoles returns the roles listed in PublicCommentRoles.
+func (c *configuration) getPublicCommentRoles() []string {
+	return splitList(c.PublicCommentRoles)
+}
+
+// splitList splits a setting listing values separated by commas or whitespace.
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// organizationChannel maps the ticket events of an organization to a channel, see OrganizationChannels.
+type organizationChannel struct {
+	organization string
+	channelID    string
+}
+
+// getOrganizationChannels parses OrganizationChannels. The channel ID is the last word of a line,
+// so organization names may contain spaces.
+func (c *configuration) getOrganizationChannels() []organizationChannel {
+	var mappings []organizationChannel
+	for _, line := range strings.Split(c.OrganizationChannels, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		mappings = append(mappings, organizationChannel{
+			organization: strings.Join(fields[:len(fields)-1], " "),
+			channelID:    fields[len(fields)-1],
+		})
+	}
+	return mappings
+}
+
+// getWebhookChannelID returns the channel the ticket events of an organization are posted to,
+// WebhookChannelID if the organization isn't mapped.
+func (c *configuration) getWebhookChannelID(organizationID, organizationName string) string {
+	for _, mapping := range c.getOrganizationChannels() {
+		if (organizationID != "" && mapping.organization == organizationID) ||
+			(organizationName != "" && strings.EqualFold(mapping.organization, organizationName)) {
+			return mapping.channelID
+		}
+	}
+	return c.WebhookChannelID
+}
+
+// IsValid checks the settings the plugin can't work without: every Zendesk instance needs an
+// https URL and OAuth credentials, and the encryption key must be an AES-256 key. An empty key is
+// generated on activation, see ensureEncryptionKey.
+func (c *configuration) IsValid() error {
+	if c.EncryptionKey != "" && len(c.EncryptionKey) != 32 {
+		return errors.New("the at rest encryption key must be 32 bytes long, please regenerate it in the plugin settings")
+	}
+	if (c.ZendeskUser == "") != (c.ZendeskPassword == "") {
+		return errors.New("the Zendesk user and password of the plugin must be set together")
+	}
+	if !model.IsValidUsername(c.getBotUsername()) {
+		return errors.Errorf("the bot username %q is not a valid Mattermost username", c.BotUsername)
+	}
+
+	instances, err := c.getInstances()
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		name := "the Zendesk instance `" + instance.Name + "`"
+		if instance.isDefault() {
+			name = "the Zendesk Web Site URL"
+		}
+		if err := validateZendeskURL(instance.URL); err != nil {
+			return errors.Wrapf(err, "invalid URL of %s", name)
+		}
+
+		if instance.isDefault() {
+			name = "the default Zendesk instance"
+		}
+		// Without an OAuth client users connect with API tokens, half of one is a mistake.
+		if instance.ClientID == "" && instance.ClientSecret != "" {
+			return errors.Errorf("the OAuth client ID of %s is not set", name)
+		}
+		if instance.ClientID != "" && instance.ClientSecret == "" {
+			return errors.Errorf("the OAuth client secret of %s is not set", name)
+		}
+	}
+	return nil
+}
+
+// validateZendeskURL checks that rawURL is an absolute https URL. OAuth tokens are sent to it, so
+// plain http is refused.
+func validateZendeskURL(rawURL string) error {
+	if rawURL == "" {
+		return errors.New("the URL is not set")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return errors.Errorf("%q must use https", rawURL)
+	}
+	if u.Host == "" {
+		return errors.Errorf("%q has no host", rawURL)
+	}
+	return nil
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -76,6 +593,88 @@ func (p *Plugin) setConfiguration(configuration *configuration) {
 	p.configuration = configuration
 }
 
+// ensureEncryptionKey generates the at rest encryption key when it isn't set yet, so the plugin
+// works without a visit to the plugin settings. The key is saved to the plugin settings, where it
+// can still be regenerated.
+func (p *Plugin) ensureEncryptionKey() error {
+	config := p.getConfiguration()
+	if config.EncryptionKey != "" {
+		return nil
+	}
+
+	// The settings generator of the System Console creates keys alike.
+	config = config.Clone()
+	config.EncryptionKey = model.NewRandomString(32)
+	if err := p.savePluginSetting("encryptionkey", config.EncryptionKey); err != nil {
+		return errors.Wrap(err, "failed to save the generated encryption key")
+	}
+	p.setConfiguration(config)
+	return nil
+}
+
+// encryptedSettingPrefix marks the settings encrypted with the at rest encryption key.
+const encryptedSettingPrefix = "encrypted:"
+
+// encryptZendeskPassword encrypts the Zendesk password of the plugin in the plugin settings, so it
+// isn't kept in plain text in the server configuration. An encrypted password is left alone, the
+// admin replaces it by entering a new one.
+func (p *Plugin) encryptZendeskPassword() error {
+	config := p.getConfiguration()
+	if config.ZendeskPassword == "" || strings.HasPrefix(config.ZendeskPassword, encryptedSettingPrefix) {
+		return nil
+	}
+
+	encrypted, err := p.encryptToken(config.ZendeskPassword)
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt the Zendesk password")
+	}
+	config = config.Clone()
+	config.ZendeskPassword = encryptedSettingPrefix + encrypted
+	if err := p.savePluginSetting("zendeskpassword", config.ZendeskPassword); err != nil {
+		return errors.Wrap(err, "failed to save the encrypted Zendesk password")
+	}
+	p.setConfiguration(config)
+	return nil
+}
+
+// savePluginSetting changes one setting of the plugin in the server configuration, keyed like the
+// json tags of configuration.
+func (p *Plugin) savePluginSetting(key, value string) error {
+	pluginConfig := p.API.GetPluginConfig()
+	if pluginConfig == nil {
+		pluginConfig = map[string]interface{}{}
+	}
+	pluginConfig[key] = value
+	if appErr := p.API.SavePluginConfig(pluginConfig); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// errNoSharedCredentials is returned by sharedCredentials when the plugin has no Zendesk account.
+var errNoSharedCredentials = errors.New("no Zendesk user and password are configured for the plugin")
+
+// sharedCredentials returns the Zendesk account of the plugin, see configuration.ZendeskUser. When
+// neither setting is set, the ZENDESK_USER and ZENDESK_PASSWORD environment variables older versions
+// of the plugin were configured with are used.
+func (p *Plugin) sharedCredentials() (user, password string, err error) {
+	config := p.getConfiguration()
+	user, password = config.ZendeskUser, config.ZendeskPassword
+	if user == "" && password == "" {
+		user, password = os.Getenv("ZENDESK_USER"), os.Getenv("ZENDESK_PASSWORD")
+	}
+	if user == "" || password == "" {
+		return "", "", errNoSharedCredentials
+	}
+
+	if strings.HasPrefix(password, encryptedSettingPrefix) {
+		if password, err = p.decryptToken(strings.TrimPrefix(password, encryptedSettingPrefix)); err != nil {
+			return "", "", errors.Wrap(err, "failed to decrypt the Zendesk password, please enter it again in the plugin settings")
+		}
+	}
+	return user, password, nil
+}
+
 // OnConfigurationChange is invoked when configuration changes may have been made.
 func (p *Plugin) OnConfigurationChange() error {
 	var configuration = new(configuration)
@@ -87,5 +686,32 @@ func (p *Plugin) OnConfigurationChange() error {
 
 	p.setConfiguration(configuration)
 
+	// Clients are rebuilt from the new instance settings on their next use. Commands already
+	// running keep the client they started with.
+	p.clientCacheLock.Lock()
+	p.clientCache = make(map[string]cachedClient)
+	p.sharedClient = cachedClient{}
+	p.clientCacheLock.Unlock()
+
+	// A password entered while the plugin is active is encrypted too. It is saved once the hook
+	// returns, as saving the configuration calls the hook again.
+	if p.botID != "" && configuration.ZendeskPassword != "" && !strings.HasPrefix(configuration.ZendeskPassword, encryptedSettingPrefix) {
+		go func() {
+			if err := p.encryptZendeskPassword(); err != nil {
+				p.API.LogError("failed to encrypt the Zendesk password", "error", err.Error())
+			}
+		}()
+	}
+
+	// The bot only exists once the plugin is activated, OnActivate renames it then.
+	if p.botID != "" {
+		p.updateBotProfile()
+	}
+
+	// The new configuration is applied anyway, so fixing one setting at a time works, but the
+	// admin is told right away what is still wrong.
+	if err := configuration.IsValid(); err != nil {
+		return errors.Wrap(err, "invalid plugin configuration")
+	}
 	return nil
 }
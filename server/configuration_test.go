@@ -0,0 +1,206 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetInstance(t *testing.T) {
+	c := &configuration{
+		ZendeskURL:           "https://acme.zendesk.com/",
+		ZendeskClientID:      "id",
+		ZendeskClientSecrete: "secret",
+		ZendeskInstances:     "EU https://acme-eu.zendesk.com eu-id eu-secret\n\n",
+	}
+
+	instance, err := c.getInstance("")
+	require.NoError(t, err)
+	assert.Equal(t, &zendeskInstance{Name: defaultInstanceName, URL: "https://acme.zendesk.com", ClientID: "id", ClientSecret: "secret"}, instance)
+
+	instance, err = c.getInstance("eu")
+	require.NoError(t, err)
+	assert.Equal(t, &zendeskInstance{Name: "eu", URL: "https://acme-eu.zendesk.com", ClientID: "eu-id", ClientSecret: "eu-secret"}, instance)
+
+	_, err = c.getInstance("us")
+	assert.Error(t, err)
+
+	// Instances without an OAuth client are connected with API tokens.
+	c.ZendeskInstances = "eu https://acme-eu.zendesk.com"
+	instance, err = c.getInstance("eu")
+	require.NoError(t, err)
+	assert.False(t, instance.supportsOAuth())
+
+	c.ZendeskInstances = "eu https://acme-eu.zendesk.com eu-id"
+	_, err = c.getInstance("eu")
+	assert.Error(t, err)
+}
+
+func TestGetTeamInstanceName(t *testing.T) {
+	c := &configuration{TeamInstances: "acme eu\nteamid123 us\n\nbroken line here"}
+
+	assert.Equal(t, "eu", c.getTeamInstanceName("someid", "Acme"))
+	assert.Equal(t, "us", c.getTeamInstanceName("teamid123", "other"))
+	assert.Equal(t, "", c.getTeamInstanceName("someid", "other"))
+}
+
+func TestGetWebhookChannelID(t *testing.T) {
+	c := &configuration{
+		WebhookChannelID:     "default-channel",
+		OrganizationChannels: "Acme Corp acme-channel\n360001 vip-channel\n\nbroken",
+	}
+
+	assert.Equal(t, "acme-channel", c.getWebhookChannelID("1", "acme corp"))
+	assert.Equal(t, "vip-channel", c.getWebhookChannelID("360001", "Other"))
+	assert.Equal(t, "default-channel", c.getWebhookChannelID("2", "Other"))
+	assert.Equal(t, "default-channel", c.getWebhookChannelID("", ""))
+}
+
+func TestConfigurationIsValid(t *testing.T) {
+	valid := configuration{
+		ZendeskURL:           "https://acme.zendesk.com",
+		ZendeskClientID:      "id",
+		ZendeskClientSecrete: "secret",
+		EncryptionKey:        testEncryptionKey,
+		ZendeskInstances:     "eu https://acme-eu.zendesk.com eu-id eu-secret",
+	}
+	assert.NoError(t, valid.IsValid())
+
+	for name, change := range map[string]func(c *configuration){
+		"missing URL":           func(c *configuration) { c.ZendeskURL = "" },
+		"http URL":              func(c *configuration) { c.ZendeskURL = "http://acme.zendesk.com" },
+		"URL without scheme":    func(c *configuration) { c.ZendeskURL = "acme.zendesk.com" },
+		"unparsable URL":        func(c *configuration) { c.ZendeskURL = "https://acme zendesk.com/%zz" },
+		"missing client ID":     func(c *configuration) { c.ZendeskClientID = "" },
+		"missing client secret": func(c *configuration) { c.ZendeskClientSecrete = "" },
+		"short encryption key":  func(c *configuration) { c.EncryptionKey = "short" },
+		"invalid instance line": func(c *configuration) { c.ZendeskInstances = "eu https://acme-eu.zendesk.com eu-id" },
+		"http instance URL":     func(c *configuration) { c.ZendeskInstances = "eu http://acme-eu.zendesk.com eu-id eu-secret" },
+		"invalid bot username":  func(c *configuration) { c.BotUsername = "zendesk bot" },
+		"user without password": func(c *configuration) { c.ZendeskUser = "bot@example.com" },
+	} {
+		c := valid
+		change(&c)
+		assert.Error(t, c.IsValid(), name)
+	}
+
+	// Users connect with API tokens to instances without an OAuth client.
+	withoutOAuth := valid
+	withoutOAuth.ZendeskClientID, withoutOAuth.ZendeskClientSecrete = "", ""
+	withoutOAuth.ZendeskInstances = "eu https://acme-eu.zendesk.com"
+	assert.NoError(t, withoutOAuth.IsValid())
+
+	// The key is generated on activation when it isn't set.
+	withoutKey := valid
+	withoutKey.EncryptionKey = ""
+	assert.NoError(t, withoutKey.IsValid())
+}
+
+func TestEnsureEncryptionKey(t *testing.T) {
+	api := &plugintest.API{}
+	p := newTestPlugin(api)
+	p.setConfiguration(&configuration{ZendeskURL: "https://acme.zendesk.com"})
+	api.On("GetPluginConfig").Return(map[string]interface{}{"zendeskurl": "https://acme.zendesk.com", "encryptionkey": ""})
+	var saved map[string]interface{}
+	api.On("SavePluginConfig", mock.Anything).Run(func(args mock.Arguments) {
+		saved = args.Get(0).(map[string]interface{})
+	}).Return(nil)
+
+	require.NoError(t, p.ensureEncryptionKey())
+	key := p.getConfiguration().EncryptionKey
+	assert.Len(t, key, 32)
+	assert.Equal(t, map[string]interface{}{"zendeskurl": "https://acme.zendesk.com", "encryptionkey": key}, saved)
+	assert.NoError(t, p.getConfiguration().IsValid())
+
+	// An existing key is kept.
+	require.NoError(t, p.ensureEncryptionKey())
+	assert.Equal(t, key, p.getConfiguration().EncryptionKey)
+	api.AssertNumberOfCalls(t, "SavePluginConfig", 1)
+}
+
+func TestSharedCredentials(t *testing.T) {
+	api := &plugintest.API{}
+	p := newTestPlugin(api)
+	p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskUser: "bot@example.com", ZendeskPassword: "s3cret"})
+	api.On("GetPluginConfig").Return(map[string]interface{}{"zendeskuser": "bot@example.com", "zendeskpassword": "s3cret"})
+	var saved map[string]interface{}
+	api.On("SavePluginConfig", mock.Anything).Run(func(args mock.Arguments) {
+		saved = args.Get(0).(map[string]interface{})
+	}).Return(nil)
+
+	require.NoError(t, p.encryptZendeskPassword())
+	encrypted := p.getConfiguration().ZendeskPassword
+	assert.True(t, strings.HasPrefix(encrypted, encryptedSettingPrefix))
+	assert.NotContains(t, encrypted, "s3cret")
+	assert.Equal(t, encrypted, saved["zendeskpassword"])
+
+	user, password, err := p.sharedCredentials()
+	require.NoError(t, err)
+	assert.Equal(t, "bot@example.com", user)
+	assert.Equal(t, "s3cret", password)
+
+	// An encrypted password isn't encrypted again.
+	require.NoError(t, p.encryptZendeskPassword())
+	api.AssertNumberOfCalls(t, "SavePluginConfig", 1)
+
+	// The environment is only read when neither setting is set.
+	os.Setenv("ZENDESK_USER", "env@example.com")
+	os.Setenv("ZENDESK_PASSWORD", "env-secret")
+	defer os.Unsetenv("ZENDESK_USER")
+	defer os.Unsetenv("ZENDESK_PASSWORD")
+	user, _, err = p.sharedCredentials()
+	require.NoError(t, err)
+	assert.Equal(t, "bot@example.com", user)
+
+	p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey})
+	user, password, err = p.sharedCredentials()
+	require.NoError(t, err)
+	assert.Equal(t, "env@example.com", user)
+	assert.Equal(t, "env-secret", password)
+
+	os.Unsetenv("ZENDESK_PASSWORD")
+	_, _, err = p.sharedCredentials()
+	assert.Equal(t, errNoSharedCredentials, err)
+}
+
+func TestOnConfigurationChange(t *testing.T) {
+	api := &plugintest.API{}
+	p := newTestPlugin(api)
+	p.clientCache["user"] = cachedClient{token: "token"}
+	api.On("LoadPluginConfiguration", mock.AnythingOfType("*main.configuration")).Run(func(args mock.Arguments) {
+		*args.Get(0).(*configuration) = configuration{ZendeskURL: "http://acme.zendesk.com", ZendeskClientID: "id", ZendeskClientSecrete: "secret", EncryptionKey: testEncryptionKey}
+	}).Return(nil)
+
+	err := p.OnConfigurationChange()
+	assert.Error(t, err, "http URLs are refused")
+	assert.Equal(t, "http://acme.zendesk.com", p.getConfiguration().ZendeskURL, "the configuration is applied anyway")
+	assert.Empty(t, p.clientCache)
+}
+
+func TestGetDescriptionLimit(t *testing.T) {
+	assert.Equal(t, 3000, (&configuration{}).getDescriptionLimit())
+	assert.Equal(t, 500, (&configuration{DescriptionLimit: " 500 "}).getDescriptionLimit())
+	assert.Equal(t, 3000, (&configuration{DescriptionLimit: "-1"}).getDescriptionLimit())
+	assert.Equal(t, 3000, (&configuration{DescriptionLimit: "100000"}).getDescriptionLimit())
+}
+
+func TestGetBotNames(t *testing.T) {
+	assert.Equal(t, "zendesk", (&configuration{}).getBotUsername())
+	assert.Equal(t, "Zendesk Bot", (&configuration{BotDisplayName: "  "}).getBotDisplayName())
+	assert.Equal(t, "support", (&configuration{BotUsername: " Support "}).getBotUsername())
+	assert.Equal(t, "Support Desk", (&configuration{BotDisplayName: "Support Desk"}).getBotDisplayName())
+}
+
+func TestFormatStatus(t *testing.T) {
+	c := &configuration{StatusEmoji: "Open :large_blue_circle:\nsolved :white_check_mark:\n\npending no-emoji"}
+
+	assert.Equal(t, ":large_blue_circle: open", c.formatStatus("open"))
+	assert.Equal(t, ":white_check_mark: solved", c.formatStatus("solved"))
+	assert.Equal(t, "pending", c.formatStatus("pending"))
+	assert.Equal(t, "hold", (&configuration{}).formatStatus("hold"), "no emoji unless configured")
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// ticketTypes are the ticket types offered when creating a ticket.
+var ticketTypes = []string{"question", "incident", "problem", "task"}
+
+// maxDialogDescriptionLength is the longest description the create dialog accepts.
+const maxDialogDescriptionLength = 3000
+
+// openCreateTicketDialog opens the dialog creating a ticket in a Zendesk instance.
+func (p *Plugin) openCreateTicketDialog(userID, triggerID, instanceName, subject, description string) error {
+	request := p.createTicketDialogRequest(userID, instanceName, subject, description)
+	request.TriggerId = triggerID
+	if appErr := p.API.OpenInteractiveDialog(request); appErr != nil {
+		return errors.Wrap(appErr, "failed to open the create ticket dialog")
+	}
+	return nil
+}
+
+// createTicketDialogRequest builds the dialog creating a ticket in a Zendesk instance for a user,
+// pre-filled with subject and description. The submission is handled by httpDialogCreate.
+func (p *Plugin) createTicketDialogRequest(userID, instanceName, subject, description string) model.OpenDialogRequest {
+	T := p.T(userID)
+	priorities := make([]*model.PostActionOptions, 0, len(ticketPriorities))
+	for _, priority := range ticketPriorities {
+		priorities = append(priorities, &model.PostActionOptions{Text: strings.Title(priority), Value: priority})
+	}
+	types := make([]*model.PostActionOptions, 0, len(ticketTypes))
+	for _, ticketType := range ticketTypes {
+		types = append(types, &model.PostActionOptions{Text: strings.Title(ticketType), Value: ticketType})
+	}
+
+	return model.OpenDialogRequest{
+		URL: p.GetPluginURL() + routeDialogCreate,
+		Dialog: model.Dialog{
+			CallbackId:  "create_ticket",
+			Title:       T("zendesk.dialog.title"),
+			SubmitLabel: T("zendesk.dialog.submit"),
+			// The instance is passed along, so the ticket is created where the command was run.
+			State: instanceName,
+			Elements: []model.DialogElement{
+				{
+					DisplayName: T("zendesk.dialog.subject"),
+					Name:        "subject",
+					Type:        "text",
+					Default:     subject,
+					MaxLength:   150,
+				},
+				{
+					DisplayName: T("zendesk.dialog.description"),
+					Name:        "description",
+					Type:        "textarea",
+					Default:     truncate(description, maxDialogDescriptionLength),
+					MaxLength:   maxDialogDescriptionLength,
+				},
+				{
+					DisplayName: T("zendesk.field.priority"),
+					Name:        "priority",
+					Type:        "select",
+					Optional:    true,
+					Options:     priorities,
+				},
+				{
+					DisplayName: T("zendesk.field.type"),
+					Name:        "type",
+					Type:        "select",
+					Optional:    true,
+					Options:     types,
+				},
+			},
+		},
+	}
+}
+
+// maxDerivedSubjectLength is the longest subject derived from a message, see ticketSubjectFromMessage.
+const maxDerivedSubjectLength = 80
+
+// httpActionCreate returns the dialog creating a ticket from a post, for the "Create Zendesk
+// Ticket" action of the post menu. The webapp opens the dialog, as there is no trigger ID to
+// open it from the server. The user has to be able to read the post.
+func httpActionCreate(p *Plugin, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("method " + r.Method + " is not allowed, must be POST")
+	}
+
+	userID := r.Header.Get("Mattermost-User-ID")
+	if userID == "" {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+
+	var in struct {
+		PostID string `json:"post_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.PostID == "" {
+		return http.StatusBadRequest, errors.New("a post_id is required")
+	}
+
+	post, appErr := p.API.GetPost(in.PostID)
+	if appErr != nil || !p.API.HasPermissionToChannel(userID, post.ChannelId, model.PERMISSION_READ_CHANNEL) {
+		return http.StatusNotFound, errors.New("post not found")
+	}
+	channel, appErr := p.API.GetChannel(post.ChannelId)
+	if appErr != nil {
+		return http.StatusInternalServerError, errors.Wrap(appErr, "failed to load the channel of the post")
+	}
+
+	// The instance is picked the same way as for a command run in the channel of the post.
+	instance, err := p.resolveInstance(&model.CommandArgs{UserId: userID, TeamId: channel.TeamId})
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if _, err = p.getToken(userID, instance.Name); err != nil {
+		return http.StatusForbidden, errors.New("please connect to Zendesk with /zendesk connect first")
+	}
+
+	request := p.createTicketDialogRequest(userID, instance.Name, ticketSubjectFromMessage(post.Message), post.Message)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(request); err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "failed to write the dialog")
+	}
+	return http.StatusOK, nil
+}
+
+// ticketSubjectFromMessage derives a ticket subject from the first non-empty line of a message.
+func ticketSubjectFromMessage(message string) string {
+	for _, line := range strings.Split(message, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			return truncate(line, maxDerivedSubjectLength)
+		}
+	}
+	return ""
+}
+
+// httpDialogCreate creates the ticket submitted with the dialog of openCreateTicketDialog and
+// confirms it to the user in the channel the dialog was opened from.
+func httpDialogCreate(p *Plugin, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("method " + r.Method + " is not allowed, must be POST")
+	}
+
+	userID := r.Header.Get("Mattermost-User-ID")
+	request := model.SubmitDialogRequestFromJson(r.Body)
+	if request == nil {
+		return http.StatusBadRequest, errors.New("failed to decode the dialog submission")
+	}
+	if userID == "" || request.UserId != userID {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+	if request.Cancelled {
+		return http.StatusOK, nil
+	}
+
+	T := p.T(userID)
+	subject := strings.TrimSpace(dialogValue(request.Submission, "subject"))
+	description := strings.TrimSpace(dialogValue(request.Submission, "description"))
+	fieldErrors := map[string]string{}
+	if subject == "" {
+		fieldErrors["subject"] = T("zendesk.dialog.subject_missing")
+	}
+	if description == "" {
+		fieldErrors["description"] = T("zendesk.dialog.description_missing")
+	}
+	if len(fieldErrors) > 0 {
+		return writeDialogResponse(w, &model.SubmitDialogResponse{Errors: fieldErrors})
+	}
+
+	in := &zendesk.Ticket{
+		Subject: &subject,
+		Comment: &zendesk.TicketComment{Body: &description},
+	}
+	if priority := dialogValue(request.Submission, "priority"); containsString(ticketPriorities, priority) {
+		in.Priority = &priority
+	}
+	if ticketType := dialogValue(request.Submission, "type"); containsString(ticketTypes, ticketType) {
+		in.Type = &ticketType
+	}
+
+	instance, err := p.getConfiguration().getInstance(request.State)
+	if err != nil {
+		return writeDialogResponse(w, &model.SubmitDialogResponse{Error: err.Error()})
+	}
+	// Every submission is a request of its own to Zendesk.
+	client, err := p.getInstanceClient(userID, instance, model.NewId())
+	if err == errNotConnected {
+		return writeDialogResponse(w, &model.SubmitDialogResponse{Error: T("zendesk.dialog.not_connected")})
+	}
+	if err != nil {
+		return writeDialogResponse(w, &model.SubmitDialogResponse{Error: err.Error()})
+	}
+
+	ticket, err := client.CreateTicket(in)
+	if isAPIError(err, http.StatusTooManyRequests) {
+		return writeDialogResponse(w, &model.SubmitDialogResponse{Error: T("zendesk.error.rate_limited")})
+	}
+	if err != nil {
+		return writeDialogResponse(w, &model.SubmitDialogResponse{Error: err.Error()})
+	}
+
+	_ = p.API.SendEphemeralPost(userID, &model.Post{
+		UserId:    p.botID,
+		ChannelId: request.ChannelId,
+		Message:   T("zendesk.create.created", map[string]interface{}{"Ticket": client.ticketLink(ticket)}),
+	})
+	return http.StatusOK, nil
+}
+
+// dialogValue returns a string field of a dialog submission, "" if it is missing.
+func dialogValue(submission map[string]interface{}, name string) string {
+	value, _ := submission[name].(string)
+	return value
+}
+
+// writeDialogResponse reports errors of a dialog submission, they are shown in the dialog.
+func writeDialogResponse(w http.ResponseWriter, response *model.SubmitDialogResponse) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(response.ToJson()); err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "failed to write the dialog response")
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCreateWithoutArgumentsOpensDialog(t *testing.T) {
+	ct := newCommandTest(t, nil)
+	defer ct.close()
+
+	siteURL := "https://chat.example.com"
+	ct.api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+	var request model.OpenDialogRequest
+	ct.api.On("OpenInteractiveDialog", mock.AnythingOfType("model.OpenDialogRequest")).Run(func(args mock.Arguments) {
+		request = args.Get(0).(model.OpenDialogRequest)
+	}).Return(nil)
+
+	if _, appErr := ct.p.ExecuteCommand(nil, &model.CommandArgs{UserId: "user", ChannelId: "channel", TriggerId: "trigger", Command: "/zendesk create"}); appErr != nil {
+		t.Fatal(appErr)
+	}
+	assert.Empty(t, ct.responses)
+	assert.Equal(t, "trigger", request.TriggerId)
+	assert.Equal(t, "https://chat.example.com/plugins/zendesk/dialog/create", request.URL)
+	assert.Equal(t, defaultInstanceName, request.Dialog.State)
+	assert.Len(t, request.Dialog.Elements, 4)
+}
+
+func TestDialogCreate(t *testing.T) {
+	var created zendesk.Ticket
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Ticket zendesk.Ticket `json:"ticket"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		created = in.Ticket
+		_, _ = w.Write([]byte(`{"ticket":{"id":7,"subject":"Cannot log in"}}`))
+	})
+	defer ct.close()
+
+	submit := func(userID, body string) (int, string) {
+		r := httptest.NewRequest(http.MethodPost, routeDialogCreate, strings.NewReader(body))
+		r.Header.Set("Mattermost-User-ID", userID)
+		w := httptest.NewRecorder()
+		status, _ := httpDialogCreate(ct.p, w, r)
+		return status, w.Body.String()
+	}
+
+	status, _ := submit("other", `{"user_id":"user","channel_id":"channel","state":"default","submission":{}}`)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, body := submit("user", `{"user_id":"user","channel_id":"channel","state":"default","submission":{"subject":" "}}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"subject":"Please enter a subject."`)
+	assert.Contains(t, body, `"description":"Please enter a description."`)
+
+	status, body = submit("user", `{"user_id":"user","channel_id":"channel","state":"default","submission":{
+		"subject":"Cannot log in","description":"The password is rejected.","priority":"high","type":"incident"}}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, body)
+	assert.Equal(t, "Cannot log in", stringValue(created.Subject))
+	assert.Equal(t, "The password is rejected.", stringValue(created.Comment.Body))
+	assert.Equal(t, "high", stringValue(created.Priority))
+	assert.Equal(t, "incident", stringValue(created.Type))
+	if assert.Len(t, ct.responses, 1) {
+		assert.Equal(t, "channel", ct.responses[0].ChannelId)
+		assert.Contains(t, ct.responses[0].Message, "[7: Cannot log in](")
+	}
+}
+
+func TestActionCreate(t *testing.T) {
+	ct := newCommandTest(t, nil)
+	defer ct.close()
+
+	siteURL := "https://chat.example.com"
+	ct.api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+	ct.api.On("GetPost", "post").Return(&model.Post{ChannelId: "channel", Message: "\n  The   printer\tis on fire\nagain, please help"}, nil)
+	ct.api.On("HasPermissionToChannel", "user", "channel", model.PERMISSION_READ_CHANNEL).Return(true)
+	ct.api.On("HasPermissionToChannel", "other", "channel", model.PERMISSION_READ_CHANNEL).Return(false)
+	ct.api.On("GetChannel", "channel").Return(&model.Channel{Id: "channel", TeamId: "team"}, nil)
+
+	action := func(userID string) (int, *httptest.ResponseRecorder) {
+		r := httptest.NewRequest(http.MethodPost, routeActionCreate, strings.NewReader(`{"post_id":"post"}`))
+		r.Header.Set("Mattermost-User-ID", userID)
+		w := httptest.NewRecorder()
+		status, _ := httpActionCreate(ct.p, w, r)
+		return status, w
+	}
+
+	status, _ := action("other")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, w := action("user")
+	assert.Equal(t, http.StatusOK, status)
+	var request model.OpenDialogRequest
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&request))
+	assert.Equal(t, "https://chat.example.com/plugins/zendesk/dialog/create", request.URL)
+	assert.Equal(t, "The printer is on fire", request.Dialog.Elements[0].Default)
+	assert.Equal(t, "\n  The   printer\tis on fire\nagain, please help", request.Dialog.Elements[1].Default)
+
+	delete(ct.kv, "user"+tokenKeySuffix)
+	status, _ = action("user")
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestTicketSubjectFromMessage(t *testing.T) {
+	assert.Equal(t, "", ticketSubjectFromMessage(" \n\t"))
+	assert.Equal(t, strings.Repeat("a", 77)+"...", ticketSubjectFromMessage(strings.Repeat("a", 100)))
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// quietHours hold back the updates of a watched ticket during a daily period, e.g. at night.
+type quietHours struct {
+	// Start and End are minutes after midnight in TimeZone. The period spans midnight when End
+	// is before Start.
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+	TimeZone string `json:"time_zone"`
+
+	// Digest posts a summary of the updates held back at the end of the period, they are dropped
+	// otherwise.
+	Digest bool `json:"digest"`
+}
+
+// parseQuietHours parses a period like 22:00-07:00. It returns false if the period is invalid or
+// empty.
+func parseQuietHours(value, timeZone string, digest bool) (*quietHours, bool) {
+	bounds := strings.Split(value, "-")
+	if len(bounds) != 2 {
+		return nil, false
+	}
+
+	var minutes [2]int
+	for i, bound := range bounds {
+		clock, err := time.Parse("15:04", strings.TrimSpace(bound))
+		if err != nil {
+			return nil, false
+		}
+		minutes[i] = clock.Hour()*60 + clock.Minute()
+	}
+	if minutes[0] == minutes[1] {
+		return nil, false
+	}
+	return &quietHours{Start: minutes[0], End: minutes[1], TimeZone: timeZone, Digest: digest}, true
+}
+
+// String formats the period like parseQuietHours parses it.
+func (q *quietHours) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", q.Start/60, q.Start%60, q.End/60, q.End%60)
+}
+
+// endAfter returns when the quiet hours t is within end, or false if t isn't within quiet hours.
+func (q *quietHours) endAfter(t time.Time) (time.Time, bool) {
+	if q == nil {
+		return time.Time{}, false
+	}
+	loc, err := time.LoadLocation(q.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	local := t.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	endDay := local.Day()
+	switch {
+	case q.Start < q.End && minute >= q.Start && minute < q.End:
+	case q.Start > q.End && minute < q.End:
+	case q.Start > q.End && minute >= q.Start:
+		endDay++
+	default:
+		return time.Time{}, false
+	}
+	return time.Date(local.Year(), local.Month(), endDay, q.End/60, q.End%60, 0, 0, loc), true
+}
+
+// maxWatchDigestInterval is the longest interval, in minutes, of a digest.
+const maxWatchDigestInterval = 24 * 60
+
+// holdWatchUpdate holds back an update of a watched ticket according to the settings of the
+// channel watching it: during the quiet hours it is added to the digest of the channel, or
+// dropped, otherwise it is added to the digest if the channel has a digest interval. It returns
+// false if the update is to be posted right away.
+func (p *Plugin) holdWatchUpdate(sub watchSubscription, event *webhookEvent, now time.Time) (bool, error) {
+	settings, err := p.getWatchSettings(sub)
+	if err != nil {
+		return false, err
+	}
+
+	if end, quiet := settings.QuietHours.endAfter(now); quiet {
+		if !settings.QuietHours.Digest {
+			return true, nil
+		}
+		return true, p.addToWatchDigest(sub, event, end)
+	}
+	if settings.DigestInterval > 0 {
+		return true, p.addToWatchDigest(sub, event, now.Add(time.Duration(settings.DigestInterval)*time.Minute))
+	}
+	return false, nil
+}
+
+// watchDigest sums up the updates of a watched ticket held back for a channel.
+type watchDigest struct {
+	Subscription watchSubscription `json:"subscription"`
+
+	// FlushAt is when the digest is due, in seconds since the epoch.
+	FlushAt int64 `json:"flush_at"`
+
+	// The ticket as of the latest update.
+	Subject      string `json:"subject"`
+	URL          string `json:"url"`
+	Status       string `json:"status"`
+	Priority     string `json:"priority"`
+	Organization string `json:"organization"`
+
+	Created         bool     `json:"created"`
+	PublicComments  int      `json:"public_comments"`
+	PrivateComments int      `json:"private_comments"`
+	StatusChanges   int      `json:"status_changes"`
+	Authors         []string `json:"authors,omitempty"`
+}
+
+// add counts an update in the digest.
+func (d *watchDigest) add(e *webhookEvent) {
+	switch e.Event {
+	case webhookEventTicketCreated:
+		d.Created = true
+	case webhookEventCommentAdded:
+		if strings.EqualFold(e.CommentPublic, "true") {
+			d.PublicComments++
+		} else {
+			d.PrivateComments++
+		}
+		if e.Author != "" && !containsString(d.Authors, e.Author) {
+			d.Authors = append(d.Authors, e.Author)
+		}
+	}
+	if d.Status != "" && e.Status != "" && !strings.EqualFold(d.Status, e.Status) {
+		d.StatusChanges++
+	}
+
+	for _, field := range []struct {
+		value  string
+		target *string
+	}{
+		{e.Subject, &d.Subject},
+		{e.URL, &d.URL},
+		{e.Status, &d.Status},
+		{e.Priority, &d.Priority},
+		{e.Organization, &d.Organization},
+	} {
+		if field.value != "" {
+			*field.target = field.value
+		}
+	}
+}
+
+// post renders the summary of the digest, without the channel and the author. The card looks like
+// the notification of a single update, see webhookEvent.post.
+func (d *watchDigest) post(colors map[string]string) *model.Post {
+	var lines []string
+	if d.Created {
+		lines = append(lines, "The ticket was created")
+	}
+	for _, count := range []struct {
+		n    int
+		noun string
+	}{
+		{d.PublicComments, "public comment"},
+		{d.PrivateComments, "private comment"},
+		{d.StatusChanges, "status change"},
+	} {
+		if count.n == 1 {
+			lines = append(lines, "1 "+count.noun)
+		} else if count.n > 1 {
+			lines = append(lines, fmt.Sprintf("%d %ss", count.n, count.noun))
+		}
+	}
+	if len(d.Authors) > 0 {
+		lines = append(lines, "Comments by **"+strings.Join(d.Authors, "**, **")+"**")
+	}
+
+	title := ticketEventTitle(formatID(d.Subscription.TicketID), d.Subject, d.URL)
+	post := &model.Post{Message: "Updates of ticket " + title + " since the last post"}
+	post.AddProp("attachments", []*model.SlackAttachment{
+		ticketEventAttachment(d.Status, d.Priority, d.Organization, "- "+strings.Join(lines, "\n- "), colors),
+	})
+	return post
+}
+
+// watchDigestFlushInterval is how often the digests due are looked for.
+const watchDigestFlushInterval = time.Minute
+
+// startWatchDigestFlusher flushes the digests due until stopWatchDigestFlusher is called. Every
+// server of a cluster runs a flusher, see flushWatchDigest.
+func (p *Plugin) startWatchDigestFlusher() {
+	stop := make(chan struct{})
+	p.watchDigestFlusherStop = stop
+
+	go func() {
+		ticker := time.NewTicker(watchDigestFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				p.flushWatchDigests(now)
+			}
+		}
+	}()
+}
+
+// stopWatchDigestFlusher stops the flusher started by startWatchDigestFlusher, if any.
+func (p *Plugin) stopWatchDigestFlusher() {
+	if p.watchDigestFlusherStop != nil {
+		close(p.watchDigestFlusherStop)
+		p.watchDigestFlusherStop = nil
+	}
+}
+
+// flushWatchDigests posts the digests due. A digest that fails is tried again on the next flush.
+func (p *Plugin) flushWatchDigests(now time.Time) {
+	_, ids, err := p.loadList(watchDigestsKey, "watch digests")
+	if err != nil {
+		p.API.LogWarn("failed to list the watch digests", "error", err.Error())
+		return
+	}
+	for _, id := range ids {
+		if err := p.flushWatchDigest(id, now); err != nil {
+			p.API.LogWarn("failed to flush the watch digest", "subscription_id", id, "error", err.Error())
+		}
+	}
+}
+
+// flushWatchDigest posts the digest of a subscription if it is due. The digest is compared and
+// deleted before it is posted, so when several servers of a cluster flush it at once only one of
+// them posts it, and an update added meanwhile is flushed on the next run instead of lost.
+func (p *Plugin) flushWatchDigest(id string, now time.Time) error {
+	key := watchDigestKeyPrefix + id
+	data, digest, err := p.loadWatchDigest(key)
+	if err != nil {
+		return err
+	}
+	if digest == nil {
+		return p.unlistWatchDigest(id)
+	}
+	if now.Unix() < digest.FlushAt {
+		return nil
+	}
+
+	sub := digest.Subscription
+	settings, err := p.getWatchSettings(sub)
+	if err != nil {
+		return err
+	}
+	// A digest due during quiet hours, e.g. after they were set, waits for their end.
+	if end, quiet := settings.QuietHours.endAfter(now); quiet {
+		digest.FlushAt = end.Unix()
+		newData, err := json.Marshal(digest)
+		if err != nil {
+			return err
+		}
+		if _, appErr := p.API.KVCompareAndSet(key, data, newData); appErr != nil {
+			return errors.Wrap(appErr, "failed to postpone the watch digest")
+		}
+		return nil
+	}
+
+	deleted, appErr := p.API.KVCompareAndDelete(key, data)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to delete the watch digest")
+	}
+	if !deleted {
+		return nil
+	}
+
+	// The channel may have stopped watching the ticket since the updates were held back.
+	watchers, err := p.getTicketWatchers(sub.Instance, sub.TicketID)
+	if err != nil {
+		return err
+	}
+	if containsString(watchers, sub.ChannelID) {
+		post := digest.post(p.getConfiguration().getTicketColors())
+		post.UserId = p.botID
+		post.ChannelId = sub.ChannelID
+		if _, appErr := p.createChannelPost(post); appErr != nil {
+			return errors.Wrap(appErr, "failed to post the watch digest")
+		}
+	}
+	return p.unlistWatchDigest(id)
+}
+
+// unlistWatchDigest removes a flushed digest from the list of digests. A digest stored again
+// meanwhile is listed again, so it isn't left out of the next flushes.
+func (p *Plugin) unlistWatchDigest(id string) error {
+	if _, err := p.setListMember(watchDigestsKey, id, false, "watch digests"); err != nil {
+		return err
+	}
+	data, _, err := p.loadWatchDigest(watchDigestKeyPrefix + id)
+	if err != nil || data == nil {
+		return err
+	}
+	_, err = p.setListMember(watchDigestsKey, id, true, "watch digests")
+	return err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuietHours(t *testing.T) {
+	quiet, ok := parseQuietHours("22:00-7:30", "UTC", true)
+	require.True(t, ok)
+	assert.Equal(t, &quietHours{Start: 22 * 60, End: 7*60 + 30, TimeZone: "UTC", Digest: true}, quiet)
+	assert.Equal(t, "22:00-07:30", quiet.String())
+
+	for _, value := range []string{"", "22:00", "22:00-22:00", "25:00-07:00", "22:00-07:00-08:00", "night"} {
+		_, ok := parseQuietHours(value, "UTC", false)
+		assert.False(t, ok, value)
+	}
+}
+
+func TestQuietHoursEndAfter(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2020, 6, 1, hour, minute, 0, 0, time.UTC)
+	}
+	night := &quietHours{Start: 22 * 60, End: 7 * 60, TimeZone: "UTC"}
+	lunch := &quietHours{Start: 12 * 60, End: 13 * 60, TimeZone: "UTC"}
+
+	for _, test := range []struct {
+		quiet *quietHours
+		t     time.Time
+		end   time.Time
+		ok    bool
+	}{
+		{night, at(23, 0), time.Date(2020, 6, 2, 7, 0, 0, 0, time.UTC), true},
+		{night, at(6, 59), at(7, 0), true},
+		{night, at(7, 0), time.Time{}, false},
+		{night, at(21, 59), time.Time{}, false},
+		{lunch, at(12, 30), at(13, 0), true},
+		{lunch, at(13, 30), time.Time{}, false},
+		{nil, at(12, 30), time.Time{}, false},
+	} {
+		end, ok := test.quiet.endAfter(test.t)
+		assert.Equal(t, test.ok, ok, test.t)
+		assert.True(t, test.end.Equal(end), "%v ends at %v, not %v", test.t, end, test.end)
+	}
+}
+
+func TestWatchQuiet(t *testing.T) {
+	ct := newCommandTest(t, nil)
+	defer ct.close()
+	ct.api.On("GetUser", "user").Return(&model.User{}, nil)
+
+	if message := ct.execute(t, "/zendesk watch quiet 7 22:00-07:00"); !strings.Contains(message, "isn't watching") {
+		t.Errorf("unexpected response for an unwatched ticket: %s", message)
+	}
+
+	_, err := ct.p.setTicketWatcher(defaultInstanceName, 7, "channel", true)
+	require.NoError(t, err)
+	sub := watchSubscription{Instance: defaultInstanceName, TicketID: 7, ChannelID: "channel"}
+
+	assert.Contains(t, ct.execute(t, "/zendesk watch quiet 7 night"), "aren't valid quiet hours")
+	assert.Contains(t, ct.execute(t, "/zendesk watch quiet 7 22:00-07:00 --digest"), "summed up")
+	settings, err := ct.p.getWatchSettings(sub)
+	require.NoError(t, err)
+	assert.Equal(t, &quietHours{Start: 22 * 60, End: 7 * 60, TimeZone: "UTC", Digest: true}, settings.QuietHours)
+
+	assert.Contains(t, ct.execute(t, "/zendesk watch quiet 7 off"), "right away again")
+	assert.NotContains(t, ct.kv, watchSettingsKeyPrefix+sub.id(), "empty settings are deleted")
+
+	ct.execute(t, "/zendesk watch quiet 7 22:00-07:00")
+	ct.execute(t, "/zendesk unwatch 7")
+	assert.NotContains(t, ct.kv, watchSettingsKeyPrefix+sub.id(), "the settings are deleted with the watch")
+}
+
+func TestWebhookQuietHours(t *testing.T) {
+	ct := newCommandTest(t, nil)
+	defer ct.close()
+	ct.p.botID = "bot"
+	ct.p.setConfiguration(&configuration{WebhookSecret: "s3cret"})
+
+	var posts []*model.Post
+	ct.api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		posts = append(posts, args.Get(0).(*model.Post))
+	}).Return(&model.Post{}, nil)
+
+	// The quiet hours of the digest channel are around now, the other channel has none.
+	for _, channelID := range []string{"digest", "dropped", "loud"} {
+		_, err := ct.p.setTicketWatcher(defaultInstanceName, 7, channelID, true)
+		require.NoError(t, err)
+	}
+	now := time.Now().UTC()
+	minute := now.Hour()*60 + now.Minute()
+	quiet := func(digest bool) *watchSettings {
+		return &watchSettings{QuietHours: &quietHours{Start: (minute + 23*60) % (24 * 60), End: (minute + 60) % (24 * 60), TimeZone: "UTC", Digest: digest}}
+	}
+	digestSub := watchSubscription{Instance: defaultInstanceName, TicketID: 7, ChannelID: "digest"}
+	require.NoError(t, ct.p.setWatchSettings(digestSub, quiet(true)))
+	require.NoError(t, ct.p.setWatchSettings(watchSubscription{Instance: defaultInstanceName, TicketID: 7, ChannelID: "dropped"}, quiet(false)))
+
+	for _, body := range []string{
+		`{"event":"ticket_created","ticket_id":"7","subject":"Printer on fire","status":"new","requester":"Jane"}`,
+		`{"event":"comment_added","ticket_id":"7","author":"Bob","comment_public":"true","status":"open"}`,
+		`{"event":"comment_added","ticket_id":"7","author":"Bob","comment_public":"false","status":"open"}`,
+		`{"event":"comment_added","ticket_id":"7","author":"Ann","comment_public":"true","status":"pending"}`,
+	} {
+		r := httptest.NewRequest(http.MethodPost, routeWebhook+"?secret=s3cret", strings.NewReader(body))
+		status, err := httpWebhook(ct.p, httptest.NewRecorder(), r)
+		require.Equal(t, http.StatusOK, status, err)
+	}
+	for _, post := range posts {
+		assert.Equal(t, "loud", post.ChannelId, "only the channel without quiet hours is posted to")
+	}
+	assert.Len(t, posts, 4)
+
+	// The digest is posted once the quiet hours are over, and only once.
+	posts = nil
+	ct.p.flushWatchDigests(now)
+	assert.Empty(t, posts, "the digest isn't due before the end of the quiet hours")
+	ct.p.flushWatchDigests(now.Add(61 * time.Minute))
+	ct.p.flushWatchDigests(now.Add(62 * time.Minute))
+	if assert.Len(t, posts, 1) {
+		assert.Equal(t, "digest", posts[0].ChannelId)
+		assert.Equal(t, "bot", posts[0].UserId)
+		assert.Equal(t, "Updates of ticket #7 Printer on fire since the last post", posts[0].Message)
+		attachment := posts[0].Attachments()[0]
+		assert.Equal(t, "- The ticket was created\n- 2 public comments\n- 1 private comment\n- 2 status changes\n- Comments by **Bob**, **Ann**", attachment.Text)
+		assert.Equal(t, "pending", attachment.Fields[0].Value)
+	}
+	assert.NotContains(t, ct.kv, watchDigestKeyPrefix+digestSub.id())
+	assert.NotContains(t, ct.kv, watchDigestsKey)
+}
+
+func TestFlushWatchDigestOfUnwatchedTicket(t *testing.T) {
+	ct := newCommandTest(t, nil)
+	defer ct.close()
+
+	sub := watchSubscription{Instance: defaultInstanceName, TicketID: 7, ChannelID: "channel"}
+	now := time.Now()
+	require.NoError(t, ct.p.addToWatchDigest(sub, &webhookEvent{Event: webhookEventCommentAdded, TicketID: "7"}, now))
+
+	// CreatePost isn't mocked, the channel stopped watching the ticket.
+	ct.p.flushWatchDigests(now)
+	assert.NotContains(t, ct.kv, watchDigestKeyPrefix+sub.id(), fmt.Sprint(ct.kv))
+	assert.NotContains(t, ct.kv, watchDigestsKey)
+}
+
+func TestWatchDigest(t *testing.T) {
+	ct := newCommandTest(t, nil)
+	defer ct.close()
+	ct.p.botID = "bot"
+
+	_, err := ct.p.setTicketWatcher(defaultInstanceName, 7, "channel", true)
+	require.NoError(t, err)
+	sub := watchSubscription{Instance: defaultInstanceName, TicketID: 7, ChannelID: "channel"}
+
+	assert.Contains(t, ct.execute(t, "/zendesk watch digest 7 0"), "isn't a valid digest interval")
+	assert.Contains(t, ct.execute(t, "/zendesk watch digest 7 1441"), "isn't a valid digest interval")
+	assert.Contains(t, ct.execute(t, "/zendesk watch digest 7 30"), "every 30 minutes")
+
+	var posts []*model.Post
+	ct.api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		posts = append(posts, args.Get(0).(*model.Post))
+	}).Return(&model.Post{}, nil)
+
+	// The updates are held back for the interval from the first one.
+	now := time.Now()
+	for i, status := range []string{"open", "open", "solved"} {
+		held, err := ct.p.holdWatchUpdate(sub, &webhookEvent{Event: webhookEventCommentAdded, TicketID: "7", Status: status, CommentPublic: "true"}, now.Add(time.Duration(i)*time.Minute))
+		require.NoError(t, err)
+		assert.True(t, held)
+	}
+	ct.p.flushWatchDigests(now.Add(29 * time.Minute))
+	assert.Empty(t, posts)
+	ct.p.flushWatchDigests(now.Add(30 * time.Minute))
+	if assert.Len(t, posts, 1) {
+		assert.Equal(t, "- 3 public comments\n- 1 status change", posts[0].Attachments()[0].Text)
+	}
+
+	assert.Contains(t, ct.execute(t, "/zendesk watch digest 7 off"), "posted to this channel right away")
+	held, err := ct.p.holdWatchUpdate(sub, &webhookEvent{Event: webhookEventCommentAdded, TicketID: "7"}, now)
+	require.NoError(t, err)
+	assert.False(t, held, "updates are posted right away without a digest")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// Values of healthStatus.Zendesk.
+const (
+	healthOK    = "ok"
+	healthError = "error"
+)
+
+// healthStatus is the JSON body of the health route.
+type healthStatus struct {
+	Zendesk string `json:"zendesk"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// httpHealth checks that Zendesk can be reached, for monitoring. The current user of the Zendesk
+// instance (selected with the instance query parameter) is loaded with the shared client of the
+// plugin when it has a Zendesk account for the instance, see getSharedClient, and with the
+// connection of the system admin calling the route otherwise, e.g. with a personal access token.
+// Zendesk failures are reported with 503 Service Unavailable. Errors are summarized, so neither
+// credentials nor tokens end up in the response.
+func httpHealth(p *Plugin, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, errors.New("method " + r.Method + " is not allowed, must be GET")
+	}
+
+	userID := r.Header.Get("Mattermost-User-ID")
+	if userID == "" {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+	if !p.API.HasPermissionTo(userID, model.PERMISSION_MANAGE_SYSTEM) {
+		return http.StatusForbidden, errors.New("only system admins can check the health of the plugin")
+	}
+
+	instance, err := p.getConfiguration().getInstance(r.URL.Query().Get("instance"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	status := http.StatusOK
+	health := healthStatus{Zendesk: healthOK}
+	if detail := p.checkZendesk(userID, instance); detail != "" {
+		status = http.StatusServiceUnavailable
+		health = healthStatus{Zendesk: healthError, Detail: detail}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "failed to write the health status")
+	}
+	return status, nil
+}
+
+// checkZendesk loads the current Zendesk user with the shared client, or the connection of a
+// Mattermost user, and describes what failed, "" if nothing did.
+func (p *Plugin) checkZendesk(userID string, instance *zendeskInstance) string {
+	// The account of the plugin belongs to the default instance.
+	var client *Client
+	err := errNoSharedCredentials
+	if instance.isDefault() {
+		client, err = p.getSharedClient(model.NewId())
+	}
+	if err == errNoSharedCredentials {
+		client, err = p.getInstanceClient(userID, instance, model.NewId())
+	}
+	if err == errNotConnected {
+		return "the user checking the health is not connected to Zendesk"
+	}
+	if err != nil {
+		return "failed to create a Zendesk client"
+	}
+
+	if _, err := client.ShowCurrentUser(); err != nil {
+		if apiErr, ok := err.(*zendesk.APIError); ok && apiErr.Response != nil {
+			return "Zendesk answered with status " + strconv.Itoa(apiErr.Response.StatusCode)
+		}
+		return "Zendesk could not be reached"
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	zendeskStatus := http.StatusOK
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(zendeskStatus)
+		_, _ = w.Write([]byte(`{"user":{"id":5,"name":"Jane Doe"}}`))
+	})
+	defer ct.close()
+	ct.api.On("HasPermissionTo", "user", model.PERMISSION_MANAGE_SYSTEM).Return(true)
+	ct.api.On("HasPermissionTo", "other", model.PERMISSION_MANAGE_SYSTEM).Return(false)
+
+	check := func(userID string) (int, string) {
+		r := httptest.NewRequest(http.MethodGet, routeHealth, nil)
+		if userID != "" {
+			r.Header.Set("Mattermost-User-ID", userID)
+		}
+		w := httptest.NewRecorder()
+		status, _ := httpHealth(ct.p, w, r)
+		return status, w.Body.String()
+	}
+
+	status, _ := check("")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = check("other")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, body := check("user")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"zendesk":"ok"}`, body)
+
+	zendeskStatus = http.StatusInternalServerError
+	status, body = check("user")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.JSONEq(t, `{"zendesk":"error","detail":"Zendesk answered with status 500"}`, body)
+	assert.NotContains(t, body, "token")
+
+	delete(ct.kv, "user"+tokenKeySuffix)
+	status, body = check("user")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.JSONEq(t, `{"zendesk":"error","detail":"the user checking the health is not connected to Zendesk"}`, body)
+}
+
+func TestHealthUsesSharedClient(t *testing.T) {
+	var authorization string
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"user":{"id":5,"name":"Plugin Bot"}}`))
+	})
+	defer ct.close()
+	ct.api.On("HasPermissionTo", "admin", model.PERMISSION_MANAGE_SYSTEM).Return(true)
+	encrypted, err := ct.p.encryptToken("s3cret")
+	require.NoError(t, err)
+	ct.p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: ct.server.URL,
+		ZendeskUser: "bot@example.com/token", ZendeskPassword: encryptedSettingPrefix + encrypted})
+
+	// The admin checking the health isn't connected to Zendesk.
+	r := httptest.NewRequest(http.MethodGet, routeHealth, nil)
+	r.Header.Set("Mattermost-User-ID", "admin")
+	w := httptest.NewRecorder()
+	status, _ := httpHealth(ct.p, w, r)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"zendesk":"ok"}`, w.Body.String())
+
+	expected := &http.Request{Header: http.Header{}}
+	expected.SetBasicAuth("bot@example.com/token", "s3cret")
+	assert.Equal(t, expected.Header.Get("Authorization"), authorization)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/mattermost/go-i18n/i18n/bundle"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// defaultLocale is the language of users whose locale has no translation, every message has an
+// English translation.
+const defaultLocale = "en"
+
+// loadTranslations loads the translations of the messages of the plugin from dir, one file per
+// locale in the go-i18n format, e.g. assets/i18n/en.json.
+func (p *Plugin) loadTranslations(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return errors.Wrap(err, "failed to list the translation files")
+	}
+
+	translations := bundle.New()
+	for _, file := range files {
+		if err := translations.LoadTranslationFile(file); err != nil {
+			return errors.Wrapf(err, "failed to load the translation file %s", filepath.Base(file))
+		}
+	}
+	if len(translations.LanguageTranslationIDs(defaultLocale)) == 0 {
+		return errors.Errorf("the %s translations are missing from %s", defaultLocale, dir)
+	}
+	p.translations = translations
+	return nil
+}
+
+// T returns the function translating messages for a user, in their Mattermost locale. Messages
+// without a translation in that locale are in English. The user is only loaded when there are
+// translations other than English.
+func (p *Plugin) T(userID string) bundle.TranslateFunc {
+	translations := p.translations
+	if translations == nil {
+		translations = bundle.New()
+	}
+	english, _ := translations.Tfunc(defaultLocale)
+
+	locale := defaultLocale
+	if len(translations.LanguageTags()) > 1 {
+		if user, appErr := p.API.GetUser(userID); appErr == nil && user.Locale != "" {
+			locale = user.Locale
+		}
+	}
+	if locale == defaultLocale {
+		return english
+	}
+
+	localized, _ := translations.Tfunc(locale, defaultLocale)
+	return func(translationID string, args ...interface{}) string {
+		if text := localized(translationID, args...); text != translationID {
+			return text
+		}
+		return english(translationID, args...)
+	}
+}
+
+// respondT responds to a command with a message translated for the user running it, see T.
+func (p *Plugin) respondT(commandArgs *model.CommandArgs, translationID string, args ...interface{}) *model.CommandResponse {
+	p.postCommandResponse(commandArgs, p.T(commandArgs.UserId)(translationID, args...))
+	return &model.CommandResponse{}
+}
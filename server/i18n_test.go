@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranslations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "i18n")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	api := &plugintest.API{}
+	p := newTestPlugin(api)
+	assert.Error(t, p.loadTranslations(dir), "the English translations are required")
+
+	english, err := ioutil.ReadFile(filepath.Join("..", "assets", "i18n", "en.json"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "en.json"), english, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "fr.json"), []byte(`[
+		{"id": "zendesk.error.ticket_not_found", "translation": "Le ticket #{{.TicketID}} est introuvable."},
+		{"id": "zendesk.queue.open", "translation": "Ouverts ({{.Count}})"}
+	]`), 0600))
+	require.NoError(t, p.loadTranslations(dir))
+
+	api.On("GetUser", "french").Return(&model.User{Locale: "fr"}, nil)
+	api.On("GetUser", "german").Return(&model.User{Locale: "de"}, nil)
+
+	T := p.T("french")
+	assert.Equal(t, "Le ticket #12 est introuvable.", T("zendesk.error.ticket_not_found", map[string]interface{}{"TicketID": 12}))
+	assert.Equal(t, "Zendesk is rate limiting us, try again shortly.", T("zendesk.error.rate_limited"), "missing translations are in English")
+	assert.Equal(t, "Ticket #12 was not found.", p.T("german")("zendesk.error.ticket_not_found", map[string]interface{}{"TicketID": 12}))
+	assert.Equal(t, "Ouverts (3)", T("zendesk.queue.open", map[string]interface{}{"Count": 3}))
+}
+
+// translationIDRegexp matches the translation IDs in the sources of the plugin, IDs ending with a
+// dot are prefixes completed at runtime.
+var translationIDRegexp = regexp.MustCompile(`"(zendesk\.[a-z0-9_.]*[a-z0-9_])"`)
+
+func TestTranslationIDsHaveEnglish(t *testing.T) {
+	api := &plugintest.API{}
+	p := newTestPlugin(api)
+	english := p.T("user")
+
+	sources, err := filepath.Glob("*.go")
+	require.NoError(t, err)
+	for _, source := range sources {
+		if strings.HasSuffix(source, "_test.go") {
+			continue
+		}
+		data, err := ioutil.ReadFile(source)
+		require.NoError(t, err)
+		for _, match := range translationIDRegexp.FindAllStringSubmatch(string(data), -1) {
+			assert.NotEqual(t, match[1], english(match[1]), "%s uses a message without an English translation", source)
+		}
+	}
+}
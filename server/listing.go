@@ -0,0 +1,365 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/mattermost/go-i18n/i18n/bundle"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+)
+
+// ticketSort is an order of the tickets listed by `/zendesk list` and `/zendesk search`, selected
+// with the --sort flag. Zendesk sorts the results by sortBy, less sorts them again in the plugin
+// for the results Zendesk doesn't sort, e.g. after they were filtered.
+type ticketSort struct {
+	sortBy string
+	less   func(a, b *zendesk.Ticket) bool
+}
+
+// ticketSorts are the values of the --sort flag. Tickets are listed most urgent or newest first.
+var ticketSorts = map[string]ticketSort{
+	"priority": {
+		sortBy: "priority",
+		less: func(a, b *zendesk.Ticket) bool {
+			return priorityRank(a) < priorityRank(b)
+		},
+	},
+	"updated": {
+		sortBy: "updated_at",
+		less: func(a, b *zendesk.Ticket) bool {
+			return a.UpdatedAt != nil && (b.UpdatedAt == nil || a.UpdatedAt.After(*b.UpdatedAt))
+		},
+	},
+	"created": {
+		sortBy: "created_at",
+		less: func(a, b *zendesk.Ticket) bool {
+			return a.CreatedAt != nil && (b.CreatedAt == nil || a.CreatedAt.After(*b.CreatedAt))
+		},
+	},
+}
+
+// ticketPriorityRank orders tickets from the most to the least urgent, tickets without a
+// priority come last.
+var ticketPriorityRank = map[string]int{"urgent": 0, "high": 1, "normal": 2, "low": 3}
+
+func priorityRank(ticket *zendesk.Ticket) int {
+	if ticket.Priority != nil {
+		if r, ok := ticketPriorityRank[*ticket.Priority]; ok {
+			return r
+		}
+	}
+	return len(ticketPriorityRank)
+}
+
+// sortTickets sorts tickets in place, keeping the order of Zendesk for equal tickets. The order of
+// Zendesk is kept entirely without a sort, e.g. the relevance of search results.
+func sortTickets(tickets []zendesk.Ticket, sortKey string) []zendesk.Ticket {
+	if s, ok := ticketSorts[sortKey]; ok {
+		sort.SliceStable(tickets, func(i, j int) bool {
+			return s.less(&tickets[i], &tickets[j])
+		})
+	}
+	return tickets
+}
+
+// listOptions are the flags of the commands listing tickets, parsed by parseListFlags.
+type listOptions struct {
+	// sort is a key of ticketSorts, "" keeps the default order of the command.
+	sort string
+	// limit is the number of tickets to list, 0 lists the number configured for the command.
+	limit int
+}
+
+// parseListFlags parses the leading --sort=<key> and --limit=<number> flags of a command listing
+// tickets and returns the remaining arguments. Limits beyond maxLimit are capped.
+func parseListFlags(T bundle.TranslateFunc, args []string, maxLimit int) (listOptions, []string, error) {
+	var options listOptions
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		name, value := args[0], ""
+		if i := strings.Index(args[0], "="); i >= 0 {
+			name, value = args[0][:i], args[0][i+1:]
+		}
+
+		switch name {
+		case "--sort":
+			key := strings.ToLower(value)
+			if _, ok := ticketSorts[key]; !ok {
+				return options, nil, errors.New(T("zendesk.list.unknown_sort", map[string]interface{}{"Sort": value, "Sorts": strings.Join(ticketSortKeys(), ", ")}))
+			}
+			options.sort = key
+		case "--limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 1 {
+				return options, nil, errors.New(T("zendesk.list.invalid_limit", map[string]interface{}{"Limit": value}))
+			}
+			if limit > maxLimit {
+				limit = maxLimit
+			}
+			options.limit = limit
+		default:
+			return options, nil, errors.New(T("zendesk.list.unknown_flag", map[string]interface{}{"Flag": name, "Sorts": strings.Join(ticketSortKeys(), "|")}))
+		}
+		args = args[1:]
+	}
+	return options, args, nil
+}
+
+// ticketSortKeys returns the values of the --sort flag in alphabetical order.
+func ticketSortKeys() []string {
+	keys := make([]string, 0, len(ticketSorts))
+	for key := range ticketSorts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// queueGroups are the sections of `/zendesk queue` in the order they are shown, by ticket status.
+var queueGroups = []struct {
+	status  string
+	titleID string
+}{
+	{status: "new", titleID: "zendesk.queue.new"},
+	{status: "open", titleID: "zendesk.queue.open"},
+	{status: "pending", titleID: "zendesk.queue.pending"},
+	{status: "hold", titleID: "zendesk.queue.hold"},
+}
+
+// queueAttachments renders tickets as one attachment per status of queueGroups, titled with the
+// number of tickets in it and colored like the details card of the status. Tickets keep their
+// order within a section, sections without tickets are left out. Tickets are listed with the names
+// of their organizations found in organizationNames.
+func queueAttachments(T bundle.TranslateFunc, client *Client, tickets []zendesk.Ticket, organizationNames map[int64]string, colors map[string]string) []*model.SlackAttachment {
+	var attachments []*model.SlackAttachment
+	for _, group := range queueGroups {
+		var lines []string
+		for i := range tickets {
+			if stringValue(tickets[i].Status) != group.status {
+				continue
+			}
+			line := "* " + client.ticketLink(&tickets[i])
+			if tickets[i].Priority != nil {
+				line += ", priority **" + *tickets[i].Priority + "**"
+			}
+			if tickets[i].OrganizationID != nil && organizationNames[*tickets[i].OrganizationID] != "" {
+				line += ", " + organizationNames[*tickets[i].OrganizationID]
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) == 0 {
+			continue
+		}
+
+		color, ok := colors[group.status]
+		if !ok {
+			color = defaultTicketColor
+		}
+		attachments = append(attachments, &model.SlackAttachment{
+			Color: color,
+			Title: T(group.titleID, map[string]interface{}{"Count": len(lines)}),
+			Text:  strings.Join(lines, "\n"),
+		})
+	}
+	return attachments
+}
+
+// ticketListing is the search of `/zendesk search` or the assigned tickets of `/zendesk list`,
+// shown a page at a time by showTicketPage. Listings with several pages are stored for the
+// buttons browsing them, along with the command they were made by.
+type ticketListing struct {
+	UserID    string `json:"user_id"`
+	ChannelID string `json:"channel_id"`
+	TeamID    string `json:"team_id"`
+	RootID    string `json:"root_id"`
+	// Command selects the Zendesk instance, see resolveInstance.
+	Command string `json:"command"`
+
+	// Query is the search, "" lists the open and pending tickets assigned to the agent.
+	Query string `json:"query"`
+	// Sort is a key of ticketSorts.
+	Sort string `json:"sort"`
+	// Limit is the number of tickets per page.
+	Limit int `json:"limit"`
+}
+
+func newTicketListing(commandArgs *model.CommandArgs, query, sortKey string, limit int) *ticketListing {
+	return &ticketListing{
+		UserID:    commandArgs.UserId,
+		ChannelID: commandArgs.ChannelId,
+		TeamID:    commandArgs.TeamId,
+		RootID:    commandArgs.RootId,
+		Command:   commandArgs.Command,
+		Query:     query,
+		Sort:      sortKey,
+		Limit:     limit,
+	}
+}
+
+// commandArgs returns the arguments of the command that made the listing.
+func (l *ticketListing) commandArgs() *model.CommandArgs {
+	return &model.CommandArgs{
+		UserId:    l.UserID,
+		ChannelId: l.ChannelID,
+		TeamId:    l.TeamID,
+		RootId:    l.RootID,
+		Command:   l.Command,
+	}
+}
+
+// fetch returns a page of the tickets of the listing, numbered from 1, and the total number of
+// tickets.
+func (l *ticketListing) fetch(client *Client, page int) ([]zendesk.Ticket, int, error) {
+	sortBy := ticketSorts[l.Sort].sortBy
+	if l.Query != "" {
+		tickets, total, err := client.SearchTicketsByQuery(l.Query, page, l.Limit, sortBy)
+		return sortTickets(tickets, l.Sort), total, err
+	}
+	assigned, total, err := client.ListAssignedTickets([]string{"open", "pending"}, page, l.Limit, sortBy)
+	return sortTickets(filterTicketsByStatus(assigned, "open", "pending"), l.Sort), total, err
+}
+
+// pages returns the number of pages of total tickets. Zendesk doesn't return the results beyond
+// maxSearchResults, so neither are their pages.
+func (l *ticketListing) pages(total int) int {
+	if total > maxSearchResults {
+		total = maxSearchResults
+	}
+	return (total + l.Limit - 1) / l.Limit
+}
+
+// message introduces a page of shown of total tickets of the listing.
+func (l *ticketListing) message(T bundle.TranslateFunc, page, shown, total int) string {
+	switch {
+	case l.Query != "":
+		return T("zendesk.search.results", map[string]interface{}{"Query": l.Query})
+	case page > 1 || total <= shown:
+		return T("zendesk.list.title")
+	case l.Sort == "priority":
+		return T("zendesk.list.most_urgent", map[string]interface{}{"Shown": shown, "Total": total})
+	default:
+		return T("zendesk.list.most_recent", map[string]interface{}{"Shown": shown, "Sort": l.Sort, "Total": total})
+	}
+}
+
+// showTicketPage sends a page of a listing to the user, or replaces the post with ID postID by it.
+// When the listing has several pages, it is stored under listingID, or a new ID when it is "",
+// and the page ends with buttons to the previous and next pages.
+func (p *Plugin) showTicketPage(commandArgs *model.CommandArgs, client *Client, listing *ticketListing, listingID string, page int, postID string) *model.CommandResponse {
+	tickets, total, err := listing.fetch(client, page)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if len(tickets) == 0 {
+		switch {
+		case page > 1:
+			return p.respondT(commandArgs, "zendesk.list.no_more")
+		case listing.Query != "":
+			return p.respondT(commandArgs, "zendesk.search.no_results", map[string]interface{}{"Query": listing.Query})
+		default:
+			return p.respondT(commandArgs, "zendesk.list.empty")
+		}
+	}
+
+	T := p.T(commandArgs.UserId)
+	post := p.ticketListPost(commandArgs, client, listing.message(T, page, len(tickets), total), tickets)
+	if pages := listing.pages(total); pages > 1 {
+		if listingID == "" {
+			if listingID, err = p.storeTicketListing(listing); err != nil {
+				return p.respondError(commandArgs, err)
+			}
+		}
+		post.AddProp("attachments", append(post.Attachments(), p.pageAttachment(T, listingID, page, pages)))
+	}
+
+	if postID != "" {
+		post.Id = postID
+		_ = p.API.UpdateEphemeralPost(commandArgs.UserId, post)
+		return &model.CommandResponse{}
+	}
+	_ = p.API.SendEphemeralPost(commandArgs.UserId, post)
+	return &model.CommandResponse{}
+}
+
+// pageAttachment tells which page of a listing is shown, with buttons to the pages around it.
+func (p *Plugin) pageAttachment(T bundle.TranslateFunc, listingID string, page, pages int) *model.SlackAttachment {
+	button := func(id, name string, page int) *model.PostAction {
+		return &model.PostAction{
+			Id:   id,
+			Type: model.POST_ACTION_TYPE_BUTTON,
+			Name: name,
+			Integration: &model.PostActionIntegration{
+				URL:     p.GetPluginURL() + routeActionPage,
+				Context: map[string]interface{}{"listing_id": listingID, "page": page},
+			},
+		}
+	}
+
+	attachment := &model.SlackAttachment{
+		Text: T("zendesk.list.page", map[string]interface{}{"Page": page, "Pages": pages}),
+	}
+	if page > 1 {
+		attachment.Actions = append(attachment.Actions, button("previous", T("zendesk.list.previous"), page-1))
+	}
+	if page < pages {
+		attachment.Actions = append(attachment.Actions, button("next", T("zendesk.list.next"), page+1))
+	}
+	return attachment
+}
+
+// httpActionPage shows another page of a listing, for the buttons of pageAttachment. The page
+// replaces the one shown, the user is told to run the command again once the listing expired.
+func httpActionPage(p *Plugin, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("method " + r.Method + " is not allowed, must be POST")
+	}
+
+	userID := r.Header.Get("Mattermost-User-ID")
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil {
+		return http.StatusBadRequest, errors.New("failed to decode the action request")
+	}
+	if userID == "" || request.UserId != userID {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+
+	listingID, _ := request.Context["listing_id"].(string)
+	// Numbers of the context are decoded from JSON.
+	page, _ := request.Context["page"].(float64)
+	if page < 1 {
+		return http.StatusBadRequest, errors.New("a page is required")
+	}
+	listing, err := p.getTicketListing(listingID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if listing == nil {
+		p.respondT(&model.CommandArgs{UserId: userID, ChannelId: request.ChannelId}, "zendesk.list.expired")
+	} else {
+		if listing.UserID != userID {
+			return http.StatusForbidden, errors.New("the tickets were listed for another user")
+		}
+		p.runHandler("list/page", func(p *Plugin, _ *plugin.Context, commandArgs *model.CommandArgs, _ ...string) *model.CommandResponse {
+			token, ok := p.requireConnected(commandArgs)
+			if !ok {
+				return &model.CommandResponse{}
+			}
+			client, err := p.getUserClient(commandArgs, token)
+			if err != nil {
+				return p.respondError(commandArgs, err)
+			}
+			return p.showTicketPage(commandArgs, client, listing, listingID, int(page), request.PostId)
+		}, nil, listing.commandArgs())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write((&model.PostActionIntegrationResponse{}).ToJson()); err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "failed to write the action response")
+	}
+	return http.StatusOK, nil
+}
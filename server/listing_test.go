@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListFlags(t *testing.T) {
+	T := newTestPlugin(&plugintest.API{}).T("user")
+	options, rest, err := parseListFlags(T, []string{"--sort=Updated", "--limit=5", "login", "--error"}, 50)
+	require.NoError(t, err)
+	assert.Equal(t, listOptions{sort: "updated", limit: 5}, options)
+	assert.Equal(t, []string{"login", "--error"}, rest, "only leading flags are parsed")
+
+	options, _, err = parseListFlags(T, []string{"--limit=500"}, 50)
+	require.NoError(t, err)
+	assert.Equal(t, 50, options.limit)
+
+	_, _, err = parseListFlags(T, []string{"--sort=name"}, 50)
+	assert.EqualError(t, err, "unknown sort `name`, please use one of: created, priority, updated")
+	_, _, err = parseListFlags(T, []string{"--limit=0"}, 50)
+	assert.Error(t, err)
+	_, _, err = parseListFlags(T, []string{"--order=asc"}, 50)
+	assert.Error(t, err)
+}
+
+func TestSortTickets(t *testing.T) {
+	day := func(d int) *time.Time {
+		stamp := time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC)
+		return &stamp
+	}
+	tickets := []zendesk.Ticket{
+		{ID: zendesk.Int(1), UpdatedAt: day(2), CreatedAt: day(1)},
+		{ID: zendesk.Int(2), UpdatedAt: day(3), CreatedAt: day(2)},
+		{ID: zendesk.Int(3)},
+		{ID: zendesk.Int(4), UpdatedAt: day(1), CreatedAt: day(3)},
+	}
+	ids := func(tickets []zendesk.Ticket) string {
+		var ids []int64
+		for _, ticket := range tickets {
+			ids = append(ids, *ticket.ID)
+		}
+		return fmt.Sprint(ids)
+	}
+
+	assert.Equal(t, "[2 1 4 3]", ids(sortTickets(tickets, "updated")))
+	assert.Equal(t, "[4 2 1 3]", ids(sortTickets(tickets, "created")))
+	assert.Equal(t, "[4 2 1 3]", ids(sortTickets(tickets, "")), "without a sort the order is kept")
+}
+
+func TestListAndSearchFlags(t *testing.T) {
+	var searches []string
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/users/me.json" {
+			_, _ = w.Write([]byte(`{"user":{"id":5}}`))
+			return
+		}
+		query := r.URL.Query()
+		searches = append(searches, query.Get("sort_by")+" "+query.Get("per_page"))
+		_, _ = w.Write([]byte(`{"results":[{"id":1,"status":"open"}],"count":1}`))
+	})
+	defer ct.close()
+
+	ct.execute(t, "/zendesk list --sort=updated --limit=5")
+	ct.execute(t, "/zendesk list")
+	ct.execute(t, "/zendesk search --limit=3 printer")
+	assert.Equal(t, []string{"updated_at 5", "priority 20", " 3"}, searches)
+
+	message := ct.execute(t, "/zendesk search --sort=name printer")
+	assert.Equal(t, "unknown sort `name`, please use one of: created, priority, updated", message)
+}
+
+func TestQueue(t *testing.T) {
+	var query string
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/users/me.json" {
+			_, _ = w.Write([]byte(`{"user":{"id":5}}`))
+			return
+		}
+		query = r.URL.Query().Get("query")
+		_, _ = w.Write([]byte(`{"results":[
+			{"id":1,"status":"open","priority":"low"},
+			{"id":2,"status":"hold"},
+			{"id":3,"status":"open","priority":"urgent"}],"count":3}`))
+	})
+	defer ct.close()
+
+	message := ct.execute(t, "/zendesk queue")
+	assert.Equal(t, "type:ticket status:new status:open status:pending status:hold assignee:5", query)
+	assert.Equal(t, "Your unsolved tickets by status:", message)
+
+	attachments := ct.responses[0].Attachments()
+	require.Len(t, attachments, 2, "groups without tickets are left out")
+	assert.Equal(t, "Open (2)", attachments[0].Title)
+	assert.Equal(t, "* [3]("+ct.server.URL+"/agent/tickets/3), priority **urgent**\n* [1]("+ct.server.URL+"/agent/tickets/1), priority **low**", attachments[0].Text)
+	assert.Equal(t, "On-Hold (1)", attachments[1].Title)
+}
+
+func TestListResolvesOrganizationsAtOnce(t *testing.T) {
+	var organizationRequests []string
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/users/me.json":
+			_, _ = w.Write([]byte(`{"user":{"id":5}}`))
+		case "/api/v2/organizations/show_many.json":
+			organizationRequests = append(organizationRequests, r.URL.Query().Get("ids"))
+			_, _ = w.Write([]byte(`{"organizations":[{"id":7,"name":"Acme"},{"id":8,"name":"Globex"}]}`))
+		default:
+			_, _ = w.Write([]byte(`{"results":[
+				{"id":1,"status":"open","organization_id":7},
+				{"id":2,"status":"open","organization_id":8},
+				{"id":3,"status":"open","organization_id":7},
+				{"id":4,"status":"open"}],"count":4}`))
+		}
+	})
+	defer ct.close()
+	ct.p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: ct.server.URL, TicketColors: "open #123456"})
+
+	ct.execute(t, "/zendesk list")
+	assert.Equal(t, []string{"7,8"}, organizationRequests)
+	attachments := ct.responses[0].Attachments()
+	require.Len(t, attachments, 4)
+	assert.Equal(t, "Acme", attachments[2].Fields[len(attachments[2].Fields)-1].Value)
+	assert.Equal(t, "Globex", attachments[1].Fields[len(attachments[1].Fields)-1].Value)
+	assert.Len(t, attachments[3].Fields, 1, "tickets without organization only have their status")
+	assert.Equal(t, "#123456", attachments[0].Color, "listed tickets are colored like their details card")
+
+	client, err := newOAuthClient(ct.server.URL, "token", 0)
+	require.NoError(t, err)
+	client = client.withRequestID("request")
+	tickets := []zendesk.Ticket{{OrganizationID: zendesk.Int(7)}}
+	for i := 0; i < 2; i++ {
+		names, err := client.organizationNames(tickets)
+		require.NoError(t, err)
+		assert.Equal(t, "Acme", names[7])
+	}
+	assert.Len(t, organizationRequests, 2, "the names are cached for the command")
+}
+
+func TestTicketListPages(t *testing.T) {
+	var pages []string
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		pages = append(pages, page)
+		if page == "1" {
+			_, _ = w.Write([]byte(`{"results":[{"id":1,"status":"open"},{"id":2,"status":"open"}],"count":3}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"results":[{"id":3,"status":"open"}],"count":3}`))
+	})
+	defer ct.close()
+	siteURL := "https://chat.example.com"
+	ct.api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+
+	assert.Equal(t, "Tickets matching `printer`:", ct.execute(t, "/zendesk search --limit=2 printer"))
+	attachments := ct.responses[0].Attachments()
+	require.Len(t, attachments, 3)
+	navigation := attachments[2]
+	assert.Equal(t, "Page 1 of 2", navigation.Text)
+	require.Len(t, navigation.Actions, 1, "the first page has no previous page")
+	assert.Equal(t, "Next", navigation.Actions[0].Name)
+	assert.Equal(t, "https://chat.example.com/plugins/zendesk/action/page", navigation.Actions[0].Integration.URL)
+	context := navigation.Actions[0].Integration.Context
+
+	click := func(userID string, context map[string]interface{}) int {
+		body, _ := json.Marshal(model.PostActionIntegrationRequest{UserId: userID, ChannelId: "channel", PostId: "list", Context: context})
+		r := httptest.NewRequest(http.MethodPost, routeActionPage, strings.NewReader(string(body)))
+		r.Header.Set("Mattermost-User-ID", userID)
+		ct.responses = []*model.Post{{Id: "list"}}
+		status, _ := httpActionPage(ct.p, httptest.NewRecorder(), r)
+		return status
+	}
+
+	assert.Equal(t, http.StatusForbidden, click("other", context))
+	assert.Equal(t, http.StatusOK, click("user", context))
+	assert.Equal(t, []string{"1", "2"}, pages)
+	require.Len(t, ct.responses, 1)
+	assert.Equal(t, "list", ct.responses[0].Id, "the page replaces the one shown")
+	assert.Equal(t, "Tickets matching `printer`:", ct.responses[0].Message)
+	attachments = ct.responses[0].Attachments()
+	require.Len(t, attachments, 2)
+	assert.Equal(t, "Page 2 of 2", attachments[1].Text)
+	require.Len(t, attachments[1].Actions, 1)
+	assert.Equal(t, "Previous", attachments[1].Actions[0].Name)
+	assert.Equal(t, 1, attachments[1].Actions[0].Integration.Context["page"])
+
+	for key := range ct.kv {
+		if strings.HasPrefix(key, ticketListingKeyPrefix) {
+			delete(ct.kv, key)
+		}
+	}
+	assert.Equal(t, http.StatusOK, click("user", context))
+	require.Len(t, ct.responses, 2)
+	assert.Equal(t, "These results have expired, please run the command again.", ct.responses[1].Message)
+	assert.Len(t, pages, 2)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	htmlWhitespaceRegexp = regexp.MustCompile(`\s+`)
+	trailingSpaceRegexp  = regexp.MustCompile(`[ \t]+\n`)
+	blankLinesRegexp     = regexp.MustCompile(`\n{3,}`)
+	blankLineRegexp      = regexp.MustCompile(`\n\s*\n`)
+)
+
+// commentText returns the body of a comment as Mattermost markdown. Rich comments are converted
+// from their HTML body, the plain body is used if there is none or it can't be parsed.
+func commentText(comment *zendesk.TicketComment) string {
+	if comment.HTMLBody != nil && *comment.HTMLBody != "" {
+		if text := htmlCommentToMarkdown(*comment.HTMLBody); text != "" {
+			return text
+		}
+	}
+	return stringValue(comment.Body)
+}
+
+// htmlCommentToMarkdown converts the HTML body of a Zendesk comment to Mattermost markdown. Links,
+// emphasis, code, quotes, line breaks and nested lists are kept, other tags are dropped.
+func htmlCommentToMarkdown(body string) string {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	text := renderMarkdownChildren(doc)
+	text = trailingSpaceRegexp.ReplaceAllString(text, "\n")
+	text = blankLinesRegexp.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
+
+func renderMarkdownChildren(n *html.Node) string {
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		b.WriteString(renderMarkdown(child))
+	}
+	return b.String()
+}
+
+func renderMarkdown(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		return htmlWhitespaceRegexp.ReplaceAllString(n.Data, " ")
+	case html.DocumentNode:
+		return renderMarkdownChildren(n)
+	case html.ElementNode:
+	default:
+		return ""
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style:
+		return ""
+	case atom.Br:
+		return "\n"
+	case atom.Hr:
+		return "\n\n---\n\n"
+	case atom.P, atom.Div:
+		return "\n\n" + strings.TrimSpace(renderMarkdownChildren(n)) + "\n\n"
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		return "\n\n" + wrapMarkdown(strings.TrimSpace(renderMarkdownChildren(n)), "**") + "\n\n"
+	case atom.B, atom.Strong:
+		return wrapMarkdown(renderMarkdownChildren(n), "**")
+	case atom.I, atom.Em:
+		return wrapMarkdown(renderMarkdownChildren(n), "_")
+	case atom.Code:
+		return wrapMarkdown(textContent(n), "`")
+	case atom.Pre:
+		return "\n\n```\n" + strings.Trim(textContent(n), "\n") + "\n```\n\n"
+	case atom.A:
+		text := strings.TrimSpace(renderMarkdownChildren(n))
+		href := attribute(n, "href")
+		switch {
+		case href == "":
+			return text
+		case text == "" || text == href:
+			return href
+		default:
+			return "[" + text + "](" + href + ")"
+		}
+	case atom.Img:
+		if src := attribute(n, "src"); src != "" {
+			return "[" + attribute(n, "alt") + "](" + src + ")"
+		}
+		return ""
+	case atom.Blockquote:
+		text := strings.TrimSpace(blankLinesRegexp.ReplaceAllString(renderMarkdownChildren(n), "\n\n"))
+		return "\n\n> " + strings.Replace(text, "\n", "\n> ", -1) + "\n\n"
+	case atom.Ul, atom.Ol:
+		return renderMarkdownList(n)
+	}
+	return renderMarkdownChildren(n)
+}
+
+// renderMarkdownList renders the items of a list, the lines of an item are indented under its
+// marker so nested lists stay nested.
+func renderMarkdownList(n *html.Node) string {
+	var b strings.Builder
+	b.WriteString("\n")
+	number := 1
+	for item := n.FirstChild; item != nil; item = item.NextSibling {
+		if item.Type != html.ElementNode || item.DataAtom != atom.Li {
+			continue
+		}
+
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = fmt.Sprintf("%d. ", number)
+			number++
+		}
+
+		text := strings.TrimSpace(renderMarkdownChildren(item))
+		text = blankLineRegexp.ReplaceAllString(text, "\n")
+		indent := "\n" + strings.Repeat(" ", len(marker))
+		b.WriteString(marker + strings.Replace(text, "\n", indent, -1) + "\n")
+	}
+	return b.String()
+}
+
+// wrapMarkdown wraps text in an inline markdown marker, keeping surrounding spaces outside of it
+// as markdown requires.
+func wrapMarkdown(text, marker string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	start := strings.Index(text, trimmed)
+	return text[:start] + marker + trimmed + marker + text[start+len(trimmed):]
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		b.WriteString(textContent(child))
+	}
+	return b.String()
+}
+
+func attribute(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
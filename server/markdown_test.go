@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+)
+
+func TestHTMLCommentToMarkdown(t *testing.T) {
+	for name, tc := range map[string]struct {
+		html     string
+		expected string
+	}{
+		"plain text": {
+			html:     "<p>Hello   world</p>",
+			expected: "Hello world",
+		},
+		"anchors": {
+			html:     `<p>See <a href="https://example.com/docs">the docs</a> or <a href="https://example.com">https://example.com</a></p>`,
+			expected: "See [the docs](https://example.com/docs) or https://example.com",
+		},
+		"emphasis": {
+			html:     "<p>This is <strong>very</strong> <em>important</em> <code>code</code></p>",
+			expected: "This is **very** _important_ `code`",
+		},
+		"line breaks and paragraphs": {
+			html:     "<p>first<br>second</p><p>third</p>",
+			expected: "first\nsecond\n\nthird",
+		},
+		"nested lists": {
+			html:     "<ul><li>one<ol><li>a</li><li>b<ul><li>deep</li></ul></li></ol></li><li>two</li></ul>",
+			expected: "- one\n  1. a\n  2. b\n     - deep\n- two",
+		},
+		"list after paragraph": {
+			html:     "<p>Steps:</p><ol><li><p>Log in</p></li><li>Click <b>Save</b></li></ol>",
+			expected: "Steps:\n\n1. Log in\n2. Click **Save**",
+		},
+		"quote": {
+			html:     "<blockquote><p>line one</p><p>line two</p></blockquote>",
+			expected: "> line one\n>\n> line two",
+		},
+		"scripts are dropped": {
+			html:     "<p>ok</p><script>alert(1)</script>",
+			expected: "ok",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if actual := htmlCommentToMarkdown(tc.html); actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestCommentText(t *testing.T) {
+	plain := zendesk.TicketComment{Body: zendesk.String("plain")}
+	if text := commentText(&plain); text != "plain" {
+		t.Errorf("expected the plain body, got %q", text)
+	}
+
+	rich := zendesk.TicketComment{Body: zendesk.String("plain"), HTMLBody: zendesk.String("<p><b>rich</b></p>")}
+	if text := commentText(&rich); text != "**rich**" {
+		t.Errorf("expected the converted HTML body, got %q", text)
+	}
+}
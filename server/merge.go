@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+)
+
+// Values of the "action" context of the buttons of a merge confirmation.
+const (
+	mergeActionConfirm = "merge"
+	mergeActionCancel  = "cancel"
+)
+
+// executeMerge - Merge a duplicate ticket into another ticket, once the user confirms it
+func executeMerge(p *Plugin, c *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+	return p.mergeTickets(commandArgs, args, false)
+}
+
+// mergeTickets merges the source ticket of a merge command into its target ticket. Merges can't be
+// undone, so unless confirmed the tickets are only shown to the user with buttons to merge them or
+// not, see sendMergeConfirmation.
+func (p *Plugin) mergeTickets(commandArgs *model.CommandArgs, args []string, confirmed bool) *model.CommandResponse {
+	if len(args) < 2 {
+		return p.respondUsage(commandArgs, "merge", "the case numbers")
+	}
+
+	sourceNumber, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	targetNumber, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if sourceNumber == targetNumber {
+		return p.respondT(commandArgs, "zendesk.merge.same_ticket")
+	}
+
+	comment := parseCommentLine("(\\/zendesk\\s*merge\\s*\\d*\\s*\\d*)(.*)", commandArgs.Command)
+	if err := checkCommentLength(comment); err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	token, ok := p.requireConnected(commandArgs)
+	if !ok {
+		return &model.CommandResponse{}
+	}
+	client, err := p.getUserClient(commandArgs, token)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	// Closed tickets can't be merged, neither into nor from.
+	source, err := client.ShowTicket(sourceNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	target, err := client.ShowTicket(targetNumber)
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	for _, ticket := range []*zendesk.Ticket{source, target} {
+		if stringValue(ticket.Status) == "closed" {
+			return p.respondT(commandArgs, "zendesk.merge.closed", map[string]interface{}{"Ticket": client.ticketLink(ticket)})
+		}
+	}
+
+	if !confirmed {
+		return p.sendMergeConfirmation(commandArgs, client, source, target, comment, args)
+	}
+
+	if comment == "" {
+		comment = fmt.Sprintf("Ticket #%d was merged into ticket #%d.", sourceNumber, targetNumber)
+	}
+	job, err := client.MergeTickets(sourceNumber, targetNumber, comment)
+	data := map[string]interface{}{"Source": client.ticketLink(source), "Target": client.ticketLink(target)}
+	// Zendesk refuses some merges, e.g. of tickets shared with another Zendesk account, upfront or
+	// when the merge job runs.
+	if apiErr, ok := err.(*zendesk.APIError); ok && isAPIError(err, http.StatusUnprocessableEntity) {
+		data["Reason"] = stringValue(apiErr.Description)
+		return p.respondT(commandArgs, "zendesk.merge.not_permitted", data)
+	}
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+	if job != nil && stringValue(job.Status) == "failed" {
+		data["Reason"] = stringValue(job.Message)
+		return p.respondT(commandArgs, "zendesk.merge.not_permitted", data)
+	}
+	return p.respondT(commandArgs, "zendesk.merge.merged", data)
+}
+
+// sendMergeConfirmation shows the tickets of a merge command to the user, with buttons to merge
+// them or cancel. Nothing is sent to Zendesk until the user confirms, the command is then run again
+// by httpActionMerge.
+func (p *Plugin) sendMergeConfirmation(commandArgs *model.CommandArgs, client *Client, source, target *zendesk.Ticket, comment string, args []string) *model.CommandResponse {
+	confirmationID, err := p.createMergeConfirmation(&mergeConfirmation{
+		UserID:    commandArgs.UserId,
+		ChannelID: commandArgs.ChannelId,
+		TeamID:    commandArgs.TeamId,
+		RootID:    commandArgs.RootId,
+		Command:   commandArgs.Command,
+		Args:      args,
+	})
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	T := p.T(commandArgs.UserId)
+	action := func(name, style, value string) *model.PostAction {
+		return &model.PostAction{
+			Id:    value,
+			Type:  model.POST_ACTION_TYPE_BUTTON,
+			Name:  name,
+			Style: style,
+			Integration: &model.PostActionIntegration{
+				URL:     p.GetPluginURL() + routeActionMerge,
+				Context: map[string]interface{}{"confirmation_id": confirmationID, "action": value},
+			},
+		}
+	}
+
+	data := map[string]interface{}{"Source": client.ticketLink(source), "Target": client.ticketLink(target)}
+	attachment := &model.SlackAttachment{
+		Color:   defaultTicketColor,
+		Pretext: T("zendesk.merge.confirm", data),
+		Text:    comment,
+		Actions: []*model.PostAction{
+			action(T("zendesk.merge.confirm_button"), "danger", mergeActionConfirm),
+			action(T("zendesk.merge.cancel_button"), "default", mergeActionCancel),
+		},
+	}
+	post := p.commandResponsePost(commandArgs, "")
+	post.AddProp("attachments", []*model.SlackAttachment{attachment})
+	_ = p.API.SendEphemeralPost(commandArgs.UserId, post)
+	return &model.CommandResponse{}
+}
+
+// httpActionMerge handles the buttons of a merge confirmation. The confirmation is removed either
+// way, the tickets are merged by running the merge command again, so they are checked again.
+func httpActionMerge(p *Plugin, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("method " + r.Method + " is not allowed, must be POST")
+	}
+
+	userID := r.Header.Get("Mattermost-User-ID")
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil {
+		return http.StatusBadRequest, errors.New("failed to decode the action request")
+	}
+	if userID == "" || request.UserId != userID {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+
+	confirmationID, _ := request.Context["confirmation_id"].(string)
+	action, _ := request.Context["action"].(string)
+	confirmation, err := p.consumeMergeConfirmation(confirmationID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if confirmation != nil && confirmation.UserID != userID {
+		return http.StatusForbidden, errors.New("the merge was requested by another user")
+	}
+	p.API.DeleteEphemeralPost(userID, request.PostId)
+
+	commandArgs := &model.CommandArgs{UserId: userID, ChannelId: request.ChannelId}
+	switch {
+	case confirmation == nil:
+		p.respondT(commandArgs, "zendesk.merge.expired")
+	case action == mergeActionConfirm:
+		commandArgs = &model.CommandArgs{
+			UserId:    confirmation.UserID,
+			ChannelId: confirmation.ChannelID,
+			TeamId:    confirmation.TeamID,
+			RootId:    confirmation.RootID,
+			Command:   confirmation.Command,
+		}
+		p.runHandler("merge", func(p *Plugin, _ *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+			return p.mergeTickets(commandArgs, args, true)
+		}, nil, commandArgs, confirmation.Args...)
+	default:
+		p.respondT(commandArgs, "zendesk.merge.canceled")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write((&model.PostActionIntegrationResponse{}).ToJson()); err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "failed to write the action response")
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeTickets(t *testing.T) {
+	var merges []map[string]interface{}
+	mergeStatus := http.StatusOK
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/tickets/1.json":
+			_, _ = w.Write([]byte(`{"ticket":{"id":1,"subject":"Printer down","status":"open"}}`))
+		case "/api/v2/tickets/2.json":
+			_, _ = w.Write([]byte(`{"ticket":{"id":2,"subject":"Printer outage","status":"pending"}}`))
+		case "/api/v2/tickets/3.json":
+			_, _ = w.Write([]byte(`{"ticket":{"id":3,"subject":"Old","status":"closed"}}`))
+		case "/api/v2/tickets/2/merge.json":
+			var in map[string]interface{}
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			merges = append(merges, in)
+			w.WriteHeader(mergeStatus)
+			if mergeStatus != http.StatusOK {
+				_, _ = w.Write([]byte(`{"error":"RecordInvalid","description":"Shared tickets can't be merged."}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"job_status":{"id":"job","status":"queued"}}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+	defer ct.close()
+	siteURL := "https://chat.example.com"
+	ct.api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+
+	link := func(id, subject string) string {
+		return "[" + id + ": " + subject + "](" + ct.server.URL + "/agent/tickets/" + id + ")"
+	}
+	confirmation := func(command string) map[string]interface{} {
+		ct.execute(t, command)
+		require.Len(t, ct.responses, 1)
+		attachment := ct.responses[0].Attachments()[0]
+		assert.Equal(t, "Merge ticket "+link("1", "Printer down")+" into "+link("2", "Printer outage")+"? Its comments are copied to "+
+			link("2", "Printer outage")+" and it is closed. Merges can't be undone.", attachment.Pretext)
+		require.Len(t, attachment.Actions, 2)
+		assert.Equal(t, "https://chat.example.com/plugins/zendesk/action/merge", attachment.Actions[0].Integration.URL)
+		return attachment.Actions[0].Integration.Context
+	}
+	click := func(context map[string]interface{}, action string) int {
+		context["action"] = action
+		body, _ := json.Marshal(model.PostActionIntegrationRequest{UserId: "user", ChannelId: "channel", PostId: "confirmation", Context: context})
+		r := httptest.NewRequest(http.MethodPost, routeActionMerge, strings.NewReader(string(body)))
+		r.Header.Set("Mattermost-User-ID", "user")
+		ct.responses = nil
+		status, _ := httpActionMerge(ct.p, httptest.NewRecorder(), r)
+		return status
+	}
+
+	assert.Equal(t, "A ticket can't be merged into itself, please specify two different case numbers.", ct.execute(t, "/zendesk merge 2 2"))
+	assert.Equal(t, "Ticket "+link("3", "Old")+" is closed, closed tickets can't be merged.", ct.execute(t, "/zendesk merge 3 2"))
+
+	context := confirmation("/zendesk merge 1 2")
+	assert.Equal(t, http.StatusOK, click(context, mergeActionCancel))
+	assert.Equal(t, "The merge was canceled, the tickets were not changed.", ct.responses[0].Message)
+	assert.Equal(t, http.StatusOK, click(context, mergeActionConfirm))
+	assert.Equal(t, "This merge has expired, please run the command again.", ct.responses[0].Message)
+	assert.Empty(t, merges, "nothing is merged before the merge is confirmed")
+
+	context = confirmation("/zendesk merge 1 2 Same outage")
+	assert.Equal(t, http.StatusOK, click(context, mergeActionConfirm))
+	require.Len(t, merges, 1)
+	assert.Equal(t, []interface{}{float64(1)}, merges[0]["ids"])
+	assert.Equal(t, "Same outage", merges[0]["source_comment"])
+	assert.Equal(t, false, merges[0]["target_comment_is_public"])
+	assert.Equal(t, "Ticket "+link("1", "Printer down")+" was merged into "+link("2", "Printer outage")+" and closed.", ct.responses[0].Message)
+
+	mergeStatus = http.StatusUnprocessableEntity
+	context = confirmation("/zendesk merge 1 2")
+	assert.Equal(t, http.StatusOK, click(context, mergeActionConfirm))
+	require.Len(t, merges, 2)
+	assert.Equal(t, "Ticket #1 was merged into ticket #2.", merges[1]["target_comment"])
+	assert.Equal(t, "Zendesk doesn't allow merging ticket "+link("1", "Printer down")+" into "+link("2", "Printer outage")+
+		" in their current state. Shared tickets can't be merged.", ct.responses[0].Message)
+}
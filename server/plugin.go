@@ -2,18 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/mattermost/go-i18n/i18n/bundle"
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin"
 	"github.com/pkg/errors"
@@ -33,27 +40,68 @@ type Plugin struct {
 	// BotId of the created bot account.
 	botID string
 
-	// zendesk client
-	zendeskClient zendesk.Client
+	// tokenRefreshLock serializes the refreshes of OAuth access tokens, see renewOAuthToken.
+	tokenRefreshLock sync.Mutex
 
-	// map of the mattermost user with access token from zendesk
-	oauthAccessTokenMap map[string]string
+	// clientCacheLock synchronizes access to clientCache and sharedClient.
+	clientCacheLock sync.Mutex
 
-	zendeskURL           string
-	zendeskClientSecrete string
+	// Zendesk clients of the connected users keyed by tokenKey. Consult getTokenClient for usage.
+	clientCache map[string]cachedClient
+
+	// Zendesk client of the account of the plugin itself. Consult getSharedClient for usage.
+	sharedClient cachedClient
+
+	// rateLimitLock synchronizes access to rateLimitBuckets.
+	rateLimitLock sync.Mutex
+
+	// Token buckets limiting the commands calling Zendesk, keyed by Mattermost user ID.
+	rateLimitBuckets map[string]*tokenBucket
+
+	// userGroupsLock synchronizes access to userGroupsCache.
+	userGroupsLock sync.Mutex
+
+	// Zendesk group memberships of the connected agents keyed by Mattermost user ID.
+	userGroupsCache map[string]cachedGroups
+
+	// ticketFieldsLock synchronizes access to ticketFieldsCache.
+	ticketFieldsLock sync.Mutex
+
+	// Titles of the custom ticket fields shown in the details card, keyed by instance URL and
+	// field ID. Consult getTicketFieldTitle for usage.
+	ticketFieldsCache map[string]cachedTicketField
+
+	// Correlation IDs of the commands being run, keyed by their *model.CommandArgs. Consult
+	// runHandler and requestIDOf for usage.
+	commandRequestIDs sync.Map
+
+	// watchDigestFlusherStop stops the flusher posting the digests of watched tickets. Consult
+	// startWatchDigestFlusher for usage.
+	watchDigestFlusherStop chan struct{}
+
+	// translations of the messages of the plugin, loaded from assets/i18n on activation. Consult
+	// T for usage.
+	translations *bundle.Bundle
 }
 
 const (
 	routeOAuthRedirect = "/oauth/redirect"
 	routeUserConnect   = "/user/connect"
-	routeTest          = "/test"
+	routeWebhook       = "/webhook"
+	routeDialogCreate  = "/dialog/create"
+	routeActionCreate  = "/action/create"
+	routeActionComment = "/action/comment"
+	routeActionPage    = "/action/page"
+	routeActionMerge   = "/action/merge"
+	routeHealth        = "/health"
 )
 
-// ServeHTTP demonstrates a plugin that handles HTTP requests by greeting the world.
+// ServeHTTP routes the HTTP requests of the plugin, see handleHTTPRequest.
 func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
+	// The query isn't logged, the OAuth redirect carries the authorization code in it.
 	status, err := handleHTTPRequest(p, w, r)
 	if err != nil {
-		p.API.LogError("ERROR: ", "Status", strconv.Itoa(status), "Error", err.Error(), "Host", r.Host, "RequestURI", r.RequestURI, "Method", r.Method, "query", r.URL.Query().Encode())
+		p.API.LogError("ERROR: ", "Status", strconv.Itoa(status), "Error", err.Error(), "Host", r.Host, "Path", r.URL.Path, "Method", r.Method)
 		http.Error(w, err.Error(), status)
 		return
 	}
@@ -65,7 +113,7 @@ func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Req
 	default:
 		w.WriteHeader(status)
 	}
-	p.API.LogDebug("OK: ", "Status", strconv.Itoa(status), "Host", r.Host, "RequestURI", r.RequestURI, "Method", r.Method, "query", r.URL.Query().Encode())
+	p.API.LogDebug("OK: ", "Status", strconv.Itoa(status), "Host", r.Host, "Path", r.URL.Path, "Method", r.Method)
 }
 
 func handleHTTPRequest(p *Plugin, w http.ResponseWriter, r *http.Request) (int, error) {
@@ -74,18 +122,25 @@ func handleHTTPRequest(p *Plugin, w http.ResponseWriter, r *http.Request) (int,
 		return httpUserConnect(p, w, r)
 	case routeOAuthRedirect:
 		return httpOAuthRedirect(p, w, r)
-	case routeTest:
-		return handleTest(w, r)
+	case routeWebhook:
+		return httpWebhook(p, w, r)
+	case routeDialogCreate:
+		return httpDialogCreate(p, w, r)
+	case routeActionCreate:
+		return httpActionCreate(p, w, r)
+	case routeActionComment:
+		return httpActionComment(p, w, r)
+	case routeActionPage:
+		return httpActionPage(p, w, r)
+	case routeActionMerge:
+		return httpActionMerge(p, w, r)
+	case routeHealth:
+		return httpHealth(p, w, r)
 	}
 
 	return http.StatusNotFound, errors.New("not found")
 }
 
-func handleTest(w http.ResponseWriter, r *http.Request) (int, error) {
-	fmt.Fprint(w, "Hello, world!")
-	return http.StatusOK, nil
-}
-
 func httpUserConnect(p *Plugin, w http.ResponseWriter, r *http.Request) (int, error) {
 	// if access token is already associated with the muser then it means connection is not required
 	// and we might skip going here; on the other hand if access token is revoked then how we would know
@@ -96,15 +151,33 @@ func httpUserConnect(p *Plugin, w http.ResponseWriter, r *http.Request) (int, er
 			errors.New("method " + r.Method + " is not allowed, must be GET")
 	}
 
-	zendeskURL := p.getConfiguration().ZendeskURL
-	clientID := p.getConfiguration().ZendeskClientID
+	mattermostUserID := r.Header.Get("Mattermost-User-ID")
+	if mattermostUserID == "" {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+
+	instance, err := p.getConfiguration().getInstance(r.URL.Query().Get("instance"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if !instance.supportsOAuth() {
+		return http.StatusBadRequest, errors.New("no OAuth client is set up for the Zendesk instance, connect with an API token")
+	}
 	pluginURL := p.GetPluginURL()
 
-	redirectURL := zendeskURL + "/oauth/authorizations/new?" +
+	// The state comes back with the redirect, it proves the flow was started by this user
+	// and tells which instance the code belongs to.
+	state, err := p.createOAuthState(mattermostUserID, instance.Name)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	redirectURL := instance.URL + "/oauth/authorizations/new?" +
 		"response_type=code&" +
 		"redirect_uri=" + pluginURL + "/oauth/redirect&" +
-		"client_id=" + clientID + "&" +
-		"scope=read%20write"
+		"client_id=" + instance.ClientID + "&" +
+		"scope=read%20write&" +
+		"state=" + url.QueryEscape(state)
 	p.API.LogDebug("zendeskplugin: redirecturl:" + redirectURL)
 
 	http.Redirect(w, r, redirectURL, http.StatusFound)
@@ -114,15 +187,25 @@ func httpUserConnect(p *Plugin, w http.ResponseWriter, r *http.Request) (int, er
 // OAuthAccessResponse -
 type OAuthAccessResponse struct {
 	AccessToken string `json:"access_token"`
+	// RefreshToken and ExpiresIn, in seconds, are only set for expiring access tokens.
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// OAuthErrorResponse is returned by Zendesk when it refuses to issue a token.
+type OAuthErrorResponse struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
 }
 
 // OAuthAccessRequest -
 type OAuthAccessRequest struct {
 	GrantType    string `json:"grant_type"`
-	Code         string `json:"code"`
+	Code         string `json:"code,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 	ClientID     string `json:"client_id"`
 	ClientSecret string `json:"client_secret"`
-	RedirectURL  string `json:"redirect_uri"`
+	RedirectURL  string `json:"redirect_uri,omitempty"`
 	Scope        string `json:"scope"`
 }
 
@@ -136,88 +219,218 @@ func httpOAuthRedirect(p *Plugin, w http.ResponseWriter, r *http.Request) (int,
 	// get the value of the `code` query param
 	err := r.ParseForm()
 	if err != nil {
-		fmt.Fprint(w, "Something went wrong: "+err.Error())
-		return http.StatusOK, nil
+		return p.oauthFailure(w, "", errors.Wrap(err, "failed to parse the OAuth redirect"))
 	}
 	code := r.FormValue("code")
 
-	// Call the zendesk oauth endpoint to get access token
-	reqURL := p.configuration.ZendeskURL + "/oauth/tokens"
+	// The state was issued by httpUserConnect and tells which user started the flow, see
+	// createOAuthState. The user header isn't guaranteed to survive the round trip through
+	// Zendesk, but if it is set it has to match.
+	flow, err := p.consumeOAuthState(r.FormValue("state"))
+	if err == errInvalidOAuthState {
+		return http.StatusBadRequest, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if headerUserID := r.Header.Get("Mattermost-User-ID"); headerUserID != "" && headerUserID != flow.UserID {
+		return http.StatusBadRequest, errInvalidOAuthState
+	}
+
+	mmuser, appErr := p.API.GetUser(flow.UserID)
+	if appErr != nil {
+		return http.StatusBadRequest, errors.Wrap(appErr, "could not resolve the Mattermost user of the OAuth flow")
+	}
 
-	clientID := p.getConfiguration().ZendeskClientID
-	clientSecret := p.getConfiguration().ZendeskClientSecrete
+	instance, err := p.getConfiguration().getInstance(flow.Instance)
+	if err != nil {
+		return p.oauthFailure(w, mmuser.Id, errors.Wrap(err, "failed to resolve the Zendesk instance of the OAuth flow"))
+	}
 
+	// Call the zendesk oauth endpoint to get access token, stop waiting for Zendesk when the user
+	// navigates away
 	redirectURL := p.GetPluginURL() + "/oauth/redirect"
-	oauthRequest := OAuthAccessRequest{
+	res, err := p.requestOAuthToken(r.Context(), instance, OAuthAccessRequest{
 		GrantType:    "authorization_code",
 		Code:         code,
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
+		ClientID:     instance.ClientID,
+		ClientSecret: instance.ClientSecret,
 		RedirectURL:  redirectURL,
 		Scope:        "read write",
-	}
-
-	requestBodyBytes, err := json.Marshal(oauthRequest)
-	if err != nil {
-		fmt.Fprint(w, "Something went wrong: "+err.Error())
-		return http.StatusOK, nil
-	}
-	requestBody := requestBodyBytes
-	p.API.LogDebug(string(requestBody))
-
-	req, err := http.NewRequest(http.MethodPost, reqURL, bytes.NewBuffer([]byte(requestBody)))
-	if err != nil {
-		fmt.Fprint(w, "Something went wrong: "+err.Error())
+	})
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		p.API.LogWarn("Zendesk did not respond to the OAuth token request in time", "user_id", mmuser.Id, "instance", instance.Name)
+		fmt.Fprint(w, "Zendesk did not respond in time, please try to connect again later.")
 		return http.StatusOK, nil
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	// Send out the HTTP request
-	httpClient := http.Client{}
-	res, err := httpClient.Do(req)
 	if err != nil {
-		fmt.Fprint(w, "Something went wrong: "+err.Error())
-		return http.StatusOK, nil
+		return p.oauthFailure(w, mmuser.Id, errors.Wrap(err, "failed to send the OAuth token request"))
 	}
 	defer res.Body.Close()
 
+	// Zendesk explains why it refused the code, e.g. because it expired, which is worth showing.
 	if res.StatusCode < 200 || res.StatusCode >= 400 {
 		bodyBytes, _ := ioutil.ReadAll(res.Body)
-		bodyString := string(bodyBytes)
-		fmt.Fprint(w, "Could not obtain OAuth access token from zendesk: "+bodyString)
+		p.API.LogError("Zendesk refused the OAuth token request", "user_id", mmuser.Id, "instance", instance.Name,
+			"status", res.StatusCode, "response", string(bodyBytes))
+		var oauthError OAuthErrorResponse
+		if json.Unmarshal(bodyBytes, &oauthError) == nil && oauthError.Description != "" {
+			fmt.Fprint(w, "Zendesk refused the authorization: "+oauthError.Description)
+			return http.StatusOK, nil
+		}
+		fmt.Fprint(w, "Could not obtain an OAuth access token from Zendesk, please try to connect again.")
 		return http.StatusOK, nil
 	}
 
 	// Parse the response with access token
 	var oauthResponse OAuthAccessResponse
 	if err = json.NewDecoder(res.Body).Decode(&oauthResponse); err != nil {
-		fmt.Fprint(w, "Something went wrong: "+err.Error())
-		return http.StatusOK, nil
+		return p.oauthFailure(w, mmuser.Id, errors.Wrap(err, "failed to decode the OAuth token response"))
 	}
 
-	mattermostUserID := r.Header.Get("Mattermost-User-ID")
-	//TODO: how to get UserName
-	p.oauthAccessTokenMap[mattermostUserID] = oauthResponse.AccessToken
+	if err = p.storeOAuthToken(mmuser.Id, instance.Name, &oauthResponse); err != nil {
+		return p.oauthFailure(w, mmuser.Id, errors.Wrap(err, "failed to store the Zendesk token"))
+	}
 
-	fmt.Fprint(w, "Successfully connected mattermost account "+
-		mattermostUserID+" "+
-		" with zendesk account: "+oauthResponse.AccessToken)
+	fmt.Fprint(w, "Successfully connected your Zendesk account. You can close this tab.")
 
 	return http.StatusOK, nil
 }
 
+// oauthFailure logs why connecting a user failed and tells the user in generic terms, the
+// details are for the system administrator.
+func (p *Plugin) oauthFailure(w http.ResponseWriter, userID string, err error) (int, error) {
+	p.API.LogError("failed to connect a Zendesk account", "user_id", userID, "error", err.Error())
+	fmt.Fprint(w, "Something went wrong while connecting your Zendesk account, please try again or contact your system administrator.")
+	return http.StatusOK, nil
+}
+
+// requestOAuthToken sends a request to the token endpoint of a Zendesk instance, exchanging either
+// an authorization code or a refresh token. The caller closes the body of the response.
+func (p *Plugin) requestOAuthToken(ctx context.Context, instance *zendeskInstance, in OAuthAccessRequest) (*http.Response, error) {
+	// The body holds the client secret and the code or refresh token, it must not be logged.
+	requestBody, err := json.Marshal(in)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal the OAuth token request")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, instance.URL+"/oauth/tokens", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build the OAuth token request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := http.Client{Timeout: p.getConfiguration().getOAuthTimeout()}
+	return httpClient.Do(req.WithContext(ctx))
+}
+
+// storeOAuthToken stores the access token issued by Zendesk for a Mattermost user, along with its
+// refresh token if it expires.
+func (p *Plugin) storeOAuthToken(userID, instanceName string, response *OAuthAccessResponse) error {
+	if err := p.setToken(userID, instanceName, response.AccessToken); err != nil {
+		return err
+	}
+
+	var refresh *oauthRefresh
+	if response.RefreshToken != "" && response.ExpiresIn > 0 {
+		refresh = &oauthRefresh{
+			RefreshToken: response.RefreshToken,
+			ExpiresAt:    time.Now().Add(time.Duration(response.ExpiresIn) * time.Second),
+		}
+	}
+	return p.setOAuthRefresh(userID, instanceName, refresh)
+}
+
+// tokenRefreshMargin is how long before it expires an access token is refreshed, so it doesn't
+// expire while a command runs.
+const tokenRefreshMargin = time.Minute
+
+// errSessionExpired is returned when an access token expired and Zendesk refused to refresh it.
+var errSessionExpired = errors.New("your Zendesk session expired and could not be renewed, please run `/zendesk connect` again")
+
+// getFreshToken returns the Zendesk access token of a Mattermost user like getToken, refreshing it
+// first when it is about to expire.
+func (p *Plugin) getFreshToken(userID string, instance *zendeskInstance) (string, error) {
+	token, err := p.getToken(userID, instance.Name)
+	if err != nil || strings.HasPrefix(token, apiTokenCredentialPrefix) {
+		return token, err
+	}
+
+	refresh, err := p.getOAuthRefresh(userID, instance.Name)
+	if err != nil {
+		return "", err
+	}
+	if refresh == nil || time.Now().Add(tokenRefreshMargin).Before(refresh.ExpiresAt) {
+		return token, nil
+	}
+	return p.renewOAuthToken(userID, instance, token)
+}
+
+// renewOAuthToken exchanges the refresh token of a Mattermost user for a new access token,
+// replacing staleToken. A user whose token can't be refreshed is disconnected and has to connect
+// again, errSessionExpired is returned then.
+func (p *Plugin) renewOAuthToken(userID string, instance *zendeskInstance, staleToken string) (string, error) {
+	p.tokenRefreshLock.Lock()
+	defer p.tokenRefreshLock.Unlock()
+
+	// Another command may have refreshed the token while this one waited, refresh tokens can only
+	// be used once.
+	token, err := p.getToken(userID, instance.Name)
+	if err != nil {
+		return "", err
+	}
+	if token != staleToken {
+		return token, nil
+	}
+	refresh, err := p.getOAuthRefresh(userID, instance.Name)
+	if err != nil {
+		return "", err
+	}
+	if refresh == nil {
+		return "", errSessionExpired
+	}
+
+	res, err := p.requestOAuthToken(context.Background(), instance, OAuthAccessRequest{
+		GrantType:    "refresh_token",
+		RefreshToken: refresh.RefreshToken,
+		ClientID:     instance.ClientID,
+		ClientSecret: instance.ClientSecret,
+		Scope:        "read write",
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to renew your Zendesk session, please try again")
+	}
+	defer res.Body.Close()
+
+	var response OAuthAccessResponse
+	if res.StatusCode < 200 || res.StatusCode >= 400 || json.NewDecoder(res.Body).Decode(&response) != nil || response.AccessToken == "" {
+		p.API.LogWarn("Zendesk refused to refresh an access token", "user_id", userID, "instance", instance.Name, "status", res.StatusCode)
+		if err := p.deleteToken(userID, instance.Name); err != nil {
+			p.API.LogWarn("failed to delete expired Zendesk token", "user_id", userID, "error", err.Error())
+		}
+		return "", errSessionExpired
+	}
+
+	if err := p.storeOAuthToken(userID, instance.Name, &response); err != nil {
+		return "", err
+	}
+	return response.AccessToken, nil
+}
+
 // GetPluginURLPath -
 func (p *Plugin) GetPluginURLPath() string {
 	return "/plugins/" + manifest.Id
 }
 
+// developerSiteURL is the address of a local Mattermost server, used instead of the Site URL in
+// developer mode.
+const developerSiteURL = "http://localhost:8066"
+
 // GetPluginURL -
 func (p *Plugin) GetPluginURL() string {
 	siteURL := p.GetSiteURL()
-
-	// workaround for localhost testing
-	if !strings.Contains(siteURL, ".com") {
-		siteURL = "http://localhost:8066"
+	if p.getConfiguration().DeveloperMode {
+		siteURL = developerSiteURL
 	}
 
 	return strings.TrimRight(siteURL, "/") + p.GetPluginURLPath()
@@ -240,12 +453,28 @@ func (p *Plugin) OnActivate() error {
 		return errors.WithMessage(err, "OnActivate: failed to register command")
 	}
 
-	p.oauthAccessTokenMap = make(map[string]string)
+	if err := p.ensureEncryptionKey(); err != nil {
+		return errors.Wrap(err, "OnActivate")
+	}
+	if err := p.encryptZendeskPassword(); err != nil {
+		return errors.Wrap(err, "OnActivate")
+	}
+	if err := p.getConfiguration().IsValid(); err != nil {
+		return errors.Wrap(err, "OnActivate: invalid plugin configuration")
+	}
+
+	p.warnInvalidWebhookChannels()
+
+	p.userGroupsCache = make(map[string]cachedGroups)
+	p.rateLimitBuckets = make(map[string]*tokenBucket)
+	p.clientCache = make(map[string]cachedClient)
+	p.ticketFieldsCache = make(map[string]cachedTicketField)
 
 	// ensure bot
+	config := p.getConfiguration()
 	botID, ensureBotError := p.Helpers.EnsureBot(&model.Bot{
-		Username:    "zendesk",
-		DisplayName: "Zendesk Bot",
+		Username:    config.getBotUsername(),
+		DisplayName: config.getBotDisplayName(),
 		Description: "A bot account created by the zendesk plugin.",
 	})
 
@@ -253,12 +482,17 @@ func (p *Plugin) OnActivate() error {
 		return errors.Wrap(ensureBotError, "failed to ensure zendesk bot.")
 	}
 	p.botID = botID
+	p.updateBotProfile()
 
 	// set profile image for the bot
 	bundlePath, err := p.API.GetBundlePath()
 	if err != nil {
 		return errors.Wrap(err, "couldn't get bundle path")
 	}
+	if err := p.loadTranslations(filepath.Join(bundlePath, "assets", "i18n")); err != nil {
+		return errors.Wrap(err, "couldn't load translations")
+	}
+
 	profileImage, err := ioutil.ReadFile(filepath.Join(bundlePath, "assets", "zendesklogo.png"))
 	if err != nil {
 		return errors.Wrap(err, "couldn't read profile image")
@@ -267,18 +501,129 @@ func (p *Plugin) OnActivate() error {
 		return errors.Wrap(appErr, "couldn't set profile image")
 	}
 
-	// connect to zendesk
-	username := os.Getenv("ZENDESK_USER")
-	password := os.Getenv("ZENDESK_PASSWORD")
+	p.startWatchDigestFlusher()
+	return nil
+}
 
-	u, _ := url.Parse(p.getConfiguration().ZendeskURL)
-	clientHost := strings.Split(u.Host, ".")[0]
+// updateBotProfile renames the bot after its username or display name were changed in the
+// settings. EnsureBot keeps using the bot it created first, whatever it is called now. A failed
+// rename, e.g. to the username of another account, only logs a warning, so the plugin keeps
+// working under the old name.
+func (p *Plugin) updateBotProfile() {
+	config := p.getConfiguration()
+	bot, appErr := p.API.GetBot(p.botID, true)
+	if appErr != nil {
+		p.API.LogWarn("failed to load the bot to update its name", "bot_id", p.botID, "error", appErr.Error())
+		return
+	}
 
-	client, err := zendesk.NewClient(clientHost, username, password)
-	if err != nil {
-		return errors.Wrap(err, "couldn't connect to zendesk")
+	patch := &model.BotPatch{}
+	if username := config.getBotUsername(); bot.Username != username {
+		patch.Username = &username
+	}
+	if displayName := config.getBotDisplayName(); bot.DisplayName != displayName {
+		patch.DisplayName = &displayName
+	}
+	if patch.Username == nil && patch.DisplayName == nil {
+		return
 	}
-	p.zendeskClient = client
 
+	if _, appErr := p.API.PatchBot(p.botID, patch); appErr != nil {
+		p.API.LogWarn("failed to update the name of the bot", "bot_id", p.botID, "error", appErr.Error())
+	}
+}
+
+// OnDeactivate stops the flusher of the watch digests and drops the cached clients, group
+// memberships, ticket fields and rate limits, so nothing is carried over when the plugin is
+// activated again. Commands don't start goroutines outliving them.
+func (p *Plugin) OnDeactivate() error {
+	p.stopWatchDigestFlusher()
+
+	p.clientCacheLock.Lock()
+	p.clientCache = make(map[string]cachedClient)
+	p.sharedClient = cachedClient{}
+	p.clientCacheLock.Unlock()
+
+	p.userGroupsLock.Lock()
+	p.userGroupsCache = make(map[string]cachedGroups)
+	p.userGroupsLock.Unlock()
+
+	p.ticketFieldsLock.Lock()
+	p.ticketFieldsCache = make(map[string]cachedTicketField)
+	p.ticketFieldsLock.Unlock()
+
+	p.rateLimitLock.Lock()
+	p.rateLimitBuckets = make(map[string]*tokenBucket)
+	p.rateLimitLock.Unlock()
+
+	p.API.LogInfo("Zendesk plugin deactivated")
 	return nil
 }
+
+// warnInvalidWebhookChannels logs the webhook channels that don't exist. The plugin still
+// activates, events for those channels just can't be posted.
+func (p *Plugin) warnInvalidWebhookChannels() {
+	config := p.getConfiguration()
+	channelIDs := map[string]string{}
+	if config.WebhookChannelID != "" {
+		channelIDs[config.WebhookChannelID] = "default"
+	}
+	for _, mapping := range config.getOrganizationChannels() {
+		channelIDs[mapping.channelID] = mapping.organization
+	}
+
+	for channelID, organization := range channelIDs {
+		if _, appErr := p.API.GetChannel(channelID); appErr != nil {
+			p.API.LogWarn("invalid webhook channel in the plugin settings", "channel_id", channelID, "organization", organization, "error", appErr.Error())
+		}
+	}
+}
+
+// encryptToken encrypts a Zendesk token with AES-GCM using the configured encryption key. The
+// result is the base64 encoded nonce followed by the sealed token.
+func (p *Plugin) encryptToken(plaintext string) (string, error) {
+	gcm, err := p.tokenCipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.Wrap(err, "failed to generate nonce")
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptToken reverses encryptToken. It fails if the token was encrypted with another key, e.g.
+// after the key was rotated.
+func (p *Plugin) decryptToken(ciphertext string) (string, error) {
+	gcm, err := p.tokenCipher()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decode token")
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("token is too short")
+	}
+
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decrypt token")
+	}
+	return string(plaintext), nil
+}
+
+func (p *Plugin) tokenCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher([]byte(p.getConfiguration().EncryptionKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid encryption key")
+	}
+	return cipher.NewGCM(block)
+}
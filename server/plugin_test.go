@@ -1,22 +1,208 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestServeHTTP(t *testing.T) {
-	// assert := assert.New(t)
-	// plugin := Plugin{}
-	// w := httptest.NewRecorder()
-	// r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	api := &plugintest.API{}
+	api.On("LogError", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	p := newTestPlugin(api)
+
+	// The scaffolding route greeting the world is gone.
+	w := httptest.NewRecorder()
+	p.ServeHTTP(nil, w, httptest.NewRequest(http.MethodGet, "/test", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NotContains(t, w.Body.String(), "Hello, world!")
+}
+
+func TestOAuthRedirectRejectsStateOfAnotherUser(t *testing.T) {
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	p := newTestPlugin(api)
+
+	api.On("KVGet", oauthStateKeyPrefix+"abc").Return([]byte(`{"user_id":"user1","instance":"default"}`), nil)
+	api.On("KVDelete", oauthStateKeyPrefix+"abc").Return(nil)
+
+	r := httptest.NewRequest(http.MethodGet, routeOAuthRedirect+"?code=xyz&state=abc", nil)
+	r.Header.Set("Mattermost-User-ID", "user2")
+
+	status, err := httpOAuthRedirect(p, httptest.NewRecorder(), r)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, errInvalidOAuthState, err)
+}
+
+func TestOAuthRedirectTimeout(t *testing.T) {
+	release := make(chan struct{})
+	zendeskServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer zendeskServer.Close()
+	defer close(release)
+
+	api := &plugintest.API{}
+	p := newTestPlugin(api)
+	p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: zendeskServer.URL, OAuthTimeout: "1"})
+
+	api.On("KVGet", oauthStateKeyPrefix+"abc").Return([]byte(`{"user_id":"user1","instance":"default"}`), nil)
+	api.On("KVDelete", oauthStateKeyPrefix+"abc").Return(nil)
+	api.On("GetUser", "user1").Return(&model.User{Id: "user1"}, nil)
+	api.On("GetConfig").Return(&model.Config{})
+	api.On("LogDebug", mock.Anything).Return()
+	api.On("LogWarn", mock.Anything, "user_id", "user1", "instance", "default").Return()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, routeOAuthRedirect+"?code=xyz&state=abc", nil)
+
+	status, err := httpOAuthRedirect(p, w, r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, w.Body.String(), "did not respond in time")
+}
+
+func TestOAuthRedirectRefused(t *testing.T) {
+	zendeskServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant","error_description":"The authorization code is invalid or expired."}`))
+	}))
+	defer zendeskServer.Close()
+
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	p := newTestPlugin(api)
+	p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: zendeskServer.URL})
+
+	api.On("KVGet", oauthStateKeyPrefix+"abc").Return([]byte(`{"user_id":"user1","instance":"default"}`), nil)
+	api.On("KVDelete", oauthStateKeyPrefix+"abc").Return(nil)
+	api.On("GetUser", "user1").Return(&model.User{Id: "user1"}, nil)
+	api.On("GetConfig").Return(&model.Config{})
+	api.On("LogError", "Zendesk refused the OAuth token request", "user_id", "user1", "instance", "default",
+		"status", http.StatusBadRequest, "response", mock.AnythingOfType("string")).Return()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, routeOAuthRedirect+"?code=xyz&state=abc", nil)
+
+	status, err := httpOAuthRedirect(p, w, r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "Zendesk refused the authorization: The authorization code is invalid or expired.", w.Body.String())
+}
+
+func TestGetPluginURL(t *testing.T) {
+	api := &plugintest.API{}
+	p := newTestPlugin(api)
+	siteURL := "https://chat.example.org/"
+	api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+
+	assert.Equal(t, "https://chat.example.org/plugins/zendesk", p.GetPluginURL())
+
+	p.setConfiguration(&configuration{DeveloperMode: true})
+	assert.Equal(t, "http://localhost:8066/plugins/zendesk", p.GetPluginURL())
+}
+
+func TestOnDeactivateClearsCaches(t *testing.T) {
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	p := newTestPlugin(api)
+	p.clientCache["user"] = cachedClient{token: "token"}
+	p.userGroupsCache["user"] = cachedGroups{}
+	p.ticketFieldsCache["https://example.zendesk.com/1"] = cachedTicketField{title: "Severity"}
+	p.rateLimitBuckets["user"] = &tokenBucket{}
+	api.On("LogInfo", "Zendesk plugin deactivated").Return()
+
+	assert.NoError(t, p.OnDeactivate())
+	assert.Empty(t, p.clientCache)
+	assert.Empty(t, p.userGroupsCache)
+	assert.Empty(t, p.ticketFieldsCache)
+	assert.Empty(t, p.rateLimitBuckets)
+}
+
+func TestUpdateBotProfile(t *testing.T) {
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	p := newTestPlugin(api)
+	p.botID = "bot"
+	api.On("GetBot", "bot", true).Return(&model.Bot{UserId: "bot", Username: "zendesk", DisplayName: "Zendesk Bot"}, nil)
+
+	// The default names are those of the existing bot.
+	p.updateBotProfile()
+
+	p.setConfiguration(&configuration{BotUsername: "Support", BotDisplayName: "Zendesk Bot"})
+	api.On("PatchBot", "bot", &model.BotPatch{Username: model.NewString("support")}).Return(&model.Bot{}, nil).Once()
+	p.updateBotProfile()
+
+	p.setConfiguration(&configuration{BotDisplayName: "Support Desk"})
+	api.On("PatchBot", "bot", &model.BotPatch{DisplayName: model.NewString("Support Desk")}).Return(nil, &model.AppError{Message: "taken"}).Once()
+	api.On("LogWarn", "failed to update the name of the bot", "bot_id", "bot", "error", mock.AnythingOfType("string")).Return().Once()
+	p.updateBotProfile()
+}
+
+func TestMessageWillBePostedRejectsAPITokens(t *testing.T) {
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	p := newTestPlugin(api)
+	api.On("SendEphemeralPost", "user", mock.AnythingOfType("*model.Post")).Return(nil).Once()
+
+	_, reason := p.MessageWillBePosted(nil, &model.Post{UserId: "user", ChannelId: "channel", Message: " /zendesk connect token jane@example.com secret"})
+	assert.NotEmpty(t, reason)
+
+	post, reason := p.MessageWillBePosted(nil, &model.Post{UserId: "user", ChannelId: "channel", Message: "Run /zendesk connect token to connect"})
+	assert.Nil(t, post)
+	assert.Empty(t, reason)
+}
+
+func TestExpiredTokenIsRefreshed(t *testing.T) {
+	refused := false
+	var refreshRequest OAuthAccessRequest
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/tokens":
+			_ = json.NewDecoder(r.Body).Decode(&refreshRequest)
+			if refused {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"access_token":"new","refresh_token":"r2","expires_in":3600}`))
+		case "/api/v2/users/me.json":
+			assert.Equal(t, "Bearer new", r.Header.Get("Authorization"))
+			_, _ = w.Write([]byte(`{"user":{"id":5,"name":"Jane Doe","email":"jane@example.com","role":"agent"}}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	})
+	defer ct.close()
 
-	// plugin.ServeHTTP(nil, w, r)
+	expire := func() {
+		require.NoError(t, ct.p.storeOAuthToken("user", defaultInstanceName, &OAuthAccessResponse{AccessToken: "old", RefreshToken: "r1", ExpiresIn: 30}))
+	}
+	expire()
+	message := ct.execute(t, "/zendesk whoami")
+	assert.Contains(t, message, "as **Jane Doe**")
+	assert.Equal(t, OAuthAccessRequest{GrantType: "refresh_token", RefreshToken: "r1", ClientID: "id", ClientSecret: "secret", Scope: "read write"}, refreshRequest)
 
-	// result := w.Result()
-	// assert.NotNil(result)
-	// bodyBytes, err := ioutil.ReadAll(result.Body)
-	// assert.Nil(err)
-	// bodyString := string(bodyBytes)
+	token, err := ct.p.getToken("user", defaultInstanceName)
+	require.NoError(t, err)
+	assert.Equal(t, "new", token)
+	refresh, err := ct.p.getOAuthRefresh("user", defaultInstanceName)
+	require.NoError(t, err)
+	assert.Equal(t, "r2", refresh.RefreshToken)
 
-	// assert.Equal("Hello, world!", bodyString)
+	// Users only have to connect again when the refresh fails.
+	refused = true
+	expire()
+	ct.api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	assert.Equal(t, errSessionExpired.Error(), ct.execute(t, "/zendesk whoami"))
+	_, err = ct.p.getToken("user", defaultInstanceName)
+	assert.Equal(t, errNotConnected, err)
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+)
+
+// previewFlag makes the update commands show the comment to the user instead of posting it.
+const previewFlag = "--preview"
+
+// Values of the "action" context of the buttons of a comment preview.
+const (
+	previewActionPost    = "post"
+	previewActionDiscard = "discard"
+)
+
+// sendCommentPreview shows the comment of an update command to the user as it will be posted, with
+// buttons to post or discard it. Nothing is sent to Zendesk until the user confirms, the command is
+// then run again by httpActionComment. in carries the field changes given as flags.
+func (p *Plugin) sendCommentPreview(commandArgs *model.CommandArgs, trigger string, isPublic bool, args []string, ticketNumber int64, comment string, in *zendesk.Ticket) *model.CommandResponse {
+	previewID, err := p.createCommentPreview(&commentPreview{
+		UserID:    commandArgs.UserId,
+		ChannelID: commandArgs.ChannelId,
+		TeamID:    commandArgs.TeamId,
+		RootID:    commandArgs.RootId,
+		Command:   commandArgs.Command,
+		Trigger:   trigger,
+		Public:    isPublic,
+		Args:      args,
+	})
+	if err != nil {
+		return p.respondError(commandArgs, err)
+	}
+
+	T := p.T(commandArgs.UserId)
+	pretextID := "zendesk.preview.private"
+	if isPublic {
+		pretextID = "zendesk.preview.public"
+	}
+	action := func(name, style, value string) *model.PostAction {
+		return &model.PostAction{
+			Id:    value,
+			Type:  model.POST_ACTION_TYPE_BUTTON,
+			Name:  name,
+			Style: style,
+			Integration: &model.PostActionIntegration{
+				URL:     p.GetPluginURL() + routeActionComment,
+				Context: map[string]interface{}{"preview_id": previewID, "action": value},
+			},
+		}
+	}
+
+	post := p.commandResponsePost(commandArgs, "")
+	post.AddProp("attachments", []*model.SlackAttachment{{
+		Color:   defaultTicketColor,
+		Pretext: T(pretextID, map[string]interface{}{"TicketID": ticketNumber, "Update": describeTicketUpdate(T, in)}),
+		Text:    comment,
+		Actions: []*model.PostAction{
+			action(T("zendesk.preview.post_button"), "primary", previewActionPost),
+			action(T("zendesk.preview.discard_button"), "default", previewActionDiscard),
+		},
+	}})
+	_ = p.API.SendEphemeralPost(commandArgs.UserId, post)
+	return &model.CommandResponse{}
+}
+
+// httpActionComment handles the buttons of a comment preview. The preview is removed either way,
+// the comment is posted by running the previewed update command again, so it is checked the same
+// way as a comment posted without preview.
+func httpActionComment(p *Plugin, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("method " + r.Method + " is not allowed, must be POST")
+	}
+
+	userID := r.Header.Get("Mattermost-User-ID")
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil {
+		return http.StatusBadRequest, errors.New("failed to decode the action request")
+	}
+	if userID == "" || request.UserId != userID {
+		return http.StatusUnauthorized, errors.New("not authorized")
+	}
+
+	previewID, _ := request.Context["preview_id"].(string)
+	action, _ := request.Context["action"].(string)
+	preview, err := p.consumeCommentPreview(previewID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if preview != nil && preview.UserID != userID {
+		return http.StatusForbidden, errors.New("the comment was previewed by another user")
+	}
+	p.API.DeleteEphemeralPost(userID, request.PostId)
+
+	commandArgs := &model.CommandArgs{UserId: userID, ChannelId: request.ChannelId}
+	switch {
+	case preview == nil:
+		p.respondT(commandArgs, "zendesk.preview.expired")
+	case action == previewActionPost:
+		commandArgs = &model.CommandArgs{
+			UserId:    preview.UserID,
+			ChannelId: preview.ChannelID,
+			TeamId:    preview.TeamID,
+			RootId:    preview.RootID,
+			Command:   preview.Command,
+		}
+		p.runHandler(strings.Replace(preview.Trigger, " ", "/", -1), func(p *Plugin, _ *plugin.Context, commandArgs *model.CommandArgs, args ...string) *model.CommandResponse {
+			return p.addTicketComment(commandArgs, preview.Trigger, preview.Public, args)
+		}, nil, commandArgs, preview.Args...)
+	default:
+		p.respondT(commandArgs, "zendesk.preview.discarded")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write((&model.PostActionIntegrationResponse{}).ToJson()); err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "failed to write the action response")
+	}
+	return http.StatusOK, nil
+}
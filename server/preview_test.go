@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommentPreview(t *testing.T) {
+	var comments []zendesk.TicketComment
+	ct := newCommandTest(t, func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Ticket zendesk.Ticket `json:"ticket"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		comments = append(comments, *in.Ticket.Comment)
+		_, _ = w.Write([]byte(`{"ticket":{"id":1}}`))
+	})
+	defer ct.close()
+	siteURL := "https://chat.example.com"
+	ct.api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+
+	preview := func() map[string]interface{} {
+		ct.execute(t, "/zendesk update public --preview 1 --status=solved The **fix** is live.")
+		require.Len(t, ct.responses, 1)
+		attachment := ct.responses[0].Attachments()[0]
+		assert.Equal(t, "Preview of the public comment to ticket #1 (status set to solved), nothing was sent to Zendesk yet:", attachment.Pretext)
+		assert.Equal(t, "The **fix** is live.", attachment.Text)
+		require.Len(t, attachment.Actions, 2)
+		assert.Equal(t, "https://chat.example.com/plugins/zendesk/action/comment", attachment.Actions[0].Integration.URL)
+		return attachment.Actions[0].Integration.Context
+	}
+	click := func(context map[string]interface{}, action string) int {
+		context["action"] = action
+		body, _ := json.Marshal(model.PostActionIntegrationRequest{UserId: "user", ChannelId: "channel", PostId: "preview", Context: context})
+		r := httptest.NewRequest(http.MethodPost, routeActionComment, strings.NewReader(string(body)))
+		r.Header.Set("Mattermost-User-ID", "user")
+		ct.responses = nil
+		status, _ := httpActionComment(ct.p, httptest.NewRecorder(), r)
+		return status
+	}
+
+	context := preview()
+	assert.Empty(t, comments, "nothing is posted before the comment is confirmed")
+	assert.Equal(t, http.StatusOK, click(context, previewActionDiscard))
+	assert.Equal(t, "The comment was discarded, nothing was sent to Zendesk.", ct.responses[0].Message)
+	assert.Equal(t, http.StatusOK, click(context, previewActionPost))
+	assert.Equal(t, "This preview has expired, please run the command again.", ct.responses[0].Message)
+	assert.Empty(t, comments)
+
+	context = preview()
+	assert.Equal(t, http.StatusOK, click(context, previewActionPost))
+	require.Len(t, comments, 1)
+	assert.Equal(t, "The **fix** is live.", *comments[0].Body)
+	assert.True(t, *comments[0].Public)
+	assert.Equal(t, "Public comment [The **fix** is live.] was added to ticket #1 (status set to solved)", ct.responses[0].Message)
+	assert.Empty(t, ct.kv[commentPreviewKeyPrefix+context["preview_id"].(string)])
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// errRateLimited is returned when a user runs commands calling Zendesk faster than allowed, so
+// that a single user can't get the whole plugin throttled by Zendesk.
+var errRateLimited = errors.New("You're issuing commands too quickly, try again in a few seconds")
+
+// tokenBucket allows a burst of commands, refilled at a constant rate.
+type tokenBucket struct {
+	tokens   float64
+	updateAt time.Time
+}
+
+// allowCommand takes a token from the bucket of a user, returning false if the bucket is empty.
+func (p *Plugin) allowCommand(userID string, now time.Time) bool {
+	config := p.getConfiguration()
+	burst := float64(config.getCommandRateBurst())
+	perSecond := float64(config.getCommandRatePerMinute()) / 60
+
+	p.rateLimitLock.Lock()
+	defer p.rateLimitLock.Unlock()
+
+	bucket, ok := p.rateLimitBuckets[userID]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, updateAt: now}
+		p.rateLimitBuckets[userID] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.updateAt).Seconds() * perSecond
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.updateAt = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// channelPostKeyPrefix is prepended to the fingerprint of a post to build the KV store key
+// marking that it was posted to a channel, see createChannelPost.
+const channelPostKeyPrefix = "channel_post_"
+
+// createChannelPost posts as the bot to a channel, unless the same post was already posted to the
+// channel within the configured window, e.g. by several users showing the same ticket during an
+// incident. It returns false if the post was dropped. The posts are marked in the KV store, so
+// duplicates are also dropped across the servers of a cluster. Ephemeral posts are never
+// coalesced.
+func (p *Plugin) createChannelPost(post *model.Post) (bool, *model.AppError) {
+	if window := p.getConfiguration().getChannelPostWindow(); window > 0 {
+		// The KV store expires the mark, but only compares and sets values that are absent or
+		// expired, so only the first of concurrent duplicates is posted.
+		stored, appErr := p.API.KVSetWithOptions(channelPostKey(post), []byte{1}, model.PluginKVSetOptions{
+			Atomic:          true,
+			ExpireInSeconds: int64(window / time.Second),
+		})
+		if appErr != nil {
+			p.API.LogWarn("failed to mark the channel post, posting it anyway", "channel_id", post.ChannelId, "error", appErr.Error())
+		} else if !stored {
+			return false, nil
+		}
+	}
+
+	if _, appErr := p.API.CreatePost(post); appErr != nil {
+		return false, appErr
+	}
+	return true, nil
+}
+
+// channelPostKey is a hash of the channel, thread and content of a post, to stay within the KV
+// store key length limit.
+func channelPostKey(post *model.Post) string {
+	attachments, _ := json.Marshal(post.Attachments())
+	sum := sha256.Sum256([]byte(post.ChannelId + "/" + post.RootId + "/" + post.Message + "/" + string(attachments)))
+	return channelPostKeyPrefix + hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAllowCommand(t *testing.T) {
+	p := newTestPlugin(&plugintest.API{})
+	p.setConfiguration(&configuration{CommandRateBurst: "2", CommandRatePerMinute: "60"})
+
+	now := time.Now()
+	if !p.allowCommand("user1", now) || !p.allowCommand("user1", now) {
+		t.Fatal("expected the burst to be allowed")
+	}
+	if p.allowCommand("user1", now) {
+		t.Error("expected the third command in a row to be limited")
+	}
+	if !p.allowCommand("user2", now) {
+		t.Error("expected other users not to be limited")
+	}
+	if !p.allowCommand("user1", now.Add(time.Second)) {
+		t.Error("expected a token to be refilled after a second")
+	}
+	if p.allowCommand("user1", now.Add(time.Second)) {
+		t.Error("expected a single token to be refilled after a second")
+	}
+}
+
+func TestCreateChannelPost(t *testing.T) {
+	api := &plugintest.API{}
+	p := newTestPlugin(api)
+	p.setConfiguration(&configuration{ChannelPostWindow: "30"})
+
+	marked := map[string]bool{}
+	api.On("KVSetWithOptions", mock.AnythingOfType("string"), []byte{1}, model.PluginKVSetOptions{Atomic: true, ExpireInSeconds: 30}).
+		Return(func(key string, _ []byte, _ model.PluginKVSetOptions) bool {
+			if marked[key] {
+				return false
+			}
+			marked[key] = true
+			return true
+		}, nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+
+	post := func(channelID, message string) *model.Post {
+		return &model.Post{UserId: "bot", ChannelId: channelID, Message: message}
+	}
+	if posted, appErr := p.createChannelPost(post("channel1", "ticket #1")); !posted || appErr != nil {
+		t.Fatalf("expected the first post to be posted, got %v, %v", posted, appErr)
+	}
+	if posted, _ := p.createChannelPost(post("channel1", "ticket #1")); posted {
+		t.Error("expected the duplicate post to be dropped")
+	}
+	if posted, _ := p.createChannelPost(post("channel2", "ticket #1")); !posted {
+		t.Error("expected the post to another channel to be posted")
+	}
+	if posted, _ := p.createChannelPost(post("channel1", "ticket #2")); !posted {
+		t.Error("expected another post to the channel to be posted")
+	}
+	api.AssertNumberOfCalls(t, "CreatePost", 3)
+
+	// Without a window every post is posted, without marking it.
+	p.setConfiguration(&configuration{})
+	if posted, _ := p.createChannelPost(post("channel1", "ticket #1")); !posted {
+		t.Error("expected the post to be posted without a window")
+	}
+	api.AssertNumberOfCalls(t, "KVSetWithOptions", 4)
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// tokenKeySuffix is appended to the Mattermost user ID to build the KV store key of the user's Zendesk token.
+const tokenKeySuffix = "_zendesk_token"
+
+// refreshTokenKeySuffix is appended to the Mattermost user ID to build the KV store key of the
+// refresh token of the user's Zendesk access token, see oauthRefresh.
+const refreshTokenKeySuffix = "_zendesk_refresh"
+
+// oauthStateKeyPrefix is prepended to the OAuth state to build the KV store key of a pending connect flow.
+const oauthStateKeyPrefix = "oauth_state_"
+
+// oauthStateTTL is how long, in seconds, a user has to complete the Zendesk authorization.
+const oauthStateTTL = 10 * 60
+
+// errInvalidOAuthState is returned when the state of an OAuth redirect is unknown, expired or was
+// issued to another user.
+var errInvalidOAuthState = errors.New("invalid or expired OAuth state, please run `/zendesk connect` again")
+
+// oauthState is stored for every started connect flow, keyed by the random state sent to Zendesk.
+type oauthState struct {
+	UserID   string `json:"user_id"`
+	Instance string `json:"instance"`
+}
+
+// commentPreviewKeyPrefix is prepended to the ID of a comment preview to build the KV store key of
+// the update command waiting for confirmation, see createCommentPreview.
+const commentPreviewKeyPrefix = "comment_preview_"
+
+// commentPreviewTTL is how long, in seconds, a user has to confirm a previewed comment.
+const commentPreviewTTL = 15 * 60
+
+// commentPreview is stored for every previewed comment, it is the update command to run once the
+// user confirms the comment.
+type commentPreview struct {
+	UserID    string   `json:"user_id"`
+	ChannelID string   `json:"channel_id"`
+	TeamID    string   `json:"team_id"`
+	RootID    string   `json:"root_id"`
+	Command   string   `json:"command"`
+	Trigger   string   `json:"trigger"`
+	Public    bool     `json:"public"`
+	Args      []string `json:"args"`
+}
+
+// mergeConfirmationKeyPrefix is prepended to the ID of a merge waiting for confirmation to build
+// the KV store key of its merge command, see createMergeConfirmation.
+const mergeConfirmationKeyPrefix = "merge_confirmation_"
+
+// mergeConfirmationTTL is how long, in seconds, a user has to confirm a merge.
+const mergeConfirmationTTL = 15 * 60
+
+// mergeConfirmation is stored for every merge waiting for confirmation, it is the merge command to
+// run once the user confirms it.
+type mergeConfirmation struct {
+	UserID    string   `json:"user_id"`
+	ChannelID string   `json:"channel_id"`
+	TeamID    string   `json:"team_id"`
+	RootID    string   `json:"root_id"`
+	Command   string   `json:"command"`
+	Args      []string `json:"args"`
+}
+
+// ticketListingKeyPrefix is prepended to the ID of a listing with several pages to build the KV
+// store key of its ticketListing, see storeTicketListing.
+const ticketListingKeyPrefix = "listing_"
+
+// ticketListingTTL is how long, in seconds, the pages of a listing can be browsed.
+const ticketListingTTL = 60 * 60
+
+// seenTicketKeyPrefix is prepended to the KV store key of the updated_at stamp a user last saw
+// on a ticket, see setSeenTicketStamp.
+const seenTicketKeyPrefix = "seen_"
+
+// seenTicketTTL is how long, in seconds, the stamp of a viewed ticket is kept. Updates made later
+// are no longer checked for conflicts.
+const seenTicketTTL = 24 * 60 * 60
+
+// oauthRefresh is stored, encrypted, for OAuth access tokens that expire. Zendesk only issues
+// expiring tokens with a refresh token.
+type oauthRefresh struct {
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// errTokenUnreadable is returned when a stored token can't be decrypted, typically because the
+// encryption key was rotated.
+var errTokenUnreadable = errors.New("your Zendesk connection could not be restored, please run `/zendesk connect` again")
+
+// setToken stores the Zendesk access token of a Mattermost user for a Zendesk instance. Tokens are
+// kept in the KV store only, so connections survive plugin restarts and every node of a cluster
+// sees the same token. Tokens are encrypted before they are written to the KV store.
+func (p *Plugin) setToken(userID, instanceName, token string) error {
+	key := tokenKey(userID, instanceName)
+	encrypted, err := p.encryptToken(token)
+	if err != nil {
+		return err
+	}
+	if appErr := p.API.KVSet(key+tokenKeySuffix, []byte(encrypted)); appErr != nil {
+		return errors.Wrap(appErr, "failed to store Zendesk token")
+	}
+	return nil
+}
+
+// getToken returns the Zendesk access token of a Mattermost user, or errNotConnected if there is none.
+func (p *Plugin) getToken(userID, instanceName string) (string, error) {
+	data, appErr := p.API.KVGet(tokenKey(userID, instanceName) + tokenKeySuffix)
+	if appErr != nil {
+		return "", errors.Wrap(appErr, "failed to load Zendesk token")
+	}
+	if data == nil {
+		return "", errNotConnected
+	}
+
+	token, err := p.decryptToken(string(data))
+	if err != nil {
+		p.API.LogWarn("failed to decrypt Zendesk token", "user_id", userID, "instance", instanceName, "error", err.Error())
+		return "", errTokenUnreadable
+	}
+	return token, nil
+}
+
+// setOAuthRefresh stores how to refresh the Zendesk access token of a Mattermost user, see
+// getFreshToken. Tokens that don't expire have nothing to store.
+func (p *Plugin) setOAuthRefresh(userID, instanceName string, refresh *oauthRefresh) error {
+	key := tokenKey(userID, instanceName) + refreshTokenKeySuffix
+	if refresh == nil {
+		if appErr := p.API.KVDelete(key); appErr != nil {
+			return errors.Wrap(appErr, "failed to delete Zendesk refresh token")
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(refresh)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal Zendesk refresh token")
+	}
+	encrypted, err := p.encryptToken(string(data))
+	if err != nil {
+		return err
+	}
+	if appErr := p.API.KVSet(key, []byte(encrypted)); appErr != nil {
+		return errors.Wrap(appErr, "failed to store Zendesk refresh token")
+	}
+	return nil
+}
+
+// getOAuthRefresh returns how to refresh the Zendesk access token of a Mattermost user, nil if
+// the token doesn't expire.
+func (p *Plugin) getOAuthRefresh(userID, instanceName string) (*oauthRefresh, error) {
+	data, appErr := p.API.KVGet(tokenKey(userID, instanceName) + refreshTokenKeySuffix)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load Zendesk refresh token")
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	decrypted, err := p.decryptToken(string(data))
+	if err != nil {
+		return nil, errTokenUnreadable
+	}
+	var refresh oauthRefresh
+	if err := json.Unmarshal([]byte(decrypted), &refresh); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal Zendesk refresh token")
+	}
+	return &refresh, nil
+}
+
+// deleteToken removes the Zendesk access token of a Mattermost user, along with its refresh token
+// and the data cached for the connection.
+func (p *Plugin) deleteToken(userID, instanceName string) error {
+	key := tokenKey(userID, instanceName)
+	if appErr := p.API.KVDelete(key + tokenKeySuffix); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete Zendesk token")
+	}
+	if appErr := p.API.KVDelete(key + refreshTokenKeySuffix); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete Zendesk refresh token")
+	}
+
+	p.clientCacheLock.Lock()
+	delete(p.clientCache, key)
+	p.clientCacheLock.Unlock()
+
+	p.userGroupsLock.Lock()
+	defer p.userGroupsLock.Unlock()
+	delete(p.userGroupsCache, key)
+	return nil
+}
+
+// tokenKey identifies the token of a user for a Zendesk instance. Tokens for the default instance
+// are keyed by the user ID alone, the same as before multiple instances were supported.
+func tokenKey(userID, instanceName string) string {
+	if instanceName == defaultInstanceName {
+		return userID
+	}
+	return userID + "_" + instanceName
+}
+
+// createOAuthState starts a connect flow for a user and returns the random state to send along with
+// the authorization request. The state expires after oauthStateTTL.
+func (p *Plugin) createOAuthState(userID, instanceName string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", errors.Wrap(err, "failed to generate OAuth state")
+	}
+	state := hex.EncodeToString(random)
+
+	data, err := json.Marshal(oauthState{UserID: userID, Instance: instanceName})
+	if err != nil {
+		return "", err
+	}
+	if appErr := p.API.KVSetWithExpiry(oauthStateKeyPrefix+state, data, oauthStateTTL); appErr != nil {
+		return "", errors.Wrap(appErr, "failed to store OAuth state")
+	}
+	return state, nil
+}
+
+// consumeOAuthState returns the connect flow a state was issued for and deletes it, so a state
+// can only be used once.
+func (p *Plugin) consumeOAuthState(state string) (*oauthState, error) {
+	if state == "" {
+		return nil, errInvalidOAuthState
+	}
+
+	data, appErr := p.API.KVGet(oauthStateKeyPrefix + state)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load OAuth state")
+	}
+	if data == nil {
+		return nil, errInvalidOAuthState
+	}
+	if appErr = p.API.KVDelete(oauthStateKeyPrefix + state); appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to delete OAuth state")
+	}
+
+	var flow oauthState
+	if err := json.Unmarshal(data, &flow); err != nil {
+		return nil, errors.Wrap(err, "failed to decode OAuth state")
+	}
+	return &flow, nil
+}
+
+// createCommentPreview stores an update command waiting for confirmation and returns the ID of the
+// preview. The preview expires after commentPreviewTTL.
+func (p *Plugin) createCommentPreview(preview *commentPreview) (string, error) {
+	data, err := json.Marshal(preview)
+	if err != nil {
+		return "", err
+	}
+
+	id := model.NewId()
+	if appErr := p.API.KVSetWithExpiry(commentPreviewKeyPrefix+id, data, commentPreviewTTL); appErr != nil {
+		return "", errors.Wrap(appErr, "failed to store comment preview")
+	}
+	return id, nil
+}
+
+// consumeCommentPreview returns the update command of a preview and deletes it, so a comment is
+// posted at most once. nil is returned if the preview expired or was already used.
+func (p *Plugin) consumeCommentPreview(id string) (*commentPreview, error) {
+	if id == "" {
+		return nil, nil
+	}
+
+	data, appErr := p.API.KVGet(commentPreviewKeyPrefix + id)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load comment preview")
+	}
+	if data == nil {
+		return nil, nil
+	}
+	if appErr = p.API.KVDelete(commentPreviewKeyPrefix + id); appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to delete comment preview")
+	}
+
+	var preview commentPreview
+	if err := json.Unmarshal(data, &preview); err != nil {
+		return nil, errors.Wrap(err, "failed to decode comment preview")
+	}
+	return &preview, nil
+}
+
+// createMergeConfirmation stores a merge command waiting for confirmation and returns the ID of
+// the confirmation. The confirmation expires after mergeConfirmationTTL.
+func (p *Plugin) createMergeConfirmation(confirmation *mergeConfirmation) (string, error) {
+	data, err := json.Marshal(confirmation)
+	if err != nil {
+		return "", err
+	}
+
+	id := model.NewId()
+	if appErr := p.API.KVSetWithExpiry(mergeConfirmationKeyPrefix+id, data, mergeConfirmationTTL); appErr != nil {
+		return "", errors.Wrap(appErr, "failed to store merge confirmation")
+	}
+	return id, nil
+}
+
+// consumeMergeConfirmation returns the merge command of a confirmation and deletes it, so tickets
+// are merged at most once. nil is returned if the confirmation expired or was already used.
+func (p *Plugin) consumeMergeConfirmation(id string) (*mergeConfirmation, error) {
+	if id == "" {
+		return nil, nil
+	}
+
+	data, appErr := p.API.KVGet(mergeConfirmationKeyPrefix + id)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load merge confirmation")
+	}
+	if data == nil {
+		return nil, nil
+	}
+	if appErr = p.API.KVDelete(mergeConfirmationKeyPrefix + id); appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to delete merge confirmation")
+	}
+
+	var confirmation mergeConfirmation
+	if err := json.Unmarshal(data, &confirmation); err != nil {
+		return nil, errors.Wrap(err, "failed to decode merge confirmation")
+	}
+	return &confirmation, nil
+}
+
+// storeTicketListing stores a listing for its paging buttons and returns its ID. The listing
+// expires after ticketListingTTL.
+func (p *Plugin) storeTicketListing(listing *ticketListing) (string, error) {
+	data, err := json.Marshal(listing)
+	if err != nil {
+		return "", err
+	}
+
+	id := model.NewId()
+	if appErr := p.API.KVSetWithExpiry(ticketListingKeyPrefix+id, data, ticketListingTTL); appErr != nil {
+		return "", errors.Wrap(appErr, "failed to store ticket listing")
+	}
+	return id, nil
+}
+
+// getTicketListing returns a listing stored by storeTicketListing, nil if it expired.
+func (p *Plugin) getTicketListing(id string) (*ticketListing, error) {
+	if id == "" {
+		return nil, nil
+	}
+
+	data, appErr := p.API.KVGet(ticketListingKeyPrefix + id)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load ticket listing")
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	var listing ticketListing
+	if err := json.Unmarshal(data, &listing); err != nil {
+		return nil, errors.Wrap(err, "failed to decode ticket listing")
+	}
+	return &listing, nil
+}
+
+// setSeenTicketStamp records the updated_at of a ticket as shown to a user, so later updates by
+// that user can be rejected if someone else changed the ticket in the meantime.
+func (p *Plugin) setSeenTicketStamp(userID, instanceName string, ticket *zendesk.Ticket) error {
+	if ticket == nil || ticket.ID == nil || ticket.UpdatedAt == nil {
+		return nil
+	}
+
+	data := []byte(ticket.UpdatedAt.UTC().Format(time.RFC3339))
+	if appErr := p.API.KVSetWithExpiry(seenTicketKey(userID, instanceName, *ticket.ID), data, seenTicketTTL); appErr != nil {
+		return errors.Wrap(appErr, "failed to store ticket stamp")
+	}
+	return nil
+}
+
+// getSeenTicketStamp returns the updated_at of a ticket the user last saw, or nil if the user
+// didn't look at the ticket recently.
+func (p *Plugin) getSeenTicketStamp(userID, instanceName string, ticketID int64) (*time.Time, error) {
+	data, appErr := p.API.KVGet(seenTicketKey(userID, instanceName, ticketID))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load ticket stamp")
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	stamp, err := time.Parse(time.RFC3339, string(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse ticket stamp")
+	}
+	return &stamp, nil
+}
+
+// seenTicketKey is hashed to stay within the KV store key length limit.
+func seenTicketKey(userID, instanceName string, ticketID int64) string {
+	sum := sha256.Sum256([]byte(tokenKey(userID, instanceName) + "/" + formatID(ticketID)))
+	return seenTicketKeyPrefix + hex.EncodeToString(sum[:16])
+}
+
+// watchKeyPrefix is prepended to the KV store key listing the channels watching a ticket.
+const watchKeyPrefix = "watch_"
+
+// listUpdateAttempts bounds how often setListMember retries when a list is changed concurrently,
+// e.g. by a command on another server of a cluster.
+const listUpdateAttempts = 5
+
+// getTicketWatchers returns the IDs of the channels watching a ticket of a Zendesk instance.
+func (p *Plugin) getTicketWatchers(instanceName string, ticketID int64) ([]string, error) {
+	_, channelIDs, err := p.loadList(watchKey(instanceName, ticketID), "ticket watchers")
+	return channelIDs, err
+}
+
+// setTicketWatcher subscribes a channel to the updates of a ticket, or unsubscribes it. It
+// returns false if the channel already was in the requested state.
+func (p *Plugin) setTicketWatcher(instanceName string, ticketID int64, channelID string, watch bool) (bool, error) {
+	return p.setListMember(watchKey(instanceName, ticketID), channelID, watch, "ticket watchers")
+}
+
+// loadList returns a list stored as JSON along with its decoded values. What names the list in
+// errors.
+func (p *Plugin) loadList(key, what string) ([]byte, []string, error) {
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to load "+what)
+	}
+	if data == nil {
+		return nil, nil, nil
+	}
+
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decode "+what)
+	}
+	return data, values, nil
+}
+
+// setListMember adds a value to a list stored as JSON, or removes it. It returns false if the
+// value already was in the requested state. The list is compared and set, so concurrent changes
+// to the list are retried instead of lost.
+func (p *Plugin) setListMember(key, value string, member bool, what string) (bool, error) {
+	for attempt := 0; attempt < listUpdateAttempts; attempt++ {
+		data, values, err := p.loadList(key, what)
+		if err != nil {
+			return false, err
+		}
+
+		var updated []string
+		for _, v := range values {
+			if v != value {
+				updated = append(updated, v)
+			}
+		}
+		if member {
+			updated = append(updated, value)
+		}
+		if len(updated) == len(values) {
+			return false, nil
+		}
+
+		var stored bool
+		var appErr *model.AppError
+		if len(updated) == 0 {
+			stored, appErr = p.API.KVCompareAndDelete(key, data)
+		} else {
+			var newData []byte
+			if newData, err = json.Marshal(updated); err != nil {
+				return false, err
+			}
+			stored, appErr = p.API.KVCompareAndSet(key, data, newData)
+		}
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to store "+what)
+		}
+		if stored {
+			return true, nil
+		}
+	}
+	return false, errors.New("failed to store " + what + ", they kept changing")
+}
+
+// watchKey identifies the watchers of a ticket. Tickets of the default instance are keyed by
+// their ID alone.
+func watchKey(instanceName string, ticketID int64) string {
+	if instanceName == defaultInstanceName {
+		return watchKeyPrefix + formatID(ticketID)
+	}
+	return watchKeyPrefix + instanceName + "_" + formatID(ticketID)
+}
+
+// watchSubscription is a channel watching a ticket of a Zendesk instance.
+type watchSubscription struct {
+	Instance  string `json:"instance"`
+	TicketID  int64  `json:"ticket_id"`
+	ChannelID string `json:"channel_id"`
+}
+
+// id identifies the subscription in KV store keys, hashed to stay within the key length limit.
+func (s watchSubscription) id() string {
+	sum := sha256.Sum256([]byte(watchKey(s.Instance, s.TicketID) + "/" + s.ChannelID))
+	return hex.EncodeToString(sum[:16])
+}
+
+// watchSettingsKeyPrefix is prepended to the ID of a subscription to build the KV store key of its
+// settings.
+const watchSettingsKeyPrefix = "watch_settings_"
+
+// watchSettings are the optional settings of a channel watching a ticket. Without settings every
+// update is posted right away.
+type watchSettings struct {
+	QuietHours *quietHours `json:"quiet_hours,omitempty"`
+
+	// DigestInterval sums up the updates received within this many minutes in a single post.
+	DigestInterval int `json:"digest_interval,omitempty"`
+}
+
+// getWatchSettings returns the settings of a subscription, empty ones if it has none.
+func (p *Plugin) getWatchSettings(sub watchSubscription) (*watchSettings, error) {
+	data, appErr := p.API.KVGet(watchSettingsKeyPrefix + sub.id())
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load watch settings")
+	}
+
+	settings := &watchSettings{}
+	if data == nil {
+		return settings, nil
+	}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, errors.Wrap(err, "failed to decode watch settings")
+	}
+	return settings, nil
+}
+
+// setWatchSettings stores the settings of a subscription, empty settings are deleted.
+func (p *Plugin) setWatchSettings(sub watchSubscription, settings *watchSettings) error {
+	key := watchSettingsKeyPrefix + sub.id()
+	if *settings == (watchSettings{}) {
+		if appErr := p.API.KVDelete(key); appErr != nil {
+			return errors.Wrap(appErr, "failed to delete watch settings")
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if appErr := p.API.KVSet(key, data); appErr != nil {
+		return errors.Wrap(appErr, "failed to store watch settings")
+	}
+	return nil
+}
+
+// watchDigestKeyPrefix is prepended to the ID of a subscription to build the KV store key of the
+// updates held back for it, see watchDigest.
+const watchDigestKeyPrefix = "watch_digest_"
+
+// watchDigestsKey lists the IDs of the subscriptions with held back updates, so they can be
+// flushed without listing the whole KV store.
+const watchDigestsKey = "watch_digests"
+
+// watchDigestUpdateAttempts bounds how often addToWatchDigest retries when the digest of a
+// subscription is changed concurrently.
+const watchDigestUpdateAttempts = 5
+
+// addToWatchDigest holds back an update of a watched ticket, to be posted with the other held
+// back updates in a single summary once it is due, see flushWatchDigests. A new digest is due at
+// flushAt, later updates don't postpone it. The digest is compared and set, so concurrent webhook
+// calls, e.g. received by different servers of a cluster, and flushes are retried instead of lost.
+func (p *Plugin) addToWatchDigest(sub watchSubscription, event *webhookEvent, flushAt time.Time) error {
+	key := watchDigestKeyPrefix + sub.id()
+	for attempt := 0; attempt < watchDigestUpdateAttempts; attempt++ {
+		data, digest, err := p.loadWatchDigest(key)
+		if err != nil {
+			return err
+		}
+		if digest == nil {
+			digest = &watchDigest{Subscription: sub, FlushAt: flushAt.Unix()}
+		}
+		digest.add(event)
+
+		newData, err := json.Marshal(digest)
+		if err != nil {
+			return err
+		}
+		stored, appErr := p.API.KVCompareAndSet(key, data, newData)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to store watch digest")
+		}
+		if stored {
+			_, err = p.setListMember(watchDigestsKey, sub.id(), true, "watch digests")
+			return err
+		}
+	}
+	return errors.New("failed to store watch digest, it kept changing")
+}
+
+// loadWatchDigest returns the stored digest of a subscription along with its decoded value.
+func (p *Plugin) loadWatchDigest(key string) ([]byte, *watchDigest, error) {
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to load watch digest")
+	}
+	if data == nil {
+		return nil, nil, nil
+	}
+
+	digest := &watchDigest{}
+	if err := json.Unmarshal(data, digest); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decode watch digest")
+	}
+	return data, digest, nil
+}
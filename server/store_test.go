@@ -0,0 +1,169 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const testEncryptionKey = "0123456789abcdef0123456789abcdef"
+
+func newTestPlugin(api *plugintest.API) *Plugin {
+	p := &Plugin{
+		userGroupsCache:   make(map[string]cachedGroups),
+		rateLimitBuckets:  make(map[string]*tokenBucket),
+		clientCache:       make(map[string]cachedClient),
+		ticketFieldsCache: make(map[string]cachedTicketField),
+	}
+	p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey})
+	p.SetAPI(api)
+	if err := p.loadTranslations(filepath.Join("..", "assets", "i18n")); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func TestTokenPersistence(t *testing.T) {
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	p := newTestPlugin(api)
+
+	encrypted, err := p.encryptToken("token2")
+	require.NoError(t, err)
+
+	var stored []byte
+	api.On("KVSet", "user1"+tokenKeySuffix, mock.AnythingOfType("[]uint8")).Run(func(args mock.Arguments) {
+		stored = args.Get(1).([]byte)
+	}).Return(nil)
+	api.On("KVGet", "user1"+tokenKeySuffix).Return(func(string) []byte { return stored }, nil)
+	api.On("KVGet", "user2"+tokenKeySuffix).Return([]byte(encrypted), nil)
+	api.On("KVGet", "user3"+tokenKeySuffix).Return(nil, nil)
+	api.On("KVDelete", "user1"+tokenKeySuffix).Return(nil)
+	api.On("KVDelete", "user1"+refreshTokenKeySuffix).Return(nil)
+
+	require.NoError(t, p.setToken("user1", defaultInstanceName, "token1"))
+	assert.NotContains(t, string(stored), "token1", "tokens must not be stored in plaintext")
+
+	token, err := p.getToken("user1", defaultInstanceName)
+	require.NoError(t, err)
+	assert.Equal(t, "token1", token)
+
+	// A token persisted before a restart is loaded from the KV store.
+	token, err = p.getToken("user2", defaultInstanceName)
+	require.NoError(t, err)
+	assert.Equal(t, "token2", token)
+
+	_, err = p.getToken("user3", defaultInstanceName)
+	assert.Equal(t, errNotConnected, err)
+
+	require.NoError(t, p.deleteToken("user1", defaultInstanceName))
+
+	// Tokens of other instances are stored separately.
+	api.On("KVGet", "user1_eu"+tokenKeySuffix).Return(nil, nil)
+	_, err = p.getToken("user1", "eu")
+	assert.Equal(t, errNotConnected, err)
+}
+
+func TestTokenEncryptionKeyRotation(t *testing.T) {
+	api := &plugintest.API{}
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	p := newTestPlugin(api)
+
+	encrypted, err := p.encryptToken("token")
+	require.NoError(t, err)
+
+	decrypted, err := p.decryptToken(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "token", decrypted)
+
+	p.setConfiguration(&configuration{EncryptionKey: "fedcba9876543210fedcba9876543210"})
+	api.On("KVGet", "user"+tokenKeySuffix).Return([]byte(encrypted), nil)
+
+	_, err = p.getToken("user", defaultInstanceName)
+	assert.Equal(t, errTokenUnreadable, err)
+}
+
+func TestOAuthState(t *testing.T) {
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	p := newTestPlugin(api)
+
+	var stored []byte
+	api.On("KVSetWithExpiry", mock.AnythingOfType("string"), mock.AnythingOfType("[]uint8"), int64(oauthStateTTL)).
+		Run(func(args mock.Arguments) { stored = args.Get(1).([]byte) }).Return(nil)
+
+	state, err := p.createOAuthState("user", "eu")
+	require.NoError(t, err)
+	assert.Len(t, state, 32)
+
+	api.On("KVGet", oauthStateKeyPrefix+state).Return(stored, nil).Once()
+	api.On("KVDelete", oauthStateKeyPrefix+state).Return(nil).Once()
+	flow, err := p.consumeOAuthState(state)
+	require.NoError(t, err)
+	assert.Equal(t, &oauthState{UserID: "user", Instance: "eu"}, flow)
+
+	// A state can only be used once.
+	api.On("KVGet", oauthStateKeyPrefix+state).Return(nil, nil).Once()
+	_, err = p.consumeOAuthState(state)
+	assert.Equal(t, errInvalidOAuthState, err)
+
+	_, err = p.consumeOAuthState("")
+	assert.Equal(t, errInvalidOAuthState, err)
+}
+
+func TestTokensAreSafeForConcurrentUse(t *testing.T) {
+	api := &plugintest.API{}
+	p := newTestPlugin(api)
+	p.setConfiguration(&configuration{EncryptionKey: testEncryptionKey, ZendeskURL: "https://acme.zendesk.com"})
+
+	// Tokens live in the KV store, the cached clients and groups are the in-memory state shared by
+	// the OAuth redirect and the commands. Run with -race.
+	var kvLock sync.Mutex
+	kv := map[string][]byte{}
+	api.On("KVSet", mock.AnythingOfType("string"), mock.AnythingOfType("[]uint8")).Run(func(args mock.Arguments) {
+		kvLock.Lock()
+		defer kvLock.Unlock()
+		kv[args.String(0)] = args.Get(1).([]byte)
+	}).Return(nil)
+	api.On("KVGet", mock.AnythingOfType("string")).Return(func(key string) []byte {
+		kvLock.Lock()
+		defer kvLock.Unlock()
+		return kv[key]
+	}, nil)
+	api.On("KVDelete", mock.AnythingOfType("string")).Run(func(args mock.Arguments) {
+		kvLock.Lock()
+		defer kvLock.Unlock()
+		delete(kv, args.String(0))
+	}).Return(nil)
+
+	instance, err := p.getConfiguration().getInstance("")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			userID := "user" + strconv.Itoa(i%2)
+			for j := 0; j < 50; j++ {
+				switch j % 3 {
+				case 0:
+					assert.NoError(t, p.setToken(userID, defaultInstanceName, "token"+strconv.Itoa(j)))
+				case 1:
+					if _, err := p.getInstanceClient(userID, instance, "request"); err != nil && err != errNotConnected && err != errRateLimited {
+						t.Error(err)
+					}
+				case 2:
+					assert.NoError(t, p.deleteToken(userID, defaultInstanceName))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kfilimon/go-zendesk/zendesk"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// Events sent by the Zendesk triggers notifying Mattermost, see webhookEvent.
+const (
+	webhookEventTicketCreated = "ticket_created"
+	webhookEventCommentAdded  = "comment_added"
+)
+
+// webhookEvent is the JSON body of the Zendesk triggers calling the webhook. Zendesk renders
+// every placeholder as a string, e.g.
+//
+//	{"event": "comment_added", "ticket_id": "{{ticket.id}}", "subject": "{{ticket.title}}",
+//	 "url": "{{ticket.link}}", "status": "{{ticket.status}}", "priority": "{{ticket.priority}}",
+//	 "organization_id": "{{ticket.organization.id}}", "organization": "{{ticket.organization.name}}",
+//	 "requester": "{{ticket.requester.name}}", "author": "{{ticket.latest_comment.author.name}}",
+//	 "comment": "{{ticket.latest_comment.value}}", "comment_public": "{{ticket.latest_comment.is_public}}"}
+type webhookEvent struct {
+	Event          string `json:"event"`
+	TicketID       string `json:"ticket_id"`
+	Subject        string `json:"subject"`
+	URL            string `json:"url"`
+	Status         string `json:"status"`
+	Priority       string `json:"priority"`
+	OrganizationID string `json:"organization_id"`
+	Organization   string `json:"organization"`
+	Requester      string `json:"requester"`
+	Author         string `json:"author"`
+	Comment        string `json:"comment"`
+	CommentPublic  string `json:"comment_public"`
+}
+
+// httpWebhook receives ticket events from Zendesk triggers and posts them to the channel of the
+// ticket's organization, or the default webhook channel, and to the channels watching the ticket.
+// Triggers of an additional instance pass its name in the instance query parameter.
+func httpWebhook(p *Plugin, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("method " + r.Method + " is not allowed, must be POST")
+	}
+
+	config := p.getConfiguration()
+	if config.WebhookSecret == "" {
+		return http.StatusForbidden, errors.New("the webhook is disabled, no secret is configured")
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("secret")), []byte(config.WebhookSecret)) != 1 {
+		return http.StatusForbidden, errors.New("invalid webhook secret")
+	}
+
+	var event webhookEvent
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		return http.StatusBadRequest, errors.Wrap(err, "failed to decode the webhook event")
+	}
+	ticketID, err := strconv.ParseInt(event.TicketID, 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, errors.Errorf("invalid ticket ID %q", event.TicketID)
+	}
+
+	post, err := event.post(config.getTicketColors())
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	instanceName := r.URL.Query().Get("instance")
+	if instanceName == "" {
+		instanceName = defaultInstanceName
+	}
+	watchers, err := p.getTicketWatchers(strings.ToLower(instanceName), ticketID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// A channel watching the ticket may also be the channel of its organization, it is only posted to once.
+	channelIDs := append([]string{config.getWebhookChannelID(event.OrganizationID, event.Organization)}, watchers...)
+	posted := map[string]bool{"": true}
+	now := time.Now()
+	for _, channelID := range channelIDs {
+		if posted[channelID] {
+			continue
+		}
+		posted[channelID] = true
+
+		// Channels watching the ticket may hold back its updates, e.g. during their quiet hours.
+		if containsString(watchers, channelID) {
+			sub := watchSubscription{Instance: strings.ToLower(instanceName), TicketID: ticketID, ChannelID: channelID}
+			held, err := p.holdWatchUpdate(sub, &event, now)
+			if err != nil {
+				p.API.LogWarn("failed to hold back the webhook event, posting it", "channel_id", channelID, "ticket_id", event.TicketID, "error", err.Error())
+			} else if held {
+				continue
+			}
+		}
+
+		channelPost := post.Clone()
+		channelPost.UserId = p.botID
+		channelPost.ChannelId = channelID
+		// A deleted or archived watching channel must not keep the other channels from being notified.
+		// Zendesk retries deliveries it considers failed, a duplicate event is only posted once.
+		if _, appErr := p.createChannelPost(channelPost); appErr != nil {
+			p.API.LogWarn("failed to post the webhook event", "channel_id", channelID, "ticket_id", event.TicketID, "error", appErr.Error())
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// post renders the notification of an event, without the channel and the author.
+func (e *webhookEvent) post(colors map[string]string) (*model.Post, error) {
+	title := ticketEventTitle(e.TicketID, e.Subject, e.URL)
+
+	var message, text string
+	switch e.Event {
+	case webhookEventTicketCreated:
+		message = "New ticket " + title
+		if e.Requester != "" {
+			message += " from **" + e.Requester + "**"
+		}
+	case webhookEventCommentAdded:
+		visibility := "private"
+		if strings.EqualFold(e.CommentPublic, "true") {
+			visibility = "public"
+		}
+		message = fmt.Sprintf("New %s comment on ticket %s", visibility, title)
+		if e.Author != "" {
+			message += " by **" + e.Author + "**"
+		}
+		text = truncate(e.Comment, 3000)
+	default:
+		return nil, errors.Errorf("unsupported event %q", e.Event)
+	}
+
+	post := &model.Post{Message: message}
+	post.AddProp("attachments", []*model.SlackAttachment{ticketEventAttachment(e.Status, e.Priority, e.Organization, text, colors)})
+	return post, nil
+}
+
+// ticketEventTitle renders the title of a ticket in a notification, linked to the ticket if its URL
+// is known.
+func ticketEventTitle(ticketID, subject, url string) string {
+	title := "#" + ticketID
+	if subject != "" {
+		title += " " + subject
+	}
+	if url != "" {
+		title = "[" + title + "](" + url + ")"
+	}
+	return title
+}
+
+// ticketEventAttachment renders the card of a notification, colored like the details card of the
+// ticket, see attachmentColor.
+func ticketEventAttachment(status, priority, organization, text string, colors map[string]string) *model.SlackAttachment {
+	attachment := &model.SlackAttachment{
+		Color: attachmentColor(&zendesk.Ticket{Status: &status, Priority: &priority}, colors),
+		Text:  text,
+	}
+	for _, field := range []struct{ title, value string }{
+		{"Status", status},
+		{"Priority", priority},
+		{"Organization", organization},
+	} {
+		if field.value != "" {
+			attachment.Fields = append(attachment.Fields, &model.SlackAttachmentField{
+				Title: field.title,
+				Value: field.value,
+				Short: true,
+			})
+		}
+	}
+	return attachment
+}
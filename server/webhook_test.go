@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestWebhook(t *testing.T) {
+	api := &plugintest.API{}
+	p := newTestPlugin(api)
+	p.botID = "bot"
+	p.setConfiguration(&configuration{WebhookSecret: "s3cret", WebhookChannelID: "support", TicketColors: "new #123456"})
+
+	api.On("KVGet", mock.AnythingOfType("string")).Return(nil, nil)
+	var posts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		posts = append(posts, args.Get(0).(*model.Post))
+	}).Return(&model.Post{}, nil)
+
+	send := func(secret, body string) int {
+		r := httptest.NewRequest(http.MethodPost, routeWebhook+"?secret="+secret, strings.NewReader(body))
+		status, _ := httpWebhook(p, httptest.NewRecorder(), r)
+		return status
+	}
+
+	assert.Equal(t, http.StatusForbidden, send("wrong", `{"event":"ticket_created","ticket_id":"1"}`))
+	assert.Equal(t, http.StatusBadRequest, send("s3cret", `{"event":"ticket_deleted","ticket_id":"1"}`))
+	assert.Equal(t, http.StatusBadRequest, send("s3cret", `{"event":"ticket_created","ticket_id":"{{ticket.id}}"}`))
+	assert.Empty(t, posts)
+
+	assert.Equal(t, http.StatusOK, send("s3cret", `{"event":"ticket_created","ticket_id":"7","subject":"Printer on fire",
+		"url":"https://example.zendesk.com/agent/tickets/7","requester":"Jane","status":"new","priority":""}`))
+	assert.Equal(t, http.StatusOK, send("s3cret", `{"event":"comment_added","ticket_id":"7","author":"Bob",
+		"comment":"Have you tried turning it off?","comment_public":"true"}`))
+
+	if assert.Len(t, posts, 2) {
+		assert.Equal(t, "New ticket [#7 Printer on fire](https://example.zendesk.com/agent/tickets/7) from **Jane**", posts[0].Message)
+		assert.Equal(t, "support", posts[0].ChannelId)
+		assert.Equal(t, "bot", posts[0].UserId)
+		assert.Len(t, posts[0].Attachments()[0].Fields, 1, "empty fields are left out")
+		assert.Equal(t, "#123456", posts[0].Attachments()[0].Color, "cards are colored like the details card")
+
+		assert.Equal(t, "New public comment on ticket #7 by **Bob**", posts[1].Message)
+		assert.Equal(t, "Have you tried turning it off?", posts[1].Attachments()[0].Text)
+		assert.Equal(t, defaultTicketColor, posts[1].Attachments()[0].Color)
+	}
+}
+
+func TestWebhookDisabledWithoutSecret(t *testing.T) {
+	p := newTestPlugin(&plugintest.API{})
+	r := httptest.NewRequest(http.MethodPost, routeWebhook+"?secret=", strings.NewReader(`{}`))
+	status, err := httpWebhook(p, httptest.NewRecorder(), r)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Error(t, err)
+}
+
+func TestWebhookPostsToWatchingChannels(t *testing.T) {
+	api := &plugintest.API{}
+	p := newTestPlugin(api)
+	p.setConfiguration(&configuration{WebhookSecret: "s3cret", WebhookChannelID: "support", OrganizationChannels: "Acme acme"})
+
+	api.On("KVGet", "watch_7").Return([]byte(`["acme","war-room","gone"]`), nil)
+	api.On("KVGet", "watch_eu_7").Return([]byte(`["eu-room"]`), nil)
+	api.On("KVGet", mock.MatchedBy(func(key string) bool { return strings.HasPrefix(key, watchSettingsKeyPrefix) })).Return(nil, nil)
+	var channelIDs []string
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		channelIDs = append(channelIDs, post.ChannelId)
+		return post
+	}, func(post *model.Post) *model.AppError {
+		if post.ChannelId == "gone" {
+			return model.NewAppError("CreatePost", "not_found", nil, "", http.StatusNotFound)
+		}
+		return nil
+	})
+	api.On("LogWarn", "failed to post the webhook event", "channel_id", "gone", "ticket_id", "7", "error", mock.Anything)
+
+	body := `{"event":"ticket_created","ticket_id":"7","organization":"Acme"}`
+	r := httptest.NewRequest(http.MethodPost, routeWebhook+"?secret=s3cret", strings.NewReader(body))
+	status, err := httpWebhook(p, httptest.NewRecorder(), r)
+	assert.Equal(t, http.StatusOK, status, err)
+	assert.Equal(t, []string{"acme", "war-room", "gone"}, channelIDs, "the organization channel is posted to once")
+
+	channelIDs = nil
+	p.setConfiguration(&configuration{WebhookSecret: "s3cret"})
+	r = httptest.NewRequest(http.MethodPost, routeWebhook+"?secret=s3cret&instance=EU", strings.NewReader(body))
+	status, err = httpWebhook(p, httptest.NewRecorder(), r)
+	assert.Equal(t, http.StatusOK, status, err)
+	assert.Equal(t, []string{"eu-room"}, channelIDs)
+}
@@ -1,9 +1,43 @@
 import manifest from './manifest';
 
+// RECEIVED_DIALOG is the action the Mattermost webapp opens interactive dialogs with.
+const RECEIVED_DIALOG = 'RECEIVED_DIALOG';
+
+function getCSRFToken() {
+    const match = document.cookie.match(/(?:^|;\s*)MMCSRF=([^;]*)/);
+    return match ? match[1] : '';
+}
+
+// openCreateTicketDialog asks the server for the create ticket dialog pre-filled with a post,
+// then opens it. Errors, like not being connected to Zendesk, are shown in an alert.
+async function openCreateTicketDialog(postId, store) {
+    const basename = window.basename || '';
+    const response = await fetch(`${basename}/plugins/${manifest.id}/action/create`, {
+        method: 'POST',
+        credentials: 'same-origin',
+        headers: {
+            'Content-Type': 'application/json',
+            'X-Requested-With': 'XMLHttpRequest',
+            'X-CSRF-Token': getCSRFToken(),
+        },
+        body: JSON.stringify({post_id: postId}),
+    });
+    if (!response.ok) {
+        const text = await response.text();
+        window.alert(`Could not create a Zendesk ticket: ${text.trim()}`); // eslint-disable-line no-alert
+        return;
+    }
+
+    store.dispatch({type: RECEIVED_DIALOG, data: await response.json()});
+}
+
 export default class Plugin {
-    // eslint-disable-next-line no-unused-vars
     initialize(registry, store) {
         // @see https://developers.mattermost.com/extend/plugins/webapp/reference/
+        registry.registerPostDropdownMenuAction(
+            'Create Zendesk Ticket',
+            (postId) => openCreateTicketDialog(postId, store),
+        );
     }
 }
 
@@ -6,7 +6,7 @@ const manifest = JSON.parse(`
     "name": "Zendesk",
     "description": "Zendesk plugin for Mattermost.",
     "version": "0.1.0",
-    "min_server_version": "5.18.0",
+    "min_server_version": "5.24.0",
     "server": {
         "executables": {
             "linux-amd64": "server/dist/plugin-linux-amd64",
@@ -34,9 +34,9 @@ const manifest = JSON.parse(`
                 "key": "ZendeskClientID",
                 "display_name": "Zendesk OAuth Client ID",
                 "type": "text",
-                "help_text": "Zendesk OAuth Client ID.",
+                "help_text": "Zendesk OAuth Client ID. Leave the client ID and secret empty if users connect with API tokens only.",
                 "placeholder": "",
-                "default": "mattermost_integration_for_zendesk_demo"
+                "default": ""
             },
             {
                 "key": "ZendeskClientSecrete",
@@ -45,6 +45,264 @@ const manifest = JSON.parse(`
                 "help_text": "Zendesk OAuth Client Secrete.",
                 "placeholder": "",
                 "default": ""
+            },
+            {
+                "key": "EncryptionKey",
+                "display_name": "At Rest Encryption Key",
+                "type": "generated",
+                "help_text": "The 32 character key used to encrypt the stored Zendesk tokens, generated when the plugin is activated if left empty. Regenerating it disconnects every user from Zendesk.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "ZendeskUser",
+                "display_name": "Zendesk User",
+                "type": "text",
+                "help_text": "The email of the Zendesk account of the plugin, used by the health check. Append /token to the email to use an API token as the password. The ZENDESK_USER environment variable is used when neither the user nor the password is set.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "ZendeskPassword",
+                "display_name": "Zendesk Password",
+                "type": "text",
+                "help_text": "The password or API token of the Zendesk account of the plugin. It is encrypted with the at rest encryption key once saved, enter it again to change it. The ZENDESK_PASSWORD environment variable is used when neither the user nor the password is set.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "ZendeskInstances",
+                "display_name": "Additional Zendesk Instances",
+                "type": "longtext",
+                "help_text": "Additional Zendesk instances, one per line in the form: \u003cname\u003e \u003curl\u003e [\u003cclient-id\u003e \u003cclient-secret\u003e]. Without an OAuth client, users connect with /zendesk connect token. Select an instance with /zendesk --instance=\u003cname\u003e \u003ccommand\u003e.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "TeamInstances",
+                "display_name": "Team Instances",
+                "type": "longtext",
+                "help_text": "Routes the commands of a team to a Zendesk instance, one team per line in the form: \u003cteam-name-or-id\u003e \u003cinstance-name\u003e. Teams that aren't listed use the default instance, --instance always takes precedence.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "AllowedChannels",
+                "display_name": "Allowed Channels",
+                "type": "text",
+                "help_text": "Channels the Zendesk commands can be run in, by ID or name and separated by commas. Leave empty, along with Allowed Teams, to allow the commands everywhere.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "AllowedTeams",
+                "display_name": "Allowed Teams",
+                "type": "text",
+                "help_text": "Teams whose channels the Zendesk commands can be run in, by ID or name and separated by commas. Commands are allowed in the listed channels and in the channels of the listed teams.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "DefaultCommentVisibility",
+                "display_name": "Default Comment Visibility",
+                "type": "dropdown",
+                "help_text": "Whether /zendesk update without public or private posts internal or public comments. /zendesk help shows the current default.",
+                "placeholder": "",
+                "default": "private",
+                "options": [
+                    {
+                        "display_name": "Private (internal note)",
+                        "value": "private"
+                    },
+                    {
+                        "display_name": "Public",
+                        "value": "public"
+                    }
+                ]
+            },
+            {
+                "key": "PublicCommentUsers",
+                "display_name": "Public Comment Users",
+                "type": "text",
+                "help_text": "Users allowed to post public comments, which are sent to the customer, by ID or username and separated by commas. Leave empty, along with Public Comment Roles, to allow everyone.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "PublicCommentRoles",
+                "display_name": "Public Comment Roles",
+                "type": "text",
+                "help_text": "Mattermost system roles allowed to post public comments, e.g. system_admin, separated by commas.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "SearchResultLimit",
+                "display_name": "Search Result Limit",
+                "type": "text",
+                "help_text": "The maximum number of tickets listed by /zendesk search.",
+                "placeholder": "",
+                "default": "10"
+            },
+            {
+                "key": "AssignedTicketsLimit",
+                "display_name": "Assigned Tickets Limit",
+                "type": "text",
+                "help_text": "The maximum number of tickets listed by /zendesk list.",
+                "placeholder": "",
+                "default": "20"
+            },
+            {
+                "key": "MaxListResults",
+                "display_name": "Maximum Listed Tickets",
+                "type": "text",
+                "help_text": "The most tickets /zendesk list and /zendesk search show when asked for more with --limit=\u003cnumber\u003e, at most 100.",
+                "placeholder": "",
+                "default": "50"
+            },
+            {
+                "key": "OAuthTimeout",
+                "display_name": "OAuth Timeout (seconds)",
+                "type": "text",
+                "help_text": "How long to wait for Zendesk when exchanging the authorization code for an access token while connecting.",
+                "placeholder": "",
+                "default": "15"
+            },
+            {
+                "key": "WebhookSecret",
+                "display_name": "Webhook Secret",
+                "type": "generated",
+                "help_text": "The secret Zendesk triggers have to pass to the webhook, e.g. https://\u003cmattermost\u003e/plugins/zendesk/webhook?secret=\u003csecret\u003e. The webhook is disabled while it is empty.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "WebhookChannelID",
+                "display_name": "Webhook Channel ID",
+                "type": "text",
+                "help_text": "The ID of the channel the ticket events received by the webhook are posted to.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "OrganizationChannels",
+                "display_name": "Organization Channels",
+                "type": "longtext",
+                "help_text": "Posts the ticket events of an organization received by the webhook to another channel, one organization per line in the form: \u003corganization-name-or-id\u003e \u003cchannel-id\u003e. Other organizations use the webhook channel.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "ChannelPostWindow",
+                "display_name": "Channel Post Window (seconds)",
+                "type": "text",
+                "help_text": "The same bot post isn't posted to a channel again within this many seconds, e.g. when several users post the details of a ticket during an incident, or a webhook event is received twice. Empty or 0 posts every time. Ephemeral responses are never held back.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "DescriptionLimit",
+                "display_name": "Description Length Limit",
+                "type": "text",
+                "help_text": "The maximum number of characters of the ticket description shown in the details card, at most 16383.",
+                "placeholder": "",
+                "default": "3000"
+            },
+            {
+                "key": "TicketCustomFields",
+                "display_name": "Ticket Custom Fields",
+                "type": "text",
+                "help_text": "Comma separated IDs of the custom ticket fields shown in the details card, e.g. 360001234567, 360007654321. Fields without a value are left out.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "TicketColors",
+                "display_name": "Ticket Colors",
+                "type": "longtext",
+                "help_text": "Overrides the color of the details card, one status or priority per line in the form: \u003cstatus-or-priority\u003e \u003c#hex-color\u003e. Statuses take precedence over priorities. By default urgent tickets are red, high ones orange, solved ones green and closed ones gray.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "StatusEmoji",
+                "display_name": "Status Emoji",
+                "type": "longtext",
+                "help_text": "Emoji shown before the ticket status by /zendesk status and in the details card, one status per line in the form: \u003cstatus\u003e \u003c:emoji:\u003e, e.g. open :large_blue_circle: or solved :white_check_mark:. Statuses without an emoji are shown as text only.",
+                "placeholder": "",
+                "default": ""
+            },
+            {
+                "key": "ShowInternalNote",
+                "display_name": "Show Latest Internal Note",
+                "type": "bool",
+                "help_text": "When true, the details card of /zendesk details shows the latest internal note of the ticket to Zendesk agents. The note is never shown on cards shared with the channel using --public.",
+                "placeholder": "",
+                "default": false
+            },
+            {
+                "key": "CommentPagesLimit",
+                "display_name": "Comment Pages Limit",
+                "type": "text",
+                "help_text": "The maximum number of pages of 100 comments fetched by /zendesk latest to find the latest public or private comment.",
+                "placeholder": "",
+                "default": "10"
+            },
+            {
+                "key": "CommandRateBurst",
+                "display_name": "Command Rate Limit Burst",
+                "type": "text",
+                "help_text": "How many commands calling Zendesk a user can run in a row before being rate limited.",
+                "placeholder": "",
+                "default": "10"
+            },
+            {
+                "key": "CommandRatePerMinute",
+                "display_name": "Command Rate Limit (per minute)",
+                "type": "text",
+                "help_text": "How many commands calling Zendesk a user can run per minute once the burst is used up.",
+                "placeholder": "",
+                "default": "30"
+            },
+            {
+                "key": "RateLimitRetries",
+                "display_name": "Zendesk Rate Limit Retries",
+                "type": "text",
+                "help_text": "How many times a request is retried, with an increasing delay, when Zendesk answers that too many requests were made.",
+                "placeholder": "",
+                "default": "3"
+            },
+            {
+                "key": "ConnectLinkDM",
+                "display_name": "Send Connect Links as Direct Messages",
+                "type": "bool",
+                "help_text": "When true, /zendesk connect sends the link to connect a Zendesk account as a direct message from the bot instead of a message only the user sees, so it persists.",
+                "placeholder": "",
+                "default": false
+            },
+            {
+                "key": "BotUsername",
+                "display_name": "Bot Username",
+                "type": "text",
+                "help_text": "The username of the bot posting the responses of the commands and the ticket updates. The bot is renamed when the setting changes.",
+                "placeholder": "",
+                "default": "zendesk"
+            },
+            {
+                "key": "BotDisplayName",
+                "display_name": "Bot Display Name",
+                "type": "text",
+                "help_text": "The display name of the bot.",
+                "placeholder": "",
+                "default": "Zendesk Bot"
+            },
+            {
+                "key": "DeveloperMode",
+                "display_name": "Developer Mode",
+                "type": "bool",
+                "help_text": "Sends the OAuth redirects to http://localhost:8066 instead of the Site URL, for testing the plugin on a local Mattermost server. Keep it disabled in production.",
+                "placeholder": "",
+                "default": false
             }
         ]
     }